@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Zeptile/docktrine/internal/database"
+)
+
+const adminUsage = `Usage: docktrine-api admin <command> [flags]
+
+Commands:
+  create-key   Create an admin API key directly in the database and print it
+  hash-key     Read a key from stdin and print it in DOCKTRINE_ADMIN_KEY_HASH form
+`
+
+// runAdmin implements the offline "docktrine-api admin" subcommands. They
+// work on the database in CONFIG_PATH without starting the server, for
+// recovery when every admin credential has been lost.
+func runAdmin(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, adminUsage)
+		return 2
+	}
+
+	switch args[0] {
+	case "create-key":
+		flags := flag.NewFlagSet("create-key", flag.ExitOnError)
+		description := flags.String("description", "Recovery admin key", "What the key is used for")
+		flags.Parse(args[1:])
+
+		db, err := database.NewDatabaseConnection()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		defer db.Close()
+
+		apiKey := &database.APIKey{Description: *description, IsAdmin: true}
+		if err := db.CreateAPIKey(apiKey); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+
+		fmt.Fprintf(os.Stderr, "Created admin API key %d (%s)\n", apiKey.ID, apiKey.Description)
+		fmt.Println(apiKey.Key)
+		return 0
+
+	case "hash-key":
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+
+		hash, err := database.HashAPIKeySecret(strings.TrimSpace(line))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		fmt.Println(hash)
+		return 0
+
+	default:
+		fmt.Fprint(os.Stderr, adminUsage)
+		return 2
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Zeptile/docktrine/cmd/api/handlers"
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/logger"
+)
+
+// setupTokenFile is where the one-time setup token is written, in the data
+// directory.
+const setupTokenFile = "setup_token"
+
+// bootstrapAdmin makes sure a fresh install can be administered without
+// ever logging a secret. An admin key is created from DOCKTRINE_ADMIN_KEY,
+// DOCKTRINE_ADMIN_KEY_FILE or DOCKTRINE_ADMIN_KEY_HASH when set; otherwise
+// a one-time setup token is written to the data directory for POST /setup.
+// It returns nil when an admin already exists or was created.
+func bootstrapAdmin(db *database.DB) (*handlers.SetupToken, error) {
+	needed, err := db.NeedsBootstrap()
+	if err != nil || !needed {
+		return nil, err
+	}
+
+	apiKey := &database.APIKey{Description: "Bootstrap admin key", IsAdmin: true}
+
+	if hash := os.Getenv("DOCKTRINE_ADMIN_KEY_HASH"); hash != "" {
+		if err := db.CreateAPIKeyWithHash(apiKey, hash); err != nil {
+			return nil, fmt.Errorf("DOCKTRINE_ADMIN_KEY_HASH: %w", err)
+		}
+		logger.Info("Created admin API key from DOCKTRINE_ADMIN_KEY_HASH")
+		return nil, nil
+	}
+
+	secret := os.Getenv("DOCKTRINE_ADMIN_KEY")
+	source := "DOCKTRINE_ADMIN_KEY"
+	if path := os.Getenv("DOCKTRINE_ADMIN_KEY_FILE"); secret == "" && path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("DOCKTRINE_ADMIN_KEY_FILE: %w", err)
+		}
+		secret = strings.TrimSpace(string(data))
+		source = "DOCKTRINE_ADMIN_KEY_FILE"
+	}
+	if secret != "" {
+		if err := db.CreateAPIKeyWithSecret(apiKey, secret); err != nil {
+			return nil, fmt.Errorf("%s: %w", source, err)
+		}
+		logger.Info("Created admin API key from " + source)
+		return nil, nil
+	}
+
+	ttl := time.Hour
+	if v := os.Getenv("SETUP_TOKEN_TTL"); v != "" {
+		if ttl, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("SETUP_TOKEN_TTL: %w", err)
+		}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(b)
+
+	path := filepath.Join(db.DataPath(), setupTokenFile)
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return nil, err
+	}
+
+	logger.Warn(fmt.Sprintf("No admin exists yet. Exchange the one-time token in %s for an admin key via POST /setup within %s", path, ttl))
+	return handlers.NewSetupToken(token, ttl, path), nil
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/Zeptile/docktrine/cmd/api/middleware"
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/auth"
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/gofiber/fiber/v2"
+)
+
+// ListAlerts godoc
+// @Summary List alerts
+// @Description List the crash loop (crash_loop), repeated non-zero exit (failing) and OOM kill (oom_killed) alerts raised from container events, most recently seen first. An alert resolves once its condition has not recurred for the alert window.
+// @Tags alerts
+// @Accept json
+// @Produce json
+// @Param status query string false "active or resolved; all alerts if empty"
+// @Param server query string false "Server name or selector (group:<name>, label:<key>=<value>); all servers if empty"
+// @Param kind query string false "crash_loop, failing or oom_killed"
+// @Param limit query int false "Maximum number of alerts" default(100)
+// @Success 200 {array} database.Alert
+// @Failure 400 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /alerts [get]
+func (h *Handler) ListAlerts(c *fiber.Ctx) error {
+	filter := database.AlertFilter{
+		Status: c.Query("status"),
+		Kind:   c.Query("kind"),
+		Limit:  100,
+	}
+	if filter.Status != "" && filter.Status != database.AlertActive && filter.Status != database.AlertResolved {
+		return apierror.Send(c, apierror.BadRequest("status must be active or resolved"))
+	}
+	if v := c.Query("limit"); v != "" {
+		var err error
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 0 {
+			return apierror.Send(c, apierror.BadRequest("invalid limit"))
+		}
+	}
+	if selector := c.Query("server"); selector != "" {
+		servers, err := h.docker.ResolveServers(selector)
+		if err != nil {
+			return apierror.Send(c, err)
+		}
+		for _, server := range servers {
+			filter.Servers = append(filter.Servers, server.Name)
+		}
+	}
+
+	alerts, err := h.db.ListAlerts(filter)
+	if err != nil {
+		logger.Error(err, "Failed to list alerts")
+		return apierror.Send(c, err)
+	}
+
+	principal := middleware.CurrentPrincipal(c)
+	if principal == nil {
+		return c.JSON(alerts)
+	}
+
+	servers, err := h.db.GetServers()
+	if err != nil {
+		logger.Error(err, "Failed to list servers")
+		return apierror.Send(c, err)
+	}
+	allowedServers := map[string]bool{}
+	for _, server := range servers {
+		allowedServers[server.Name] = auth.AllowsServer(principal, server)
+	}
+
+	allowed := []database.Alert{}
+	for _, alert := range alerts {
+		if allowedServers[alert.Server] && auth.AllowsContainer(principal, alert.Labels) {
+			allowed = append(allowed, alert)
+		}
+	}
+	return c.JSON(allowed)
+}
+
+func alertKey(server, containerID string) string {
+	return server + "/" + containerID
+}
+
+// activeAlerts returns the kinds of the active alerts of each container,
+// keyed by alertKey. A failure is logged and leaves containers unflagged.
+func (h *Handler) activeAlerts() map[string][]string {
+	alerts, err := h.db.ListAlerts(database.AlertFilter{Status: database.AlertActive})
+	if err != nil {
+		logger.Error(err, "Failed to list active alerts")
+		return nil
+	}
+
+	kinds := map[string][]string{}
+	for _, alert := range alerts {
+		key := alertKey(alert.Server, alert.ContainerID)
+		kinds[key] = append(kinds[key], alert.Kind)
+	}
+	return kinds
+}
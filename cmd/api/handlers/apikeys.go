@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/auth"
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/docker"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/gofiber/fiber/v2"
+)
+
+type CreateAPIKeyRequest struct {
+	Description string `json:"description"`
+	IsAdmin     bool   `json:"is_admin"`
+	// Scopes granted to the key, defaults to containers:read and servers:read.
+	Scopes []string `json:"scopes"`
+	// AllowedServers limits the key to servers matching any of these names
+	// or selectors.
+	AllowedServers []string `json:"allowed_servers"`
+	// ContainerLabels limits the key to containers carrying these labels.
+	ContainerLabels map[string]string `json:"container_labels"`
+	// ExpiresAt is when the key stops working (RFC 3339). Optional.
+	ExpiresAt *time.Time `json:"expires_at"`
+	// AllowedCIDRs limits the client addresses the key can be used from.
+	AllowedCIDRs []string `json:"allowed_cidrs"`
+}
+
+// ListAPIKeys godoc
+// @Summary List API keys
+// @Description Get every API key with its last use. Secrets are never returned.
+// @Tags apikeys
+// @Accept json
+// @Produce json
+// @Success 200 {array} database.APIKey
+// @Failure 403 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /apikeys [get]
+func (h *Handler) ListAPIKeys(c *fiber.Ctx) error {
+	keys, err := h.db.ListAPIKeys()
+	if err != nil {
+		logger.Error(err, "Failed to list API keys")
+		return apierror.Send(c, err)
+	}
+	return c.JSON(keys)
+}
+
+// CreateAPIKey godoc
+// @Summary Create an API key
+// @Description Create a new API key. The secret is only returned in this response.
+// @Tags apikeys
+// @Accept json
+// @Produce json
+// @Param key body CreateAPIKeyRequest true "API key"
+// @Success 201 {object} database.APIKey
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /apikeys [post]
+func (h *Handler) CreateAPIKey(c *fiber.Ctx) error {
+	var req CreateAPIKeyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Send(c, apierror.BadRequest("invalid request body"))
+	}
+
+	if req.Description == "" {
+		return apierror.Send(c, apierror.BadRequest("description is required"))
+	}
+
+	if len(req.Scopes) == 0 {
+		req.Scopes = auth.DefaultScopes
+	}
+	if err := auth.ValidateScopes(req.Scopes); err != nil {
+		return apierror.Send(c, apierror.BadRequest(err.Error()))
+	}
+	for _, selector := range req.AllowedServers {
+		if _, err := docker.ParseSelector(selector); err != nil {
+			return apierror.Send(c, apierror.BadRequest(err.Error()))
+		}
+	}
+
+	for _, cidr := range req.AllowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return apierror.Send(c, apierror.BadRequest(fmt.Sprintf("invalid CIDR %q", cidr)))
+		}
+	}
+	if req.ExpiresAt != nil && req.ExpiresAt.Before(time.Now()) {
+		return apierror.Send(c, apierror.BadRequest("expires_at must be in the future"))
+	}
+
+	key := &database.APIKey{
+		Description:     req.Description,
+		IsAdmin:         req.IsAdmin,
+		Scopes:          req.Scopes,
+		AllowedServers:  req.AllowedServers,
+		ContainerLabels: req.ContainerLabels,
+		ExpiresAt:       req.ExpiresAt,
+		AllowedCIDRs:    req.AllowedCIDRs,
+	}
+	if err := h.db.CreateAPIKey(key); err != nil {
+		logger.Error(err, "Failed to create API key")
+		return apierror.Send(c, err)
+	}
+
+	logger.Info(fmt.Sprintf("API key created: %d (%s)", key.ID, key.Description))
+	return c.Status(201).JSON(key)
+}
+
+// RevokeAPIKey godoc
+// @Summary Revoke an API key
+// @Description Delete an API key so it can no longer be used
+// @Tags apikeys
+// @Accept json
+// @Produce json
+// @Param id path int true "API key ID"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 409 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /apikeys/{id} [delete]
+func (h *Handler) RevokeAPIKey(c *fiber.Ctx) error {
+	key, err := h.lookupAPIKey(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	if key.IsAdmin {
+		admins, err := h.db.CountAdminAPIKeys()
+		if err != nil {
+			logger.Error(err, "Failed to count admin API keys")
+			return apierror.Send(c, err)
+		}
+		if admins <= 1 {
+			return apierror.Send(c, apierror.Conflict("cannot revoke the last admin API key"))
+		}
+	}
+
+	if err := h.db.DeleteAPIKey(key.ID); err != nil {
+		logger.Error(err, "Failed to revoke API key")
+		return apierror.Send(c, err)
+	}
+
+	logger.Info(fmt.Sprintf("API key revoked: %d (%s)", key.ID, key.Description))
+	return c.JSON(MessageResponse{Message: "api key revoked successfully"})
+}
+
+// RotateAPIKey godoc
+// @Summary Rotate an API key
+// @Description Replace the secret of an API key. The old secret stops working immediately and the new one is only returned in this response.
+// @Tags apikeys
+// @Accept json
+// @Produce json
+// @Param id path int true "API key ID"
+// @Success 200 {object} database.APIKey
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /apikeys/{id}/rotate [post]
+func (h *Handler) RotateAPIKey(c *fiber.Ctx) error {
+	key, err := h.lookupAPIKey(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	rotated, err := h.db.RotateAPIKey(key.ID)
+	if err != nil {
+		logger.Error(err, "Failed to rotate API key")
+		return apierror.Send(c, err)
+	}
+
+	logger.Info(fmt.Sprintf("API key rotated: %d (%s)", key.ID, key.Description))
+	return c.JSON(rotated)
+}
+
+// DisableAPIKey godoc
+// @Summary Disable an API key
+// @Description Disable an API key without deleting it
+// @Tags apikeys
+// @Accept json
+// @Produce json
+// @Param id path int true "API key ID"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /apikeys/{id}/disable [post]
+func (h *Handler) DisableAPIKey(c *fiber.Ctx) error {
+	return h.setAPIKeyDisabled(c, true)
+}
+
+// EnableAPIKey godoc
+// @Summary Enable an API key
+// @Description Re-enable a disabled API key
+// @Tags apikeys
+// @Accept json
+// @Produce json
+// @Param id path int true "API key ID"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /apikeys/{id}/enable [post]
+func (h *Handler) EnableAPIKey(c *fiber.Ctx) error {
+	return h.setAPIKeyDisabled(c, false)
+}
+
+func (h *Handler) setAPIKeyDisabled(c *fiber.Ctx, disabled bool) error {
+	key, err := h.lookupAPIKey(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	if err := h.db.SetAPIKeyDisabled(key.ID, disabled, "disabled by an administrator"); err != nil {
+		logger.Error(err, "Failed to update API key")
+		return apierror.Send(c, err)
+	}
+
+	if disabled {
+		logger.Info(fmt.Sprintf("API key disabled: %d (%s)", key.ID, key.Description))
+		return c.JSON(MessageResponse{Message: "api key disabled successfully"})
+	}
+	logger.Info(fmt.Sprintf("API key enabled: %d (%s)", key.ID, key.Description))
+	return c.JSON(MessageResponse{Message: "api key enabled successfully"})
+}
+
+func (h *Handler) lookupAPIKey(c *fiber.Ctx) (*database.APIKey, error) {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return nil, apierror.BadRequest("invalid api key id")
+	}
+
+	key, err := h.db.GetAPIKeyByID(id)
+	if err != nil {
+		logger.Error(err, "Failed to get API key")
+		return nil, err
+	}
+	if key == nil {
+		return nil, apierror.NotFound("api key not found")
+	}
+	return key, nil
+}
@@ -0,0 +1,410 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Zeptile/docktrine/cmd/api/middleware"
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/auth"
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/docker/docker/errdefs"
+	"github.com/gofiber/fiber/v2"
+)
+
+// actionScopes are the scopes needed to run each action that can require
+// approval or run as a job, and so to approve, reject or retry it.
+var actionScopes = map[string][]string{
+	"containers.start":    {auth.ScopeContainersStart},
+	"containers.stop":     {auth.ScopeContainersStop},
+	"containers.restart":  {auth.ScopeContainersRestart},
+	"containers.recreate": {auth.ScopeContainersRestart, auth.ScopeImagesWrite},
+	"servers.delete":      {auth.ScopeServersAdmin},
+}
+
+// ListApprovals godoc
+// @Summary List approvals
+// @Description Get operations on protected containers and servers, newest first. Keys limited to servers or container labels only see their own requests and operations on what they may access.
+// @Tags approvals
+// @Accept json
+// @Produce json
+// @Param status query string false "Only approvals with this status (pending, approved, executed, failed, rejected or expired)"
+// @Success 200 {array} database.Approval
+// @Failure 500 {object} apierror.Response
+// @Router /approvals [get]
+func (h *Handler) ListApprovals(c *fiber.Ctx) error {
+	approvals, err := h.db.ListApprovals(c.Query("status", ""))
+	if err != nil {
+		logger.Error(err, "Failed to list approvals")
+		return apierror.Send(c, err)
+	}
+
+	principal := middleware.CurrentPrincipal(c)
+	if principal == nil || principal.IsAdmin {
+		return c.JSON(approvals)
+	}
+
+	visible := newApprovalVisibility(h, principal)
+	allowed := []database.Approval{}
+	for _, approval := range approvals {
+		if visible.allows(&approval) {
+			allowed = append(allowed, approval)
+		}
+	}
+	return c.JSON(allowed)
+}
+
+// GetApproval godoc
+// @Summary Get an approval
+// @Description Get an operation on a protected container or server by ID
+// @Tags approvals
+// @Accept json
+// @Produce json
+// @Param id path int true "Approval ID"
+// @Success 200 {object} database.Approval
+// @Failure 400 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /approvals/{id} [get]
+func (h *Handler) GetApproval(c *fiber.Ctx) error {
+	approval, err := h.lookupApproval(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+	return c.JSON(approval)
+}
+
+// ApproveApproval godoc
+// @Summary Approve an operation
+// @Description Approve a pending operation on a protected container or server and run it. Container operations are queued as a background job, queued by the approver, and answered with 202; removing a server runs right away. The approver must be a different user or API key than the requester and hold the scopes the operation needs.
+// @Tags approvals
+// @Accept json
+// @Produce json
+// @Param id path int true "Approval ID"
+// @Success 200 {object} ActionResponse
+// @Success 202 {object} JobAcceptedResponse
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 409 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /approvals/{id}/approve [post]
+func (h *Handler) ApproveApproval(c *fiber.Ctx) error {
+	approval, err := h.lookupApproval(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	principal := middleware.CurrentPrincipal(c)
+	if principal.Type == approval.RequesterType && principal.ID == approval.RequesterID {
+		return apierror.Send(c, apierror.Forbidden("an operation must be approved by someone other than its requester"))
+	}
+	if err := h.authorizeAction(principal, approval.Action, approval.Server, approval.Target, approval.Params); err != nil {
+		return apierror.Send(c, err)
+	}
+
+	claimed, err := h.db.DecideApproval(approval.ID, database.ApprovalApproved, principal.Type, principal.ID, principal.Name)
+	if err != nil {
+		logger.Error(err, "Failed to approve")
+		return apierror.Send(c, err)
+	}
+	if !claimed {
+		return apierror.Send(c, apierror.Conflict(fmt.Sprintf("approval %d is no longer pending", approval.ID)))
+	}
+
+	if approval.Action != "servers.delete" {
+		return h.queueApproval(c, principal, approval)
+	}
+
+	start := time.Now()
+	results, err := h.executeApproval(approval)
+	if err == nil {
+		if apiErr := resultsError(results); apiErr != nil {
+			err = apiErr
+		}
+	}
+
+	approval.Status = database.ApprovalExecuted
+	approval.Result = "ok"
+	if err != nil {
+		approval.Status = database.ApprovalFailed
+		approval.Result = err.Error()
+	}
+	if finishErr := h.db.FinishApproval(approval.ID, approval.Status, approval.Result); finishErr != nil {
+		logger.Error(finishErr, "Failed to record approval result")
+	}
+	h.auditApproval(c, principal, approval, start, err)
+
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("Approved %s on %s failed", approval.Action, approval.Target))
+		return apierror.Send(c, err)
+	}
+
+	logger.Info(fmt.Sprintf("Approval %d executed: %s on %s", approval.ID, approval.Action, approval.Target))
+	return c.JSON(ActionResponse{
+		Message: fmt.Sprintf("%s on %s approved and executed", approval.Action, approval.Target),
+		Results: results,
+	})
+}
+
+// RejectApproval godoc
+// @Summary Reject an operation
+// @Description Reject a pending operation on a protected container or server. The requester may reject their own request to cancel it.
+// @Tags approvals
+// @Accept json
+// @Produce json
+// @Param id path int true "Approval ID"
+// @Success 200 {object} MessageResponse
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 409 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /approvals/{id}/reject [post]
+func (h *Handler) RejectApproval(c *fiber.Ctx) error {
+	approval, err := h.lookupApproval(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	principal := middleware.CurrentPrincipal(c)
+	if principal.Type != approval.RequesterType || principal.ID != approval.RequesterID {
+		if err := h.authorizeAction(principal, approval.Action, approval.Server, approval.Target, approval.Params); err != nil {
+			return apierror.Send(c, err)
+		}
+	}
+
+	rejected, err := h.db.DecideApproval(approval.ID, database.ApprovalRejected, principal.Type, principal.ID, principal.Name)
+	if err != nil {
+		logger.Error(err, "Failed to reject approval")
+		return apierror.Send(c, err)
+	}
+	if !rejected {
+		return apierror.Send(c, apierror.Conflict(fmt.Sprintf("approval %d is no longer pending", approval.ID)))
+	}
+
+	logger.Info(fmt.Sprintf("Approval %d rejected by %s", approval.ID, principal))
+	return c.JSON(MessageResponse{Message: fmt.Sprintf("approval %d rejected", approval.ID)})
+}
+
+func (h *Handler) lookupApproval(c *fiber.Ctx) (*database.Approval, error) {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return nil, apierror.BadRequest("invalid approval id")
+	}
+
+	approval, err := h.db.GetApproval(id)
+	if err != nil {
+		logger.Error(err, "Failed to get approval")
+		return nil, err
+	}
+	if approval == nil {
+		return nil, apierror.NotFound("approval not found")
+	}
+	// Approvals the principal may not see are reported as missing, as
+	// containers and servers are.
+	if principal := middleware.CurrentPrincipal(c); principal != nil && !principal.IsAdmin {
+		if !newApprovalVisibility(h, principal).allows(approval) {
+			return nil, apierror.NotFound("approval not found")
+		}
+	}
+	return approval, nil
+}
+
+// approvalVisibility decides which approvals a restricted principal may
+// see: its own requests, and operations on servers and containers it may
+// access. Servers and container labels are looked up once per listing.
+type approvalVisibility struct {
+	h         *Handler
+	principal *auth.Principal
+	servers   map[string][]database.Server
+	labels    map[string]map[string]string
+}
+
+func newApprovalVisibility(h *Handler, principal *auth.Principal) *approvalVisibility {
+	return &approvalVisibility{
+		h:         h,
+		principal: principal,
+		servers:   map[string][]database.Server{},
+		labels:    map[string]map[string]string{},
+	}
+}
+
+func (v *approvalVisibility) allows(approval *database.Approval) bool {
+	if v.principal.IsAdmin || len(v.principal.AllowedServers) == 0 && !auth.RestrictsContainers(v.principal) {
+		return true
+	}
+	if approval.RequesterType == v.principal.Type && approval.RequesterID == v.principal.ID {
+		return true
+	}
+
+	servers, ok := v.servers[approval.Server]
+	if !ok {
+		// Servers that no longer exist cannot be checked, so their
+		// approvals are hidden.
+		servers, _ = v.h.docker.ResolveServers(approval.Server)
+		v.servers[approval.Server] = servers
+	}
+	if len(servers) == 0 {
+		return false
+	}
+	for _, server := range servers {
+		if !auth.AllowsServer(v.principal, server) {
+			return false
+		}
+	}
+	if approval.Action == "servers.delete" || !auth.RestrictsContainers(v.principal) {
+		return true
+	}
+
+	// The container must be found with allowed labels on at least one of
+	// the servers; removed containers cannot be checked.
+	for _, server := range servers {
+		key := server.Name + "/" + approval.Target
+		labels, ok := v.labels[key]
+		if !ok {
+			labels, _ = v.h.docker.ContainerLabels(approval.Target, server.Name)
+			v.labels[key] = labels
+		}
+		if labels != nil && auth.AllowsContainer(v.principal, labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeAction checks that principal may run action on target, e.g. to
+// approve it or retry it as a job.
+func (h *Handler) authorizeAction(principal *auth.Principal, action, selector, target string, params map[string]string) error {
+	scopes, ok := actionScopes[action]
+	if !ok {
+		return apierror.Internal(fmt.Sprintf("unknown action %s", action))
+	}
+	if params["pull_latest"] == "true" {
+		scopes = append(append([]string{}, scopes...), auth.ScopeImagesWrite)
+	}
+	for _, scope := range scopes {
+		if !auth.HasScope(principal, scope) {
+			return apierror.Forbidden(fmt.Sprintf("missing the %s scope", scope))
+		}
+	}
+
+	if principal.IsAdmin || action == "servers.delete" {
+		return nil
+	}
+
+	servers, err := h.docker.ResolveServers(selector)
+	if err != nil {
+		return err
+	}
+	for _, server := range servers {
+		if !auth.AllowsServer(principal, server) {
+			return apierror.Forbidden(fmt.Sprintf("not allowed to access server %s", server.Name))
+		}
+		if !auth.RestrictsContainers(principal) {
+			continue
+		}
+
+		labels, err := h.docker.ContainerLabels(target, server.Name)
+		if errdefs.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return apierror.Forbidden(fmt.Sprintf("cannot verify access to container %s on %s: %v", target, server.Name, err))
+		}
+		if !auth.AllowsContainer(principal, labels) {
+			return apierror.Forbidden(fmt.Sprintf("not allowed to access container %s on %s", target, server.Name))
+		}
+	}
+	return nil
+}
+
+// queueApproval runs an approved container operation the way any other
+// runs in the background: as a job, under the per-server concurrency
+// limits and without the request timeout. The job is queued by the
+// approver and its audit event carries the approval.
+func (h *Handler) queueApproval(c *fiber.Ctx, approver *auth.Principal, approval *database.Approval) error {
+	requestedBy := fmt.Sprintf("%s:%d (%s)", approval.RequesterType, approval.RequesterID, approval.RequesterName)
+	params := map[string]string{
+		"approval_id":  strconv.FormatInt(approval.ID, 10),
+		"requested_by": requestedBy,
+	}
+	for k, v := range approval.Params {
+		params[k] = v
+	}
+	job := &database.Job{
+		Action:        approval.Action,
+		Server:        approval.Server,
+		Target:        approval.Target,
+		Params:        params,
+		RequesterType: approver.Type,
+		RequesterID:   approver.ID,
+		RequesterName: approver.Name,
+	}
+	err := h.queueJob(job, fmt.Sprintf("queued by %s, approving approval %d requested by %s", approver, approval.ID, requestedBy))
+
+	status, result := database.ApprovalApproved, fmt.Sprintf("queued as job %d", job.ID)
+	if err != nil {
+		status, result = database.ApprovalFailed, err.Error()
+	}
+	if finishErr := h.db.FinishApproval(approval.ID, status, result); finishErr != nil {
+		logger.Error(finishErr, "Failed to record approval result")
+	}
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	logger.Info(fmt.Sprintf("Approval %d approved: %s on %s queued as job %d", approval.ID, approval.Action, approval.Target, job.ID))
+	return sendJobAccepted(c, fmt.Sprintf("%s on %s approved and queued as job %d", approval.Action, approval.Target, job.ID), job)
+}
+
+// executeApproval runs an approved operation that is not a container
+// operation, which queueApproval runs as a job instead.
+func (h *Handler) executeApproval(approval *database.Approval) ([]ServerResult, error) {
+	switch approval.Action {
+	case "servers.delete":
+		result := ServerResult{Server: approval.Target}
+		if err := h.db.DeleteServer(approval.Target); err != nil {
+			result.Error = err.Error()
+			result.err = err
+		}
+		return []ServerResult{result}, nil
+	}
+	return nil, fmt.Errorf("unknown approval action %s", approval.Action)
+}
+
+// auditApproval records the approved operation itself. The approve request
+// is recorded separately by the audit middleware.
+func (h *Handler) auditApproval(c *fiber.Ctx, approver *auth.Principal, approval *database.Approval, start time.Time, err error) {
+	params := map[string]interface{}{
+		"approval_id":  approval.ID,
+		"requested_by": fmt.Sprintf("%s:%d (%s)", approval.RequesterType, approval.RequesterID, approval.RequesterName),
+	}
+	for k, v := range approval.Params {
+		params[k] = v
+	}
+
+	event := &database.AuditEvent{
+		Timestamp:  start,
+		ActorType:  approver.Type,
+		ActorID:    approver.ID,
+		ActorName:  approver.Name,
+		SourceIP:   middleware.RealIP(c),
+		Action:     approval.Action,
+		Server:     approval.Server,
+		Target:     approval.Target,
+		Params:     params,
+		Status:     200,
+		Result:     database.AuditResultSuccess,
+		DurationMS: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		event.Status = 500
+		event.Result = database.AuditResultFailure
+		event.Error = err.Error()
+	}
+
+	if recordErr := h.db.RecordAuditEvent(event); recordErr != nil {
+		logger.Error(recordErr, "Failed to record audit event")
+	}
+}
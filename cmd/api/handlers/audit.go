@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/audit"
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/gofiber/fiber/v2"
+)
+
+const defaultAuditLimit = 100
+
+// ListAuditEvents godoc
+// @Summary List audit events
+// @Description Get recorded mutating actions, oldest first. Use format=jsonl to export as JSON lines.
+// @Tags audit
+// @Produce json
+// @Param actor query string false "Actor name (API key description or username)"
+// @Param actor_type query string false "api_key, user, system or anonymous"
+// @Param action query string false "Action, e.g. containers.restart"
+// @Param server query string false "Target server"
+// @Param target query string false "Target container, key or user"
+// @Param result query string false "success, failure or pending_approval"
+// @Param since query string false "RFC 3339 timestamp or duration such as 24h"
+// @Param until query string false "RFC 3339 timestamp"
+// @Param after_id query int false "Only events with a greater ID"
+// @Param limit query int false "Maximum events to return (default 100, 0 for all when exporting)"
+// @Param format query string false "json (default) or jsonl"
+// @Success 200 {array} database.AuditEvent
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /audit [get]
+func (h *Handler) ListAuditEvents(c *fiber.Ctx) error {
+	filter := database.AuditFilter{
+		ActorType: c.Query("actor_type"),
+		ActorName: c.Query("actor"),
+		Action:    c.Query("action"),
+		Server:    c.Query("server"),
+		Target:    c.Query("target"),
+		Result:    c.Query("result"),
+		Limit:     defaultAuditLimit,
+	}
+
+	var err error
+	if v := c.Query("since"); v != "" {
+		if filter.Since, err = parseTimeOrAge(v); err != nil {
+			return apierror.Send(c, apierror.BadRequest("invalid since: "+err.Error()))
+		}
+	}
+	if v := c.Query("until"); v != "" {
+		if filter.Until, err = parseTimeOrAge(v); err != nil {
+			return apierror.Send(c, apierror.BadRequest("invalid until: "+err.Error()))
+		}
+	}
+	if v := c.Query("after_id"); v != "" {
+		if filter.AfterID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return apierror.Send(c, apierror.BadRequest("invalid after_id"))
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 0 {
+			return apierror.Send(c, apierror.BadRequest("invalid limit"))
+		}
+	}
+
+	events, err := h.db.ListAuditEvents(filter)
+	if err != nil {
+		logger.Error(err, "Failed to list audit events")
+		return apierror.Send(c, err)
+	}
+
+	if c.Query("format") != "jsonl" {
+		return c.JSON(events)
+	}
+
+	c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	w := bufio.NewWriter(c)
+	encoder := json.NewEncoder(w)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+type AuditCheckpointsResponse struct {
+	// PublicKey is the hex-encoded Ed25519 key that verifies the signatures.
+	PublicKey   string             `json:"public_key"`
+	Checkpoints []audit.Checkpoint `json:"checkpoints"`
+}
+
+// ListAuditCheckpoints godoc
+// @Summary List audit checkpoints
+// @Description Get the signed checkpoints of the audit hash chain and the key that verifies them
+// @Tags audit
+// @Produce json
+// @Success 200 {object} AuditCheckpointsResponse
+// @Failure 403 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /audit/checkpoints [get]
+func (h *Handler) ListAuditCheckpoints(c *fiber.Ctx) error {
+	publicKey, err := h.db.AuditPublicKey()
+	if err != nil {
+		logger.Error(err, "Failed to load audit signing key")
+		return apierror.Send(c, err)
+	}
+
+	checkpoints, err := h.db.ListAuditCheckpoints()
+	if err != nil {
+		logger.Error(err, "Failed to list audit checkpoints")
+		return apierror.Send(c, err)
+	}
+
+	return c.JSON(AuditCheckpointsResponse{
+		PublicKey:   hex.EncodeToString(publicKey),
+		Checkpoints: checkpoints,
+	})
+}
+
+// parseTimeOrAge accepts an RFC 3339 timestamp or a duration meaning that
+// long ago.
+func parseTimeOrAge(value string) (time.Time, error) {
+	if age, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-age), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,421 @@
+package handlers
+
+import (
+	"fmt"
+	"net/mail"
+	"strconv"
+
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/email"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/Zeptile/docktrine/internal/notify"
+	"github.com/gofiber/fiber/v2"
+)
+
+type CreateEmailChannelRequest struct {
+	Name string `json:"name"`
+	// Host and Port are the SMTP server. Port defaults to 587 for
+	// starttls, 465 for tls and 25 for none.
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// TLS is starttls (the default), tls or none.
+	TLS           string `json:"tls"`
+	TLSSkipVerify bool   `json:"tls_skip_verify"`
+	// Username and Password authenticate with the SMTP server when set.
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// From is the sender, e.g. "Docktrine <docktrine@example.com>".
+	From string   `json:"from"`
+	To   []string `json:"to"`
+	// Events the channel receives, or * for all of them. Defaults to *.
+	Events []string `json:"events"`
+	// MinSeverity only sends notifications of this severity or higher:
+	// info, warning or critical.
+	MinSeverity string `json:"min_severity"`
+	// DigestSeconds is the least time between two emails; notifications in
+	// between are batched into one digest.
+	DigestSeconds int `json:"digest_seconds"`
+	// SubjectTemplate, TextTemplate and HTMLTemplate are Go templates
+	// replacing the default subject and bodies.
+	SubjectTemplate string `json:"subject_template"`
+	TextTemplate    string `json:"text_template"`
+	HTMLTemplate    string `json:"html_template"`
+}
+
+// UpdateEmailChannelRequest changes the fields that are set and leaves the
+// others as they are.
+type UpdateEmailChannelRequest struct {
+	Name            *string  `json:"name"`
+	Host            *string  `json:"host"`
+	Port            *int     `json:"port"`
+	TLS             *string  `json:"tls"`
+	TLSSkipVerify   *bool    `json:"tls_skip_verify"`
+	Username        *string  `json:"username"`
+	Password        *string  `json:"password"`
+	From            *string  `json:"from"`
+	To              []string `json:"to"`
+	Events          []string `json:"events"`
+	MinSeverity     *string  `json:"min_severity"`
+	DigestSeconds   *int     `json:"digest_seconds"`
+	SubjectTemplate *string  `json:"subject_template"`
+	TextTemplate    *string  `json:"text_template"`
+	HTMLTemplate    *string  `json:"html_template"`
+}
+
+// ListEmailChannels godoc
+// @Summary List email channels
+// @Description Get every email channel with its outbox state. Passwords are never returned.
+// @Tags email
+// @Accept json
+// @Produce json
+// @Success 200 {array} database.EmailChannel
+// @Failure 403 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /email/channels [get]
+func (h *Handler) ListEmailChannels(c *fiber.Ctx) error {
+	channels, err := h.db.ListEmailChannels()
+	if err != nil {
+		logger.Error(err, "Failed to list email channels")
+		return apierror.Send(c, err)
+	}
+	for i := range channels {
+		channels[i].Password = ""
+	}
+	return c.JSON(channels)
+}
+
+// CreateEmailChannel godoc
+// @Summary Create an email channel
+// @Description Send notifications by email through an SMTP server. With digest_seconds set, notifications arriving within that long of the last email are batched into one digest email.
+// @Tags email
+// @Accept json
+// @Produce json
+// @Param channel body CreateEmailChannelRequest true "Email channel"
+// @Success 201 {object} database.EmailChannel
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /email/channels [post]
+func (h *Handler) CreateEmailChannel(c *fiber.Ctx) error {
+	var req CreateEmailChannelRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Send(c, apierror.BadRequest("invalid request body"))
+	}
+
+	if len(req.Events) == 0 {
+		req.Events = []string{"*"}
+	}
+	if req.TLS == "" {
+		req.TLS = database.EmailTLSStartTLS
+	}
+	if req.Port == 0 {
+		switch req.TLS {
+		case database.EmailTLSImplicit:
+			req.Port = 465
+		case database.EmailTLSNone:
+			req.Port = 25
+		default:
+			req.Port = 587
+		}
+	}
+
+	channel := &database.EmailChannel{
+		Name:            req.Name,
+		Host:            req.Host,
+		Port:            req.Port,
+		TLS:             req.TLS,
+		TLSSkipVerify:   req.TLSSkipVerify,
+		Username:        req.Username,
+		Password:        req.Password,
+		From:            req.From,
+		To:              req.To,
+		Events:          req.Events,
+		MinSeverity:     req.MinSeverity,
+		DigestSeconds:   req.DigestSeconds,
+		SubjectTemplate: req.SubjectTemplate,
+		TextTemplate:    req.TextTemplate,
+		HTMLTemplate:    req.HTMLTemplate,
+	}
+	if err := validateEmailChannel(channel); err != nil {
+		return apierror.Send(c, err)
+	}
+	if err := h.db.CreateEmailChannel(channel); err != nil {
+		logger.Error(err, "Failed to create email channel")
+		return apierror.Send(c, err)
+	}
+
+	logger.Info(fmt.Sprintf("Email channel created: %d (%s)", channel.ID, channel.Name))
+	channel.Password = ""
+	return c.Status(201).JSON(channel)
+}
+
+// GetEmailChannel godoc
+// @Summary Get an email channel
+// @Description Get an email channel with its outbox state: pending notifications, when they are sent next and the last error. Its password is never returned.
+// @Tags email
+// @Accept json
+// @Produce json
+// @Param id path int true "Email channel ID"
+// @Success 200 {object} database.EmailChannel
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /email/channels/{id} [get]
+func (h *Handler) GetEmailChannel(c *fiber.Ctx) error {
+	channel, err := h.lookupEmailChannel(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+	channel.Password = ""
+	return c.JSON(channel)
+}
+
+// UpdateEmailChannel godoc
+// @Summary Update an email channel
+// @Description Change an email channel's settings. Only the fields that are set change; set a template to "" to go back to the default.
+// @Tags email
+// @Accept json
+// @Produce json
+// @Param id path int true "Email channel ID"
+// @Param channel body UpdateEmailChannelRequest true "Fields to change"
+// @Success 200 {object} database.EmailChannel
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /email/channels/{id} [patch]
+func (h *Handler) UpdateEmailChannel(c *fiber.Ctx) error {
+	channel, err := h.lookupEmailChannel(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	var req UpdateEmailChannelRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Send(c, apierror.BadRequest("invalid request body"))
+	}
+	for _, field := range []struct {
+		value *string
+		dest  *string
+	}{
+		{req.Name, &channel.Name},
+		{req.Host, &channel.Host},
+		{req.TLS, &channel.TLS},
+		{req.Username, &channel.Username},
+		{req.Password, &channel.Password},
+		{req.From, &channel.From},
+		{req.MinSeverity, &channel.MinSeverity},
+		{req.SubjectTemplate, &channel.SubjectTemplate},
+		{req.TextTemplate, &channel.TextTemplate},
+		{req.HTMLTemplate, &channel.HTMLTemplate},
+	} {
+		if field.value != nil {
+			*field.dest = *field.value
+		}
+	}
+	if req.Port != nil {
+		channel.Port = *req.Port
+	}
+	if req.TLSSkipVerify != nil {
+		channel.TLSSkipVerify = *req.TLSSkipVerify
+	}
+	if req.To != nil {
+		channel.To = req.To
+	}
+	if req.Events != nil {
+		channel.Events = req.Events
+	}
+	if req.DigestSeconds != nil {
+		channel.DigestSeconds = *req.DigestSeconds
+	}
+	if err := validateEmailChannel(channel); err != nil {
+		return apierror.Send(c, err)
+	}
+
+	if err := h.db.UpdateEmailChannel(channel); err != nil {
+		logger.Error(err, "Failed to update email channel")
+		return apierror.Send(c, err)
+	}
+
+	logger.Info(fmt.Sprintf("Email channel updated: %d (%s)", channel.ID, channel.Name))
+	channel.Password = ""
+	return c.JSON(channel)
+}
+
+// DeleteEmailChannel godoc
+// @Summary Delete an email channel
+// @Description Delete an email channel along with the notifications waiting in its outbox
+// @Tags email
+// @Accept json
+// @Produce json
+// @Param id path int true "Email channel ID"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /email/channels/{id} [delete]
+func (h *Handler) DeleteEmailChannel(c *fiber.Ctx) error {
+	channel, err := h.lookupEmailChannel(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	if err := h.db.DeleteEmailChannel(channel.ID); err != nil {
+		logger.Error(err, "Failed to delete email channel")
+		return apierror.Send(c, err)
+	}
+
+	logger.Info(fmt.Sprintf("Email channel deleted: %d (%s)", channel.ID, channel.Name))
+	return c.JSON(MessageResponse{Message: "email channel deleted successfully"})
+}
+
+// DisableEmailChannel godoc
+// @Summary Disable an email channel
+// @Description Stop sending notifications to an email channel without deleting it. Notifications already queued are sent once it is enabled again.
+// @Tags email
+// @Accept json
+// @Produce json
+// @Param id path int true "Email channel ID"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /email/channels/{id}/disable [post]
+func (h *Handler) DisableEmailChannel(c *fiber.Ctx) error {
+	return h.setEmailChannelEnabled(c, false)
+}
+
+// EnableEmailChannel godoc
+// @Summary Enable an email channel
+// @Description Resume sending notifications to a disabled email channel
+// @Tags email
+// @Accept json
+// @Produce json
+// @Param id path int true "Email channel ID"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /email/channels/{id}/enable [post]
+func (h *Handler) EnableEmailChannel(c *fiber.Ctx) error {
+	return h.setEmailChannelEnabled(c, true)
+}
+
+func (h *Handler) setEmailChannelEnabled(c *fiber.Ctx, enabled bool) error {
+	channel, err := h.lookupEmailChannel(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	if err := h.db.SetEmailChannelEnabled(channel.ID, enabled); err != nil {
+		logger.Error(err, "Failed to update email channel")
+		return apierror.Send(c, err)
+	}
+
+	if !enabled {
+		logger.Info(fmt.Sprintf("Email channel disabled: %d (%s)", channel.ID, channel.Name))
+		return c.JSON(MessageResponse{Message: "email channel disabled successfully"})
+	}
+	h.Email.Wake()
+	logger.Info(fmt.Sprintf("Email channel enabled: %d (%s)", channel.ID, channel.Name))
+	return c.JSON(MessageResponse{Message: "email channel enabled successfully"})
+}
+
+// TestEmailChannel godoc
+// @Summary Send a test email
+// @Description Send a test email to an email channel right away, whatever its subscriptions and digest window, and report the SMTP server's answer.
+// @Tags email
+// @Accept json
+// @Produce json
+// @Param id path int true "Email channel ID"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 502 {object} apierror.Response
+// @Router /email/channels/{id}/test [post]
+func (h *Handler) TestEmailChannel(c *fiber.Ctx) error {
+	channel, err := h.lookupEmailChannel(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	if err := h.Email.Test(c.Context(), channel); err != nil {
+		logger.Warn(fmt.Sprintf("Test email to channel %s failed: %v", channel.Name, err))
+		return apierror.Send(c, apierror.New(fiber.StatusBadGateway, apierror.CodeSMTP, err.Error()))
+	}
+	return c.JSON(MessageResponse{Message: fmt.Sprintf("test email sent to %d recipients", len(channel.To))})
+}
+
+func (h *Handler) lookupEmailChannel(c *fiber.Ctx) (*database.EmailChannel, error) {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return nil, apierror.BadRequest("invalid email channel id")
+	}
+
+	channel, err := h.db.GetEmailChannel(id)
+	if err != nil {
+		logger.Error(err, "Failed to get email channel")
+		return nil, err
+	}
+	if channel == nil {
+		return nil, apierror.NotFound("email channel not found")
+	}
+	return channel, nil
+}
+
+// validateEmailChannel checks the settings of an email channel being
+// created or updated.
+func validateEmailChannel(channel *database.EmailChannel) error {
+	if channel.Name == "" {
+		return apierror.BadRequest("name is required")
+	}
+	if channel.Host == "" {
+		return apierror.BadRequest("host is required")
+	}
+	if channel.Port < 1 || channel.Port > 65535 {
+		return apierror.BadRequest("port must be between 1 and 65535")
+	}
+	switch channel.TLS {
+	case database.EmailTLSStartTLS, database.EmailTLSImplicit, database.EmailTLSNone:
+	default:
+		return apierror.BadRequest("tls must be starttls, tls or none")
+	}
+	if channel.Password != "" && channel.Username == "" {
+		return apierror.BadRequest("password requires a username")
+	}
+	if _, err := mail.ParseAddress(channel.From); err != nil {
+		return apierror.BadRequest(fmt.Sprintf("invalid from address %q", channel.From))
+	}
+	if len(channel.To) == 0 {
+		return apierror.BadRequest("to must list at least one recipient")
+	}
+	for _, recipient := range channel.To {
+		if _, err := mail.ParseAddress(recipient); err != nil {
+			return apierror.BadRequest(fmt.Sprintf("invalid recipient %q", recipient))
+		}
+	}
+	if len(channel.Events) == 0 {
+		return apierror.BadRequest("events must not be empty")
+	}
+	for _, event := range channel.Events {
+		if event != "*" && !isEvent(event) {
+			return apierror.BadRequest(fmt.Sprintf("unknown event %q", event))
+		}
+	}
+	if channel.MinSeverity != "" && !notify.ValidSeverity(channel.MinSeverity) {
+		return apierror.BadRequest("min_severity must be info, warning or critical")
+	}
+	if channel.DigestSeconds < 0 {
+		return apierror.BadRequest("digest_seconds must not be negative")
+	}
+	if err := email.ParseTemplates(channel.SubjectTemplate, channel.TextTemplate, channel.HTMLTemplate); err != nil {
+		return apierror.BadRequest(err.Error())
+	}
+	return nil
+}
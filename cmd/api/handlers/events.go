@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zeptile/docktrine/cmd/api/middleware"
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/auth"
+	"github.com/Zeptile/docktrine/internal/docker"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/gofiber/fiber/v2"
+)
+
+// eventHeartbeatInterval is how often an idle event stream sends a comment,
+// which keeps proxies from closing it and notices clients that went away.
+const eventHeartbeatInterval = 15 * time.Second
+
+// StreamEvents godoc
+// @Summary Stream Docker events
+// @Description Stream the Docker events of the selected servers as server-sent events. Each event is tagged with its server. Lost daemon connections are retried with the time of the last event, so no events are missed, and reported as events of type docktrine. The id of each event can be sent back in Last-Event-ID to resume.
+// @Tags events
+// @Produce text/event-stream
+// @Param server query string false "Server name or selector (group:<name>, label:<key>=<value>, * for all)"
+// @Param type query string false "Comma-separated event types, e.g. container,image"
+// @Param action query string false "Comma-separated actions, e.g. start,die,pull"
+// @Param label query []string false "Only events whose actor has this label (key or key=value); repeatable" collectionFormat(multi)
+// @Param since query string false "Replay events since this time (RFC 3339 or Unix seconds)"
+// @Param Last-Event-ID header string false "Resume after this event id"
+// @Success 200 {object} docker.Event
+// @Failure 400 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Router /events [get]
+func (h *Handler) StreamEvents(c *fiber.Ctx) error {
+	servers, err := h.docker.ResolveServers(c.Query("server", ""))
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	filter := docker.EventFilter{
+		Types:   splitList(c.Query("type")),
+		Actions: splitList(c.Query("action")),
+	}
+	for _, label := range c.Context().QueryArgs().PeekMulti("label") {
+		filter.Labels = append(filter.Labels, string(label))
+	}
+
+	since, err := eventsSince(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	principal := middleware.CurrentPrincipal(c)
+	requestID := middleware.CurrentRequestID(c)
+
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		events := make(chan docker.Event, 64)
+		for _, server := range servers {
+			go h.docker.WatchEvents(ctx, server.Name, filter, since, events)
+		}
+		logger.Debug(fmt.Sprintf("Streaming events of %d server(s) [ID: %s]", len(servers), requestID))
+
+		// Say something straight away so clients and proxies see the
+		// stream is open.
+		fmt.Fprint(w, ": connected\n\n")
+		if err := w.Flush(); err != nil {
+			return
+		}
+
+		heartbeat := time.NewTicker(eventHeartbeatInterval)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case event := <-events:
+				if !eventAllowed(principal, event) {
+					continue
+				}
+				data, err := json.Marshal(event)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Time.UnixNano(), event.Type, data)
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": ping\n\n")
+			}
+			if err := w.Flush(); err != nil {
+				// The client went away.
+				logger.Debug(fmt.Sprintf("Event stream closed [ID: %s]", requestID))
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// eventsSince is where a stream starts: after the event in Last-Event-ID,
+// at the since query parameter, or now.
+func eventsSince(c *fiber.Ctx) (time.Time, error) {
+	if lastID := c.Get("Last-Event-ID"); lastID != "" {
+		nanos, err := strconv.ParseInt(lastID, 10, 64)
+		if err != nil {
+			return time.Time{}, apierror.BadRequest("invalid Last-Event-ID")
+		}
+		return time.Unix(0, nanos).UTC(), nil
+	}
+
+	value := c.Query("since")
+	if value == "" {
+		return time.Time{}, nil
+	}
+	since, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		seconds, parseErr := strconv.ParseInt(value, 10, 64)
+		if parseErr != nil {
+			return time.Time{}, apierror.BadRequest("invalid since, expected RFC 3339 or Unix seconds")
+		}
+		since = time.Unix(seconds, 0)
+	}
+	// Events at since itself are included.
+	return since.UTC().Add(-time.Nanosecond), nil
+}
+
+// eventAllowed hides events about containers a principal limited to some
+// container labels may not see, and everything but container events from
+// it. Docker puts a container's labels in its event attributes.
+func eventAllowed(principal *auth.Principal, event docker.Event) bool {
+	if principal == nil || !auth.RestrictsContainers(principal) || event.Type == docker.EventTypeStream {
+		return true
+	}
+	return event.Type == "container" && auth.AllowsContainer(principal, event.Attributes)
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/gofiber/fiber/v2"
+)
+
+type ServerResult struct {
+	Server string `json:"server"`
+	Error  string `json:"error,omitempty"`
+
+	err error
+}
+
+// forEachServer runs action concurrently against every server matched by
+// selector and collects the per-server outcome.
+func (h *Handler) forEachServer(selector string, action func(server string) error) ([]ServerResult, error) {
+	servers, err := h.docker.ResolveServers(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]ServerResult, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			results[i] = ServerResult{Server: name}
+			if err := action(name); err != nil {
+				logger.Error(err, fmt.Sprintf("Action failed on server: %s", name))
+				results[i].Error = err.Error()
+				results[i].err = err
+			}
+		}(i, server.Name)
+	}
+	wg.Wait()
+
+	return results, nil
+}
+
+// resultsError summarizes the failures in results, or returns nil if every
+// server succeeded. When all servers failed the same way the error keeps
+// that status, e.g. 404 if the container exists nowhere; mixed outcomes are
+// a 500 partial_failure. The results are attached as details.
+func resultsError(results []ServerResult) *apierror.Error {
+	var failed []*apierror.Error
+	var messages []string
+	for _, r := range results {
+		if r.err != nil {
+			failed = append(failed, apierror.From(r.err))
+			messages = append(messages, fmt.Sprintf("%s: %s", r.Server, r.Error))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+
+	message := fmt.Sprintf("failed on %d of %d servers: %s", len(failed), len(results), strings.Join(messages, "; "))
+	apiErr := apierror.New(failed[0].Status, failed[0].Code, message)
+	if len(failed) < len(results) {
+		apiErr = apierror.New(fiber.StatusInternalServerError, apierror.CodePartialFailure, message)
+	}
+	for _, e := range failed[1:] {
+		if e.Code != apiErr.Code {
+			apiErr = apierror.Internal(message)
+			break
+		}
+	}
+	return apiErr.WithDetail("results", results)
+}
+
+// fanOut answers a container action addressed to a server selector. The
+// response lists the outcome per server and is an error if any server
+// failed.
+func (h *Handler) fanOut(c *fiber.Ctx, selector string, message string, action func(server string) error) error {
+	results, err := h.forEachServer(selector, action)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	if apiErr := resultsError(results); apiErr != nil {
+		return apierror.Send(c, apiErr)
+	}
+
+	return c.JSON(ActionResponse{
+		Message: message,
+		Results: results,
+	})
+}
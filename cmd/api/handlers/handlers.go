@@ -2,22 +2,56 @@ package handlers
 
 import (
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/Zeptile/docktrine/cmd/api/middleware"
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/auth"
 	"github.com/Zeptile/docktrine/internal/database"
 	"github.com/Zeptile/docktrine/internal/docker"
+	"github.com/Zeptile/docktrine/internal/email"
+	"github.com/Zeptile/docktrine/internal/jobs"
 	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/Zeptile/docktrine/internal/notify"
+	"github.com/Zeptile/docktrine/internal/oidc"
+	"github.com/Zeptile/docktrine/internal/webhooks"
 	"github.com/gofiber/fiber/v2"
 )
 
 type Handler struct {
 	docker *docker.DockerClient
 	db     *database.DB
+
+	// SessionTTL is how long user session tokens stay valid.
+	SessionTTL time.Duration
+	// OIDC is the single sign-on provider, nil when SSO is not configured.
+	OIDC *oidc.Provider
+	// RateLimits holds the rate limiters whose counters GET /limits reports.
+	RateLimits *middleware.RateLimits
+	// SetupToken is set while the API is waiting for its first admin.
+	SetupToken *SetupToken
+	// Jobs runs the operations queued with ?async=true.
+	Jobs *jobs.Runner
+	// Notifications is sent the restarts performed through the API.
+	Notifications *notify.Dispatcher
+	// Webhooks delivers notifications to the registered webhooks.
+	Webhooks *webhooks.Notifier
+	// Email sends notifications to the email channels.
+	Email *email.Notifier
+	// ApprovalTTL is how long operations held for approval stay pending.
+	ApprovalTTL time.Duration
+
+	oidcLogins pendingLogins
 }
 
 func NewHandler(db *database.DB) *Handler {
 	return &Handler{
-		docker: docker.NewDockerClient(db),
-		db:     db,
+		docker:      docker.NewDockerClient(db),
+		db:          db,
+		SessionTTL:  12 * time.Hour,
+		ApprovalTTL: time.Hour,
 	}
 }
 
@@ -27,22 +61,73 @@ func NewHandler(db *database.DB) *Handler {
 // @Tags containers
 // @Accept json
 // @Produce json
-// @Param server query string false "Server name"
-// @Success 200 {array} interface{}
-// @Failure 500 {object} interface{}
+// @Param server query string false "Server name or selector (group:<name>, label:<key>=<value>)"
+// @Success 200 {array} docker.Container
+// @Failure 500 {object} apierror.Response
 // @Router /containers [get]
 func (h *Handler) ListContainers(c *fiber.Ctx) error {
+	containers, err := h.listContainers(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	logger.Info("Successfully listed containers")
+	return c.JSON(containers)
+}
+
+// listContainers lists the containers the principal may see on the servers
+// matched by the server query, with their active alerts. Servers that
+// failed are named in the X-Failed-Servers header unless all of them did.
+func (h *Handler) listContainers(c *fiber.Ctx) ([]docker.Container, error) {
 	serverName := c.Query("server", "")
 	logger.Debug("Listing containers")
-	containers, err := h.docker.ListContainers(serverName)
+
+	principal := middleware.CurrentPrincipal(c)
+	var mu sync.Mutex
+	containers := []docker.Container{}
+	results, err := h.forEachServer(serverName, func(server string) error {
+		list, err := h.docker.ListContainers(server)
+		if err != nil {
+			return err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, container := range list {
+			if principal != nil && auth.RestrictsContainers(principal) {
+				if !auth.AllowsContainer(principal, container.Labels) {
+					continue
+				}
+			}
+			container.Server = server
+			containers = append(containers, container)
+		}
+		return nil
+	})
 	if err != nil {
 		logger.Error(err, "Failed to list containers")
-		return c.Status(500).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return nil, err
 	}
-	logger.Info("Successfully listed containers")
-	return c.JSON(containers)
+
+	var failed []string
+	for _, r := range results {
+		if r.Error != "" {
+			failed = append(failed, r.Server)
+		}
+	}
+
+	if apiErr := resultsError(results); apiErr != nil && len(failed) == len(results) {
+		return nil, apiErr
+	}
+	if len(failed) > 0 {
+		c.Set("X-Failed-Servers", strings.Join(failed, ","))
+	}
+
+	alerts := h.activeAlerts()
+	for i := range containers {
+		containers[i].Alerts = alerts[alertKey(containers[i].Server, containers[i].ID)]
+	}
+	return containers, nil
 }
 
 // StartContainer godoc
@@ -52,34 +137,42 @@ func (h *Handler) ListContainers(c *fiber.Ctx) error {
 // @Accept json
 // @Produce json
 // @Param id path string true "Container ID"
-// @Param server query string false "Server name"
-// @Success 200 {object} interface{}
-// @Failure 400 {object} interface{}
-// @Failure 500 {object} interface{}
+// @Param server query string false "Server name or selector (group:<name>, label:<key>=<value>)"
+// @Param async query boolean false "Queue the operation as a background job and return 202 with the job" default(false)
+// @Success 200 {object} ActionResponse
+// @Success 202 {object} JobAcceptedResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
 // @Router /containers/start/{id} [post]
 func (h *Handler) StartContainer(c *fiber.Ctx) error {
 	containerID := c.Params("id")
 	serverName := c.Query("server", "")
 	logger.Debug(fmt.Sprintf("Starting container: %s", containerID))
-	
+
 	if containerID == "" {
 		logger.Warn("Container ID is required")
-		return c.Status(400).JSON(fiber.Map{
-			"error": "container ID is required",
+		return apierror.Send(c, apierror.BadRequest("container ID is required"))
+	}
+
+	if middleware.WantsAsync(c) {
+		return h.enqueueJob(c, "containers.start", serverName, containerID, nil)
+	}
+
+	if docker.IsSelector(serverName) {
+		return h.fanOut(c, serverName, fmt.Sprintf("Container %s started successfully", containerID), func(server string) error {
+			return h.docker.StartContainer(containerID, server)
 		})
 	}
 
 	err := h.docker.StartContainer(containerID, serverName)
 	if err != nil {
 		logger.Error(err, fmt.Sprintf("Failed to start container: %s", containerID))
-		return c.Status(500).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return apierror.Send(c, err)
 	}
 
 	logger.Info(fmt.Sprintf("Container started successfully: %s", containerID))
-	return c.JSON(fiber.Map{
-		"message": fmt.Sprintf("Container %s started successfully", containerID),
+	return c.JSON(ActionResponse{
+		Message: fmt.Sprintf("Container %s started successfully", containerID),
 	})
 }
 
@@ -90,68 +183,120 @@ func (h *Handler) StartContainer(c *fiber.Ctx) error {
 // @Accept json
 // @Produce json
 // @Param id path string true "Container ID"
-// @Param server query string false "Server name"
-// @Success 200 {object} interface{}
-// @Failure 400 {object} interface{}
-// @Failure 500 {object} interface{}
+// @Param server query string false "Server name or selector (group:<name>, label:<key>=<value>)"
+// @Param async query boolean false "Queue the operation as a background job and return 202 with the job" default(false)
+// @Success 200 {object} ActionResponse
+// @Success 202 {object} middleware.ApprovalRequiredResponse "Held for approval, or with async queued as a job (JobAcceptedResponse)"
+// @Failure 400 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
 // @Router /containers/stop/{id} [post]
 func (h *Handler) StopContainer(c *fiber.Ctx) error {
 	containerID := c.Params("id")
 	serverName := c.Query("server", "")
-	
+
 	if containerID == "" {
-		return c.Status(400).JSON(fiber.Map{
-			"error": "container ID is required",
+		return apierror.Send(c, apierror.BadRequest("container ID is required"))
+	}
+
+	if middleware.WantsAsync(c) {
+		return h.enqueueJob(c, "containers.stop", serverName, containerID, nil)
+	}
+
+	if docker.IsSelector(serverName) {
+		return h.fanOut(c, serverName, fmt.Sprintf("Container %s stopped successfully", containerID), func(server string) error {
+			return h.docker.StopContainer(containerID, server)
 		})
 	}
 
 	err := h.docker.StopContainer(containerID, serverName)
 	if err != nil {
-		return c.Status(500).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return apierror.Send(c, err)
 	}
 
 	logger.Info(fmt.Sprintf("Container stopped successfully: %s", containerID))
-	return c.JSON(fiber.Map{
-		"message": fmt.Sprintf("Container %s stopped successfully", containerID),
+	return c.JSON(ActionResponse{
+		Message: fmt.Sprintf("Container %s stopped successfully", containerID),
 	})
 }
 
 // GetContainer godoc
 // @Summary Get container details
-// @Description Get detailed information about a specific Docker container
+// @Description Get detailed information about a specific Docker container. With a server selector, the matches from every selected server are returned as an array.
 // @Tags containers
 // @Accept json
 // @Produce json
 // @Param id path string true "Container ID"
-// @Param server query string false "Server name"
-// @Success 200 {object} interface{}
-// @Failure 400 {object} interface{}
-// @Failure 500 {object} interface{}
+// @Param server query string false "Server name or selector (group:<name>, label:<key>=<value>)"
+// @Success 200 {object} docker.Container
+// @Failure 400 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
 // @Router /containers/{id} [get]
 func (h *Handler) GetContainer(c *fiber.Ctx) error {
 	containerID := c.Params("id")
 	serverName := c.Query("server", "")
 	logger.Debug(fmt.Sprintf("Getting container: %s", containerID))
-	
+
 	if containerID == "" {
 		logger.Warn("Container ID is required")
-		return c.Status(400).JSON(fiber.Map{
-			"error": "container ID is required",
+		return apierror.Send(c, apierror.BadRequest("container ID is required"))
+	}
+
+	found, err := h.getContainer(containerID, serverName)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+	if docker.IsSelector(serverName) {
+		return c.JSON(found)
+	}
+
+	logger.Info(fmt.Sprintf("Container retrieved successfully: %s", containerID))
+	return c.JSON(found[0])
+}
+
+// getContainer looks containerID up on the server named serverName, or on
+// every server it matches when it is a selector, with its active alerts.
+// Found containers only carry their server when serverName is a selector.
+func (h *Handler) getContainer(containerID, serverName string) ([]docker.Container, error) {
+	if docker.IsSelector(serverName) {
+		var mu sync.Mutex
+		found := []docker.Container{}
+		results, err := h.forEachServer(serverName, func(server string) error {
+			container, err := h.docker.GetContainer(containerID, server)
+			if err != nil {
+				return err
+			}
+			container.Server = server
+
+			mu.Lock()
+			defer mu.Unlock()
+			found = append(found, *container)
+			return nil
 		})
+		if err != nil {
+			return nil, err
+		}
+		if apiErr := resultsError(results); len(found) == 0 && apiErr != nil && apiErr.Code != apierror.CodeNotFound {
+			return nil, apiErr
+		}
+		if len(found) == 0 {
+			return nil, apierror.NotFound(fmt.Sprintf("container %s not found on any matching server", containerID))
+		}
+		alerts := h.activeAlerts()
+		for i := range found {
+			found[i].Alerts = alerts[alertKey(found[i].Server, found[i].ID)]
+		}
+		return found, nil
 	}
 
 	container, err := h.docker.GetContainer(containerID, serverName)
 	if err != nil {
 		logger.Error(err, fmt.Sprintf("Failed to get container: %s", containerID))
-		return c.Status(500).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return nil, err
 	}
-
-	logger.Info(fmt.Sprintf("Container retrieved successfully: %s", containerID))
-	return c.JSON(container)
+	if servers, err := h.docker.ResolveServers(serverName); err == nil && len(servers) == 1 {
+		container.Alerts = h.activeAlerts()[alertKey(servers[0].Name, container.ID)]
+	}
+	return []docker.Container{*container}, nil
 }
 
 // RestartContainer godoc
@@ -161,11 +306,13 @@ func (h *Handler) GetContainer(c *fiber.Ctx) error {
 // @Accept json
 // @Produce json
 // @Param id path string true "Container ID"
-// @Param server query string false "Server name"
+// @Param server query string false "Server name or selector (group:<name>, label:<key>=<value>)"
 // @Param pull_latest query boolean false "Pull latest image before restart" default(false)
-// @Success 200 {object} interface{}
-// @Failure 400 {object} interface{}
-// @Failure 500 {object} interface{}
+// @Param async query boolean false "Queue the operation as a background job and return 202 with the job" default(false)
+// @Success 200 {object} ActionResponse
+// @Success 202 {object} middleware.ApprovalRequiredResponse "Held for approval, or with async queued as a job (JobAcceptedResponse)"
+// @Failure 400 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
 // @Router /containers/restart/{id} [post]
 func (h *Handler) RestartContainer(c *fiber.Ctx) error {
 	containerID := c.Params("id")
@@ -173,25 +320,57 @@ func (h *Handler) RestartContainer(c *fiber.Ctx) error {
 	pullLatest := c.Query("pull_latest", "false") == "true"
 
 	logger.Debug(fmt.Sprintf("Restarting container: %s", containerID))
-	
+
 	if containerID == "" {
 		logger.Warn("Container ID is required")
-		return c.Status(400).JSON(fiber.Map{
-			"error": "container ID is required",
-		})
+		return apierror.Send(c, apierror.BadRequest("container ID is required"))
 	}
 
+	if middleware.WantsAsync(c) {
+		params := map[string]string{}
+		if pullLatest {
+			params["pull_latest"] = "true"
+		}
+		return h.enqueueJob(c, "containers.restart", serverName, containerID, params)
+	}
 
-	err := h.docker.RestartContainer(containerID, serverName, pullLatest)
+	by := ""
+	if principal := middleware.CurrentPrincipal(c); principal != nil {
+		by = principal.Name
+	}
+	if docker.IsSelector(serverName) {
+		return h.fanOut(c, serverName, fmt.Sprintf("Container %s restarted successfully", containerID), func(server string) error {
+			digest, err := h.docker.RestartContainer(containerID, server, pullLatest)
+			if err != nil {
+				return err
+			}
+			h.notifyRestarted(by, server, containerID, pullLatest, digest)
+			return nil
+		})
+	}
+
+	digest, err := h.docker.RestartContainer(containerID, serverName, pullLatest)
 	if err != nil {
 		logger.Error(err, fmt.Sprintf("Failed to restart container: %s", containerID))
-		return c.Status(500).JSON(fiber.Map{
-			"error": err.Error(),
-		})
+		return apierror.Send(c, err)
+	}
+	if servers, err := h.docker.ResolveServers(serverName); err == nil && len(servers) == 1 {
+		h.notifyRestarted(by, servers[0].Name, containerID, pullLatest, digest)
 	}
 
 	logger.Info(fmt.Sprintf("Container restarted successfully: %s", containerID))
-	return c.JSON(fiber.Map{
-		"message": fmt.Sprintf("Container %s restarted successfully", containerID),
+	return c.JSON(ActionResponse{
+		Message: fmt.Sprintf("Container %s restarted successfully", containerID),
 	})
-} 
\ No newline at end of file
+}
+
+// notifyRestarted reports a restart asked for by the principal named by.
+func (h *Handler) notifyRestarted(by, server, containerID string, pullLatest bool, digest string) {
+	h.Notifications.Send(notify.Restarted(notify.Restart{
+		Server:     server,
+		Container:  containerID,
+		PullLatest: pullLatest,
+		Digest:     digest,
+		By:         by,
+	}))
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/Zeptile/docktrine/cmd/api/middleware"
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/auth"
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/gofiber/fiber/v2"
+)
+
+const defaultHistoryLimit = 500
+
+// GetContainerHistory godoc
+// @Summary Get a container's history
+// @Description Get the recorded lifecycle events (create, start, die with exit code, oom, health_status, restart, ...) of a container, oldest first. The container is matched by ID, ID prefix or name, so the history of a name spans the containers that had it.
+// @Tags containers
+// @Accept json
+// @Produce json
+// @Param id path string true "Container ID or name"
+// @Param server query string false "Server name or selector (group:<name>, label:<key>=<value>)"
+// @Param action query string false "Comma-separated actions, e.g. die,oom"
+// @Param since query string false "Only events after this RFC 3339 time or this long ago, e.g. 24h"
+// @Param until query string false "Only events before this RFC 3339 time or this long ago"
+// @Param limit query int false "Maximum number of events, the newest are kept" default(500)
+// @Success 200 {array} database.ContainerEvent
+// @Failure 400 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /containers/{id}/history [get]
+func (h *Handler) GetContainerHistory(c *fiber.Ctx) error {
+	filter, err := h.historyFilter(c, c.Query("server", ""))
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+	filter.Container = c.Params("id")
+	return h.sendHistory(c, filter)
+}
+
+// GetServerHistory godoc
+// @Summary Get a server's container timeline
+// @Description Get the recorded lifecycle events of every container on a server, oldest first.
+// @Tags servers
+// @Accept json
+// @Produce json
+// @Param name path string true "Server name"
+// @Param container query string false "Only this container (ID, ID prefix or name)"
+// @Param action query string false "Comma-separated actions, e.g. die,oom"
+// @Param since query string false "Only events after this RFC 3339 time or this long ago, e.g. 24h"
+// @Param until query string false "Only events before this RFC 3339 time or this long ago"
+// @Param limit query int false "Maximum number of events, the newest are kept" default(500)
+// @Success 200 {array} database.ContainerEvent
+// @Failure 400 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /servers/{name}/history [get]
+func (h *Handler) GetServerHistory(c *fiber.Ctx) error {
+	filter, err := h.historyFilter(c, c.Params("name"))
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+	filter.Container = c.Query("container")
+	return h.sendHistory(c, filter)
+}
+
+func (h *Handler) historyFilter(c *fiber.Ctx, selector string) (database.ContainerEventFilter, error) {
+	filter := database.ContainerEventFilter{
+		Actions: splitList(c.Query("action")),
+		Limit:   defaultHistoryLimit,
+	}
+
+	servers, err := h.docker.ResolveServers(selector)
+	if err != nil {
+		return filter, err
+	}
+	for _, server := range servers {
+		filter.Servers = append(filter.Servers, server.Name)
+	}
+
+	if v := c.Query("since"); v != "" {
+		if filter.Since, err = parseTimeOrAge(v); err != nil {
+			return filter, apierror.BadRequest("invalid since: " + err.Error())
+		}
+	}
+	if v := c.Query("until"); v != "" {
+		if filter.Until, err = parseTimeOrAge(v); err != nil {
+			return filter, apierror.BadRequest("invalid until: " + err.Error())
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 0 {
+			return filter, apierror.BadRequest("invalid limit")
+		}
+	}
+	return filter, nil
+}
+
+// sendHistory answers with the events matching filter that the principal
+// may see. Keys limited to container labels are checked against the labels
+// recorded with each event, so removed containers stay covered.
+func (h *Handler) sendHistory(c *fiber.Ctx, filter database.ContainerEventFilter) error {
+	events, err := h.db.ListContainerEvents(filter)
+	if err != nil {
+		logger.Error(err, "Failed to list container history")
+		return apierror.Send(c, err)
+	}
+
+	principal := middleware.CurrentPrincipal(c)
+	if principal == nil || !auth.RestrictsContainers(principal) {
+		return c.JSON(events)
+	}
+
+	allowed := []database.ContainerEvent{}
+	for _, event := range events {
+		if auth.AllowsContainer(principal, event.Attributes) {
+			allowed = append(allowed, event)
+		}
+	}
+	return c.JSON(allowed)
+}
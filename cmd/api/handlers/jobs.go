@@ -0,0 +1,321 @@
+package handlers
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/Zeptile/docktrine/cmd/api/middleware"
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/auth"
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/gofiber/fiber/v2"
+)
+
+// jobLogPollInterval is how often a followed job log is checked for new
+// lines.
+const jobLogPollInterval = 500 * time.Millisecond
+
+// enqueueJob queues action as a background job and answers 202 Accepted
+// with the job.
+func (h *Handler) enqueueJob(c *fiber.Ctx, action, server, target string, params map[string]string) error {
+	// Fail unknown servers and bad selectors now rather than in the job.
+	if _, err := h.docker.ResolveServers(server); err != nil {
+		return apierror.Send(c, err)
+	}
+
+	principal := middleware.CurrentPrincipal(c)
+	job := &database.Job{
+		Action:        action,
+		Server:        server,
+		Target:        target,
+		Params:        params,
+		RequesterType: principal.Type,
+		RequesterID:   principal.ID,
+		RequesterName: principal.Name,
+	}
+	if err := h.queueJob(job, fmt.Sprintf("queued by %s", principal)); err != nil {
+		return apierror.Send(c, err)
+	}
+	return sendJobAccepted(c, fmt.Sprintf("%s on %s queued as job %d", action, target, job.ID), job)
+}
+
+// queueJob stores job, starts its log with queuedBy and wakes the runner.
+func (h *Handler) queueJob(job *database.Job, queuedBy string) error {
+	if err := h.db.CreateJob(job); err != nil {
+		logger.Error(err, "Failed to queue job")
+		return err
+	}
+	if err := h.db.AppendJobLog(job.ID, queuedBy); err != nil {
+		logger.Error(err, fmt.Sprintf("Failed to write the log of job %d", job.ID))
+	}
+	h.Jobs.Notify()
+
+	logger.Info(fmt.Sprintf("Job %d queued: %s on %s", job.ID, job.Action, job.Target))
+	return nil
+}
+
+// sendJobAccepted answers 202 Accepted with the queued job.
+func sendJobAccepted(c *fiber.Ctx, message string, job *database.Job) error {
+	c.Location(fmt.Sprintf("/v1/jobs/%d", job.ID))
+	return c.Status(fiber.StatusAccepted).JSON(JobAcceptedResponse{
+		Message: message,
+		Job:     job,
+	})
+}
+
+// ListJobs godoc
+// @Summary List jobs
+// @Description Get background jobs, newest first. Admins see every job, everyone else the jobs they queued.
+// @Tags jobs
+// @Accept json
+// @Produce json
+// @Param status query string false "Only jobs with this status (queued, running, succeeded, failed or canceled)"
+// @Param limit query int false "Maximum number of jobs" default(100)
+// @Success 200 {array} database.Job
+// @Failure 400 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /jobs [get]
+func (h *Handler) ListJobs(c *fiber.Ctx) error {
+	limit, err := strconv.Atoi(c.Query("limit", "100"))
+	if err != nil || limit < 1 {
+		return apierror.Send(c, apierror.BadRequest("invalid limit"))
+	}
+
+	filter := database.JobFilter{Status: c.Query("status", ""), Limit: limit}
+	if principal := middleware.CurrentPrincipal(c); !principal.IsAdmin {
+		filter.RequesterType = principal.Type
+		filter.RequesterID = principal.ID
+	}
+
+	jobs, err := h.db.ListJobs(filter)
+	if err != nil {
+		logger.Error(err, "Failed to list jobs")
+		return apierror.Send(c, err)
+	}
+	return c.JSON(jobs)
+}
+
+// GetJob godoc
+// @Summary Get a job
+// @Description Get a background job by ID
+// @Tags jobs
+// @Accept json
+// @Produce json
+// @Param id path int true "Job ID"
+// @Success 200 {object} database.Job
+// @Failure 400 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /jobs/{id} [get]
+func (h *Handler) GetJob(c *fiber.Ctx) error {
+	job, err := h.lookupJob(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+	return c.JSON(job)
+}
+
+// GetJobLogs godoc
+// @Summary Get a job's log
+// @Description Get the log lines of a background job. With follow, the response is a stream of newline-delimited JSON log lines that ends when the job has finished.
+// @Tags jobs
+// @Accept json
+// @Produce json
+// @Produce application/x-ndjson
+// @Param id path int true "Job ID"
+// @Param after query int false "Only lines with an ID above this one"
+// @Param follow query boolean false "Stream new lines until the job finishes" default(false)
+// @Success 200 {array} database.JobLog
+// @Failure 400 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /jobs/{id}/logs [get]
+func (h *Handler) GetJobLogs(c *fiber.Ctx) error {
+	job, err := h.lookupJob(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	after, err := strconv.ParseInt(c.Query("after", "0"), 10, 64)
+	if err != nil {
+		return apierror.Send(c, apierror.BadRequest("invalid after"))
+	}
+
+	if c.Query("follow") != "true" {
+		logs, err := h.db.JobLogs(job.ID, after)
+		if err != nil {
+			logger.Error(err, "Failed to get job logs")
+			return apierror.Send(c, err)
+		}
+		return c.JSON(logs)
+	}
+
+	c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		for {
+			// Read the status before the lines, the last line is written
+			// before the job is marked finished.
+			current, err := h.db.GetJob(job.ID)
+			if err != nil || current == nil {
+				logger.Error(err, fmt.Sprintf("Failed to follow job %d", job.ID))
+				return
+			}
+
+			logs, err := h.db.JobLogs(job.ID, after)
+			if err != nil {
+				logger.Error(err, fmt.Sprintf("Failed to follow job %d", job.ID))
+				return
+			}
+			for _, line := range logs {
+				data, _ := json.Marshal(line)
+				w.Write(data)
+				w.WriteByte('\n')
+				after = line.ID
+			}
+			if err := w.Flush(); err != nil {
+				// The client went away.
+				return
+			}
+
+			if current.Finished() {
+				return
+			}
+			time.Sleep(jobLogPollInterval)
+		}
+	})
+	return nil
+}
+
+// CancelJob godoc
+// @Summary Cancel a job
+// @Description Cancel a queued or running background job. Only the principal that queued the job and admins may cancel it.
+// @Tags jobs
+// @Accept json
+// @Produce json
+// @Param id path int true "Job ID"
+// @Success 200 {object} MessageResponse
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 409 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /jobs/{id}/cancel [post]
+func (h *Handler) CancelJob(c *fiber.Ctx) error {
+	job, err := h.lookupJob(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	canceled, err := h.Jobs.Cancel(job.ID)
+	if err != nil {
+		logger.Error(err, "Failed to cancel job")
+		return apierror.Send(c, err)
+	}
+	if !canceled {
+		return apierror.Send(c, apierror.Conflict(fmt.Sprintf("job %d is not queued or running", job.ID)))
+	}
+
+	principal := middleware.CurrentPrincipal(c)
+	logger.Info(fmt.Sprintf("Job %d canceled by %s", job.ID, principal))
+	return c.JSON(MessageResponse{Message: fmt.Sprintf("job %d canceled", job.ID)})
+}
+
+// RetryJob godoc
+// @Summary Retry a job
+// @Description Queue a failed or canceled background job again. Only the principal that queued the job and admins may retry it, and they need the scopes the job's action needs. A job on a protected server or container is not queued; a pending approval to run its operation is created instead.
+// @Tags jobs
+// @Accept json
+// @Produce json
+// @Param id path int true "Job ID"
+// @Success 202 {object} JobAcceptedResponse
+// @Success 202 {object} middleware.ApprovalRequiredResponse
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 409 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /jobs/{id}/retry [post]
+func (h *Handler) RetryJob(c *fiber.Ctx) error {
+	job, err := h.lookupJob(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	principal := middleware.CurrentPrincipal(c)
+	if err := h.authorizeAction(principal, job.Action, job.Server, job.Target, job.Params); err != nil {
+		return apierror.Send(c, err)
+	}
+	if job.Status != database.JobFailed && job.Status != database.JobCanceled {
+		return apierror.Send(c, apierror.Conflict(fmt.Sprintf("job %d has not failed or been canceled", job.ID)))
+	}
+
+	// A retry runs the operation again, so it is held for approval just
+	// like the request that queued the job would be now.
+	reason, err := middleware.ProtectionReason(h.db, h.docker, job.Action, job.Server, job.Target)
+	if err != nil {
+		apiErr := apierror.From(err)
+		apiErr.Message = fmt.Sprintf("cannot check whether %s is protected: %v", job.Target, err)
+		return apierror.Send(c, apiErr)
+	}
+	if reason != "" {
+		params := map[string]string{"retry_of_job": strconv.FormatInt(job.ID, 10)}
+		for k, v := range job.Params {
+			params[k] = v
+		}
+		return middleware.HoldForApproval(c, h.db, &database.Approval{
+			Action:    job.Action,
+			Server:    job.Server,
+			Target:    job.Target,
+			Params:    params,
+			Reason:    reason,
+			ExpiresAt: time.Now().Add(h.ApprovalTTL),
+		})
+	}
+
+	queued, err := h.db.RetryJob(job.ID)
+	if err != nil {
+		logger.Error(err, "Failed to retry job")
+		return apierror.Send(c, err)
+	}
+	if !queued {
+		return apierror.Send(c, apierror.Conflict(fmt.Sprintf("job %d has not failed or been canceled", job.ID)))
+	}
+	if err := h.db.AppendJobLog(job.ID, fmt.Sprintf("retry queued by %s", principal)); err != nil {
+		logger.Error(err, fmt.Sprintf("Failed to write the log of job %d", job.ID))
+	}
+	h.Jobs.Notify()
+
+	job, err = h.db.GetJob(job.ID)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	logger.Info(fmt.Sprintf("Job %d retried by %s", job.ID, principal))
+	return sendJobAccepted(c, fmt.Sprintf("job %d queued again", job.ID), job)
+}
+
+// lookupJob finds the job in the :id parameter. Jobs queued by someone else
+// are not found unless the principal is an admin.
+func (h *Handler) lookupJob(c *fiber.Ctx) (*database.Job, error) {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return nil, apierror.BadRequest("invalid job id")
+	}
+
+	job, err := h.db.GetJob(id)
+	if err != nil {
+		logger.Error(err, "Failed to get job")
+		return nil, err
+	}
+	if job == nil || !ownsJob(middleware.CurrentPrincipal(c), job) {
+		return nil, apierror.NotFound("job not found")
+	}
+	return job, nil
+}
+
+func ownsJob(principal *auth.Principal, job *database.Job) bool {
+	return principal.IsAdmin || (principal.Type == job.RequesterType && principal.ID == job.RequesterID)
+}
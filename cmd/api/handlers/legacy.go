@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/docker"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/docker/docker/api/types"
+	"github.com/gofiber/fiber/v2"
+)
+
+// The unversioned routes predate /v1 and answer with the shapes they had
+// then, which existing integrations parse: containers with Docker's own
+// state and port fields, and servers with Go field names. They are not in
+// the Swagger docs.
+
+// legacyServer is a server as the unversioned routes return and accept it.
+type legacyServer struct {
+	ID          int64
+	Name        string
+	Host        string
+	Description string
+	IsDefault   bool
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func newLegacyServer(s database.Server) legacyServer {
+	return legacyServer{
+		ID:          s.ID,
+		Name:        s.Name,
+		Host:        s.Host,
+		Description: s.Description,
+		IsDefault:   s.IsDefault,
+		CreatedAt:   s.CreatedAt,
+		UpdatedAt:   s.UpdatedAt,
+	}
+}
+
+// legacyContainer is a container as the unversioned routes return it; the
+// list also carries its ports and labels.
+func legacyContainer(container docker.Container, listed bool) fiber.Map {
+	state := container.State
+	legacy := fiber.Map{
+		"id":    container.ID,
+		"name":  "/" + container.Name,
+		"image": container.Image,
+		"state": types.ContainerState{
+			Status:     state.Status,
+			Running:    state.Running,
+			Paused:     state.Paused,
+			Restarting: state.Restarting,
+			OOMKilled:  state.OOMKilled,
+			Dead:       state.Dead,
+			Pid:        state.Pid,
+			ExitCode:   state.ExitCode,
+			Error:      state.Error,
+			StartedAt:  state.StartedAt.Format(time.RFC3339Nano),
+			FinishedAt: state.FinishedAt.Format(time.RFC3339Nano),
+		},
+		"created": container.Created.Format(time.RFC3339Nano),
+		"status":  container.Status,
+	}
+	if listed {
+		ports := make([]types.Port, len(container.Ports))
+		for i, p := range container.Ports {
+			ports[i] = types.Port{IP: p.IP, PrivatePort: uint16(p.PrivatePort), PublicPort: uint16(p.PublicPort), Type: p.Type}
+		}
+		legacy["ports"] = ports
+		legacy["labels"] = container.Labels
+	}
+	return legacy
+}
+
+// LegacyListContainers serves GET /containers.
+func (h *Handler) LegacyListContainers(c *fiber.Ctx) error {
+	containers, err := h.listContainers(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	legacy := make([]fiber.Map, len(containers))
+	for i, container := range containers {
+		legacy[i] = legacyContainer(container, true)
+	}
+	return c.JSON(legacy)
+}
+
+// LegacyGetContainer serves GET /containers/:id.
+func (h *Handler) LegacyGetContainer(c *fiber.Ctx) error {
+	containerID := c.Params("id")
+	serverName := c.Query("server", "")
+	if containerID == "" {
+		return apierror.Send(c, apierror.BadRequest("container ID is required"))
+	}
+
+	found, err := h.getContainer(containerID, serverName)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+	if docker.IsSelector(serverName) {
+		legacy := make([]fiber.Map, len(found))
+		for i, container := range found {
+			legacy[i] = legacyContainer(container, false)
+		}
+		return c.JSON(legacy)
+	}
+	return c.JSON(legacyContainer(found[0], false))
+}
+
+// LegacyListServers serves GET /servers.
+func (h *Handler) LegacyListServers(c *fiber.Ctx) error {
+	servers, err := h.listServers(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	legacy := make([]legacyServer, len(servers))
+	for i, server := range servers {
+		legacy[i] = newLegacyServer(server)
+	}
+	return c.JSON(legacy)
+}
+
+// LegacyGetServer serves GET /servers/:name.
+func (h *Handler) LegacyGetServer(c *fiber.Ctx) error {
+	name := c.Params("name")
+	server, err := h.db.GetServerByName(name)
+	if err != nil {
+		logger.Error(err, "Failed to get server")
+		return apierror.Send(c, err)
+	}
+	if server == nil {
+		return apierror.Send(c, apierror.NotFound("server not found"))
+	}
+	return c.JSON(newLegacyServer(*server))
+}
+
+// LegacyCreateServer serves POST /servers, which takes the server with Go
+// field names, e.g. IsDefault.
+func (h *Handler) LegacyCreateServer(c *fiber.Ctx) error {
+	var req legacyServer
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Send(c, apierror.BadRequest("invalid request body"))
+	}
+
+	server := database.Server{
+		Name:        req.Name,
+		Host:        req.Host,
+		Description: req.Description,
+		IsDefault:   req.IsDefault,
+	}
+	if err := h.createServer(&server); err != nil {
+		return apierror.Send(c, err)
+	}
+
+	return c.Status(201).JSON(newLegacyServer(server))
+}
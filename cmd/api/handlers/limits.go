@@ -0,0 +1,21 @@
+package handlers
+
+import (
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetRateLimits godoc
+// @Summary Rate limit counters
+// @Description Get the configured rate limits per route class, how many requests each allowed and rejected, and the mutating operations running on each server
+// @Tags limits
+// @Produce json
+// @Success 200 {object} middleware.RateLimitStats
+// @Failure 403 {object} apierror.Response
+// @Router /limits [get]
+func (h *Handler) GetRateLimits(c *fiber.Ctx) error {
+	if h.RateLimits == nil {
+		return apierror.Send(c, apierror.NotFound("rate limiting is not configured"))
+	}
+	return c.JSON(h.RateLimits.Stats())
+}
@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/Zeptile/docktrine/internal/oidc"
+	"github.com/gofiber/fiber/v2"
+)
+
+// oidcStateTTL bounds how long a browser login may take between the
+// redirect to the provider and the callback.
+const oidcStateTTL = 10 * time.Minute
+
+type DeviceTokenRequest struct {
+	DeviceCode string `json:"device_code"`
+}
+
+// pendingLogins holds the PKCE verifier of each browser login in flight,
+// keyed by its state parameter.
+type pendingLogins struct {
+	mu     sync.Mutex
+	logins map[string]pendingLogin
+}
+
+type pendingLogin struct {
+	verifier  string
+	expiresAt time.Time
+}
+
+func (p *pendingLogins) add(state, verifier string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.logins == nil {
+		p.logins = make(map[string]pendingLogin)
+	}
+	now := time.Now()
+	for s, login := range p.logins {
+		if now.After(login.expiresAt) {
+			delete(p.logins, s)
+		}
+	}
+	p.logins[state] = pendingLogin{verifier: verifier, expiresAt: now.Add(oidcStateTTL)}
+}
+
+// take returns and forgets the verifier for state, so each state can be
+// used once.
+func (p *pendingLogins) take(state string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	login, ok := p.logins[state]
+	delete(p.logins, state)
+	if !ok || time.Now().After(login.expiresAt) {
+		return "", false
+	}
+	return login.verifier, true
+}
+
+// OIDCLogin godoc
+// @Summary Start single sign-on
+// @Description Redirect the browser to the OIDC provider to log in
+// @Tags auth
+// @Success 302
+// @Failure 404 {object} apierror.Response
+// @Router /auth/oidc/login [get]
+func (h *Handler) OIDCLogin(c *fiber.Ctx) error {
+	if h.OIDC == nil {
+		return apierror.Send(c, apierror.NotFound("single sign-on is not configured"))
+	}
+
+	state := oidc.RandomString()
+	verifier := oidc.RandomString()
+	h.oidcLogins.add(state, verifier)
+
+	return c.Redirect(h.OIDC.AuthCodeURL(state, verifier))
+}
+
+// OIDCCallback godoc
+// @Summary Finish single sign-on
+// @Description Exchange the authorization code returned by the OIDC provider for a session token
+// @Tags auth
+// @Produce json
+// @Param code query string true "Authorization code"
+// @Param state query string true "State from /auth/oidc/login"
+// @Success 200 {object} LoginResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 401 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Router /auth/oidc/callback [get]
+func (h *Handler) OIDCCallback(c *fiber.Ctx) error {
+	if h.OIDC == nil {
+		return apierror.Send(c, apierror.NotFound("single sign-on is not configured"))
+	}
+
+	if errCode := c.Query("error"); errCode != "" {
+		return apierror.Send(c, apierror.Unauthorized(fmt.Sprintf("login failed: %s %s", errCode, c.Query("error_description"))))
+	}
+
+	verifier, ok := h.oidcLogins.take(c.Query("state"))
+	if !ok {
+		return apierror.Send(c, apierror.BadRequest("unknown or expired login state"))
+	}
+
+	tokens, err := h.OIDC.Exchange(c.Context(), c.Query("code"), verifier)
+	if err != nil {
+		logger.Error(err, "Failed to exchange OIDC authorization code")
+		return apierror.Send(c, apierror.Unauthorized(err.Error()))
+	}
+
+	return h.ssoLogin(c, tokens.IDToken)
+}
+
+// OIDCDeviceAuthorize godoc
+// @Summary Start a device login
+// @Description Start an OIDC device authorization, used by "docktrine login --sso"
+// @Tags auth
+// @Produce json
+// @Success 200 {object} oidc.DeviceAuthorization
+// @Failure 404 {object} apierror.Response
+// @Failure 502 {object} apierror.Response
+// @Router /auth/oidc/device [post]
+func (h *Handler) OIDCDeviceAuthorize(c *fiber.Ctx) error {
+	if h.OIDC == nil {
+		return apierror.Send(c, apierror.NotFound("single sign-on is not configured"))
+	}
+
+	device, err := h.OIDC.AuthorizeDevice(c.Context())
+	if err != nil {
+		logger.Error(err, "Failed to start OIDC device authorization")
+		return apierror.Send(c, apierror.New(fiber.StatusBadGateway, apierror.CodeIdentityProvider, err.Error()))
+	}
+
+	return c.JSON(device)
+}
+
+// OIDCDeviceToken godoc
+// @Summary Finish a device login
+// @Description Poll a device authorization. Returns 400 with error code "authorization_pending" or "slow_down" until the user has logged in
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body DeviceTokenRequest true "Device code"
+// @Success 200 {object} LoginResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 401 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Router /auth/oidc/device/token [post]
+func (h *Handler) OIDCDeviceToken(c *fiber.Ctx) error {
+	if h.OIDC == nil {
+		return apierror.Send(c, apierror.NotFound("single sign-on is not configured"))
+	}
+
+	var req DeviceTokenRequest
+	if err := c.BodyParser(&req); err != nil || req.DeviceCode == "" {
+		return apierror.Send(c, apierror.BadRequest("device_code is required"))
+	}
+
+	tokens, err := h.OIDC.PollDevice(c.Context(), req.DeviceCode)
+	if errors.Is(err, oidc.ErrAuthorizationPending) {
+		return apierror.Send(c, apierror.New(fiber.StatusBadRequest, apierror.CodeAuthorizationPending, err.Error()))
+	}
+	if errors.Is(err, oidc.ErrSlowDown) {
+		return apierror.Send(c, apierror.New(fiber.StatusBadRequest, apierror.CodeSlowDown, err.Error()))
+	}
+	if err != nil {
+		return apierror.Send(c, apierror.Unauthorized(err.Error()))
+	}
+
+	return h.ssoLogin(c, tokens.IDToken)
+}
+
+// ssoLogin validates an ID token, maps the user's groups to a role and
+// issues a Docktrine session.
+func (h *Handler) ssoLogin(c *fiber.Ctx, idToken string) error {
+	claims, err := h.OIDC.VerifyIDToken(idToken)
+	if err != nil {
+		logger.Error(err, "Rejected OIDC ID token")
+		return apierror.Send(c, apierror.Unauthorized("invalid ID token"))
+	}
+
+	role := h.OIDC.Config().RoleForGroups(claims.Groups)
+	if role == "" {
+		logger.Warn(fmt.Sprintf("SSO login denied for %s: no group maps to a role", claims.Username()))
+		return apierror.Send(c, apierror.Forbidden("none of your groups grant access to Docktrine"))
+	}
+
+	user, err := h.db.UpsertSSOUser(claims.Subject, claims.Username(), role)
+	if err != nil {
+		logger.Error(err, "Failed to record SSO user")
+		return apierror.Send(c, apierror.Conflict(err.Error()))
+	}
+
+	session, err := h.db.CreateSession(user, h.SessionTTL)
+	if err != nil {
+		logger.Error(err, "Failed to create session")
+		return apierror.Send(c, err)
+	}
+
+	logger.Info(fmt.Sprintf("User logged in via SSO: %s (%s)", user.Username, role))
+	return c.JSON(LoginResponse{
+		Token:     session.Token,
+		ExpiresAt: session.ExpiresAt,
+		User:      user,
+	})
+}
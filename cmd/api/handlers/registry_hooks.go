@@ -0,0 +1,476 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zeptile/docktrine/cmd/api/middleware"
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/auth"
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/Zeptile/docktrine/internal/registry"
+	"github.com/gofiber/fiber/v2"
+)
+
+type CreateRegistryHookRequest struct {
+	Name string `json:"name"`
+	// Repository is the watched image repository, e.g. myorg/api,
+	// ghcr.io/myorg/api or harbor.example.com/library/api.
+	Repository string `json:"repository"`
+	// Tag is the watched tag, or * for any tag. Defaults to latest.
+	Tag string `json:"tag"`
+	// Server is the server name or selector (group:<name>,
+	// label:<key>=<value>) the containers run on; the default server if
+	// empty.
+	Server string `json:"server"`
+	// Containers are the names or IDs of the containers recreated on every
+	// push.
+	Containers []string `json:"containers"`
+}
+
+// UpdateRegistryHookRequest changes the fields that are set and leaves the
+// others as they are.
+type UpdateRegistryHookRequest struct {
+	Name       *string  `json:"name"`
+	Repository *string  `json:"repository"`
+	Tag        *string  `json:"tag"`
+	Server     *string  `json:"server"`
+	Containers []string `json:"containers"`
+}
+
+// RegistryPushResponse is returned with 202 Accepted when a push triggered a
+// registry hook.
+type RegistryPushResponse struct {
+	Message string          `json:"message"`
+	Jobs    []*database.Job `json:"jobs"`
+	// Approvals hold the recreates of protected containers, and of
+	// containers on protected servers, until someone approves them.
+	Approvals []*database.Approval `json:"approvals"`
+}
+
+// ListRegistryHooks godoc
+// @Summary List registry hooks
+// @Description Get every registry hook. Tokens are never returned.
+// @Tags registry-hooks
+// @Accept json
+// @Produce json
+// @Success 200 {array} database.RegistryHook
+// @Failure 403 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /registry-hooks [get]
+func (h *Handler) ListRegistryHooks(c *fiber.Ctx) error {
+	hooks, err := h.db.ListRegistryHooks()
+	if err != nil {
+		logger.Error(err, "Failed to list registry hooks")
+		return apierror.Send(c, err)
+	}
+	return c.JSON(hooks)
+}
+
+// CreateRegistryHook godoc
+// @Summary Create a registry hook
+// @Description Create a receiver for a container registry's push webhook at /hooks/registry/<token>. When the watched repository and tag are pushed, the image is pulled and the hook's containers are recreated from it. Docker Hub, GitHub package, Harbor and generic {"repository", "tag", "digest"} payloads are understood. The token is only returned in this response.
+// @Tags registry-hooks
+// @Accept json
+// @Produce json
+// @Param hook body CreateRegistryHookRequest true "Registry hook"
+// @Success 201 {object} database.RegistryHook
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /registry-hooks [post]
+func (h *Handler) CreateRegistryHook(c *fiber.Ctx) error {
+	var req CreateRegistryHookRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Send(c, apierror.BadRequest("invalid request body"))
+	}
+
+	if req.Tag == "" {
+		req.Tag = "latest"
+	}
+	hook := &database.RegistryHook{
+		Name:       req.Name,
+		Repository: req.Repository,
+		Tag:        req.Tag,
+		Server:     req.Server,
+		Containers: req.Containers,
+	}
+	if err := h.validateRegistryHook(hook); err != nil {
+		return apierror.Send(c, err)
+	}
+	if err := h.db.CreateRegistryHook(hook); err != nil {
+		logger.Error(err, "Failed to create registry hook")
+		return apierror.Send(c, err)
+	}
+
+	logger.Info(fmt.Sprintf("Registry hook created: %d (%s)", hook.ID, hook.Name))
+	return c.Status(201).JSON(hook)
+}
+
+// GetRegistryHook godoc
+// @Summary Get a registry hook
+// @Description Get a registry hook. Its token is never returned.
+// @Tags registry-hooks
+// @Accept json
+// @Produce json
+// @Param id path int true "Registry hook ID"
+// @Success 200 {object} database.RegistryHook
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /registry-hooks/{id} [get]
+func (h *Handler) GetRegistryHook(c *fiber.Ctx) error {
+	hook, err := h.lookupRegistryHook(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+	return c.JSON(hook)
+}
+
+// UpdateRegistryHook godoc
+// @Summary Update a registry hook
+// @Description Change a registry hook's name, repository, tag, server or containers. Only the fields that are set change; its token stays the same.
+// @Tags registry-hooks
+// @Accept json
+// @Produce json
+// @Param id path int true "Registry hook ID"
+// @Param hook body UpdateRegistryHookRequest true "Fields to change"
+// @Success 200 {object} database.RegistryHook
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /registry-hooks/{id} [patch]
+func (h *Handler) UpdateRegistryHook(c *fiber.Ctx) error {
+	hook, err := h.lookupRegistryHook(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	var req UpdateRegistryHookRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Send(c, apierror.BadRequest("invalid request body"))
+	}
+	if req.Name != nil {
+		hook.Name = *req.Name
+	}
+	if req.Repository != nil {
+		hook.Repository = *req.Repository
+	}
+	if req.Tag != nil {
+		hook.Tag = *req.Tag
+	}
+	if req.Server != nil {
+		hook.Server = *req.Server
+	}
+	if req.Containers != nil {
+		hook.Containers = req.Containers
+	}
+	if err := h.validateRegistryHook(hook); err != nil {
+		return apierror.Send(c, err)
+	}
+
+	if err := h.db.UpdateRegistryHook(hook); err != nil {
+		logger.Error(err, "Failed to update registry hook")
+		return apierror.Send(c, err)
+	}
+
+	logger.Info(fmt.Sprintf("Registry hook updated: %d (%s)", hook.ID, hook.Name))
+	return c.JSON(hook)
+}
+
+// DeleteRegistryHook godoc
+// @Summary Delete a registry hook
+// @Description Delete a registry hook. Its URL stops working immediately.
+// @Tags registry-hooks
+// @Accept json
+// @Produce json
+// @Param id path int true "Registry hook ID"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /registry-hooks/{id} [delete]
+func (h *Handler) DeleteRegistryHook(c *fiber.Ctx) error {
+	hook, err := h.lookupRegistryHook(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	if err := h.db.DeleteRegistryHook(hook.ID); err != nil {
+		logger.Error(err, "Failed to delete registry hook")
+		return apierror.Send(c, err)
+	}
+
+	logger.Info(fmt.Sprintf("Registry hook deleted: %d (%s)", hook.ID, hook.Name))
+	return c.JSON(MessageResponse{Message: "registry hook deleted successfully"})
+}
+
+// RotateRegistryHookToken godoc
+// @Summary Rotate a registry hook's token
+// @Description Give a registry hook a new token, and so a new URL. The old URL stops working immediately and the new token is only returned in this response.
+// @Tags registry-hooks
+// @Accept json
+// @Produce json
+// @Param id path int true "Registry hook ID"
+// @Success 200 {object} database.RegistryHook
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /registry-hooks/{id}/rotate [post]
+func (h *Handler) RotateRegistryHookToken(c *fiber.Ctx) error {
+	hook, err := h.lookupRegistryHook(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	hook.Token, err = h.db.RotateRegistryHookToken(hook.ID)
+	if err != nil {
+		logger.Error(err, "Failed to rotate registry hook token")
+		return apierror.Send(c, err)
+	}
+
+	logger.Info(fmt.Sprintf("Registry hook token rotated: %d (%s)", hook.ID, hook.Name))
+	return c.JSON(hook)
+}
+
+// DisableRegistryHook godoc
+// @Summary Disable a registry hook
+// @Description Refuse the pushes sent to a registry hook without deleting it
+// @Tags registry-hooks
+// @Accept json
+// @Produce json
+// @Param id path int true "Registry hook ID"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /registry-hooks/{id}/disable [post]
+func (h *Handler) DisableRegistryHook(c *fiber.Ctx) error {
+	return h.setRegistryHookEnabled(c, false)
+}
+
+// EnableRegistryHook godoc
+// @Summary Enable a registry hook
+// @Description Resume acting on the pushes sent to a disabled registry hook
+// @Tags registry-hooks
+// @Accept json
+// @Produce json
+// @Param id path int true "Registry hook ID"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /registry-hooks/{id}/enable [post]
+func (h *Handler) EnableRegistryHook(c *fiber.Ctx) error {
+	return h.setRegistryHookEnabled(c, true)
+}
+
+func (h *Handler) setRegistryHookEnabled(c *fiber.Ctx, enabled bool) error {
+	hook, err := h.lookupRegistryHook(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	if err := h.db.SetRegistryHookEnabled(hook.ID, enabled); err != nil {
+		logger.Error(err, "Failed to update registry hook")
+		return apierror.Send(c, err)
+	}
+
+	if !enabled {
+		logger.Info(fmt.Sprintf("Registry hook disabled: %d (%s)", hook.ID, hook.Name))
+		return c.JSON(MessageResponse{Message: "registry hook disabled successfully"})
+	}
+	logger.Info(fmt.Sprintf("Registry hook enabled: %d (%s)", hook.ID, hook.Name))
+	return c.JSON(MessageResponse{Message: "registry hook enabled successfully"})
+}
+
+// ReceiveRegistryPush godoc
+// @Summary Receive a registry push
+// @Description Endpoint for a container registry's push webhook; the token in the path authenticates it. A push of the hook's repository and tag queues a containers.recreate job per container, which pulls the image and recreates the container from it if it changed. Protected containers, and containers on protected servers, get a pending approval instead of a job. Other pushes and events are acknowledged and ignored.
+// @Tags registry-hooks
+// @Accept json
+// @Produce json
+// @Param token path string true "Registry hook token"
+// @Param payload body object true "Docker Hub, GitHub package, Harbor or generic {\"repository\", \"tag\", \"digest\"} push event"
+// @Success 200 {object} MessageResponse
+// @Success 202 {object} RegistryPushResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /hooks/registry/{token} [post]
+func (h *Handler) ReceiveRegistryPush(c *fiber.Ctx) error {
+	hook, err := h.db.GetRegistryHookByToken(c.Params("token"))
+	if err != nil {
+		logger.Error(err, "Failed to get registry hook")
+		return apierror.Send(c, err)
+	}
+	if hook == nil {
+		return apierror.Send(c, apierror.NotFound("registry hook not found"))
+	}
+	principal := auth.FromRegistryHook(hook)
+	c.Locals(middleware.PrincipalLocal, principal)
+	if !hook.Enabled {
+		return apierror.Send(c, apierror.Forbidden(fmt.Sprintf("registry hook %s is disabled", hook.Name)))
+	}
+
+	pushes, err := registry.Parse(func(name string) string { return c.Get(name) }, c.Body())
+	if err != nil {
+		return apierror.Send(c, apierror.BadRequest(err.Error()))
+	}
+	var push *registry.Push
+	for i := range pushes {
+		if registry.Matches(hook.Repository, hook.Tag, pushes[i]) {
+			push = &pushes[i]
+			break
+		}
+	}
+	if push == nil {
+		logger.Debug(fmt.Sprintf("Registry hook %s ignored an event with %d pushes", hook.Name, len(pushes)))
+		return c.JSON(MessageResponse{Message: "no push of a watched image, ignored"})
+	}
+
+	if _, err := h.docker.ResolveServers(hook.Server); err != nil {
+		return apierror.Send(c, err)
+	}
+	params := map[string]string{"image": push.Image(), "digest": push.Digest}
+	if hook.Tag == registry.AnyTag {
+		// With any tag, every container pulls the tag it runs.
+		params["image"] = push.Repository
+	}
+	queuedBy := fmt.Sprintf("queued by %s for a push of %s", principal, push.Image())
+	if push.Pusher != "" {
+		queuedBy += " by " + push.Pusher
+	}
+
+	jobs := make([]*database.Job, 0, len(hook.Containers))
+	approvals := []*database.Approval{}
+	var recreating, held []string
+	for _, target := range hook.Containers {
+		// Protected containers are held for approval here, as the job
+		// runner does not check.
+		reason, err := middleware.ProtectionReason(h.db, h.docker, "containers.recreate", hook.Server, target)
+		if err != nil {
+			logger.Error(err, fmt.Sprintf("Registry hook %s: cannot check whether %s is protected, skipping it", hook.Name, target))
+			held = append(held, fmt.Sprintf("%s (cannot check whether it is protected)", target))
+			continue
+		}
+		if reason != "" {
+			approval := &database.Approval{
+				Action:        "containers.recreate",
+				Server:        hook.Server,
+				Target:        target,
+				Params:        params,
+				Reason:        reason,
+				RequesterType: principal.Type,
+				RequesterID:   principal.ID,
+				RequesterName: principal.Name,
+				ExpiresAt:     time.Now().Add(h.ApprovalTTL),
+			}
+			if err := h.db.CreateApproval(approval); err != nil {
+				logger.Error(err, "Failed to create approval")
+				return apierror.Send(c, err)
+			}
+			logger.Info(fmt.Sprintf("Approval %d required for containers.recreate on %s: %s", approval.ID, target, reason))
+			approvals = append(approvals, approval)
+			held = append(held, fmt.Sprintf("%s (approval %d: %s)", target, approval.ID, reason))
+			continue
+		}
+
+		job := &database.Job{
+			Action:        "containers.recreate",
+			Server:        hook.Server,
+			Target:        target,
+			Params:        params,
+			RequesterType: principal.Type,
+			RequesterID:   principal.ID,
+			RequesterName: principal.Name,
+		}
+		if err := h.db.CreateJob(job); err != nil {
+			logger.Error(err, "Failed to queue job")
+			return apierror.Send(c, err)
+		}
+		if err := h.db.AppendJobLog(job.ID, queuedBy); err != nil {
+			logger.Error(err, fmt.Sprintf("Failed to write the log of job %d", job.ID))
+		}
+		jobs = append(jobs, job)
+		recreating = append(recreating, target)
+	}
+	if len(jobs) > 0 {
+		h.Jobs.Notify()
+	}
+	if err := h.db.RecordRegistryHookTriggered(hook.ID, push.Digest); err != nil {
+		logger.Error(err, fmt.Sprintf("Failed to record the trigger of registry hook %s", hook.Name))
+	}
+
+	ids := make([]string, len(jobs))
+	for i, job := range jobs {
+		ids[i] = strconv.FormatInt(job.ID, 10)
+	}
+	logger.Info(fmt.Sprintf("Registry hook %s: push of %s queued jobs %s", hook.Name, push.Image(), strings.Join(ids, ", ")))
+
+	var outcome []string
+	if len(recreating) > 0 {
+		outcome = append(outcome, "recreating "+strings.Join(recreating, ", "))
+	}
+	if len(held) > 0 {
+		outcome = append(outcome, "not recreating "+strings.Join(held, ", "))
+	}
+	return c.Status(fiber.StatusAccepted).JSON(RegistryPushResponse{
+		Message:   fmt.Sprintf("push of %s: %s", push.Image(), strings.Join(outcome, "; ")),
+		Jobs:      jobs,
+		Approvals: approvals,
+	})
+}
+
+func (h *Handler) lookupRegistryHook(c *fiber.Ctx) (*database.RegistryHook, error) {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return nil, apierror.BadRequest("invalid registry hook id")
+	}
+
+	hook, err := h.db.GetRegistryHook(id)
+	if err != nil {
+		logger.Error(err, "Failed to get registry hook")
+		return nil, err
+	}
+	if hook == nil {
+		return nil, apierror.NotFound("registry hook not found")
+	}
+	return hook, nil
+}
+
+// validateRegistryHook checks the settings of a registry hook being created
+// or updated.
+func (h *Handler) validateRegistryHook(hook *database.RegistryHook) error {
+	if hook.Name == "" {
+		return apierror.BadRequest("name is required")
+	}
+	if _, err := registry.NormalizeRepository(hook.Repository); err != nil {
+		return apierror.BadRequest(err.Error())
+	}
+	if err := registry.ValidateTag(hook.Tag); err != nil {
+		return apierror.BadRequest(err.Error())
+	}
+	if len(hook.Containers) == 0 {
+		return apierror.BadRequest("at least one container is required")
+	}
+	for _, container := range hook.Containers {
+		if strings.TrimSpace(container) == "" {
+			return apierror.BadRequest("container names must not be empty")
+		}
+	}
+	// Fail unknown servers and bad selectors now rather than on a push.
+	_, err := h.docker.ResolveServers(hook.Server)
+	return err
+}
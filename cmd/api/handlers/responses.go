@@ -0,0 +1,22 @@
+package handlers
+
+import "github.com/Zeptile/docktrine/internal/database"
+
+// MessageResponse is returned by actions that have nothing else to report.
+type MessageResponse struct {
+	Message string `json:"message"`
+}
+
+// ActionResponse reports a container action. Results lists the outcome per
+// server when the action was addressed to a server selector.
+type ActionResponse struct {
+	Message string         `json:"message"`
+	Results []ServerResult `json:"results,omitempty"`
+}
+
+// JobAcceptedResponse is returned with 202 Accepted when an operation was
+// queued as a background job.
+type JobAcceptedResponse struct {
+	Message string        `json:"message"`
+	Job     *database.Job `json:"job"`
+}
@@ -1,7 +1,13 @@
 package handlers
 
 import (
+	"fmt"
+
+	"github.com/Zeptile/docktrine/cmd/api/middleware"
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/auth"
 	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/docker"
 	"github.com/Zeptile/docktrine/internal/logger"
 	"github.com/gofiber/fiber/v2"
 )
@@ -12,16 +18,50 @@ import (
 // @Tags servers
 // @Accept json
 // @Produce json
+// @Param source query string false "Only servers from this source (config, api or docker-context)"
+// @Param selector query string false "Only servers matching this selector (group:<name>, label:<key>=<value>)"
 // @Success 200 {array} database.Server
-// @Failure 500 {object} interface{}
+// @Failure 400 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
 // @Router /servers [get]
 func (h *Handler) ListServers(c *fiber.Ctx) error {
+	servers, err := h.listServers(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+	return c.JSON(servers)
+}
+
+// listServers returns the servers the principal may access, filtered by
+// the source and selector queries.
+func (h *Handler) listServers(c *fiber.Ctx) ([]database.Server, error) {
+	source := c.Query("source", "")
+	selector, err := docker.ParseSelector(c.Query("selector", "*"))
+	if err != nil {
+		return nil, apierror.BadRequest(err.Error())
+	}
+
 	servers, err := h.db.GetServers()
 	if err != nil {
 		logger.Error(err, "Failed to list servers")
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return nil, err
 	}
-	return c.JSON(servers)
+
+	principal := middleware.CurrentPrincipal(c)
+	filtered := []database.Server{}
+	for _, s := range servers {
+		if principal != nil && !auth.AllowsServer(principal, s) {
+			continue
+		}
+		if source != "" && s.Source != source {
+			continue
+		}
+		if !selector.Matches(s) {
+			continue
+		}
+		filtered = append(filtered, s)
+	}
+	return filtered, nil
 }
 
 // GetServer godoc
@@ -32,18 +72,18 @@ func (h *Handler) ListServers(c *fiber.Ctx) error {
 // @Produce json
 // @Param name path string true "Server name"
 // @Success 200 {object} database.Server
-// @Failure 404 {object} interface{}
-// @Failure 500 {object} interface{}
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
 // @Router /servers/{name} [get]
 func (h *Handler) GetServer(c *fiber.Ctx) error {
 	name := c.Params("name")
 	server, err := h.db.GetServerByName(name)
 	if err != nil {
 		logger.Error(err, "Failed to get server")
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return apierror.Send(c, err)
 	}
 	if server == nil {
-		return c.Status(404).JSON(fiber.Map{"error": "server not found"})
+		return apierror.Send(c, apierror.NotFound("server not found"))
 	}
 	return c.JSON(server)
 }
@@ -56,35 +96,45 @@ func (h *Handler) GetServer(c *fiber.Ctx) error {
 // @Produce json
 // @Param server body database.Server true "Server configuration"
 // @Success 201 {object} database.Server
-// @Failure 400 {object} interface{}
-// @Failure 500 {object} interface{}
+// @Failure 400 {object} apierror.Response
+// @Failure 409 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
 // @Router /servers [post]
 func (h *Handler) CreateServer(c *fiber.Ctx) error {
 	var server database.Server
 	if err := c.BodyParser(&server); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "invalid request body"})
+		return apierror.Send(c, apierror.BadRequest("invalid request body"))
 	}
 
+	if err := h.createServer(&server); err != nil {
+		return apierror.Send(c, err)
+	}
+
+	return c.Status(201).JSON(server)
+}
+
+// createServer stores a server added through the API.
+func (h *Handler) createServer(server *database.Server) error {
 	if server.Name == "" || server.Host == "" {
-		return c.Status(400).JSON(fiber.Map{"error": "name and host are required"})
+		return apierror.BadRequest("name and host are required")
 	}
+	server.Source = database.ServerSourceAPI
 
 	// Check if server already exists
 	existing, err := h.db.GetServerByName(server.Name)
 	if err != nil {
 		logger.Error(err, "Failed to check server existence")
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return err
 	}
 	if existing != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "server with this name already exists"})
+		return apierror.Conflict("server with this name already exists")
 	}
 
-	if err := h.db.CreateServer(&server); err != nil {
+	if err := h.db.CreateServer(server); err != nil {
 		logger.Error(err, "Failed to create server")
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return err
 	}
-
-	return c.Status(201).JSON(server)
+	return nil
 }
 
 // DeleteServer godoc
@@ -94,26 +144,94 @@ func (h *Handler) CreateServer(c *fiber.Ctx) error {
 // @Accept json
 // @Produce json
 // @Param name path string true "Server name"
-// @Success 200 {object} interface{}
-// @Failure 404 {object} interface{}
-// @Failure 500 {object} interface{}
+// @Success 200 {object} MessageResponse
+// @Success 202 {object} middleware.ApprovalRequiredResponse
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
 // @Router /servers/{name} [delete]
 func (h *Handler) DeleteServer(c *fiber.Ctx) error {
 	name := c.Params("name")
-	
+
 	exists, err := h.db.GetServerByName(name)
 	if err != nil {
 		logger.Error(err, "Failed to check server existence")
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return apierror.Send(c, err)
 	}
 	if exists == nil {
-		return c.Status(404).JSON(fiber.Map{"error": "server not found"})
+		return apierror.Send(c, apierror.NotFound("server not found"))
 	}
 
 	if err := h.db.DeleteServer(name); err != nil {
 		logger.Error(err, "Failed to delete server")
-		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		return apierror.Send(c, err)
 	}
 
-	return c.JSON(fiber.Map{"message": "server deleted successfully"})
-} 
\ No newline at end of file
+	return c.JSON(MessageResponse{Message: "server deleted successfully"})
+}
+
+type ImportServersRequest struct {
+	// Servers to import, typically read from Docker contexts by the CLI.
+	Servers []docker.ServerConfig `json:"servers"`
+	// FromDockerContexts also imports the contexts of the Docker CLI config
+	// directory on the API host.
+	FromDockerContexts bool `json:"from_docker_contexts"`
+	// Update overwrites servers that already exist instead of skipping them.
+	Update bool `json:"update"`
+}
+
+// ImportServers godoc
+// @Summary Import servers
+// @Description Import servers from Docker CLI contexts, skipping or updating existing servers by name
+// @Tags servers
+// @Accept json
+// @Produce json
+// @Param request body ImportServersRequest true "Servers to import"
+// @Success 200 {object} docker.ImportResult
+// @Failure 400 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /servers/import [post]
+func (h *Handler) ImportServers(c *fiber.Ctx) error {
+	var req ImportServersRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Send(c, apierror.BadRequest("invalid request body"))
+	}
+
+	servers := req.Servers
+	var skipped []string
+	if req.FromDockerContexts {
+		configDir, err := docker.DefaultDockerConfigDir()
+		if err != nil {
+			logger.Error(err, "Failed to locate Docker config directory")
+			return apierror.Send(c, err)
+		}
+
+		contexts, contextSkipped, err := docker.LoadDockerContexts(configDir)
+		if err != nil {
+			logger.Error(err, "Failed to read Docker contexts")
+			return apierror.Send(c, err)
+		}
+		servers = append(servers, contexts...)
+		skipped = contextSkipped
+	}
+
+	if len(servers) == 0 && len(skipped) == 0 {
+		return apierror.Send(c, apierror.BadRequest("no servers to import"))
+	}
+
+	for _, s := range servers {
+		if s.Name == "" || s.Host == "" {
+			return apierror.Send(c, apierror.BadRequest("name and host are required"))
+		}
+	}
+
+	result, err := docker.ImportServers(h.db, servers, req.Update)
+	if err != nil {
+		logger.Error(err, "Failed to import servers")
+		return apierror.Send(c, err)
+	}
+	result.Skipped = append(result.Skipped, skipped...)
+
+	logger.Info(fmt.Sprintf("Imported servers: %d created, %d updated, %d skipped",
+		len(result.Created), len(result.Updated), len(result.Skipped)))
+	return c.JSON(result)
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/gofiber/fiber/v2"
+)
+
+// SetupToken is the one-time token that creates the first admin on a fresh
+// install. It is written to a file in the data directory rather than logged.
+type SetupToken struct {
+	mu        sync.Mutex
+	hash      [sha256.Size]byte
+	expiresAt time.Time
+	path      string
+	used      bool
+}
+
+func NewSetupToken(token string, ttl time.Duration, path string) *SetupToken {
+	return &SetupToken{
+		hash:      sha256.Sum256([]byte(token)),
+		expiresAt: time.Now().Add(ttl),
+		path:      path,
+	}
+}
+
+// redeem checks token and, if it matches, runs create. Only when create
+// succeeds is the token invalidated and its file removed, so a rejected
+// admin can be retried with the same token. Token errors are returned as
+// 401 Unauthorized, errors from create as they are.
+func (s *SetupToken) redeem(token string, create func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.used || time.Now().After(s.expiresAt) {
+		return apierror.Unauthorized("setup token has expired, restart the API to get a new one")
+	}
+
+	hash := sha256.Sum256([]byte(token))
+	if subtle.ConstantTimeCompare(hash[:], s.hash[:]) != 1 {
+		return apierror.Unauthorized("invalid setup token")
+	}
+
+	if err := create(); err != nil {
+		return err
+	}
+
+	s.used = true
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		logger.Error(err, "Failed to remove setup token file")
+	}
+	return nil
+}
+
+type SetupRequest struct {
+	Token string `json:"token"`
+	// Username and Password create an admin user. Without them an admin
+	// API key is created instead.
+	Username    string `json:"username"`
+	Password    string `json:"password"`
+	Description string `json:"description"`
+}
+
+type SetupResponse struct {
+	APIKey *database.APIKey `json:"api_key,omitempty"`
+	User   *database.User   `json:"user,omitempty"`
+}
+
+// Setup godoc
+// @Summary Create the first admin
+// @Description Exchange the one-time setup token from the data directory for an admin API key, or an admin user when username and password are given. Only available until an admin exists.
+// @Tags setup
+// @Accept json
+// @Produce json
+// @Param request body SetupRequest true "Setup token and admin to create"
+// @Success 201 {object} SetupResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 401 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 409 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /setup [post]
+func (h *Handler) Setup(c *fiber.Ctx) error {
+	needed, err := h.db.NeedsBootstrap()
+	if err != nil {
+		logger.Error(err, "Failed to check for admins")
+		return apierror.Send(c, err)
+	}
+	if h.SetupToken == nil || !needed {
+		return apierror.Send(c, apierror.NotFound("setup has already been completed"))
+	}
+
+	var req SetupRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Send(c, apierror.BadRequest("invalid request body"))
+	}
+	if req.Username != "" && len(req.Password) < minPasswordLength {
+		return apierror.Send(c, apierror.BadRequest(fmt.Sprintf("password must be at least %d characters", minPasswordLength)))
+	}
+
+	if req.Username != "" {
+		user := &database.User{Username: req.Username, Role: database.RoleAdmin}
+		err := h.SetupToken.redeem(req.Token, func() error {
+			// Users without admin rights, such as SSO viewers, may
+			// already exist.
+			existing, err := h.db.GetUserByUsername(req.Username)
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				return apierror.Conflict("user with this username already exists")
+			}
+			return h.db.CreateUser(user, req.Password)
+		})
+		if err != nil {
+			return h.setupFailed(c, err, "Failed to create admin user")
+		}
+		logger.Info(fmt.Sprintf("Setup created admin user: %s", user.Username))
+		return c.Status(201).JSON(SetupResponse{User: user})
+	}
+
+	if req.Description == "" {
+		req.Description = "Setup admin key"
+	}
+	apiKey := &database.APIKey{Description: req.Description, IsAdmin: true}
+	err = h.SetupToken.redeem(req.Token, func() error {
+		return h.db.CreateAPIKey(apiKey)
+	})
+	if err != nil {
+		return h.setupFailed(c, err, "Failed to create admin API key")
+	}
+	logger.Info(fmt.Sprintf("Setup created admin API key: %d", apiKey.ID))
+	return c.Status(201).JSON(SetupResponse{APIKey: apiKey})
+}
+
+// setupFailed logs a rejected setup token as a warning and any other error
+// as a failure to create the admin.
+func (h *Handler) setupFailed(c *fiber.Ctx, err error, message string) error {
+	var apiErr *apierror.Error
+	if errors.As(err, &apiErr) && apiErr.Status == fiber.StatusUnauthorized {
+		logger.Warn(fmt.Sprintf("Rejected setup attempt from %s: %v", c.IP(), err))
+	} else {
+		logger.Error(err, message)
+	}
+	return apierror.Send(c, err)
+}
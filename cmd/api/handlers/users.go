@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Zeptile/docktrine/cmd/api/middleware"
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/gofiber/fiber/v2"
+)
+
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type LoginResponse struct {
+	Token     string         `json:"token"`
+	ExpiresAt time.Time      `json:"expires_at"`
+	User      *database.User `json:"user"`
+}
+
+type CreateUserRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Role is one of viewer, operator or admin.
+	Role string `json:"role"`
+}
+
+type SetPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+const minPasswordLength = 12
+
+// Login godoc
+// @Summary Log in
+// @Description Exchange a username and password for a session token to send as "Authorization: Bearer <token>"
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param credentials body LoginRequest true "Credentials"
+// @Success 200 {object} LoginResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 401 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /auth/login [post]
+func (h *Handler) Login(c *fiber.Ctx) error {
+	var req LoginRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Send(c, apierror.BadRequest("invalid request body"))
+	}
+
+	user, err := h.db.AuthenticateUser(req.Username, req.Password)
+	if err != nil {
+		logger.Error(err, "Failed to authenticate user")
+		return apierror.Send(c, err)
+	}
+	if user == nil {
+		logger.Warn(fmt.Sprintf("Failed login for user: %s", req.Username))
+		return apierror.Send(c, apierror.Unauthorized("invalid username or password"))
+	}
+
+	session, err := h.db.CreateSession(user, h.SessionTTL)
+	if err != nil {
+		logger.Error(err, "Failed to create session")
+		return apierror.Send(c, err)
+	}
+
+	logger.Info(fmt.Sprintf("User logged in: %s", user.Username))
+	return c.JSON(LoginResponse{
+		Token:     session.Token,
+		ExpiresAt: session.ExpiresAt,
+		User:      user,
+	})
+}
+
+// Logout godoc
+// @Summary Log out
+// @Description End the session used to authenticate this request
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /auth/logout [post]
+func (h *Handler) Logout(c *fiber.Ctx) error {
+	session := middleware.CurrentSession(c)
+	if session == nil {
+		return apierror.Send(c, apierror.BadRequest("request was not authenticated with a session"))
+	}
+
+	if err := h.db.DeleteSession(session.ID); err != nil {
+		logger.Error(err, "Failed to delete session")
+		return apierror.Send(c, err)
+	}
+
+	return c.JSON(MessageResponse{Message: "logged out successfully"})
+}
+
+// ListUsers godoc
+// @Summary List users
+// @Description Get every user account
+// @Tags users
+// @Accept json
+// @Produce json
+// @Success 200 {array} database.User
+// @Failure 403 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /users [get]
+func (h *Handler) ListUsers(c *fiber.Ctx) error {
+	users, err := h.db.GetUsers()
+	if err != nil {
+		logger.Error(err, "Failed to list users")
+		return apierror.Send(c, err)
+	}
+	return c.JSON(users)
+}
+
+// CreateUser godoc
+// @Summary Create a user
+// @Description Create a user account with a role (viewer, operator or admin)
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param user body CreateUserRequest true "User"
+// @Success 201 {object} database.User
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 409 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /users [post]
+func (h *Handler) CreateUser(c *fiber.Ctx) error {
+	var req CreateUserRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Send(c, apierror.BadRequest("invalid request body"))
+	}
+
+	if req.Username == "" {
+		return apierror.Send(c, apierror.BadRequest("username is required"))
+	}
+	if len(req.Password) < minPasswordLength {
+		return apierror.Send(c, apierror.BadRequest(fmt.Sprintf("password must be at least %d characters", minPasswordLength)))
+	}
+	if !database.ValidRole(req.Role) {
+		return apierror.Send(c, apierror.BadRequest("role must be viewer, operator or admin"))
+	}
+
+	existing, err := h.db.GetUserByUsername(req.Username)
+	if err != nil {
+		logger.Error(err, "Failed to check user existence")
+		return apierror.Send(c, err)
+	}
+	if existing != nil {
+		return apierror.Send(c, apierror.Conflict("user with this username already exists"))
+	}
+
+	user := &database.User{Username: req.Username, Role: req.Role}
+	if err := h.db.CreateUser(user, req.Password); err != nil {
+		logger.Error(err, "Failed to create user")
+		return apierror.Send(c, err)
+	}
+
+	logger.Info(fmt.Sprintf("User created: %s (%s)", user.Username, user.Role))
+	return c.Status(201).JSON(user)
+}
+
+// SetUserPassword godoc
+// @Summary Set a user's password
+// @Description Replace a user's password and end their sessions
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param username path string true "Username"
+// @Param password body SetPasswordRequest true "New password"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /users/{username}/password [put]
+func (h *Handler) SetUserPassword(c *fiber.Ctx) error {
+	var req SetPasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Send(c, apierror.BadRequest("invalid request body"))
+	}
+	if len(req.Password) < minPasswordLength {
+		return apierror.Send(c, apierror.BadRequest(fmt.Sprintf("password must be at least %d characters", minPasswordLength)))
+	}
+
+	username := c.Params("username")
+	user, err := h.db.GetUserByUsername(username)
+	if err != nil {
+		logger.Error(err, "Failed to get user")
+		return apierror.Send(c, err)
+	}
+	if user == nil {
+		return apierror.Send(c, apierror.NotFound("user not found"))
+	}
+	if user.Source != database.UserSourceLocal {
+		return apierror.Send(c, apierror.BadRequest("user signs in through single sign-on and has no password"))
+	}
+
+	if err := h.db.UpdateUserPassword(username, req.Password); err != nil {
+		logger.Error(err, "Failed to update password")
+		return apierror.Send(c, err)
+	}
+
+	return c.JSON(MessageResponse{Message: "password updated successfully"})
+}
+
+// DeleteUser godoc
+// @Summary Delete a user
+// @Description Delete a user account and end its sessions
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param username path string true "Username"
+// @Success 200 {object} MessageResponse
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /users/{username} [delete]
+func (h *Handler) DeleteUser(c *fiber.Ctx) error {
+	username := c.Params("username")
+	user, err := h.db.GetUserByUsername(username)
+	if err != nil {
+		logger.Error(err, "Failed to get user")
+		return apierror.Send(c, err)
+	}
+	if user == nil {
+		return apierror.Send(c, apierror.NotFound("user not found"))
+	}
+
+	if err := h.db.DeleteUser(username); err != nil {
+		logger.Error(err, "Failed to delete user")
+		return apierror.Send(c, err)
+	}
+
+	logger.Info(fmt.Sprintf("User deleted: %s", username))
+	return c.JSON(MessageResponse{Message: "user deleted successfully"})
+}
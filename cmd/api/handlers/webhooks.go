@@ -0,0 +1,452 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/Zeptile/docktrine/internal/notify"
+	"github.com/Zeptile/docktrine/internal/webhooks"
+	"github.com/gofiber/fiber/v2"
+)
+
+type CreateWebhookRequest struct {
+	Name string `json:"name"`
+	// URL is the http or https endpoint notifications are POSTed to.
+	URL string `json:"url"`
+	// Secret is the HMAC key payloads are signed with; generated if empty.
+	Secret string `json:"secret"`
+	// Events the webhook receives: alert.fired, alert.resolved,
+	// container.died, container.restarted, server.offline, server.online,
+	// job.finished, or * for all of them. Defaults to *.
+	Events []string `json:"events"`
+	// Format is json (the default), slack, mattermost or discord.
+	Format string `json:"format"`
+	// Templates are Go templates for the message text of chat formats, per
+	// event or * for all, e.g. {"container.restarted": "{{.Data.Container}}
+	// restarted on {{.Server}} by {{.Data.By}}"}.
+	Templates map[string]string `json:"templates"`
+	// MinSeverity only sends notifications of this severity or higher:
+	// info, warning or critical.
+	MinSeverity string `json:"min_severity"`
+}
+
+// UpdateWebhookRequest changes the fields that are set and leaves the others
+// as they are.
+type UpdateWebhookRequest struct {
+	Name        *string           `json:"name"`
+	URL         *string           `json:"url"`
+	Events      []string          `json:"events"`
+	Format      *string           `json:"format"`
+	Templates   map[string]string `json:"templates"`
+	MinSeverity *string           `json:"min_severity"`
+}
+
+// ListWebhooks godoc
+// @Summary List webhooks
+// @Description Get every webhook. Secrets are never returned.
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Success 200 {array} database.Webhook
+// @Failure 403 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /webhooks [get]
+func (h *Handler) ListWebhooks(c *fiber.Ctx) error {
+	webhooks, err := h.db.ListWebhooks()
+	if err != nil {
+		logger.Error(err, "Failed to list webhooks")
+		return apierror.Send(c, err)
+	}
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+	return c.JSON(webhooks)
+}
+
+// CreateWebhook godoc
+// @Summary Create a webhook
+// @Description Register an endpoint that notifications are POSTed to, as JSON or as a Slack, Mattermost or Discord message rendered from the webhook's templates. Each request carries X-Docktrine-Event, X-Docktrine-Delivery and X-Docktrine-Signature (t=<unix time>,v1=<hex HMAC-SHA256 of "<t>.<body>" keyed with the secret). The secret is only returned in this response.
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Param webhook body CreateWebhookRequest true "Webhook"
+// @Success 201 {object} database.Webhook
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /webhooks [post]
+func (h *Handler) CreateWebhook(c *fiber.Ctx) error {
+	var req CreateWebhookRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Send(c, apierror.BadRequest("invalid request body"))
+	}
+
+	if len(req.Events) == 0 {
+		req.Events = []string{"*"}
+	}
+	if req.Format == "" {
+		req.Format = webhooks.FormatJSON
+	}
+
+	webhook := &database.Webhook{
+		Name:        req.Name,
+		URL:         req.URL,
+		Secret:      req.Secret,
+		Events:      req.Events,
+		Format:      req.Format,
+		Templates:   req.Templates,
+		MinSeverity: req.MinSeverity,
+	}
+	if err := validateWebhook(webhook); err != nil {
+		return apierror.Send(c, err)
+	}
+	if err := h.db.CreateWebhook(webhook); err != nil {
+		logger.Error(err, "Failed to create webhook")
+		return apierror.Send(c, err)
+	}
+
+	logger.Info(fmt.Sprintf("Webhook created: %d (%s)", webhook.ID, webhook.Name))
+	return c.Status(201).JSON(webhook)
+}
+
+// GetWebhook godoc
+// @Summary Get a webhook
+// @Description Get a webhook. Its secret is never returned.
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Success 200 {object} database.Webhook
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /webhooks/{id} [get]
+func (h *Handler) GetWebhook(c *fiber.Ctx) error {
+	webhook, err := h.lookupWebhook(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+	webhook.Secret = ""
+	return c.JSON(webhook)
+}
+
+// UpdateWebhook godoc
+// @Summary Update a webhook
+// @Description Change a webhook's name, URL, events, format, templates or minimum severity. Only the fields that are set change; templates replace the existing ones.
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Param webhook body UpdateWebhookRequest true "Fields to change"
+// @Success 200 {object} database.Webhook
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /webhooks/{id} [patch]
+func (h *Handler) UpdateWebhook(c *fiber.Ctx) error {
+	webhook, err := h.lookupWebhook(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	var req UpdateWebhookRequest
+	if err := c.BodyParser(&req); err != nil {
+		return apierror.Send(c, apierror.BadRequest("invalid request body"))
+	}
+	if req.Name != nil {
+		webhook.Name = *req.Name
+	}
+	if req.URL != nil {
+		webhook.URL = *req.URL
+	}
+	if req.Events != nil {
+		webhook.Events = req.Events
+	}
+	if req.Format != nil {
+		webhook.Format = *req.Format
+	}
+	if req.Templates != nil {
+		webhook.Templates = req.Templates
+	}
+	if req.MinSeverity != nil {
+		webhook.MinSeverity = *req.MinSeverity
+	}
+	if err := validateWebhook(webhook); err != nil {
+		return apierror.Send(c, err)
+	}
+
+	if err := h.db.UpdateWebhook(webhook); err != nil {
+		logger.Error(err, "Failed to update webhook")
+		return apierror.Send(c, err)
+	}
+
+	logger.Info(fmt.Sprintf("Webhook updated: %d (%s)", webhook.ID, webhook.Name))
+	webhook.Secret = ""
+	return c.JSON(webhook)
+}
+
+// DeleteWebhook godoc
+// @Summary Delete a webhook
+// @Description Delete a webhook along with its pending deliveries and delivery log
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /webhooks/{id} [delete]
+func (h *Handler) DeleteWebhook(c *fiber.Ctx) error {
+	webhook, err := h.lookupWebhook(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	if err := h.db.DeleteWebhook(webhook.ID); err != nil {
+		logger.Error(err, "Failed to delete webhook")
+		return apierror.Send(c, err)
+	}
+
+	logger.Info(fmt.Sprintf("Webhook deleted: %d (%s)", webhook.ID, webhook.Name))
+	return c.JSON(MessageResponse{Message: "webhook deleted successfully"})
+}
+
+// DisableWebhook godoc
+// @Summary Disable a webhook
+// @Description Stop sending notifications to a webhook without deleting it. Its pending deliveries fail.
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /webhooks/{id}/disable [post]
+func (h *Handler) DisableWebhook(c *fiber.Ctx) error {
+	return h.setWebhookEnabled(c, false)
+}
+
+// EnableWebhook godoc
+// @Summary Enable a webhook
+// @Description Resume sending notifications to a disabled webhook
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Success 200 {object} MessageResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /webhooks/{id}/enable [post]
+func (h *Handler) EnableWebhook(c *fiber.Ctx) error {
+	return h.setWebhookEnabled(c, true)
+}
+
+func (h *Handler) setWebhookEnabled(c *fiber.Ctx, enabled bool) error {
+	webhook, err := h.lookupWebhook(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	if err := h.db.SetWebhookEnabled(webhook.ID, enabled); err != nil {
+		logger.Error(err, "Failed to update webhook")
+		return apierror.Send(c, err)
+	}
+
+	if !enabled {
+		logger.Info(fmt.Sprintf("Webhook disabled: %d (%s)", webhook.ID, webhook.Name))
+		return c.JSON(MessageResponse{Message: "webhook disabled successfully"})
+	}
+	logger.Info(fmt.Sprintf("Webhook enabled: %d (%s)", webhook.ID, webhook.Name))
+	return c.JSON(MessageResponse{Message: "webhook enabled successfully"})
+}
+
+// TestWebhook godoc
+// @Summary Send a test notification
+// @Description Queue a ping event to a webhook, whatever its subscriptions, and return the delivery. Follow it in the delivery log.
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Success 202 {object} database.WebhookDelivery
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 409 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /webhooks/{id}/test [post]
+func (h *Handler) TestWebhook(c *fiber.Ctx) error {
+	webhook, err := h.lookupWebhook(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+	if !webhook.Enabled {
+		return apierror.Send(c, apierror.Conflict(fmt.Sprintf("webhook %s is disabled", webhook.Name)))
+	}
+
+	delivery, err := h.Webhooks.Ping(webhook)
+	if err != nil {
+		logger.Error(err, "Failed to queue test delivery")
+		return apierror.Send(c, err)
+	}
+	return c.Status(fiber.StatusAccepted).JSON(delivery)
+}
+
+// ListWebhookDeliveries godoc
+// @Summary List a webhook's deliveries
+// @Description Get the delivery log of a webhook, newest first: pending deliveries with their next attempt, and delivered or failed ones with the last response status and error.
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Param status query string false "pending, succeeded or failed"
+// @Param limit query int false "Maximum number of deliveries" default(50)
+// @Success 200 {array} database.WebhookDelivery
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /webhooks/{id}/deliveries [get]
+func (h *Handler) ListWebhookDeliveries(c *fiber.Ctx) error {
+	webhook, err := h.lookupWebhook(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+
+	status := c.Query("status")
+	switch status {
+	case "", database.DeliveryPending, database.DeliverySucceeded, database.DeliveryFailed:
+	default:
+		return apierror.Send(c, apierror.BadRequest("status must be pending, succeeded or failed"))
+	}
+	limit := 50
+	if v := c.Query("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 0 {
+			return apierror.Send(c, apierror.BadRequest("invalid limit"))
+		}
+	}
+
+	deliveries, err := h.db.ListWebhookDeliveries(webhook.ID, status, limit)
+	if err != nil {
+		logger.Error(err, "Failed to list webhook deliveries")
+		return apierror.Send(c, err)
+	}
+	return c.JSON(deliveries)
+}
+
+// RedeliverWebhookDelivery godoc
+// @Summary Redeliver a notification
+// @Description Send a delivery again with its original payload, e.g. after fixing the receiving end
+// @Tags webhooks
+// @Accept json
+// @Produce json
+// @Param id path int true "Webhook ID"
+// @Param delivery path int true "Delivery ID"
+// @Success 202 {object} MessageResponse
+// @Failure 400 {object} apierror.Response
+// @Failure 403 {object} apierror.Response
+// @Failure 404 {object} apierror.Response
+// @Failure 409 {object} apierror.Response
+// @Failure 500 {object} apierror.Response
+// @Router /webhooks/{id}/deliveries/{delivery}/redeliver [post]
+func (h *Handler) RedeliverWebhookDelivery(c *fiber.Ctx) error {
+	webhook, err := h.lookupWebhook(c)
+	if err != nil {
+		return apierror.Send(c, err)
+	}
+	if !webhook.Enabled {
+		return apierror.Send(c, apierror.Conflict(fmt.Sprintf("webhook %s is disabled", webhook.Name)))
+	}
+
+	id, err := strconv.ParseInt(c.Params("delivery"), 10, 64)
+	if err != nil {
+		return apierror.Send(c, apierror.BadRequest("invalid delivery id"))
+	}
+	delivery, err := h.db.GetWebhookDelivery(id)
+	if err != nil {
+		logger.Error(err, "Failed to get webhook delivery")
+		return apierror.Send(c, err)
+	}
+	if delivery == nil || delivery.WebhookID != webhook.ID {
+		return apierror.Send(c, apierror.NotFound("delivery not found"))
+	}
+	if delivery.Status == database.DeliveryPending {
+		return apierror.Send(c, apierror.Conflict(fmt.Sprintf("delivery %d is still pending", delivery.ID)))
+	}
+
+	if err := h.db.RedeliverWebhookDelivery(delivery.ID); err != nil {
+		logger.Error(err, "Failed to requeue webhook delivery")
+		return apierror.Send(c, err)
+	}
+	h.Webhooks.Wake()
+	return c.Status(fiber.StatusAccepted).JSON(MessageResponse{Message: fmt.Sprintf("delivery %d queued", delivery.ID)})
+}
+
+func (h *Handler) lookupWebhook(c *fiber.Ctx) (*database.Webhook, error) {
+	id, err := strconv.ParseInt(c.Params("id"), 10, 64)
+	if err != nil {
+		return nil, apierror.BadRequest("invalid webhook id")
+	}
+
+	webhook, err := h.db.GetWebhook(id)
+	if err != nil {
+		logger.Error(err, "Failed to get webhook")
+		return nil, err
+	}
+	if webhook == nil {
+		return nil, apierror.NotFound("webhook not found")
+	}
+	return webhook, nil
+}
+
+// validateWebhook checks the settings of a webhook being created or
+// updated.
+func validateWebhook(webhook *database.Webhook) error {
+	if webhook.Name == "" {
+		return apierror.BadRequest("name is required")
+	}
+	endpoint, err := url.Parse(webhook.URL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return apierror.BadRequest("url must be an http or https URL")
+	}
+	if len(webhook.Events) == 0 {
+		return apierror.BadRequest("events must not be empty")
+	}
+	for _, event := range webhook.Events {
+		if event != "*" && !isEvent(event) {
+			return apierror.BadRequest(fmt.Sprintf("unknown event %q", event))
+		}
+	}
+	if !slices.Contains(webhooks.Formats, webhook.Format) {
+		return apierror.BadRequest(fmt.Sprintf("format must be one of %s", strings.Join(webhooks.Formats, ", ")))
+	}
+	if webhook.MinSeverity != "" && !notify.ValidSeverity(webhook.MinSeverity) {
+		return apierror.BadRequest("min_severity must be info, warning or critical")
+	}
+	for event, text := range webhook.Templates {
+		if event != "*" && !isEvent(event) && event != webhooks.EventPing {
+			return apierror.BadRequest(fmt.Sprintf("template for unknown event %q", event))
+		}
+		if _, err := webhooks.ParseTemplate(text); err != nil {
+			return apierror.BadRequest(fmt.Sprintf("invalid template for %s: %v", event, err))
+		}
+	}
+	return nil
+}
+
+func isEvent(event string) bool {
+	return slices.Contains(notify.Events, event)
+}
@@ -1,13 +1,30 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Zeptile/docktrine/cmd/api/handlers"
 	"github.com/Zeptile/docktrine/cmd/api/middleware"
 	_ "github.com/Zeptile/docktrine/docs"
+	"github.com/Zeptile/docktrine/internal/alerts"
+	"github.com/Zeptile/docktrine/internal/apierror"
 	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/docker"
+	"github.com/Zeptile/docktrine/internal/email"
+	"github.com/Zeptile/docktrine/internal/history"
+	"github.com/Zeptile/docktrine/internal/jobs"
 	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/Zeptile/docktrine/internal/notify"
+	"github.com/Zeptile/docktrine/internal/oidc"
+	"github.com/Zeptile/docktrine/internal/ratelimit"
+	"github.com/Zeptile/docktrine/internal/webhooks"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/swagger"
 )
@@ -16,51 +33,284 @@ import (
 // @version 1.0
 // @description Docker management API
 // @host localhost:3000
-// @BasePath /
+// @BasePath /v1
 func main() {
 	logger.Init()
 
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		os.Exit(runAdmin(os.Args[2:]))
+	}
+
 	db, err := database.NewDatabaseConnection()
 	if err != nil {
 		logger.Fatal(err, "Failed to initialize database")
 	}
 	defer db.Close()
 
-	app := fiber.New()
-	
+	setupToken, err := bootstrapAdmin(db)
+	if err != nil {
+		logger.Fatal(err, "Failed to bootstrap admin access")
+	}
+
+	configFile := os.Getenv("CONFIG_FILE")
+	if configFile == "" {
+		configFile = "config.json"
+	}
+
+	syncMode, err := docker.ParseSyncMode(os.Getenv("CONFIG_SYNC_MODE"))
+	if err != nil {
+		logger.Fatal(err, "Invalid CONFIG_SYNC_MODE")
+	}
+
+	config, err := docker.LoadConfig(configFile)
+	if err != nil {
+		logger.Fatal(err, "Failed to load config")
+	}
+
+	if err := docker.SyncServers(db, config, syncMode); err != nil {
+		logger.Fatal(err, "Failed to sync servers from config")
+	}
+
+	watchInterval := 5 * time.Second
+	if v := os.Getenv("CONFIG_WATCH_INTERVAL"); v != "" {
+		watchInterval, err = time.ParseDuration(v)
+		if err != nil {
+			logger.Fatal(err, "Invalid CONFIG_WATCH_INTERVAL")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if watchInterval > 0 {
+		go docker.WatchConfig(ctx, db, configFile, syncMode, watchInterval)
+	}
+
+	if v := os.Getenv("APIKEY_MAX_IDLE_DAYS"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil {
+			logger.Fatal(err, "Invalid APIKEY_MAX_IDLE_DAYS")
+		}
+		if days > 0 {
+			go db.WatchIdleAPIKeys(ctx, time.Duration(days)*24*time.Hour, time.Hour)
+		}
+	}
+
+	checkpointInterval := 15 * time.Minute
+	if v := os.Getenv("AUDIT_CHECKPOINT_INTERVAL"); v != "" {
+		checkpointInterval, err = time.ParseDuration(v)
+		if err == nil && checkpointInterval <= 0 {
+			err = errors.New("interval must be positive")
+		}
+		if err != nil {
+			logger.Fatal(err, "Invalid AUDIT_CHECKPOINT_INTERVAL")
+		}
+	}
+	go db.WatchAuditCheckpoints(ctx, checkpointInterval)
+
+	limits := &middleware.RateLimits{}
+	for _, l := range []struct {
+		env      string
+		fallback string
+		limiter  **ratelimit.Limiter
+	}{
+		{"RATE_LIMIT_READS", "300/1m", &limits.Reads},
+		{"RATE_LIMIT_WRITES", "60/1m", &limits.Writes},
+		{"RATE_LIMIT_PULLS", "10/1m", &limits.Pulls},
+	} {
+		value, ok := os.LookupEnv(l.env)
+		if !ok {
+			value = l.fallback
+		}
+		rate, err := ratelimit.ParseRate(value)
+		if err != nil {
+			logger.Fatal(err, "Invalid "+l.env)
+		}
+		*l.limiter = ratelimit.NewLimiter(rate)
+	}
+
+	maxServerOps := 4
+	if v := os.Getenv("MAX_CONCURRENT_OPS_PER_SERVER"); v != "" {
+		maxServerOps, err = strconv.Atoi(v)
+		if err != nil {
+			logger.Fatal(err, "Invalid MAX_CONCURRENT_OPS_PER_SERVER")
+		}
+	}
+	limits.Servers = ratelimit.NewSlots(maxServerOps)
+
+	var provider *oidc.Provider
+	if oidcConfig := oidc.ConfigFromEnv(); oidcConfig != nil {
+		provider, err = oidc.NewProvider(ctx, *oidcConfig)
+		if err != nil {
+			logger.Fatal(err, "Failed to set up OIDC provider")
+		}
+		logger.Info("Single sign-on enabled with issuer " + oidcConfig.Issuer)
+	}
+
+	appConfig := fiber.Config{
+		// Errors no handler answered, such as unknown routes, get the
+		// same body as every other error.
+		ErrorHandler: func(c *fiber.Ctx, err error) error {
+			return apierror.Send(c, err)
+		},
+	}
+	// The client address is only taken from a proxy header when the
+	// request comes from one of these proxies.
+	if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+		for _, proxy := range strings.Split(v, ",") {
+			proxy = strings.TrimSpace(proxy)
+			if net.ParseIP(proxy) == nil {
+				if _, _, err := net.ParseCIDR(proxy); err != nil {
+					logger.Fatal(fmt.Errorf("%q is not an IP address or CIDR", proxy), "Invalid TRUSTED_PROXIES")
+				}
+			}
+			appConfig.TrustedProxies = append(appConfig.TrustedProxies, proxy)
+		}
+		appConfig.EnableTrustedProxyCheck = true
+		appConfig.EnableIPValidation = true
+		appConfig.ProxyHeader = os.Getenv("PROXY_HEADER")
+		if appConfig.ProxyHeader == "" {
+			appConfig.ProxyHeader = fiber.HeaderXForwardedFor
+		}
+	}
+	app := fiber.New(appConfig)
+
+	app.Use(middleware.RequestID())
 	app.Use(middleware.RequestLogger())
-	
+	app.Use(middleware.Audit(db))
+
+	signingWindow := 5 * time.Minute
+	if v := os.Getenv("REQUEST_SIGNING_WINDOW"); v != "" {
+		signingWindow, err = time.ParseDuration(v)
+		if err != nil {
+			logger.Fatal(err, "Invalid REQUEST_SIGNING_WINDOW")
+		}
+	}
+
+	authenticate := middleware.Authenticate(db, provider, signingWindow)
 	app.Use(func(c *fiber.Ctx) error {
-		if strings.HasPrefix(c.Path(), "/swagger") {
+		path := c.Path()
+		if strings.HasPrefix(path, "/swagger") || path == "/v1/auth/login" || path == "/v1/setup" || strings.HasPrefix(path, "/v1/auth/oidc/") || strings.HasPrefix(path, "/v1/hooks/") {
 			return c.Next()
 		}
-		return middleware.APIKeyAuth(db)(c)
+		return authenticate(c)
 	})
-	
+	app.Use(middleware.RateLimit(limits))
+
 	app.Get("/", func(c *fiber.Ctx) error {
 		return c.Redirect("/swagger/")
 	})
-	
+
 	handler := handlers.NewHandler(db)
-	
+	handler.OIDC = provider
+	handler.RateLimits = limits
+	handler.SetupToken = setupToken
+	if v := os.Getenv("SESSION_TTL"); v != "" {
+		handler.SessionTTL, err = time.ParseDuration(v)
+		if err != nil {
+			logger.Fatal(err, "Invalid SESSION_TTL")
+		}
+	}
+	dockerClient := docker.NewDockerClient(db)
+
+	approvalTTL := time.Hour
+	if v := os.Getenv("APPROVAL_TTL"); v != "" {
+		approvalTTL, err = time.ParseDuration(v)
+		if err == nil && approvalTTL <= 0 {
+			err = errors.New("ttl must be positive")
+		}
+		if err != nil {
+			logger.Fatal(err, "Invalid APPROVAL_TTL")
+		}
+	}
+	requireApproval := middleware.RequireApproval(db, dockerClient, approvalTTL)
+	handler.ApprovalTTL = approvalTTL
+
+	jobWorkers := 4
+	if v := os.Getenv("JOB_WORKERS"); v != "" {
+		jobWorkers, err = strconv.Atoi(v)
+		if err == nil && jobWorkers < 1 {
+			err = errors.New("must be at least 1")
+		}
+		if err != nil {
+			logger.Fatal(err, "Invalid JOB_WORKERS")
+		}
+	}
+	webhookRetention := 30 * 24 * time.Hour
+	if v := os.Getenv("WEBHOOK_DELIVERY_RETENTION"); v != "" {
+		webhookRetention, err = time.ParseDuration(v)
+		if err == nil && webhookRetention < 0 {
+			err = errors.New("retention must not be negative")
+		}
+		if err != nil {
+			logger.Fatal(err, "Invalid WEBHOOK_DELIVERY_RETENTION")
+		}
+	}
+	handler.Webhooks = webhooks.NewNotifier(db, webhookRetention)
+	go handler.Webhooks.Run(ctx)
+	handler.Email = email.NewNotifier(db)
+	go handler.Email.Run(ctx)
+	notifications := notify.NewDispatcher(notify.LogNotifier{}, handler.Webhooks, handler.Email)
+	handler.Notifications = notifications
+
+	handler.Jobs = jobs.NewRunner(db, dockerClient, limits.Servers, jobWorkers)
+	handler.Jobs.Notifications = notifications
+	go handler.Jobs.Run(ctx)
+
+	historyRetention := 30 * 24 * time.Hour
+	if v := os.Getenv("CONTAINER_HISTORY_RETENTION"); v != "" {
+		historyRetention, err = time.ParseDuration(v)
+		if err == nil && historyRetention < 0 {
+			err = errors.New("retention must not be negative")
+		}
+		if err != nil {
+			logger.Fatal(err, "Invalid CONTAINER_HISTORY_RETENTION")
+		}
+	}
+
+	alertRules := alerts.DefaultRules
+	for _, setting := range []struct {
+		env   string
+		value *int
+	}{
+		{"ALERT_CRASH_LOOP_RESTARTS", &alertRules.CrashLoopRestarts},
+		{"ALERT_FAILED_EXITS", &alertRules.FailedExits},
+	} {
+		if v := os.Getenv(setting.env); v != "" {
+			*setting.value, err = strconv.Atoi(v)
+			if err == nil && *setting.value < 1 {
+				err = errors.New("must be at least 1")
+			}
+			if err != nil {
+				logger.Fatal(err, "Invalid "+setting.env)
+			}
+		}
+	}
+	if v := os.Getenv("ALERT_WINDOW"); v != "" {
+		alertRules.Window, err = time.ParseDuration(v)
+		if err == nil && alertRules.Window <= 0 {
+			err = errors.New("window must be positive")
+		}
+		if err != nil {
+			logger.Fatal(err, "Invalid ALERT_WINDOW")
+		}
+	}
+	detector := alerts.NewDetector(db, notifications, alertRules)
+	go detector.Run(ctx)
+
+	recorder := history.NewRecorder(db, dockerClient, historyRetention)
+	recorder.OnEvent = detector.Observe
+	recorder.Notifications = notifications
+	go recorder.Run(ctx)
+
 	logger.Info("Setting up routes...")
 	app.Get("/swagger/*", swagger.HandlerDefault)
-	
-	containers := app.Group("/containers")
-	containers.Get("/", handler.ListContainers)
-	containers.Post("/start/:id", handler.StartContainer)
-	containers.Post("/stop/:id", handler.StopContainer)
-	containers.Get("/:id", handler.GetContainer)
-	containers.Post("/restart/:id", handler.RestartContainer)
-	
-	servers := app.Group("/servers")
-	servers.Get("/", handler.ListServers)
-	servers.Get("/:name", handler.GetServer)
-	servers.Post("/", handler.CreateServer)
-	servers.Delete("/:name", handler.DeleteServer)
-	
+
+	registerRoutes(app.Group("/v1"), handler, dockerClient, limits, requireApproval)
+	registerLegacyRoutes(app, handler, dockerClient, limits, requireApproval)
+
 	logger.Info("Starting server on :3000")
 	if err := app.Listen(":3000"); err != nil {
 		logger.Fatal(err, "Server failed to start")
 	}
-} 
+}
@@ -1,28 +1,147 @@
 package middleware
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/auth"
 	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/signing"
 	"github.com/gofiber/fiber/v2"
 )
 
-func APIKeyAuth(db *database.DB) fiber.Handler {
-    return func(c *fiber.Ctx) error {
-        apiKey := c.Get("X-API-Key")
-        if apiKey == "" {
-            return c.Status(401).JSON(fiber.Map{
-                "error": "API key is required",
-            })
-        }
-
-        key, err := db.GetAPIKey(apiKey)
-        if err != nil || key == nil {
-            return c.Status(401).JSON(fiber.Map{
-                "error": "Invalid API key",
-            })
-        }
-
-        db.UpdateAPIKeyLastUsed(apiKey)
-
-        return c.Next()
-    }
-}
\ No newline at end of file
+// PrincipalLocal is the fiber.Ctx Locals key holding the authenticated
+// *auth.Principal.
+const PrincipalLocal = "principal"
+
+// APIKeyAuth authenticates requests by the X-API-Key header, or by an HMAC
+// signature made with an API key (see internal/signing). Signed requests
+// must be timestamped within signingWindow of the server clock and each
+// nonce is accepted once.
+func APIKeyAuth(db *database.DB, signingWindow time.Duration) fiber.Handler {
+	nonces := signing.NewNonceCache(signingWindow)
+
+	return func(c *fiber.Ctx) error {
+		if c.Get(signing.HeaderSignature) != "" {
+			key, err := verifySignedRequest(c, db, nonces, signingWindow)
+			if err != nil {
+				return apierror.Send(c, apierror.Unauthorized(err.Error()))
+			}
+			return authorizeAPIKey(c, db, key)
+		}
+
+		apiKey := c.Get("X-API-Key")
+		if apiKey == "" {
+			return apierror.Send(c, apierror.Unauthorized("API key is required"))
+		}
+
+		key, err := db.GetAPIKey(apiKey)
+		if err != nil || key == nil {
+			return apierror.Send(c, apierror.Unauthorized("Invalid API key"))
+		}
+
+		return authorizeAPIKey(c, db, key)
+	}
+}
+
+func verifySignedRequest(c *fiber.Ctx, db *database.DB, nonces *signing.NonceCache, window time.Duration) (*database.APIKey, error) {
+	keyID, err := strconv.ParseInt(c.Get(signing.HeaderKeyID), 10, 64)
+	if err != nil {
+		return nil, errors.New("Signed request is missing a valid " + signing.HeaderKeyID)
+	}
+
+	timestamp := c.Get(signing.HeaderTimestamp)
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, errors.New("Signed request is missing a valid " + signing.HeaderTimestamp)
+	}
+	if skew := time.Since(time.Unix(unix, 0)); skew > window || skew < -window {
+		return nil, errors.New("Request timestamp is outside the allowed window")
+	}
+
+	nonce := c.Get(signing.HeaderNonce)
+	if nonce == "" || len(nonce) > 128 {
+		return nil, errors.New("Signed request is missing a valid " + signing.HeaderNonce)
+	}
+
+	key, err := db.GetAPIKeyByID(keyID)
+	if err != nil || key == nil {
+		return nil, errors.New("Invalid API key")
+	}
+
+	canonical := signing.CanonicalRequest(c.Method(), string(c.Request().URI().PathOriginal()),
+		string(c.Request().URI().QueryString()), c.Body(), timestamp, nonce)
+	if !key.VerifySignature(canonical, c.Get(signing.HeaderSignature)) {
+		return nil, errors.New("Invalid request signature")
+	}
+
+	if !nonces.Use(fmt.Sprintf("%d:%s", key.ID, nonce)) {
+		return nil, errors.New("Request nonce has already been used")
+	}
+
+	return key, nil
+}
+
+// authorizeAPIKey applies the key's state and restrictions once the key has
+// been identified.
+func authorizeAPIKey(c *fiber.Ctx, db *database.DB, key *database.APIKey) error {
+	if key.Disabled {
+		return apierror.Send(c, apierror.Unauthorized("API key is disabled"))
+	}
+
+	if key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt) {
+		return apierror.Send(c, apierror.Unauthorized("API key has expired"))
+	}
+
+	if !ipAllowed(key.AllowedCIDRs, RealIP(c)) {
+		return apierror.Send(c, apierror.Forbidden("API key is not allowed from this IP address"))
+	}
+
+	db.UpdateAPIKeyLastUsed(key.ID)
+
+	c.Locals(PrincipalLocal, auth.FromAPIKey(key))
+	return c.Next()
+}
+
+func ipAllowed(cidrs []string, ip string) bool {
+	if len(cidrs) == 0 {
+		return true
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		if network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// CurrentPrincipal returns who authenticated the request, if anyone.
+func CurrentPrincipal(c *fiber.Ctx) *auth.Principal {
+	principal, _ := c.Locals(PrincipalLocal).(*auth.Principal)
+	return principal
+}
+
+// RequireAdmin only lets requests from admin keys and users through.
+func RequireAdmin() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		principal := CurrentPrincipal(c)
+		if principal == nil || !principal.IsAdmin {
+			return apierror.Send(c, apierror.Forbidden("admin privileges required"))
+		}
+		return c.Next()
+	}
+}
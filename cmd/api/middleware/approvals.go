@@ -0,0 +1,150 @@
+package middleware
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/docker"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/docker/docker/errdefs"
+	"github.com/gofiber/fiber/v2"
+)
+
+// ApprovalLocal holds the approval a request was held for, so the audit log
+// can tell it apart from an operation that ran.
+const ApprovalLocal = "approval"
+
+// ApprovalRequiredResponse is returned with 202 Accepted when an operation
+// was held for approval.
+type ApprovalRequiredResponse struct {
+	Message  string             `json:"message"`
+	Approval *database.Approval `json:"approval"`
+}
+
+// RequireApproval holds destructive operations on protected servers and
+// containers until a second principal approves them. Instead of running the
+// handler it stores a pending approval and answers 202 Accepted. Servers are
+// protected by their protected flag, containers by the docktrine.protected
+// label.
+func RequireApproval(db *database.DB, d *docker.DockerClient, ttl time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		action := auditAction(c.Method(), auditRoute(c))
+
+		server := c.Query("server", "")
+		target := auditTarget(c)
+		if name := c.Params("name"); name != "" {
+			server, target = name, name
+		}
+		reason, err := ProtectionReason(db, d, action, server, target)
+		if err != nil {
+			apiErr := apierror.From(err)
+			apiErr.Message = fmt.Sprintf("cannot check whether %s is protected: %v", target, err)
+			return apierror.Send(c, apiErr)
+		}
+		if reason == "" {
+			return c.Next()
+		}
+
+		params := map[string]string{}
+		c.Context().QueryArgs().VisitAll(func(key, value []byte) {
+			// The approved operation runs when it is approved, whether
+			// or not the request asked for a job.
+			if string(key) != "server" && string(key) != "async" {
+				params[string(key)] = string(value)
+			}
+		})
+
+		return HoldForApproval(c, db, &database.Approval{
+			Action:    action,
+			Server:    server,
+			Target:    target,
+			Params:    params,
+			Reason:    reason,
+			ExpiresAt: time.Now().Add(ttl),
+		})
+	}
+}
+
+// approvalActions are the operations held for approval on protected
+// servers and containers. Starting a container is never held.
+var approvalActions = map[string]bool{
+	"containers.stop":     true,
+	"containers.restart":  true,
+	"containers.recreate": true,
+	"servers.delete":      true,
+}
+
+// ProtectionReason says why running action on target needs approval, or
+// returns "" when it does not. target is a server name for servers.delete
+// and a container on the servers matching selector otherwise.
+func ProtectionReason(db *database.DB, d *docker.DockerClient, action, selector, target string) (string, error) {
+	if !approvalActions[action] {
+		return "", nil
+	}
+	if action == "servers.delete" {
+		return protectedServer(db, target)
+	}
+	return protectedContainer(d, target, selector)
+}
+
+// HoldForApproval stores approval as requested by the current principal
+// and answers 202 Accepted instead of running the operation.
+func HoldForApproval(c *fiber.Ctx, db *database.DB, approval *database.Approval) error {
+	if principal := CurrentPrincipal(c); principal != nil {
+		approval.RequesterType = principal.Type
+		approval.RequesterID = principal.ID
+		approval.RequesterName = principal.Name
+	}
+
+	if err := db.CreateApproval(approval); err != nil {
+		logger.Error(err, "Failed to create approval")
+		return apierror.Send(c, err)
+	}
+
+	c.Locals(ApprovalLocal, approval)
+	logger.Info(fmt.Sprintf("Approval %d required for %s on %s: %s", approval.ID, approval.Action, approval.Target, approval.Reason))
+	return c.Status(202).JSON(ApprovalRequiredResponse{
+		Message:  fmt.Sprintf("%s needs approval by another user or API key", approval.Action),
+		Approval: approval,
+	})
+}
+
+func protectedServer(db *database.DB, name string) (string, error) {
+	server, err := db.GetServerByName(name)
+	if err != nil || server == nil {
+		// Unknown servers are reported by the handler.
+		return "", err
+	}
+	if server.Protected {
+		return fmt.Sprintf("server %s is protected", server.Name), nil
+	}
+	return "", nil
+}
+
+func protectedContainer(d *docker.DockerClient, containerID string, selector string) (string, error) {
+	servers, err := d.ResolveServers(selector)
+	if err != nil {
+		// Let the handler report unknown servers and bad selectors.
+		return "", nil
+	}
+
+	for _, server := range servers {
+		if server.Protected {
+			return fmt.Sprintf("server %s is protected", server.Name), nil
+		}
+
+		labels, err := d.ContainerLabels(containerID, server.Name)
+		if errdefs.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if labels[docker.ProtectedLabel] == "true" {
+			return fmt.Sprintf("container %s on %s has the %s=true label", containerID, server.Name, docker.ProtectedLabel), nil
+		}
+	}
+	return "", nil
+}
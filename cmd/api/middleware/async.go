@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// WantsAsync reports whether the client asked for an operation to be queued
+// as a background job, with ?async=true or a Prefer: respond-async header.
+func WantsAsync(c *fiber.Ctx) bool {
+	if c.Query("async") == "true" {
+		return true
+	}
+	for _, preference := range strings.Split(c.Get("Prefer"), ",") {
+		if strings.EqualFold(strings.TrimSpace(preference), "respond-async") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,194 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/gofiber/fiber/v2"
+)
+
+// auditActorAnonymous is recorded for requests that were not authenticated,
+// such as failed logins.
+const auditActorAnonymous = "anonymous"
+
+// redactedParams are request fields never written to the audit log.
+var redactedParams = []string{"password", "secret", "token", "key", "device_code"}
+
+// Audit records every mutating request in the audit_events table, whether
+// it succeeded, failed or was held for approval. Reads are not recorded.
+func Audit(db *database.DB) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		switch c.Method() {
+		case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+			return c.Next()
+		}
+
+		start := time.Now()
+		params := auditParams(c)
+
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		var fiberErr *fiber.Error
+		if errors.As(err, &fiberErr) {
+			status = fiberErr.Code
+		} else if err != nil {
+			status = fiber.StatusInternalServerError
+		}
+
+		event := &database.AuditEvent{
+			Timestamp:  start,
+			ActorType:  auditActorAnonymous,
+			SourceIP:   RealIP(c),
+			Action:     auditAction(c.Method(), auditRoute(c)),
+			Server:     c.Query("server"),
+			Target:     auditTarget(c),
+			Params:     params,
+			Status:     status,
+			Result:     database.AuditResultSuccess,
+			DurationMS: time.Since(start).Milliseconds(),
+		}
+		if principal := CurrentPrincipal(c); principal != nil {
+			event.ActorType = principal.Type
+			event.ActorID = principal.ID
+			event.ActorName = principal.Name
+		}
+		if event.Server == "" && strings.HasPrefix(event.Action, "servers.") {
+			event.Server = c.Params("name")
+			if name, ok := params["name"].(string); ok && event.Server == "" {
+				event.Server = name
+			}
+		}
+		if status >= 400 {
+			event.Result = database.AuditResultFailure
+			event.Error = responseError(c, err)
+		} else if approval, ok := c.Locals(ApprovalLocal).(*database.Approval); ok {
+			// The operation did not run; it is recorded again when the
+			// approval executes it.
+			event.Result = database.AuditResultPendingApproval
+			event.Params["approval_id"] = approval.ID
+		}
+
+		if recordErr := db.RecordAuditEvent(event); recordErr != nil {
+			logger.Error(recordErr, "Failed to record audit event")
+		}
+
+		return err
+	}
+}
+
+// auditAction names a route for the audit log, e.g. POST
+// /containers/restart/:id is "containers.restart" and DELETE /apikeys/:id is
+// "apikeys.delete".
+func auditAction(method, route string) string {
+	var parts []string
+	for _, segment := range strings.Split(route, "/") {
+		if segment == "" || strings.HasPrefix(segment, ":") || segment == "*" {
+			continue
+		}
+		parts = append(parts, segment)
+	}
+
+	if len(parts) == 1 {
+		switch method {
+		case fiber.MethodPost:
+			parts = append(parts, "create")
+		case fiber.MethodPut, fiber.MethodPatch:
+			parts = append(parts, "update")
+		case fiber.MethodDelete:
+			parts = append(parts, "delete")
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// auditRoute is the path pattern of the route that handled the request, or
+// the raw path when a middleware such as authentication stopped the request
+// before it reached a route. The /v1 prefix is dropped so both API versions
+// are recorded under the same action.
+func auditRoute(c *fiber.Ctx) string {
+	route := c.Route().Path
+	if route == "/" {
+		route = c.Path()
+	}
+	return strings.TrimPrefix(route, "/v1")
+}
+
+func auditTarget(c *fiber.Ctx) string {
+	for _, param := range []string{"id", "username"} {
+		if value := c.Params(param); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// auditParams collects the query string and JSON body of a request with
+// secrets removed.
+func auditParams(c *fiber.Ctx) map[string]interface{} {
+	params := map[string]interface{}{}
+
+	c.Context().QueryArgs().VisitAll(func(key, value []byte) {
+		params[string(key)] = string(value)
+	})
+
+	if body := c.Body(); len(body) > 0 {
+		var fields map[string]interface{}
+		if err := json.Unmarshal(body, &fields); err == nil {
+			for k, v := range fields {
+				params[k] = v
+			}
+		}
+	}
+
+	redactSecrets(params)
+	return params
+}
+
+// redactSecrets replaces the values of fields named like redactedParams,
+// in nested objects and arrays too.
+func redactSecrets(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			if isSecretParam(k) {
+				v[k] = "[redacted]"
+			} else {
+				v[k] = redactSecrets(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactSecrets(value)
+		}
+	}
+	return v
+}
+
+func isSecretParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, redacted := range redactedParams {
+		if strings.Contains(name, redacted) {
+			return true
+		}
+	}
+	return false
+}
+
+func responseError(c *fiber.Ctx, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+
+	var body apierror.Response
+	json.Unmarshal(c.Response().Body(), &body)
+	if body.Error == nil {
+		return ""
+	}
+	return body.Error.Message
+}
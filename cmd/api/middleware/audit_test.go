@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestAuditRecordsHeldRequestsAsPending(t *testing.T) {
+	t.Setenv("CONFIG_PATH", t.TempDir())
+	db, err := database.NewDatabaseConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	app := fiber.New()
+	app.Use(Audit(db))
+	app.Post("/containers/stop/:id", func(c *fiber.Ctx) error {
+		return HoldForApproval(c, db, &database.Approval{
+			Action:    "containers.stop",
+			Target:    c.Params("id"),
+			Reason:    "container is protected",
+			ExpiresAt: time.Now().Add(time.Hour),
+		})
+	})
+
+	resp, err := app.Test(httptest.NewRequest("POST", "/containers/stop/abc123", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusAccepted {
+		t.Fatalf("status = %d, want 202", resp.StatusCode)
+	}
+
+	events, err := db.ListAuditEvents(database.AuditFilter{Action: "containers.stop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	if events[0].Result != database.AuditResultPendingApproval {
+		t.Errorf("result = %q, want %q", events[0].Result, database.AuditResultPendingApproval)
+	}
+	if events[0].Params["approval_id"] == nil {
+		t.Errorf("params = %v, want the approval ID", events[0].Params)
+	}
+}
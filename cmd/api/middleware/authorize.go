@@ -0,0 +1,79 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/auth"
+	"github.com/Zeptile/docktrine/internal/docker"
+	"github.com/docker/docker/errdefs"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Authorize checks that the principal has every scope and may act
+// on the servers and the container the route targets. The target server is
+// the :name route parameter on server routes and the server query parameter
+// everywhere else; the container is the :id route parameter.
+func Authorize(d *docker.DockerClient, scopes ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		principal := CurrentPrincipal(c)
+		if principal == nil {
+			return apierror.Send(c, apierror.Unauthorized("authentication required"))
+		}
+
+		required := scopes
+		if c.Query("pull_latest") == "true" {
+			required = append(append([]string{}, scopes...), auth.ScopeImagesWrite)
+		}
+		for _, scope := range required {
+			if !auth.HasScope(principal, scope) {
+				return apierror.Send(c, apierror.Forbidden(fmt.Sprintf("missing the %s scope", scope)))
+			}
+		}
+
+		if principal.IsAdmin {
+			return c.Next()
+		}
+
+		containerID := c.Params("id")
+		checkContainer := containerID != "" && auth.RestrictsContainers(principal)
+		if len(principal.AllowedServers) == 0 && !checkContainer {
+			return c.Next()
+		}
+
+		target := c.Params("name")
+		if target == "" {
+			target = c.Query("server", "")
+		}
+
+		servers, err := d.ResolveServers(target)
+		if err != nil {
+			// The principal is restricted, so a target that cannot be
+			// checked is refused rather than left to the handler.
+			return apierror.Send(c, err)
+		}
+
+		for _, server := range servers {
+			if !auth.AllowsServer(principal, server) {
+				return apierror.Send(c, apierror.Forbidden(fmt.Sprintf("not allowed to access server %s", server.Name)))
+			}
+
+			if !checkContainer {
+				continue
+			}
+
+			labels, err := d.ContainerLabels(containerID, server.Name)
+			if errdefs.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return apierror.Send(c, apierror.Forbidden(fmt.Sprintf("cannot verify access to container %s on %s: %v", containerID, server.Name, err)))
+			}
+			if !auth.AllowsContainer(principal, labels) {
+				return apierror.Send(c, apierror.Forbidden(fmt.Sprintf("not allowed to access container %s on %s", containerID, server.Name)))
+			}
+		}
+
+		return c.Next()
+	}
+}
@@ -0,0 +1,18 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Deprecation marks responses from the unversioned API paths as deprecated
+// and points at their successor under prefix, e.g. /containers at
+// /v1/containers. It is only mounted on the unversioned routes.
+func Deprecation(prefix string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		c.Set("Deprecation", "true")
+		c.Set("Link", "<"+prefix+strings.TrimSuffix(c.Path(), "/")+`>; rel="successor-version"`)
+		return c.Next()
+	}
+}
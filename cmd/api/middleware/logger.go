@@ -1,30 +1,134 @@
 package middleware
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"net"
+	"regexp"
+	"strings"
 	"time"
 
+	"github.com/Zeptile/docktrine/internal/apierror"
 	"github.com/Zeptile/docktrine/internal/logger"
 	"github.com/gofiber/fiber/v2"
 )
 
+// RequestIDLocal is the fiber.Ctx Locals key holding the request ID.
+const RequestIDLocal = "request_id"
+
+// RealIP returns the client address. When the request came from one of the
+// TRUSTED_PROXIES, it is the rightmost address in the proxy header that is
+// not itself a trusted proxy: proxies append the address they received the
+// request from, so entries left of it were sent by the client and cannot be
+// trusted. Otherwise it is the peer address.
+func RealIP(c *fiber.Ctx) string {
+	peer := c.Context().RemoteIP().String()
+	config := c.App().Config()
+	if !config.EnableTrustedProxyCheck || config.ProxyHeader == "" || !c.IsProxyTrusted() {
+		return peer
+	}
+
+	ip := peer
+	entries := strings.Split(c.Get(config.ProxyHeader), ",")
+	for i := len(entries) - 1; i >= 0; i-- {
+		addr := net.ParseIP(strings.TrimSpace(entries[i]))
+		if addr == nil {
+			// Nothing left of a malformed entry can be trusted.
+			break
+		}
+		ip = addr.String()
+		if !trustedProxy(config.TrustedProxies, addr) {
+			break
+		}
+	}
+	return ip
+}
+
+func trustedProxy(proxies []string, addr net.IP) bool {
+	for _, proxy := range proxies {
+		if ip := net.ParseIP(proxy); ip != nil {
+			if ip.Equal(addr) {
+				return true
+			}
+			continue
+		}
+		if _, network, err := net.ParseCIDR(proxy); err == nil && network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestID tags every request with an ID, returned in the X-Request-ID
+// header and in error bodies so a failure can be found in the log. A
+// well-formed X-Request-ID sent by the client, e.g. from a proxy, is kept.
+func RequestID() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		id := c.Get(apierror.RequestIDHeader)
+		if !validRequestID(id) {
+			buf := make([]byte, 8)
+			rand.Read(buf)
+			id = hex.EncodeToString(buf)
+		}
+
+		c.Locals(RequestIDLocal, id)
+		c.Set(apierror.RequestIDHeader, id)
+		return c.Next()
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// CurrentRequestID returns the ID RequestID gave the request.
+func CurrentRequestID(c *fiber.Ctx) string {
+	id, _ := c.Locals(RequestIDLocal).(string)
+	return id
+}
+
+// hookPath matches the paths of registry hooks, whose last segment is the
+// hook's secret token.
+var hookPath = regexp.MustCompile(`^((?:/v1)?/hooks/registry/)[^/]+`)
+
+// loggedBody returns a request body fit for the log: JSON with the same
+// fields redacted as in the audit log. Other bodies, e.g. forms, could hold
+// secrets the log cannot pick out, so only their size is logged.
+func loggedBody(body []byte) string {
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return fmt.Sprintf("[%d bytes, not JSON]", len(body))
+	}
+	redacted, err := json.Marshal(redactSecrets(value))
+	if err != nil {
+		return fmt.Sprintf("[%d bytes]", len(body))
+	}
+	return string(redacted)
+}
+
 func RequestLogger() fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		start := time.Now()
-		path := c.Path()
+		path := hookPath.ReplaceAllString(c.Path(), "${1}[redacted]")
 		method := c.Method()
 
-		ip := c.IP()
-
-		// X-REAL-IP > X-FORWARDED-FOR > IP
-		// - GBF 2024-12-03
-		realIP := c.Get("X-Real-IP", c.Get("X-Forwarded-For", ip))
+		realIP := RealIP(c)
+		requestID := CurrentRequestID(c)
 
-		logger.Info(fmt.Sprintf("--> %s %s [IP: %s]", method, path, realIP))
+		logger.Info(fmt.Sprintf("--> %s %s [IP: %s] [ID: %s]", method, path, realIP, requestID))
 
-		body := string(c.Body())
-		if len(body) > 0 {
-			logger.Debug(fmt.Sprintf("Request Body: %s", body))
+		if body := c.Body(); len(body) > 0 {
+			logger.Debug(fmt.Sprintf("Request Body: %s", loggedBody(body)))
 		}
 
 		err := c.Next()
@@ -34,9 +138,9 @@ func RequestLogger() fiber.Handler {
 		status := c.Response().StatusCode()
 
 		if err != nil {
-			logger.Error(err, fmt.Sprintf("<-- %s %s %d %v [IP: %s]", method, path, status, duration, realIP))
+			logger.Error(err, fmt.Sprintf("<-- %s %s %d %v [IP: %s] [ID: %s]", method, path, status, duration, realIP, requestID))
 		} else {
-			logger.Info(fmt.Sprintf("<-- %s %s %d %v [IP: %s]", method, path, status, duration, realIP))
+			logger.Info(fmt.Sprintf("<-- %s %s %d %v [IP: %s] [ID: %s]", method, path, status, duration, realIP, requestID))
 		}
 
 		return err
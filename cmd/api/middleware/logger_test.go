@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// newIPApp answers with RealIP, behind the given trusted proxies. Requests
+// made with app.Test come from 0.0.0.0.
+func newIPApp(proxies ...string) *fiber.App {
+	config := fiber.Config{}
+	if len(proxies) > 0 {
+		config.TrustedProxies = proxies
+		config.EnableTrustedProxyCheck = true
+		config.EnableIPValidation = true
+		config.ProxyHeader = fiber.HeaderXForwardedFor
+	}
+	app := fiber.New(config)
+	app.Get("/", func(c *fiber.Ctx) error {
+		return c.SendString(RealIP(c))
+	})
+	return app
+}
+
+func realIP(t *testing.T, app *fiber.App, forwardedFor string) string {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/", nil)
+	if forwardedFor != "" {
+		req.Header.Set(fiber.HeaderXForwardedFor, forwardedFor)
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestRealIP(t *testing.T) {
+	tests := []struct {
+		name         string
+		proxies      []string
+		forwardedFor string
+		want         string
+	}{
+		{"no proxies configured", nil, "203.0.113.5", "0.0.0.0"},
+		{"untrusted peer", []string{"192.0.2.1"}, "203.0.113.5", "0.0.0.0"},
+		{"no header", []string{"0.0.0.0"}, "", "0.0.0.0"},
+		{"single proxy", []string{"0.0.0.0"}, "203.0.113.5", "203.0.113.5"},
+		{"spoofed leading entry", []string{"0.0.0.0"}, "10.0.0.1, 203.0.113.5", "203.0.113.5"},
+		{"proxy chain", []string{"0.0.0.0", "172.18.0.0/16"}, "10.0.0.1, 203.0.113.5, 172.18.0.3", "203.0.113.5"},
+		{"spoofed trusted entry", []string{"0.0.0.0", "172.18.0.0/16"}, "172.18.0.9, 203.0.113.5", "203.0.113.5"},
+		{"malformed entry", []string{"0.0.0.0", "172.18.0.0/16"}, "10.0.0.1, bogus, 172.18.0.3", "172.18.0.3"},
+		{"only trusted entries", []string{"0.0.0.0", "172.18.0.0/16"}, "172.18.0.9, 172.18.0.3", "172.18.0.9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := realIP(t, newIPApp(tt.proxies...), tt.forwardedFor); got != tt.want {
+				t.Errorf("RealIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowedCIDRsIgnoreSpoofedAddress(t *testing.T) {
+	app := newIPApp("0.0.0.0")
+	app.Get("/key", func(c *fiber.Ctx) error {
+		if !ipAllowed([]string{"10.0.0.0/8"}, RealIP(c)) {
+			return c.SendStatus(fiber.StatusForbidden)
+		}
+		return c.SendStatus(fiber.StatusOK)
+	})
+
+	for forwardedFor, want := range map[string]int{
+		"10.0.0.1, 203.0.113.5": fiber.StatusForbidden,
+		"10.0.0.1":              fiber.StatusOK,
+		"203.0.113.5, 10.0.0.1": fiber.StatusOK,
+	} {
+		req := httptest.NewRequest("GET", "/key", nil)
+		req.Header.Set(fiber.HeaderXForwardedFor, forwardedFor)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != want {
+			t.Errorf("X-Forwarded-For %q: status %d, want %d", forwardedFor, resp.StatusCode, want)
+		}
+	}
+}
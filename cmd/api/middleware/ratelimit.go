@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/docker"
+	"github.com/Zeptile/docktrine/internal/ratelimit"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Route classes with separate rate limits.
+const (
+	RouteClassReads  = "reads"
+	RouteClassWrites = "writes"
+	RouteClassPulls  = "pulls"
+)
+
+type RateLimits struct {
+	Reads  *ratelimit.Limiter
+	Writes *ratelimit.Limiter
+	Pulls  *ratelimit.Limiter
+	// Servers caps concurrent mutating operations on each Docker server.
+	Servers *ratelimit.Slots
+}
+
+type RateLimitStats struct {
+	Classes map[string]ratelimit.LimiterStats `json:"classes"`
+	Servers ratelimit.SlotsStats              `json:"servers"`
+}
+
+func (l *RateLimits) Stats() RateLimitStats {
+	return RateLimitStats{
+		Classes: map[string]ratelimit.LimiterStats{
+			RouteClassReads:  l.Reads.Stats(),
+			RouteClassWrites: l.Writes.Stats(),
+			RouteClassPulls:  l.Pulls.Stats(),
+		},
+		Servers: l.Servers.Stats(),
+	}
+}
+
+// routeClass puts reads, image pulls and other mutations in separate
+// buckets so a client polling container lists cannot starve its own
+// restarts, and pulls, the most expensive call, are limited hardest.
+func routeClass(c *fiber.Ctx) string {
+	switch {
+	case c.Query("pull_latest") == "true":
+		return RouteClassPulls
+	case c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead:
+		return RouteClassReads
+	default:
+		return RouteClassWrites
+	}
+}
+
+// rateLimitKey identifies the client: its API key or user, or its IP for
+// unauthenticated requests.
+func rateLimitKey(c *fiber.Ctx) string {
+	if principal := CurrentPrincipal(c); principal != nil {
+		return fmt.Sprintf("%s:%d", principal.Type, principal.ID)
+	}
+	return "ip:" + RealIP(c)
+}
+
+// RateLimit applies the token bucket of the request's route class. It must
+// run after authentication so requests are keyed by principal.
+func RateLimit(limits *RateLimits) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		class := routeClass(c)
+
+		var limiter *ratelimit.Limiter
+		switch class {
+		case RouteClassReads:
+			limiter = limits.Reads
+		case RouteClassPulls:
+			limiter = limits.Pulls
+		default:
+			limiter = limits.Writes
+		}
+
+		ok, remaining, retryAfter := limiter.Allow(rateLimitKey(c))
+		if rate := limiter.Rate(); rate.Enabled() {
+			c.Set("X-RateLimit-Limit", rate.String())
+			c.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		}
+		if !ok {
+			return tooManyRequests(c, retryAfter.Seconds(),
+				fmt.Sprintf("rate limit for %s exceeded", class))
+		}
+
+		return c.Next()
+	}
+}
+
+// LimitServerConcurrency rejects a mutating request when any server it
+// targets already has the maximum number of operations running. Requests
+// queued as jobs are let through; the job runner waits for a free slot.
+func LimitServerConcurrency(limits *RateLimits, d *docker.DockerClient) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if WantsAsync(c) {
+			return c.Next()
+		}
+
+		servers, err := d.ResolveServers(c.Query("server", ""))
+		if err != nil {
+			// Let the handler report unknown servers and bad selectors.
+			return c.Next()
+		}
+
+		names := make([]string, len(servers))
+		for i, server := range servers {
+			names[i] = server.Name
+		}
+
+		if !limits.Servers.Acquire(names) {
+			return tooManyRequests(c, 1, "too many operations already running on the target server")
+		}
+		defer limits.Servers.Release(names)
+
+		return c.Next()
+	}
+}
+
+func tooManyRequests(c *fiber.Ctx, retryAfterSeconds float64, message string) error {
+	retryAfter := int(math.Max(1, math.Ceil(retryAfterSeconds)))
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+	return apierror.Send(c, apierror.New(fiber.StatusTooManyRequests, apierror.CodeRateLimited, message).
+		WithDetail("retry_after_seconds", retryAfter))
+}
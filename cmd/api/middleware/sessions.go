@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/apierror"
+	"github.com/Zeptile/docktrine/internal/auth"
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/Zeptile/docktrine/internal/oidc"
+	"github.com/gofiber/fiber/v2"
+)
+
+// SessionLocal is the fiber.Ctx Locals key holding the *database.Session of
+// requests authenticated with a session token.
+const SessionLocal = "session"
+
+// Authenticate accepts either a user session token in the Authorization
+// header ("Bearer <token>") or an API key in X-API-Key. When provider is
+// set, bearer tokens that are JWTs are validated against the OIDC
+// provider's signing keys instead. Requests without an Authorization header
+// go to APIKeyAuth.
+func Authenticate(db *database.DB, provider *oidc.Provider, signingWindow time.Duration) fiber.Handler {
+	apiKeyAuth := APIKeyAuth(db, signingWindow)
+
+	return func(c *fiber.Ctx) error {
+		header := c.Get("Authorization")
+		if header == "" {
+			return apiKeyAuth(c)
+		}
+
+		token, ok := strings.CutPrefix(header, "Bearer ")
+		if !ok || token == "" {
+			return apierror.Send(c, apierror.Unauthorized("Authorization header must be a bearer token"))
+		}
+
+		if provider != nil && oidc.LooksLikeJWT(token) {
+			return authenticateJWT(c, db, provider, token)
+		}
+
+		session, user, err := db.GetSessionUser(token)
+		if err != nil || user == nil {
+			return apierror.Send(c, apierror.Unauthorized("Invalid or expired session"))
+		}
+
+		c.Locals(SessionLocal, session)
+		c.Locals(PrincipalLocal, auth.FromUser(user))
+		return c.Next()
+	}
+}
+
+func authenticateJWT(c *fiber.Ctx, db *database.DB, provider *oidc.Provider, token string) error {
+	claims, err := provider.VerifyAccessToken(token)
+	if err != nil {
+		logger.Debug("Rejected OIDC bearer token: " + err.Error())
+		return apierror.Send(c, apierror.Unauthorized("Invalid bearer token"))
+	}
+
+	role := provider.Config().RoleForGroups(claims.Groups)
+	if role == "" {
+		return apierror.Send(c, apierror.Forbidden("None of your groups grant access to Docktrine"))
+	}
+
+	// Bearer tokens come with every request, so the user is only written
+	// when it is new or its claims changed since it was last recorded.
+	user, err := db.GetUserBySubject(claims.Subject)
+	if err != nil {
+		logger.Error(err, "Failed to look up SSO user")
+		return apierror.Send(c, err)
+	}
+	if user == nil || user.Username != claims.Username() || user.Role != role {
+		user, err = db.UpsertSSOUser(claims.Subject, claims.Username(), role)
+		if err != nil {
+			logger.Error(err, "Failed to record SSO user")
+			return apierror.Send(c, apierror.Forbidden(err.Error()))
+		}
+	}
+
+	c.Locals(PrincipalLocal, auth.FromUser(user))
+	return c.Next()
+}
+
+// CurrentSession returns the session the request was authenticated with,
+// or nil for API key requests.
+func CurrentSession(c *fiber.Ctx) *database.Session {
+	session, _ := c.Locals(SessionLocal).(*database.Session)
+	return session
+}
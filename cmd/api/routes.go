@@ -0,0 +1,129 @@
+package main
+
+import (
+	"github.com/Zeptile/docktrine/cmd/api/handlers"
+	"github.com/Zeptile/docktrine/cmd/api/middleware"
+	"github.com/Zeptile/docktrine/internal/auth"
+	"github.com/Zeptile/docktrine/internal/docker"
+	"github.com/gofiber/fiber/v2"
+)
+
+// registerLegacyRoutes mounts the routes that predate /v1 on their
+// unversioned paths, with the response shapes they had then and a
+// deprecation header. Routes added since are only served under /v1.
+func registerLegacyRoutes(app *fiber.App, handler *handlers.Handler, dockerClient *docker.DockerClient, limits *middleware.RateLimits, requireApproval fiber.Handler) {
+	deprecated := middleware.Deprecation("/v1")
+
+	containers := app.Group("/containers", deprecated)
+	containers.Get("/", middleware.Authorize(dockerClient, auth.ScopeContainersRead), handler.LegacyListContainers)
+	containers.Post("/start/:id", middleware.Authorize(dockerClient, auth.ScopeContainersStart), middleware.LimitServerConcurrency(limits, dockerClient), handler.StartContainer)
+	containers.Post("/stop/:id", middleware.Authorize(dockerClient, auth.ScopeContainersStop), requireApproval, middleware.LimitServerConcurrency(limits, dockerClient), handler.StopContainer)
+	containers.Get("/:id", middleware.Authorize(dockerClient, auth.ScopeContainersRead), handler.LegacyGetContainer)
+	containers.Post("/restart/:id", middleware.Authorize(dockerClient, auth.ScopeContainersRestart), requireApproval, middleware.LimitServerConcurrency(limits, dockerClient), handler.RestartContainer)
+
+	servers := app.Group("/servers", deprecated)
+	servers.Get("/", middleware.Authorize(dockerClient, auth.ScopeServersRead), handler.LegacyListServers)
+	servers.Get("/:name", middleware.Authorize(dockerClient, auth.ScopeServersRead), handler.LegacyGetServer)
+	servers.Post("/", middleware.Authorize(dockerClient, auth.ScopeServersAdmin), handler.LegacyCreateServer)
+	servers.Delete("/:name", middleware.Authorize(dockerClient, auth.ScopeServersAdmin), requireApproval, handler.DeleteServer)
+}
+
+// registerRoutes mounts the API on router, the /v1 group.
+func registerRoutes(router fiber.Router, handler *handlers.Handler, dockerClient *docker.DockerClient, limits *middleware.RateLimits, requireApproval fiber.Handler) {
+	containers := router.Group("/containers")
+	containers.Get("/", middleware.Authorize(dockerClient, auth.ScopeContainersRead), handler.ListContainers)
+	containers.Post("/start/:id", middleware.Authorize(dockerClient, auth.ScopeContainersStart), middleware.LimitServerConcurrency(limits, dockerClient), handler.StartContainer)
+	containers.Post("/stop/:id", middleware.Authorize(dockerClient, auth.ScopeContainersStop), requireApproval, middleware.LimitServerConcurrency(limits, dockerClient), handler.StopContainer)
+	containers.Get("/:id", middleware.Authorize(dockerClient, auth.ScopeContainersRead), handler.GetContainer)
+	containers.Get("/:id/history", middleware.Authorize(dockerClient, auth.ScopeContainersRead), handler.GetContainerHistory)
+	containers.Post("/restart/:id", middleware.Authorize(dockerClient, auth.ScopeContainersRestart), requireApproval, middleware.LimitServerConcurrency(limits, dockerClient), handler.RestartContainer)
+
+	router.Get("/events", middleware.Authorize(dockerClient, auth.ScopeContainersRead), handler.StreamEvents)
+	router.Get("/alerts", middleware.Authorize(dockerClient, auth.ScopeContainersRead), handler.ListAlerts)
+
+	servers := router.Group("/servers")
+	servers.Get("/", middleware.Authorize(dockerClient, auth.ScopeServersRead), handler.ListServers)
+	servers.Get("/:name", middleware.Authorize(dockerClient, auth.ScopeServersRead), handler.GetServer)
+	servers.Get("/:name/history", middleware.Authorize(dockerClient, auth.ScopeContainersRead), handler.GetServerHistory)
+	servers.Post("/", middleware.Authorize(dockerClient, auth.ScopeServersAdmin), handler.CreateServer)
+	servers.Post("/import", middleware.Authorize(dockerClient, auth.ScopeServersAdmin), handler.ImportServers)
+	servers.Delete("/:name", middleware.Authorize(dockerClient, auth.ScopeServersAdmin), requireApproval, handler.DeleteServer)
+
+	approvals := router.Group("/approvals")
+	approvals.Get("/", handler.ListApprovals)
+	approvals.Get("/:id", handler.GetApproval)
+	approvals.Post("/:id/approve", handler.ApproveApproval)
+	approvals.Post("/:id/reject", handler.RejectApproval)
+
+	jobs := router.Group("/jobs")
+	jobs.Get("/", handler.ListJobs)
+	jobs.Get("/:id", handler.GetJob)
+	jobs.Get("/:id/logs", handler.GetJobLogs)
+	jobs.Post("/:id/cancel", handler.CancelJob)
+	jobs.Post("/:id/retry", handler.RetryJob)
+
+	apikeys := router.Group("/apikeys", middleware.RequireAdmin())
+	apikeys.Get("/", handler.ListAPIKeys)
+	apikeys.Post("/", handler.CreateAPIKey)
+	apikeys.Delete("/:id", handler.RevokeAPIKey)
+	apikeys.Post("/:id/rotate", handler.RotateAPIKey)
+	apikeys.Post("/:id/disable", handler.DisableAPIKey)
+	apikeys.Post("/:id/enable", handler.EnableAPIKey)
+
+	webhooks := router.Group("/webhooks", middleware.RequireAdmin())
+	webhooks.Get("/", handler.ListWebhooks)
+	webhooks.Post("/", handler.CreateWebhook)
+	webhooks.Get("/:id", handler.GetWebhook)
+	webhooks.Patch("/:id", handler.UpdateWebhook)
+	webhooks.Delete("/:id", handler.DeleteWebhook)
+	webhooks.Post("/:id/disable", handler.DisableWebhook)
+	webhooks.Post("/:id/enable", handler.EnableWebhook)
+	webhooks.Post("/:id/test", handler.TestWebhook)
+	webhooks.Get("/:id/deliveries", handler.ListWebhookDeliveries)
+	webhooks.Post("/:id/deliveries/:delivery/redeliver", handler.RedeliverWebhookDelivery)
+
+	emailChannels := router.Group("/email/channels", middleware.RequireAdmin())
+	emailChannels.Get("/", handler.ListEmailChannels)
+	emailChannels.Post("/", handler.CreateEmailChannel)
+	emailChannels.Get("/:id", handler.GetEmailChannel)
+	emailChannels.Patch("/:id", handler.UpdateEmailChannel)
+	emailChannels.Delete("/:id", handler.DeleteEmailChannel)
+	emailChannels.Post("/:id/disable", handler.DisableEmailChannel)
+	emailChannels.Post("/:id/enable", handler.EnableEmailChannel)
+	emailChannels.Post("/:id/test", handler.TestEmailChannel)
+
+	registryHooks := router.Group("/registry-hooks", middleware.RequireAdmin())
+	registryHooks.Get("/", handler.ListRegistryHooks)
+	registryHooks.Post("/", handler.CreateRegistryHook)
+	registryHooks.Get("/:id", handler.GetRegistryHook)
+	registryHooks.Patch("/:id", handler.UpdateRegistryHook)
+	registryHooks.Delete("/:id", handler.DeleteRegistryHook)
+	registryHooks.Post("/:id/disable", handler.DisableRegistryHook)
+	registryHooks.Post("/:id/enable", handler.EnableRegistryHook)
+	registryHooks.Post("/:id/rotate", handler.RotateRegistryHookToken)
+
+	// Authenticated by the token in the path rather than an API key.
+	router.Post("/hooks/registry/:token", handler.ReceiveRegistryPush)
+
+	router.Post("/setup", handler.Setup)
+
+	authGroup := router.Group("/auth")
+	authGroup.Post("/login", handler.Login)
+	authGroup.Post("/logout", handler.Logout)
+	authGroup.Get("/oidc/login", handler.OIDCLogin)
+	authGroup.Get("/oidc/callback", handler.OIDCCallback)
+	authGroup.Post("/oidc/device", handler.OIDCDeviceAuthorize)
+	authGroup.Post("/oidc/device/token", handler.OIDCDeviceToken)
+
+	users := router.Group("/users", middleware.RequireAdmin())
+	users.Get("/", handler.ListUsers)
+	users.Post("/", handler.CreateUser)
+	users.Put("/:username/password", handler.SetUserPassword)
+	users.Delete("/:username", handler.DeleteUser)
+
+	auditGroup := router.Group("/audit", middleware.RequireAdmin())
+	auditGroup.Get("/", handler.ListAuditEvents)
+	auditGroup.Get("/checkpoints", handler.ListAuditCheckpoints)
+
+	router.Get("/limits", middleware.RequireAdmin(), handler.GetRateLimits)
+}
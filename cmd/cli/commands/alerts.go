@@ -0,0 +1,109 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type AlertResponse struct {
+	ID            int64             `json:"id"`
+	Server        string            `json:"server"`
+	ContainerID   string            `json:"container_id"`
+	ContainerName string            `json:"container_name"`
+	Kind          string            `json:"kind"`
+	Severity      string            `json:"severity"`
+	Message       string            `json:"message"`
+	Count         int               `json:"count"`
+	Status        string            `json:"status"`
+	Labels        map[string]string `json:"labels"`
+	FirstSeen     time.Time         `json:"first_seen"`
+	LastSeen      time.Time         `json:"last_seen"`
+	ResolvedAt    *time.Time        `json:"resolved_at"`
+}
+
+func init() {
+	alertsCmd := &cobra.Command{
+		Use:   "alerts",
+		Short: "Show crash-looping, failing and OOM-killed containers",
+		Long: `Show the alerts raised for containers that restart too often, exit with a
+non-zero code repeatedly or are killed for running out of memory. Only
+active alerts are shown unless --status or --all is given. Alerts on all
+servers are shown unless --server is given.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			params := url.Values{}
+			status, _ := cmd.Flags().GetString("status")
+			if all, _ := cmd.Flags().GetBool("all"); all {
+				status = ""
+			}
+			if status != "" {
+				params.Add("status", status)
+			}
+			if server != "" {
+				params.Add("server", server)
+			}
+			if kind, _ := cmd.Flags().GetString("kind"); kind != "" {
+				params.Add("kind", kind)
+			}
+			if cmd.Flags().Changed("limit") {
+				limit, _ := cmd.Flags().GetInt("limit")
+				params.Add("limit", fmt.Sprint(limit))
+			}
+
+			uri := fmt.Sprintf("%s/v1/alerts", apiURL)
+			if len(params) > 0 {
+				uri += "?" + params.Encode()
+			}
+
+			resp, err := makeRequest("GET", uri, nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			var alerts []AlertResponse
+			if err := json.NewDecoder(resp.Body).Decode(&alerts); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			if len(alerts) == 0 {
+				fmt.Println("No alerts")
+				return
+			}
+
+			for _, a := range alerts {
+				id := a.ContainerID
+				if len(id) > 12 {
+					id = id[:12]
+				}
+
+				fmt.Printf("%d  [%s] %s  %s (%s) on %s\n", a.ID, a.Severity, a.Kind, a.ContainerName, id, a.Server)
+				fmt.Printf("    %s\n", a.Message)
+				seen := fmt.Sprintf("    First seen %s, last seen %s", a.FirstSeen.Local().Format(time.RFC3339), a.LastSeen.Local().Format(time.RFC3339))
+				if a.Count > 1 {
+					seen += fmt.Sprintf(" (%d times)", a.Count)
+				}
+				fmt.Println(seen)
+				if a.ResolvedAt != nil {
+					fmt.Printf("    Resolved %s\n", a.ResolvedAt.Local().Format(time.RFC3339))
+				}
+			}
+		},
+	}
+	alertsCmd.Flags().String("status", "active", "Only alerts with this status (active, resolved)")
+	alertsCmd.Flags().Bool("all", false, "Show active and resolved alerts")
+	alertsCmd.Flags().String("kind", "", "Only alerts of this kind (crash_loop, failing, oom_killed)")
+	alertsCmd.Flags().Int("limit", 100, "Maximum number of alerts")
+
+	rootCmd.AddCommand(alertsCmd)
+}
@@ -0,0 +1,263 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type APIKeyResponse struct {
+	ID              int64             `json:"id"`
+	Key             string            `json:"key"`
+	Prefix          string            `json:"prefix"`
+	Description     string            `json:"description"`
+	IsAdmin         bool              `json:"is_admin"`
+	Scopes          []string          `json:"scopes"`
+	AllowedServers  []string          `json:"allowed_servers"`
+	ContainerLabels map[string]string `json:"container_labels"`
+	ExpiresAt       *time.Time        `json:"expires_at"`
+	AllowedCIDRs    []string          `json:"allowed_cidrs"`
+	Disabled        bool              `json:"disabled"`
+	DisabledReason  string            `json:"disabled_reason"`
+	CreatedAt       time.Time         `json:"created_at"`
+	LastUsedAt      *time.Time        `json:"last_used_at"`
+}
+
+func printAPIKeyPermissions(key APIKeyResponse) {
+	if len(key.Scopes) > 0 {
+		fmt.Printf("Scopes: %s\n", strings.Join(key.Scopes, ", "))
+	}
+	if len(key.AllowedServers) > 0 {
+		fmt.Printf("Servers: %s\n", strings.Join(key.AllowedServers, ", "))
+	}
+	if len(key.ContainerLabels) > 0 {
+		keys := make([]string, 0, len(key.ContainerLabels))
+		for k := range key.ContainerLabels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, 0, len(keys))
+		for _, k := range keys {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", k, key.ContainerLabels[k]))
+		}
+		fmt.Printf("Container labels: %s\n", strings.Join(pairs, ", "))
+	}
+	if len(key.AllowedCIDRs) > 0 {
+		fmt.Printf("Allowed IPs: %s\n", strings.Join(key.AllowedCIDRs, ", "))
+	}
+	if key.ExpiresAt != nil {
+		fmt.Printf("Expires: %s\n", key.ExpiresAt.Format(time.RFC3339))
+	}
+	if key.Disabled {
+		fmt.Printf("Disabled: %s\n", key.DisabledReason)
+	}
+}
+
+func setAPIKeyDisabledCmd(use, short, action, done string) *cobra.Command {
+	return &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			resp, err := makeRequest("POST", fmt.Sprintf("%s/v1/apikeys/%s/%s", apiURL, args[0], action), nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			fmt.Printf("API key %s %s\n", args[0], done)
+		},
+	}
+}
+
+func printNewAPIKey(key APIKeyResponse) {
+	fmt.Printf("ID: %d\nDescription: %s\nAdmin: %v\nKey: %s\n",
+		key.ID,
+		key.Description,
+		key.IsAdmin,
+		key.Key)
+	printAPIKeyPermissions(key)
+	fmt.Println("Store this key now, it will not be shown again.")
+}
+
+func init() {
+	apikeysCmd := &cobra.Command{
+		Use:   "apikeys",
+		Short: "Manage API keys (requires an admin key)",
+	}
+
+	listAPIKeysCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List API keys",
+		Run: func(cmd *cobra.Command, args []string) {
+			resp, err := makeRequest("GET", fmt.Sprintf("%s/v1/apikeys", apiURL), nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			var keys []APIKeyResponse
+			if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			for _, key := range keys {
+				lastUsed := "never"
+				if key.LastUsedAt != nil {
+					lastUsed = key.LastUsedAt.Format(time.RFC3339)
+				}
+				fmt.Printf("ID: %d\nPrefix: %s\nDescription: %s\nAdmin: %v\nCreated: %s\nLast used: %s\n",
+					key.ID,
+					key.Prefix,
+					key.Description,
+					key.IsAdmin,
+					key.CreatedAt.Format(time.RFC3339),
+					lastUsed)
+				printAPIKeyPermissions(key)
+				fmt.Println()
+			}
+		},
+	}
+
+	createAPIKeyCmd := &cobra.Command{
+		Use:   "create",
+		Short: "Create an API key",
+		Run: func(cmd *cobra.Command, args []string) {
+			desc, _ := cmd.Flags().GetString("description")
+			isAdmin, _ := cmd.Flags().GetBool("admin")
+			scopes, _ := cmd.Flags().GetStringSlice("scope")
+			allowedServers, _ := cmd.Flags().GetStringArray("allow-server")
+			labelArgs, _ := cmd.Flags().GetStringSlice("container-label")
+			allowedCIDRs, _ := cmd.Flags().GetStringSlice("allow-cidr")
+			expiresIn, _ := cmd.Flags().GetDuration("expires-in")
+
+			containerLabels := map[string]string{}
+			for _, l := range labelArgs {
+				key, value, _ := strings.Cut(l, "=")
+				if key == "" {
+					fmt.Printf("Error: invalid container label %q, expected key or key=value\n", l)
+					return
+				}
+				containerLabels[key] = value
+			}
+
+			keyData := map[string]interface{}{
+				"description":      desc,
+				"is_admin":         isAdmin,
+				"scopes":           scopes,
+				"allowed_servers":  allowedServers,
+				"container_labels": containerLabels,
+				"allowed_cidrs":    allowedCIDRs,
+			}
+			if expiresIn > 0 {
+				keyData["expires_at"] = time.Now().Add(expiresIn).UTC().Format(time.RFC3339)
+			}
+
+			jsonData, err := json.Marshal(keyData)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			resp, err := makeRequest("POST", fmt.Sprintf("%s/v1/apikeys", apiURL), bytes.NewBuffer(jsonData))
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			var key APIKeyResponse
+			if err := json.NewDecoder(resp.Body).Decode(&key); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			printNewAPIKey(key)
+		},
+	}
+
+	revokeAPIKeyCmd := &cobra.Command{
+		Use:   "revoke [id]",
+		Short: "Revoke an API key",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			resp, err := makeRequest("DELETE", fmt.Sprintf("%s/v1/apikeys/%s", apiURL, args[0]), nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			fmt.Printf("API key %s revoked\n", args[0])
+		},
+	}
+
+	rotateAPIKeyCmd := &cobra.Command{
+		Use:   "rotate [id]",
+		Short: "Replace the secret of an API key",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			resp, err := makeRequest("POST", fmt.Sprintf("%s/v1/apikeys/%s/rotate", apiURL, args[0]), nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			var key APIKeyResponse
+			if err := json.NewDecoder(resp.Body).Decode(&key); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			printNewAPIKey(key)
+		},
+	}
+
+	createAPIKeyCmd.Flags().String("description", "", "What the key is used for")
+	createAPIKeyCmd.Flags().Bool("admin", false, "Grant every scope, including API key management")
+	createAPIKeyCmd.Flags().StringSlice("scope", nil, "Scope to grant, e.g. containers:read, containers:restart (repeatable)")
+	createAPIKeyCmd.Flags().StringArray("allow-server", nil, "Only allow servers matching this name or selector (repeatable)")
+	createAPIKeyCmd.Flags().StringSlice("container-label", nil, "Only allow containers with this label, as key or key=value (repeatable)")
+	createAPIKeyCmd.Flags().StringSlice("allow-cidr", nil, "Only allow requests from this CIDR range (repeatable)")
+	createAPIKeyCmd.Flags().Duration("expires-in", 0, "Expire the key after this duration, e.g. 720h")
+	createAPIKeyCmd.MarkFlagRequired("description")
+
+	disableAPIKeyCmd := setAPIKeyDisabledCmd("disable [id]", "Disable an API key", "disable", "disabled")
+	enableAPIKeyCmd := setAPIKeyDisabledCmd("enable [id]", "Re-enable a disabled API key", "enable", "enabled")
+
+	apikeysCmd.AddCommand(listAPIKeysCmd, createAPIKeyCmd, revokeAPIKeyCmd, rotateAPIKeyCmd,
+		disableAPIKeyCmd, enableAPIKeyCmd)
+	rootCmd.AddCommand(apikeysCmd)
+}
@@ -0,0 +1,155 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type ApprovalResponse struct {
+	ID            int64             `json:"id"`
+	Action        string            `json:"action"`
+	Server        string            `json:"server"`
+	Target        string            `json:"target"`
+	Params        map[string]string `json:"params"`
+	Reason        string            `json:"reason"`
+	Status        string            `json:"status"`
+	RequesterType string            `json:"requester_type"`
+	RequesterID   int64             `json:"requester_id"`
+	RequesterName string            `json:"requester_name"`
+	DeciderType   string            `json:"decider_type"`
+	DeciderID     int64             `json:"decider_id"`
+	DeciderName   string            `json:"decider_name"`
+	Result        string            `json:"result"`
+	CreatedAt     time.Time         `json:"created_at"`
+	ExpiresAt     time.Time         `json:"expires_at"`
+	DecidedAt     *time.Time        `json:"decided_at"`
+}
+
+func decideApproval(id string, decision string) {
+	resp, err := makeRequest("POST", fmt.Sprintf("%s/v1/approvals/%s/%s", apiURL, url.PathEscape(id), decision), nil)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := handleError(resp); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	var body struct {
+		Message string       `json:"message"`
+		Job     *JobResponse `json:"job"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Println(body.Message)
+	if body.Job != nil {
+		fmt.Printf("Follow it with:\n  docktrine jobs watch %d\n", body.Job.ID)
+	}
+}
+
+func init() {
+	approvalsCmd := &cobra.Command{
+		Use:   "approvals",
+		Short: "Review operations on protected containers and servers",
+	}
+
+	listApprovalsCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List approvals",
+		Run: func(cmd *cobra.Command, args []string) {
+			uri := fmt.Sprintf("%s/v1/approvals", apiURL)
+			if status, _ := cmd.Flags().GetString("status"); status != "" {
+				uri += "?status=" + url.QueryEscape(status)
+			}
+
+			resp, err := makeRequest("GET", uri, nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			var approvals []ApprovalResponse
+			if err := json.NewDecoder(resp.Body).Decode(&approvals); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			if len(approvals) == 0 {
+				fmt.Println("No approvals")
+				return
+			}
+
+			for _, a := range approvals {
+				target := a.Target
+				if a.Server != "" && a.Server != a.Target {
+					target = fmt.Sprintf("%s@%s", a.Target, a.Server)
+				}
+				fmt.Printf("%d  %-8s  %-20s  %s\n", a.ID, a.Status, a.Action, target)
+				if len(a.Params) > 0 {
+					keys := make([]string, 0, len(a.Params))
+					for k := range a.Params {
+						keys = append(keys, k)
+					}
+					sort.Strings(keys)
+					pairs := make([]string, 0, len(keys))
+					for _, k := range keys {
+						pairs = append(pairs, fmt.Sprintf("%s=%s", k, a.Params[k]))
+					}
+					fmt.Printf("    params: %s\n", strings.Join(pairs, ", "))
+				}
+				fmt.Printf("    reason: %s\n", a.Reason)
+				fmt.Printf("    requested by %s:%d (%s) at %s\n", a.RequesterType, a.RequesterID, a.RequesterName,
+					a.CreatedAt.Local().Format(time.RFC3339))
+				if a.DecidedAt != nil {
+					fmt.Printf("    decided by %s:%d (%s) at %s\n", a.DeciderType, a.DeciderID, a.DeciderName,
+						a.DecidedAt.Local().Format(time.RFC3339))
+				} else if a.Status == "pending" {
+					fmt.Printf("    expires at %s\n", a.ExpiresAt.Local().Format(time.RFC3339))
+				}
+				if a.Result != "" && a.Result != "ok" {
+					fmt.Printf("    result: %s\n", a.Result)
+				}
+			}
+		},
+	}
+
+	listApprovalsCmd.Flags().String("status", "", "Only show approvals with this status (pending, approved, executed, failed, rejected or expired)")
+
+	approveCmd := &cobra.Command{
+		Use:   "approve [id]",
+		Short: "Approve and run a pending operation",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			decideApproval(args[0], "approve")
+		},
+	}
+
+	rejectCmd := &cobra.Command{
+		Use:   "reject [id]",
+		Short: "Reject a pending operation",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			decideApproval(args[0], "reject")
+		},
+	}
+
+	approvalsCmd.AddCommand(listApprovalsCmd, approveCmd, rejectCmd)
+	rootCmd.AddCommand(approvalsCmd)
+}
@@ -0,0 +1,226 @@
+package commands
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/audit"
+	"github.com/spf13/cobra"
+)
+
+type AuditEventResponse struct {
+	ID         int64                  `json:"id"`
+	Timestamp  time.Time              `json:"timestamp"`
+	ActorType  string                 `json:"actor_type"`
+	ActorID    int64                  `json:"actor_id"`
+	ActorName  string                 `json:"actor_name"`
+	SourceIP   string                 `json:"source_ip"`
+	Action     string                 `json:"action"`
+	Server     string                 `json:"server"`
+	Target     string                 `json:"target"`
+	Params     map[string]interface{} `json:"params"`
+	Status     int                    `json:"status"`
+	Result     string                 `json:"result"`
+	Error      string                 `json:"error"`
+	DurationMS int64                  `json:"duration_ms"`
+}
+
+func fetchAuditCheckpoints() ([]audit.Checkpoint, string, error) {
+	resp, err := makeRequest("GET", fmt.Sprintf("%s/v1/audit/checkpoints", apiURL), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if err := handleError(resp); err != nil {
+		return nil, "", err
+	}
+
+	var body struct {
+		PublicKey   string             `json:"public_key"`
+		Checkpoints []audit.Checkpoint `json:"checkpoints"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, "", err
+	}
+	return body.Checkpoints, body.PublicKey, nil
+}
+
+// fetchAuditRecords downloads every audit event in order.
+func fetchAuditRecords() ([]audit.Record, error) {
+	resp, err := makeRequest("GET", fmt.Sprintf("%s/v1/audit?format=jsonl&limit=0", apiURL), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := handleError(resp); err != nil {
+		return nil, err
+	}
+
+	var records []audit.Record
+	decoder := json.NewDecoder(resp.Body)
+	for decoder.More() {
+		var record audit.Record
+		if err := decoder.Decode(&record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+func init() {
+	auditCmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Show the audit log of mutating actions",
+		Run: func(cmd *cobra.Command, args []string) {
+			params := url.Values{}
+			for flag, param := range map[string]string{
+				"actor":      "actor",
+				"actor-type": "actor_type",
+				"action":     "action",
+				"server":     "server",
+				"target":     "target",
+				"result":     "result",
+				"since":      "since",
+				"until":      "until",
+			} {
+				if value, _ := cmd.Flags().GetString(flag); value != "" {
+					params.Add(param, value)
+				}
+			}
+
+			export, _ := cmd.Flags().GetString("export")
+			if cmd.Flags().Changed("limit") || export == "" {
+				limit, _ := cmd.Flags().GetInt("limit")
+				params.Add("limit", fmt.Sprint(limit))
+			} else {
+				params.Add("limit", "0")
+			}
+			if export != "" {
+				params.Add("format", "jsonl")
+			}
+
+			resp, err := makeRequest("GET", fmt.Sprintf("%s/v1/audit?%s", apiURL, params.Encode()), nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			if export != "" {
+				out := os.Stdout
+				if export != "-" {
+					out, err = os.Create(export)
+					if err != nil {
+						fmt.Printf("Error: %v\n", err)
+						return
+					}
+					defer out.Close()
+				}
+				if _, err := io.Copy(out, resp.Body); err != nil {
+					fmt.Printf("Error: %v\n", err)
+				}
+				return
+			}
+
+			var events []AuditEventResponse
+			if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			for _, event := range events {
+				actor := event.ActorType
+				if event.ActorName != "" {
+					actor = fmt.Sprintf("%s:%d (%s)", event.ActorType, event.ActorID, event.ActorName)
+				}
+				target := event.Target
+				if event.Server != "" {
+					target = fmt.Sprintf("%s@%s", event.Target, event.Server)
+				}
+
+				fmt.Printf("%s  %-7s  %-20s  %s  %s  from %s (%dms)\n",
+					event.Timestamp.Local().Format(time.RFC3339),
+					event.Result,
+					event.Action,
+					target,
+					actor,
+					event.SourceIP,
+					event.DurationMS)
+				if event.Error != "" {
+					fmt.Printf("    error: %s\n", event.Error)
+				}
+			}
+		},
+	}
+
+	auditCmd.Flags().String("actor", "", "Only show actions by this API key description or username")
+	auditCmd.Flags().String("actor-type", "", "Only show actions by api_key, user, system or anonymous actors")
+	auditCmd.Flags().String("action", "", "Only show this action, e.g. containers.restart")
+	auditCmd.Flags().String("server", "", "Only show actions on this server")
+	auditCmd.Flags().String("target", "", "Only show actions on this container, key or user")
+	auditCmd.Flags().String("result", "", "Only show success, failure or pending_approval")
+	auditCmd.Flags().String("since", "", "Only show actions after this RFC 3339 time or this long ago, e.g. 24h")
+	auditCmd.Flags().String("until", "", "Only show actions before this RFC 3339 time")
+	auditCmd.Flags().Int("limit", 100, "Maximum number of events to show")
+	auditCmd.Flags().String("export", "", "Write every matching event as JSON lines to this file (- for stdout)")
+
+	verifyAuditCmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Check the audit log's hash chain and signed checkpoints",
+		Run: func(cmd *cobra.Command, args []string) {
+			checkpoints, serverKey, err := fetchAuditCheckpoints()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			keyHex, _ := cmd.Flags().GetString("public-key")
+			if keyHex == "" {
+				keyHex = serverKey
+				fmt.Println("Warning: using the public key reported by the server; pass --public-key to pin it")
+			}
+			key, err := hex.DecodeString(keyHex)
+			if err != nil || len(key) != ed25519.PublicKeySize {
+				fmt.Println("Error: invalid public key")
+				return
+			}
+
+			records, err := fetchAuditRecords()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			result := audit.Verify(records, checkpoints, ed25519.PublicKey(key))
+			if !result.OK() {
+				fmt.Printf("Audit log is BROKEN at event %d: %s\n", result.BrokenAt, result.Reason)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Audit log intact: %d events, %d checkpoints verified\n",
+				result.EventsChecked, result.CheckpointsChecked)
+			if len(records) > 0 && (len(checkpoints) == 0 || checkpoints[len(checkpoints)-1].EventID < records[len(records)-1].ID) {
+				fmt.Println("Note: the newest events are not covered by a checkpoint yet")
+			}
+		},
+	}
+
+	verifyAuditCmd.Flags().String("public-key", "", "Hex-encoded Ed25519 public key to verify checkpoints with")
+
+	auditCmd.AddCommand(verifyAuditCmd)
+	rootCmd.AddCommand(auditCmd)
+}
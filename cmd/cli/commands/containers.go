@@ -1,12 +1,18 @@
 package commands
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/Zeptile/docktrine/internal/docker"
+	"github.com/Zeptile/docktrine/internal/signing"
 	"github.com/spf13/cobra"
 )
 
@@ -17,29 +23,192 @@ var (
 	restartCmd *cobra.Command
 )
 
+// APIError is the body of a failed API request.
+type APIError struct {
+	Status    int                    `json:"-"`
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details"`
+	RequestID string                 `json:"request_id"`
+}
+
+func (e *APIError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Message)
+	switch {
+	case e.Code != "" && e.RequestID != "":
+		fmt.Fprintf(&b, " (%s, request %s)", e.Code, e.RequestID)
+	case e.Code != "":
+		fmt.Fprintf(&b, " (%s)", e.Code)
+	}
+
+	keys := make([]string, 0, len(e.Details))
+	for k := range e.Details {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "results" {
+			// Per-server outcome of an action fanned out over a selector.
+			results, _ := e.Details[k].([]interface{})
+			for _, r := range results {
+				result, _ := r.(map[string]interface{})
+				if msg, _ := result["error"].(string); msg != "" {
+					fmt.Fprintf(&b, "\n  %v: %s", result["server"], msg)
+				} else {
+					fmt.Fprintf(&b, "\n  %v: ok", result["server"])
+				}
+			}
+			continue
+		}
+		fmt.Fprintf(&b, "\n  %s: %v", k, e.Details[k])
+	}
+	return b.String()
+}
+
+// decodeAPIError reads the error body of a failed response. Bodies of
+// older servers, where error is a plain string, and non-JSON bodies are
+// handled too.
+func decodeAPIError(resp *http.Response) *APIError {
+	apiErr := &APIError{Status: resp.StatusCode}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		apiErr.Message = fmt.Sprintf("HTTP %d: %v", resp.StatusCode, err)
+		return apiErr
+	}
+
+	var structured struct {
+		Error *APIError `json:"error"`
+	}
+	if json.Unmarshal(body, &structured) == nil && structured.Error != nil && structured.Error.Message != "" {
+		structured.Error.Status = resp.StatusCode
+		return structured.Error
+	}
+
+	var legacy struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &legacy) == nil && legacy.Error != "" {
+		apiErr.Message = legacy.Error
+		return apiErr
+	}
+
+	apiErr.Message = fmt.Sprintf("HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	return apiErr
+}
+
 func handleError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotModified {
+		return nil
+	}
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		var errorResponse map[string]interface{}
-		if err := json.NewDecoder(resp.Body).Decode(&errorResponse); err != nil {
-			return fmt.Errorf("HTTP %d: %v", resp.StatusCode, err)
-		}
-		return fmt.Errorf("%v", errorResponse["error"])
+		return decodeAPIError(resp)
 	}
 	return nil
 }
 
+// printServerResults prints the per-server outcome of an action that was
+// fanned out over a server selector.
+func printServerResults(resp *http.Response) {
+	var body struct {
+		Results []struct {
+			Server string `json:"server"`
+			Error  string `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return
+	}
+	for _, r := range body.Results {
+		if r.Error != "" {
+			fmt.Printf("  %s: %s\n", r.Server, r.Error)
+		} else {
+			fmt.Printf("  %s: ok\n", r.Server)
+		}
+	}
+}
+
+// printAccepted reports an operation the API accepted without running it
+// yet (202 Accepted), because it was held for approval or queued as a job,
+// and returns whether it did.
+func printAccepted(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusAccepted {
+		return false
+	}
+
+	var body struct {
+		Message  string            `json:"message"`
+		Approval *ApprovalResponse `json:"approval"`
+		Job      *JobResponse      `json:"job"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return true
+	}
+
+	switch {
+	case body.Job != nil:
+		printQueuedJob(body.Job)
+	case body.Approval != nil:
+		printApprovalRequired(body.Approval)
+	default:
+		fmt.Println(body.Message)
+	}
+	return true
+}
+
+func printApprovalRequired(approval *ApprovalResponse) {
+	fmt.Printf("Approval required: %s\n", approval.Reason)
+	fmt.Printf("Approval %d expires at %s. Another user or API key must run:\n  docktrine approvals approve %d\n",
+		approval.ID, approval.ExpiresAt.Local().Format(time.RFC3339), approval.ID)
+}
+
 func makeRequest(method, url string, body io.Reader) (*http.Response, error) {
+	return makeRequestWithHeaders(method, url, body, nil)
+}
+
+// makeRequestWithHeaders is makeRequest with extra request headers; empty
+// values are not sent.
+func makeRequestWithHeaders(method, url string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = io.ReadAll(body); err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(payload)
+	}
+
 	req, err := http.NewRequest(method, url, body)
 	if err != nil {
 		return nil, err
 	}
-	
-	req.Header.Set("X-API-Key", apiKey)
-	
+
+	for name, value := range headers {
+		if value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+
+	if apiKey != "" && apiKeyID != 0 {
+		headers := signing.Headers(apiKeyID, apiKey, method, req.URL.EscapedPath(), req.URL.RawQuery, payload)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+	} else if apiKey != "" {
+		req.Header.Set("X-API-Key", apiKey)
+	} else if sessionToken != "" {
+		req.Header.Set("Authorization", "Bearer "+sessionToken)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
 	return http.DefaultClient.Do(req)
 }
 
-func init() {	
+func init() {
 	containersCmd := &cobra.Command{
 		Use:   "containers",
 		Short: "Manage Docker containers",
@@ -49,11 +218,11 @@ func init() {
 		Use:   "list",
 		Short: "List all containers",
 		Run: func(cmd *cobra.Command, args []string) {
-			uri := fmt.Sprintf("%s/containers", apiURL)
+			uri := fmt.Sprintf("%s/v1/containers", apiURL)
 			if server != "" {
 				uri += fmt.Sprintf("?server=%s", url.QueryEscape(server))
 			}
-			
+
 			resp, err := makeRequest("GET", uri, nil)
 			if err != nil {
 				fmt.Printf("Error: %v\n", err)
@@ -66,38 +235,42 @@ func init() {
 				return
 			}
 
-			var containers []map[string]interface{}
+			var containers []docker.Container
 			if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
 				fmt.Printf("Error: %v\n", err)
 				return
 			}
 
 			for _, container := range containers {
-				fmt.Printf("ID: %s\nName: %s\nStatus: %s\n", 
-					container["id"], 
-					container["name"], 
-					container["status"])
-				
-				if ports, ok := container["ports"].([]interface{}); ok && len(ports) > 0 {
+				fmt.Printf("ID: %s\nName: %s\nStatus: %s\n",
+					container.ID,
+					container.Name,
+					container.Status)
+				if container.Server != "" {
+					fmt.Printf("Server: %s\n", container.Server)
+				}
+				if len(container.Alerts) > 0 {
+					fmt.Printf("Alerts: %s\n", strings.Join(container.Alerts, ", "))
+				}
+
+				if len(container.Ports) > 0 {
 					fmt.Println("Ports:")
-					for _, p := range ports {
-						if port, ok := p.(map[string]interface{}); ok {
-							ip := port["IP"]
-							if ip == nil || ip == "" {
-								ip = "0.0.0.0"
-							}
-							
-							if publicPort, exists := port["PublicPort"]; exists && publicPort != 0 {
-								fmt.Printf("  %v:%v → %v/%s\n",
-									ip,
-									publicPort,
-									port["PrivatePort"],
-									port["Type"])
-							} else {
-								fmt.Printf("  %v/%s\n",
-									port["PrivatePort"],
-									port["Type"])
-							}
+					for _, port := range container.Ports {
+						ip := port.IP
+						if ip == "" {
+							ip = "0.0.0.0"
+						}
+
+						if port.PublicPort != 0 {
+							fmt.Printf("  %s:%d → %d/%s\n",
+								ip,
+								port.PublicPort,
+								port.PrivatePort,
+								port.Type)
+						} else {
+							fmt.Printf("  %d/%s\n",
+								port.PrivatePort,
+								port.Type)
 						}
 					}
 				}
@@ -111,24 +284,39 @@ func init() {
 		Short: "Start a container",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			uri := fmt.Sprintf("%s/containers/start/%s", apiURL, args[0])
+			uri := fmt.Sprintf("%s/v1/containers/start/%s", apiURL, args[0])
+			params := url.Values{}
+
 			if server != "" {
-				uri += fmt.Sprintf("?server=%s", url.QueryEscape(server))
+				params.Add("server", server)
+			}
+
+			if async, _ := cmd.Flags().GetBool("async"); async {
+				params.Add("async", "true")
 			}
-			
+
+			if len(params) > 0 {
+				uri += "?" + params.Encode()
+			}
+
 			resp, err := makeRequest("POST", uri, nil)
 			if err != nil {
 				fmt.Printf("Error: %v\n", err)
 				return
 			}
 			defer resp.Body.Close()
-			
+
 			if err := handleError(resp); err != nil {
 				fmt.Printf("Error: %v\n", err)
 				return
 			}
-			
+
+			if printAccepted(resp) {
+				return
+			}
+
 			fmt.Printf("Container %s started\n", args[0])
+			printServerResults(resp)
 		},
 	}
 
@@ -137,11 +325,21 @@ func init() {
 		Short: "Stop a container",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			uri := fmt.Sprintf("%s/containers/stop/%s", apiURL, args[0])
+			uri := fmt.Sprintf("%s/v1/containers/stop/%s", apiURL, args[0])
+			params := url.Values{}
+
 			if server != "" {
-				uri += fmt.Sprintf("?server=%s", url.QueryEscape(server))
+				params.Add("server", server)
+			}
+
+			if async, _ := cmd.Flags().GetBool("async"); async {
+				params.Add("async", "true")
 			}
-			
+
+			if len(params) > 0 {
+				uri += "?" + params.Encode()
+			}
+
 			resp, err := makeRequest("POST", uri, nil)
 			if err != nil {
 				fmt.Printf("Error: %v\n", err)
@@ -154,7 +352,12 @@ func init() {
 				return
 			}
 
+			if printAccepted(resp) {
+				return
+			}
+
 			fmt.Printf("Container %s stopped\n", args[0])
+			printServerResults(resp)
 		},
 	}
 
@@ -163,7 +366,7 @@ func init() {
 		Short: "Restart a container",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			uri := fmt.Sprintf("%s/containers/restart/%s", apiURL, args[0])
+			uri := fmt.Sprintf("%s/v1/containers/restart/%s", apiURL, args[0])
 			params := url.Values{}
 
 			if server != "" {
@@ -174,10 +377,14 @@ func init() {
 				params.Add("pull_latest", "true")
 			}
 
+			if async, _ := cmd.Flags().GetBool("async"); async {
+				params.Add("async", "true")
+			}
+
 			if len(params) > 0 {
 				uri += "?" + params.Encode()
 			}
-			
+
 			resp, err := makeRequest("POST", uri, nil)
 			if err != nil {
 				fmt.Printf("Error: %v\n", err)
@@ -190,12 +397,36 @@ func init() {
 				return
 			}
 
+			if printAccepted(resp) {
+				return
+			}
+
 			fmt.Printf("Container %s restarted\n", args[0])
+			printServerResults(resp)
 		},
 	}
 
 	restartCmd.Flags().Bool("pull-latest", false, "Pull latest image before restart")
 
-	containersCmd.AddCommand(listCmd, startCmd, stopCmd, restartCmd)
+	for _, cmd := range []*cobra.Command{startCmd, stopCmd, restartCmd} {
+		cmd.Flags().Bool("async", false, "Queue the operation as a background job instead of waiting for it")
+	}
+
+	historyCmd := &cobra.Command{
+		Use:   "history [container-id]",
+		Short: "Show a container's recorded lifecycle events",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			params := url.Values{}
+			if server != "" {
+				params.Add("server", server)
+			}
+			showHistory(cmd, fmt.Sprintf("%s/v1/containers/%s/history", apiURL, url.PathEscape(args[0])), params)
+		},
+	}
+
+	addHistoryFlags(historyCmd)
+
+	containersCmd.AddCommand(listCmd, startCmd, stopCmd, restartCmd, historyCmd)
 	rootCmd.AddCommand(containersCmd)
-} 
\ No newline at end of file
+}
@@ -0,0 +1,341 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type EmailChannelResponse struct {
+	ID              int64      `json:"id"`
+	Name            string     `json:"name"`
+	Host            string     `json:"host"`
+	Port            int        `json:"port"`
+	TLS             string     `json:"tls"`
+	TLSSkipVerify   bool       `json:"tls_skip_verify"`
+	Username        string     `json:"username"`
+	From            string     `json:"from"`
+	To              []string   `json:"to"`
+	Events          []string   `json:"events"`
+	MinSeverity     string     `json:"min_severity"`
+	DigestSeconds   int        `json:"digest_seconds"`
+	SubjectTemplate string     `json:"subject_template"`
+	TextTemplate    string     `json:"text_template"`
+	HTMLTemplate    string     `json:"html_template"`
+	Enabled         bool       `json:"enabled"`
+	Pending         int        `json:"pending"`
+	LastSentAt      *time.Time `json:"last_sent_at"`
+	NextSendAt      *time.Time `json:"next_send_at"`
+	Failures        int        `json:"failures"`
+	LastError       string     `json:"last_error"`
+}
+
+func printEmailChannel(channel EmailChannelResponse) {
+	state := "enabled"
+	if !channel.Enabled {
+		state = "disabled"
+	}
+	minSeverity := channel.MinSeverity
+	if minSeverity == "" {
+		minSeverity = "any"
+	}
+	digest := "off"
+	if channel.DigestSeconds > 0 {
+		digest = (time.Duration(channel.DigestSeconds) * time.Second).String()
+	}
+	server := fmt.Sprintf("%s:%d (%s)", channel.Host, channel.Port, channel.TLS)
+	if channel.Username != "" {
+		server += " as " + channel.Username
+	}
+	fmt.Printf("ID: %d\nName: %s\nSMTP server: %s\nFrom: %s\nTo: %s\nEvents: %s\nMin severity: %s\nDigest: %s\nState: %s\n",
+		channel.ID,
+		channel.Name,
+		server,
+		channel.From,
+		strings.Join(channel.To, ", "),
+		strings.Join(channel.Events, ", "),
+		minSeverity,
+		digest,
+		state)
+
+	var custom []string
+	for _, template := range []struct{ name, text string }{
+		{"subject", channel.SubjectTemplate},
+		{"text", channel.TextTemplate},
+		{"html", channel.HTMLTemplate},
+	} {
+		if template.text != "" {
+			custom = append(custom, template.name)
+		}
+	}
+	if len(custom) > 0 {
+		fmt.Printf("Custom templates: %s\n", strings.Join(custom, ", "))
+	}
+	if channel.Pending > 0 {
+		line := fmt.Sprintf("Pending: %d", channel.Pending)
+		if channel.NextSendAt != nil {
+			line += fmt.Sprintf(", next email %s", channel.NextSendAt.Local().Format(time.RFC3339))
+		}
+		fmt.Println(line)
+	}
+	if channel.LastSentAt != nil {
+		fmt.Printf("Last sent: %s\n", channel.LastSentAt.Local().Format(time.RFC3339))
+	}
+	if channel.LastError != "" {
+		fmt.Printf("Last error: %s (%d failed attempts)\n", channel.LastError, channel.Failures)
+	}
+}
+
+// emailChannelFields collects the settings given as flags, only those that
+// were set unless all is set.
+func emailChannelFields(cmd *cobra.Command, all bool) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	for _, flag := range []struct{ name, field string }{
+		{"name", "name"},
+		{"host", "host"},
+		{"tls", "tls"},
+		{"username", "username"},
+		{"password", "password"},
+		{"from", "from"},
+		{"min-severity", "min_severity"},
+		{"subject", "subject_template"},
+	} {
+		if all || cmd.Flags().Changed(flag.name) {
+			value, _ := cmd.Flags().GetString(flag.name)
+			fields[flag.field] = value
+		}
+	}
+	if all || cmd.Flags().Changed("port") {
+		port, _ := cmd.Flags().GetInt("port")
+		fields["port"] = port
+	}
+	if all || cmd.Flags().Changed("tls-skip-verify") {
+		skip, _ := cmd.Flags().GetBool("tls-skip-verify")
+		fields["tls_skip_verify"] = skip
+	}
+	if all || cmd.Flags().Changed("to") {
+		to, _ := cmd.Flags().GetStringSlice("to")
+		fields["to"] = to
+	}
+	if all || cmd.Flags().Changed("event") {
+		events, _ := cmd.Flags().GetStringSlice("event")
+		fields["events"] = events
+	}
+	if all || cmd.Flags().Changed("digest") {
+		digest, _ := cmd.Flags().GetDuration("digest")
+		fields["digest_seconds"] = int(digest.Seconds())
+	}
+	for _, flag := range []struct{ name, field string }{
+		{"text-template", "text_template"},
+		{"html-template", "html_template"},
+	} {
+		if !cmd.Flags().Changed(flag.name) {
+			continue
+		}
+		// An empty path goes back to the default template.
+		path, _ := cmd.Flags().GetString(flag.name)
+		template := ""
+		if path != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			template = string(data)
+		}
+		fields[flag.field] = template
+	}
+	return fields, nil
+}
+
+func addEmailChannelFlags(cmd *cobra.Command) {
+	cmd.Flags().String("name", "", "Name of the channel")
+	cmd.Flags().String("host", "", "SMTP server host")
+	cmd.Flags().Int("port", 0, "SMTP server port (default 587 for starttls, 465 for tls, 25 for none)")
+	cmd.Flags().String("tls", "", "Connection security: starttls (default), tls or none")
+	cmd.Flags().Bool("tls-skip-verify", false, "Accept any certificate from the SMTP server")
+	cmd.Flags().String("username", "", "SMTP username")
+	cmd.Flags().String("password", "", "SMTP password")
+	cmd.Flags().String("from", "", "Sender, e.g. \"Docktrine <docktrine@example.com>\"")
+	cmd.Flags().StringSlice("to", nil, "Recipient (repeatable)")
+	cmd.Flags().StringSlice("event", nil, "Event to send: alert.fired, alert.resolved, container.died, container.restarted, server.offline, server.online, job.finished (repeatable, default all)")
+	cmd.Flags().String("min-severity", "", "Only send notifications of this severity or higher: info, warning or critical")
+	cmd.Flags().Duration("digest", 0, "Batch the notifications arriving within this long of the last email into one digest, e.g. 15m")
+	cmd.Flags().String("subject", "", "Subject template")
+	cmd.Flags().String("text-template", "", "File with the plain-text body template")
+	cmd.Flags().String("html-template", "", "File with the HTML body template")
+}
+
+func emailChannelRequest(method, uri string, fields map[string]interface{}) {
+	jsonData, err := json.Marshal(fields)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	resp, err := makeRequest(method, uri, bytes.NewBuffer(jsonData))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := handleError(resp); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	var channel EmailChannelResponse
+	if err := json.NewDecoder(resp.Body).Decode(&channel); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	printEmailChannel(channel)
+}
+
+func emailChannelActionCmd(use, short, action, done string) *cobra.Command {
+	return &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			uri := fmt.Sprintf("%s/v1/email/channels/%s", apiURL, url.PathEscape(args[0]))
+			method := "DELETE"
+			if action != "" {
+				uri += "/" + action
+				method = "POST"
+			}
+
+			resp, err := makeRequest(method, uri, nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			fmt.Printf("Email channel %s %s\n", args[0], done)
+		},
+	}
+}
+
+func init() {
+	emailCmd := &cobra.Command{
+		Use:   "email",
+		Short: "Manage email notifications (requires an admin key)",
+	}
+
+	listEmailCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List email channels",
+		Run: func(cmd *cobra.Command, args []string) {
+			resp, err := makeRequest("GET", fmt.Sprintf("%s/v1/email/channels", apiURL), nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			var channels []EmailChannelResponse
+			if err := json.NewDecoder(resp.Body).Decode(&channels); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			if len(channels) == 0 {
+				fmt.Println("No email channels")
+				return
+			}
+			for _, channel := range channels {
+				printEmailChannel(channel)
+				fmt.Println()
+			}
+		},
+	}
+
+	addEmailCmd := &cobra.Command{
+		Use:   "add",
+		Short: "Add an email channel",
+		Run: func(cmd *cobra.Command, args []string) {
+			fields, err := emailChannelFields(cmd, true)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			emailChannelRequest("POST", fmt.Sprintf("%s/v1/email/channels", apiURL), fields)
+		},
+	}
+	addEmailChannelFlags(addEmailCmd)
+	addEmailCmd.MarkFlagRequired("name")
+	addEmailCmd.MarkFlagRequired("host")
+	addEmailCmd.MarkFlagRequired("from")
+	addEmailCmd.MarkFlagRequired("to")
+
+	updateEmailCmd := &cobra.Command{
+		Use:   "update [id]",
+		Short: "Change the settings of an email channel",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			fields, err := emailChannelFields(cmd, false)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			if len(fields) == 0 {
+				fmt.Println("Error: nothing to change")
+				return
+			}
+			emailChannelRequest("PATCH", fmt.Sprintf("%s/v1/email/channels/%s", apiURL, url.PathEscape(args[0])), fields)
+		},
+	}
+	addEmailChannelFlags(updateEmailCmd)
+
+	testEmailCmd := &cobra.Command{
+		Use:   "test [id]",
+		Short: "Send a test email",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			resp, err := makeRequest("POST", fmt.Sprintf("%s/v1/email/channels/%s/test", apiURL, url.PathEscape(args[0])), nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			var body struct {
+				Message string `json:"message"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			fmt.Println(body.Message)
+		},
+	}
+
+	removeEmailCmd := emailChannelActionCmd("remove [id]", "Delete an email channel and its pending notifications", "", "removed")
+	disableEmailCmd := emailChannelActionCmd("disable [id]", "Stop sending notifications to an email channel", "disable", "disabled")
+	enableEmailCmd := emailChannelActionCmd("enable [id]", "Resume sending notifications to an email channel", "enable", "enabled")
+
+	emailCmd.AddCommand(listEmailCmd, addEmailCmd, updateEmailCmd, removeEmailCmd, disableEmailCmd, enableEmailCmd, testEmailCmd)
+	rootCmd.AddCommand(emailCmd)
+}
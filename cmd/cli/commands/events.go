@@ -0,0 +1,147 @@
+package commands
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/docker"
+	"github.com/spf13/cobra"
+)
+
+// streamEvents reads one connection to the event stream, printing events
+// and returning the id of the last one. It returns an *APIError if the API
+// refused the stream.
+func streamEvents(uri string, lastID string, raw bool) (string, error) {
+	resp, err := makeRequestWithHeaders("GET", uri, nil, map[string]string{"Last-Event-ID": lastID, "Accept": "text/event-stream"})
+	if err != nil {
+		return lastID, err
+	}
+	defer resp.Body.Close()
+
+	if err := handleError(resp); err != nil {
+		return lastID, err
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var id, data string
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		case line == "" && data != "":
+			printEvent(data, raw)
+			if id != "" {
+				lastID = id
+			}
+			id, data = "", ""
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return lastID, err
+	}
+	return lastID, fmt.Errorf("event stream closed")
+}
+
+func printEvent(data string, raw bool) {
+	if raw {
+		fmt.Println(data)
+		return
+	}
+
+	var event docker.Event
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	at := event.Time.Local().Format(time.RFC3339)
+	if event.Type == docker.EventTypeStream {
+		if reason := event.Attributes["error"]; reason != "" {
+			fmt.Printf("%s  %s  event stream %s: %s\n", at, event.Server, event.Action, reason)
+		} else {
+			fmt.Printf("%s  %s  event stream %s\n", at, event.Server, event.Action)
+		}
+		return
+	}
+
+	actor := event.ActorID
+	if len(actor) > 12 {
+		actor = actor[:12]
+	}
+	if name := event.Attributes["name"]; name != "" {
+		actor = fmt.Sprintf("%s (%s)", name, actor)
+	}
+	fmt.Printf("%s  %s  %s  %s  %s\n", at, event.Server, event.Type, event.Action, actor)
+}
+
+func init() {
+	eventsCmd := &cobra.Command{
+		Use:   "events",
+		Short: "Stream Docker events as they happen",
+		Long: `Stream Docker events from the servers selected with --server (the default
+server if none is given, * for all of them) until interrupted. If the
+connection to the API drops, the stream is resumed after the last event.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			params := url.Values{}
+			if server != "" {
+				params.Add("server", server)
+			}
+			if types, _ := cmd.Flags().GetStringSlice("type"); len(types) > 0 {
+				params.Add("type", strings.Join(types, ","))
+			}
+			if actions, _ := cmd.Flags().GetStringSlice("action"); len(actions) > 0 {
+				params.Add("action", strings.Join(actions, ","))
+			}
+			labels, _ := cmd.Flags().GetStringArray("label")
+			for _, label := range labels {
+				params.Add("label", label)
+			}
+			if since, _ := cmd.Flags().GetString("since"); since != "" {
+				if d, err := time.ParseDuration(since); err == nil {
+					since = time.Now().Add(-d).UTC().Format(time.RFC3339)
+				}
+				params.Add("since", since)
+			}
+			raw, _ := cmd.Flags().GetBool("json")
+
+			uri := fmt.Sprintf("%s/v1/events", apiURL)
+			if len(params) > 0 {
+				uri += "?" + params.Encode()
+			}
+
+			retry := time.Second
+			lastID := ""
+			for {
+				id, err := streamEvents(uri, lastID, raw)
+				if _, refused := err.(*APIError); refused {
+					fmt.Printf("Error: %v\n", err)
+					return
+				}
+				if id != lastID {
+					retry = time.Second
+				}
+				lastID = id
+
+				fmt.Printf("Error: %v, reconnecting in %s\n", err, retry)
+				time.Sleep(retry)
+				retry = min(retry*2, 30*time.Second)
+			}
+		},
+	}
+
+	eventsCmd.Flags().StringSlice("type", nil, "Only events of these types (container, image, network, volume, ...)")
+	eventsCmd.Flags().StringSlice("action", nil, "Only events with these actions (start, die, pull, ...)")
+	eventsCmd.Flags().StringArray("label", nil, "Only events whose actor has this label, key or key=value (repeatable)")
+	eventsCmd.Flags().String("since", "", "Replay events since a time (RFC 3339, Unix seconds or a duration such as 10m)")
+	eventsCmd.Flags().Bool("json", false, "Print each event as JSON")
+
+	rootCmd.AddCommand(eventsCmd)
+}
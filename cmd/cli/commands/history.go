@@ -0,0 +1,92 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type ContainerEventResponse struct {
+	ID            int64             `json:"id"`
+	Server        string            `json:"server"`
+	ContainerID   string            `json:"container_id"`
+	ContainerName string            `json:"container_name"`
+	Image         string            `json:"image"`
+	Action        string            `json:"action"`
+	ExitCode      *int              `json:"exit_code"`
+	Detail        string            `json:"detail"`
+	Attributes    map[string]string `json:"attributes"`
+	Time          time.Time         `json:"time"`
+}
+
+// addHistoryFlags adds the filters shared by the history commands.
+func addHistoryFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSlice("action", nil, "Only these actions (create, start, restart, stop, kill, die, oom, health_status, destroy)")
+	cmd.Flags().String("since", "", "Only events after this RFC 3339 time or this long ago, e.g. 24h")
+	cmd.Flags().String("until", "", "Only events before this RFC 3339 time or this long ago")
+	cmd.Flags().Int("limit", 500, "Maximum number of events, the newest are kept")
+}
+
+func showHistory(cmd *cobra.Command, uri string, params url.Values) {
+	if actions, _ := cmd.Flags().GetStringSlice("action"); len(actions) > 0 {
+		params.Add("action", strings.Join(actions, ","))
+	}
+	for _, name := range []string{"since", "until"} {
+		if value, _ := cmd.Flags().GetString(name); value != "" {
+			params.Add(name, value)
+		}
+	}
+	if cmd.Flags().Changed("limit") {
+		limit, _ := cmd.Flags().GetInt("limit")
+		params.Add("limit", fmt.Sprint(limit))
+	}
+	if len(params) > 0 {
+		uri += "?" + params.Encode()
+	}
+
+	resp, err := makeRequest("GET", uri, nil)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := handleError(resp); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	var events []ContainerEventResponse
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	if len(events) == 0 {
+		fmt.Println("No recorded events")
+		return
+	}
+
+	for _, e := range events {
+		id := e.ContainerID
+		if len(id) > 12 {
+			id = id[:12]
+		}
+
+		action := e.Action
+		switch {
+		case e.ExitCode != nil:
+			action = fmt.Sprintf("%s (exit code %d)", action, *e.ExitCode)
+		case e.Action == "kill" && e.Detail != "":
+			action = fmt.Sprintf("%s (signal %s)", action, e.Detail)
+		case e.Detail != "":
+			action = fmt.Sprintf("%s: %s", action, e.Detail)
+		}
+
+		fmt.Printf("%s  %s  %s (%s)  %s\n", e.Time.Local().Format(time.RFC3339), e.Server, e.ContainerName, id, action)
+	}
+}
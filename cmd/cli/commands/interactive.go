@@ -5,6 +5,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/Zeptile/docktrine/internal/docker"
 	"github.com/c-bata/go-prompt"
 	"github.com/spf13/cobra"
 )
@@ -21,14 +22,14 @@ func getPromptPrefix() string {
 
 func init() {
 	interactiveCmd := &cobra.Command{
-		Use:   "interactive",
-		Short: "Start interactive shell mode",
+		Use:               "interactive",
+		Short:             "Start interactive shell mode",
 		PersistentPreRunE: rootCmd.PersistentPreRunE,
 		Run: func(cmd *cobra.Command, args []string) {
 			fmt.Println("Docktrine Interactive Shell")
 			fmt.Println("Type 'exit' to quit, 'help' for commands")
 			fmt.Printf("Using API URL: %s\n", apiURL)
-			
+
 			p := prompt.New(
 				executor,
 				completer,
@@ -70,7 +71,7 @@ func executor(input string) {
 			// Check if server exists in cache
 			serverExists := false
 			requestedServer := args[1]
-			
+
 			if requestedServer == "default" {
 				currentServer = ""
 				server = currentServer
@@ -85,6 +86,10 @@ func executor(input string) {
 				}
 			}
 
+			if docker.IsSelector(requestedServer) {
+				serverExists = true
+			}
+
 			if !serverExists {
 				fmt.Printf("Error: server '%s' not found\n", requestedServer)
 				return
@@ -104,6 +109,7 @@ func executor(input string) {
 		fmt.Println("  containers restart <id>      - Restart a container")
 		fmt.Println("  server                       - Show current server")
 		fmt.Println("  server <name>                - Switch to different server")
+		fmt.Println("  server group:<g>|label:<k=v> - Target every matching server")
 		fmt.Println("  servers list                 - List all servers")
 		fmt.Println("  servers add                  - Add a new server")
 		fmt.Println("  servers remove <name>        - Remove a server")
@@ -115,9 +121,9 @@ func executor(input string) {
 			fmt.Println("Usage: containers <command> [args]")
 			return
 		}
-		
+
 		cmdArgs := args[1:]
-		
+
 		switch cmdArgs[0] {
 		case "list":
 			if currentServer != "" {
@@ -170,7 +176,7 @@ func executor(input string) {
 			fmt.Println("Usage: servers <command> [args]")
 			return
 		}
-		
+
 		cmdArgs := args[1:]
 		switch cmdArgs[0] {
 		case "list":
@@ -212,7 +218,7 @@ func executor(input string) {
 			cmd.Flags().Set("host", host)
 			cmd.Flags().Set("description", desc)
 			cmd.Flags().Set("default", fmt.Sprintf("%v", isDefault))
-			
+
 			cmd.Run(cmd, []string{})
 		case "remove":
 			if len(cmdArgs) < 2 {
@@ -273,4 +279,4 @@ func completer(d prompt.Document) []prompt.Suggest {
 	}
 
 	return prompt.FilterHasPrefix(suggestions, d.GetWordBeforeCursor(), true)
-} 
\ No newline at end of file
+}
@@ -0,0 +1,235 @@
+package commands
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type JobResponse struct {
+	ID            int64             `json:"id"`
+	Action        string            `json:"action"`
+	Server        string            `json:"server"`
+	Target        string            `json:"target"`
+	Params        map[string]string `json:"params"`
+	Status        string            `json:"status"`
+	Attempts      int               `json:"attempts"`
+	Error         string            `json:"error"`
+	RequesterType string            `json:"requester_type"`
+	RequesterID   int64             `json:"requester_id"`
+	RequesterName string            `json:"requester_name"`
+	CreatedAt     time.Time         `json:"created_at"`
+	StartedAt     *time.Time        `json:"started_at"`
+	FinishedAt    *time.Time        `json:"finished_at"`
+}
+
+type JobLogResponse struct {
+	ID        int64     `json:"id"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func printQueuedJob(job *JobResponse) {
+	fmt.Printf("Queued as job %d. Follow it with:\n  docktrine jobs watch %d\n", job.ID, job.ID)
+}
+
+func getJob(id string) (*JobResponse, error) {
+	resp, err := makeRequest("GET", fmt.Sprintf("%s/v1/jobs/%s", apiURL, url.PathEscape(id)), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := handleError(resp); err != nil {
+		return nil, err
+	}
+
+	var job JobResponse
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// watchJob prints the job's log as it is written until the job finishes.
+func watchJob(id string) {
+	job, err := getJob(id)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("Job %d: %s on %s (%s)\n", job.ID, job.Action, jobTarget(job), job.Status)
+
+	resp, err := makeRequest("GET", fmt.Sprintf("%s/v1/jobs/%d/logs?follow=true", apiURL, job.ID), nil)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := handleError(resp); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var line JobLogResponse
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		fmt.Printf("%s  %s\n", line.CreatedAt.Local().Format(time.TimeOnly), line.Message)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	job, err = getJob(id)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if job.Error != "" {
+		fmt.Printf("Job %d %s: %s\n", job.ID, job.Status, job.Error)
+	} else {
+		fmt.Printf("Job %d %s\n", job.ID, job.Status)
+	}
+}
+
+func jobTarget(job *JobResponse) string {
+	if job.Server != "" {
+		return fmt.Sprintf("%s@%s", job.Target, job.Server)
+	}
+	return job.Target
+}
+
+func jobAction(id string, action string) {
+	resp, err := makeRequest("POST", fmt.Sprintf("%s/v1/jobs/%s/%s", apiURL, url.PathEscape(id), action), nil)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := handleError(resp); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	var body struct {
+		Message string `json:"message"`
+		// Set when a retry on a protected target was held for approval.
+		Approval *ApprovalResponse `json:"approval"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if body.Approval != nil {
+		printApprovalRequired(body.Approval)
+		return
+	}
+	fmt.Println(body.Message)
+}
+
+func init() {
+	jobsCmd := &cobra.Command{
+		Use:   "jobs",
+		Short: "Follow operations running in the background",
+	}
+
+	listJobsCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List jobs",
+		Run: func(cmd *cobra.Command, args []string) {
+			params := url.Values{}
+			if status, _ := cmd.Flags().GetString("status"); status != "" {
+				params.Add("status", status)
+			}
+			if cmd.Flags().Changed("limit") {
+				limit, _ := cmd.Flags().GetInt("limit")
+				params.Add("limit", fmt.Sprint(limit))
+			}
+
+			uri := fmt.Sprintf("%s/v1/jobs", apiURL)
+			if len(params) > 0 {
+				uri += "?" + params.Encode()
+			}
+
+			resp, err := makeRequest("GET", uri, nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			var jobs []JobResponse
+			if err := json.NewDecoder(resp.Body).Decode(&jobs); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			if len(jobs) == 0 {
+				fmt.Println("No jobs")
+				return
+			}
+
+			for _, j := range jobs {
+				fmt.Printf("%d  %-9s  %-20s  %s\n", j.ID, j.Status, j.Action, jobTarget(&j))
+				fmt.Printf("    queued by %s:%d (%s) at %s\n", j.RequesterType, j.RequesterID, j.RequesterName,
+					j.CreatedAt.Local().Format(time.RFC3339))
+				if j.FinishedAt != nil {
+					fmt.Printf("    finished at %s after %d attempt(s)\n", j.FinishedAt.Local().Format(time.RFC3339), j.Attempts)
+				}
+				if j.Error != "" {
+					fmt.Printf("    error: %s\n", j.Error)
+				}
+			}
+		},
+	}
+
+	listJobsCmd.Flags().String("status", "", "Only show jobs with this status (queued, running, succeeded, failed or canceled)")
+	listJobsCmd.Flags().Int("limit", 100, "Maximum number of jobs to show")
+
+	watchCmd := &cobra.Command{
+		Use:   "watch [id]",
+		Short: "Follow a job's log until it finishes",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			watchJob(args[0])
+		},
+	}
+
+	cancelJobCmd := &cobra.Command{
+		Use:   "cancel [id]",
+		Short: "Cancel a queued or running job",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			jobAction(args[0], "cancel")
+		},
+	}
+
+	retryJobCmd := &cobra.Command{
+		Use:   "retry [id]",
+		Short: "Queue a failed or canceled job again",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			jobAction(args[0], "retry")
+		},
+	}
+
+	jobsCmd.AddCommand(listJobsCmd, watchCmd, cancelJobCmd, retryJobCmd)
+	rootCmd.AddCommand(jobsCmd)
+}
@@ -0,0 +1,287 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// Credentials are what `docktrine login` stores on disk.
+type Credentials struct {
+	APIURL    string    `json:"api_url"`
+	Username  string    `json:"username"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// skipAuthAnnotation marks commands that run without an API key or session.
+const skipAuthAnnotation = "docktrine/skip-auth"
+
+var sessionToken string
+
+func credentialsPath() (string, error) {
+	if path := os.Getenv("DOCKTRINE_CREDENTIALS"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "docktrine", "credentials.json"), nil
+}
+
+func loadCredentials() (*Credentials, error) {
+	path, err := credentialsPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var creds Credentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("invalid credentials file %s: %w", path, err)
+	}
+	return &creds, nil
+}
+
+func saveCredentials(creds *Credentials) error {
+	path, err := credentialsPath()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+func removeCredentials() error {
+	path, err := credentialsPath()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func readPassword(prompt string) (string, error) {
+	fmt.Print(prompt)
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		password, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Println()
+		return string(password), err
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// storeLogin saves the session from a successful login response.
+func storeLogin(resp *http.Response) error {
+	var login struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+		User      struct {
+			Username string `json:"username"`
+			Role     string `json:"role"`
+		} `json:"user"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&login); err != nil {
+		return err
+	}
+
+	if err := saveCredentials(&Credentials{
+		APIURL:    apiURL,
+		Username:  login.User.Username,
+		Token:     login.Token,
+		ExpiresAt: login.ExpiresAt,
+	}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Logged in as %s (%s) until %s\n",
+		login.User.Username,
+		login.User.Role,
+		login.ExpiresAt.Local().Format(time.RFC1123))
+	return nil
+}
+
+// loginSSO runs the OIDC device flow: the user approves the login in a
+// browser while the CLI polls the API until a session is issued.
+func loginSSO() error {
+	resp, err := makeRequest("POST", fmt.Sprintf("%s/v1/auth/oidc/device", apiURL), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := handleError(resp); err != nil {
+		return err
+	}
+
+	var device struct {
+		DeviceCode              string `json:"device_code"`
+		UserCode                string `json:"user_code"`
+		VerificationURI         string `json:"verification_uri"`
+		VerificationURIComplete string `json:"verification_uri_complete"`
+		ExpiresIn               int    `json:"expires_in"`
+		Interval                int    `json:"interval"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&device); err != nil {
+		return err
+	}
+
+	if device.VerificationURIComplete != "" {
+		fmt.Printf("Open %s to log in\n", device.VerificationURIComplete)
+	} else {
+		fmt.Printf("Open %s and enter the code %s\n", device.VerificationURI, device.UserCode)
+	}
+
+	jsonData, err := json.Marshal(map[string]string{"device_code": device.DeviceCode})
+	if err != nil {
+		return err
+	}
+
+	interval := time.Duration(device.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(device.ExpiresIn) * time.Second)
+	for device.ExpiresIn == 0 || time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		resp, err := makeRequest("POST", fmt.Sprintf("%s/v1/auth/oidc/device/token", apiURL), bytes.NewBuffer(jsonData))
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusBadRequest {
+			pending := decodeAPIError(resp)
+			resp.Body.Close()
+
+			// Older servers put the code in the message.
+			switch {
+			case pending.Code == "authorization_pending", pending.Message == "authorization_pending":
+				continue
+			case pending.Code == "slow_down", pending.Message == "slow_down":
+				interval += 5 * time.Second
+				continue
+			}
+			return pending
+		}
+
+		err = handleError(resp)
+		if err == nil {
+			err = storeLogin(resp)
+		}
+		resp.Body.Close()
+		return err
+	}
+
+	return fmt.Errorf("device code expired before the login was approved")
+}
+
+func init() {
+	loginCmd := &cobra.Command{
+		Use:         "login",
+		Short:       "Log in with a username and password, or through SSO, and store the session token",
+		Annotations: map[string]string{skipAuthAnnotation: "true"},
+		Run: func(cmd *cobra.Command, args []string) {
+			if sso, _ := cmd.Flags().GetBool("sso"); sso {
+				if err := loginSSO(); err != nil {
+					fmt.Printf("Error: %v\n", err)
+				}
+				return
+			}
+
+			username, _ := cmd.Flags().GetString("username")
+			if username == "" {
+				fmt.Print("Username: ")
+				line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+				username = strings.TrimSpace(line)
+			}
+
+			password, err := readPassword("Password: ")
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			jsonData, err := json.Marshal(map[string]string{
+				"username": username,
+				"password": password,
+			})
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			resp, err := makeRequest("POST", fmt.Sprintf("%s/v1/auth/login", apiURL), bytes.NewBuffer(jsonData))
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			if err := storeLogin(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+			}
+		},
+	}
+
+	logoutCmd := &cobra.Command{
+		Use:         "logout",
+		Short:       "End the stored session",
+		Annotations: map[string]string{skipAuthAnnotation: "true"},
+		Run: func(cmd *cobra.Command, args []string) {
+			if sessionToken != "" {
+				resp, err := makeRequest("POST", fmt.Sprintf("%s/v1/auth/logout", apiURL), nil)
+				if err != nil {
+					fmt.Printf("Warning: failed to end session on the server: %v\n", err)
+				} else {
+					resp.Body.Close()
+				}
+			}
+
+			if err := removeCredentials(); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			fmt.Println("Logged out")
+		},
+	}
+
+	loginCmd.Flags().String("username", "", "Username (prompted if not set)")
+	loginCmd.Flags().Bool("sso", false, "Log in through the single sign-on provider using a device code")
+
+	rootCmd.AddCommand(loginCmd, logoutCmd)
+}
@@ -0,0 +1,231 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type RegistryHookResponse struct {
+	ID              int64      `json:"id"`
+	Name            string     `json:"name"`
+	Token           string     `json:"token"`
+	Repository      string     `json:"repository"`
+	Tag             string     `json:"tag"`
+	Server          string     `json:"server"`
+	Containers      []string   `json:"containers"`
+	Enabled         bool       `json:"enabled"`
+	LastTriggeredAt *time.Time `json:"last_triggered_at"`
+	LastDigest      string     `json:"last_digest"`
+}
+
+func printRegistryHook(hook RegistryHookResponse) {
+	state := "enabled"
+	if !hook.Enabled {
+		state = "disabled"
+	}
+	server := hook.Server
+	if server == "" {
+		server = "default"
+	}
+	fmt.Printf("ID: %d\nName: %s\nImage: %s:%s\nServer: %s\nContainers: %s\nState: %s\n",
+		hook.ID,
+		hook.Name,
+		hook.Repository,
+		hook.Tag,
+		server,
+		strings.Join(hook.Containers, ", "),
+		state)
+
+	if hook.LastTriggeredAt != nil {
+		line := fmt.Sprintf("Last triggered: %s", hook.LastTriggeredAt.Local().Format(time.RFC3339))
+		if hook.LastDigest != "" {
+			line += " (" + hook.LastDigest + ")"
+		}
+		fmt.Println(line)
+	}
+	if hook.Token != "" {
+		fmt.Printf("URL: %s/v1/hooks/registry/%s\n", apiURL, hook.Token)
+		fmt.Println("Give this URL to the registry's webhook settings. It cannot be shown again; rotate the token to get a new one.")
+	}
+}
+
+// registryHookFields collects the settings given as flags, only those that
+// were set unless all is set.
+func registryHookFields(cmd *cobra.Command, all bool) map[string]interface{} {
+	fields := map[string]interface{}{}
+	for _, flag := range []struct{ name, field string }{
+		{"name", "name"},
+		{"repository", "repository"},
+		{"tag", "tag"},
+		{"server", "server"},
+	} {
+		if all || cmd.Flags().Changed(flag.name) {
+			value, _ := cmd.Flags().GetString(flag.name)
+			fields[flag.field] = value
+		}
+	}
+	if all || cmd.Flags().Changed("container") {
+		containers, _ := cmd.Flags().GetStringSlice("container")
+		fields["containers"] = containers
+	}
+	return fields
+}
+
+func addRegistryHookFlags(cmd *cobra.Command) {
+	cmd.Flags().String("name", "", "Name of the hook")
+	cmd.Flags().String("repository", "", "Watched image repository, e.g. myorg/api or ghcr.io/myorg/api")
+	cmd.Flags().String("tag", "", "Watched tag, or * for any tag (default latest)")
+	cmd.Flags().String("server", "", "Server name or selector (group:<name>, label:<key>=<value>) the containers run on (default server if empty)")
+	cmd.Flags().StringSlice("container", nil, "Container to recreate on a push (repeatable)")
+}
+
+func registryHookRequest(method, uri string, fields map[string]interface{}) {
+	var body io.Reader
+	if fields != nil {
+		jsonData, err := json.Marshal(fields)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return
+		}
+		body = bytes.NewBuffer(jsonData)
+	}
+
+	resp, err := makeRequest(method, uri, body)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if err := handleError(resp); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	var hook RegistryHookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&hook); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	printRegistryHook(hook)
+}
+
+func registryHookActionCmd(use, short, action, done string) *cobra.Command {
+	return &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			uri := fmt.Sprintf("%s/v1/registry-hooks/%s", apiURL, url.PathEscape(args[0]))
+			method := "DELETE"
+			if action != "" {
+				uri += "/" + action
+				method = "POST"
+			}
+
+			resp, err := makeRequest(method, uri, nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			fmt.Printf("Registry hook %s %s\n", args[0], done)
+		},
+	}
+}
+
+func init() {
+	registryHooksCmd := &cobra.Command{
+		Use:   "registry-hooks",
+		Short: "Manage registry hooks that recreate containers when an image is pushed (requires an admin key)",
+	}
+
+	listRegistryHooksCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List registry hooks",
+		Run: func(cmd *cobra.Command, args []string) {
+			resp, err := makeRequest("GET", fmt.Sprintf("%s/v1/registry-hooks", apiURL), nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			var hooks []RegistryHookResponse
+			if err := json.NewDecoder(resp.Body).Decode(&hooks); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			if len(hooks) == 0 {
+				fmt.Println("No registry hooks")
+				return
+			}
+			for _, hook := range hooks {
+				printRegistryHook(hook)
+				fmt.Println()
+			}
+		},
+	}
+
+	addRegistryHookCmd := &cobra.Command{
+		Use:   "add",
+		Short: "Add a registry hook and print its URL",
+		Run: func(cmd *cobra.Command, args []string) {
+			registryHookRequest("POST", fmt.Sprintf("%s/v1/registry-hooks", apiURL), registryHookFields(cmd, true))
+		},
+	}
+	addRegistryHookFlags(addRegistryHookCmd)
+	addRegistryHookCmd.MarkFlagRequired("name")
+	addRegistryHookCmd.MarkFlagRequired("repository")
+	addRegistryHookCmd.MarkFlagRequired("container")
+
+	updateRegistryHookCmd := &cobra.Command{
+		Use:   "update [id]",
+		Short: "Change the settings of a registry hook",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			fields := registryHookFields(cmd, false)
+			if len(fields) == 0 {
+				fmt.Println("Error: nothing to change")
+				return
+			}
+			registryHookRequest("PATCH", fmt.Sprintf("%s/v1/registry-hooks/%s", apiURL, url.PathEscape(args[0])), fields)
+		},
+	}
+	addRegistryHookFlags(updateRegistryHookCmd)
+
+	rotateRegistryHookCmd := &cobra.Command{
+		Use:   "rotate [id]",
+		Short: "Give a registry hook a new URL; the old one stops working",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			registryHookRequest("POST", fmt.Sprintf("%s/v1/registry-hooks/%s/rotate", apiURL, url.PathEscape(args[0])), nil)
+		},
+	}
+
+	removeRegistryHookCmd := registryHookActionCmd("remove [id]", "Delete a registry hook", "", "removed")
+	disableRegistryHookCmd := registryHookActionCmd("disable [id]", "Ignore the pushes sent to a registry hook", "disable", "disabled")
+	enableRegistryHookCmd := registryHookActionCmd("enable [id]", "Resume acting on the pushes sent to a registry hook", "enable", "enabled")
+
+	registryHooksCmd.AddCommand(listRegistryHooksCmd, addRegistryHookCmd, updateRegistryHookCmd, removeRegistryHookCmd, disableRegistryHookCmd, enableRegistryHookCmd, rotateRegistryHookCmd)
+	rootCmd.AddCommand(registryHooksCmd)
+}
@@ -3,15 +3,20 @@ package commands
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
 var (
-	apiURL  string
-	server  string
-	apiKey  string
-	rootCmd = &cobra.Command{
+	apiURL string
+	server string
+	apiKey string
+	// apiKeyID, when set, makes the CLI sign requests with apiKey instead
+	// of sending it.
+	apiKeyID int64
+	rootCmd  = &cobra.Command{
 		Use:   "docktrine",
 		Short: "Docktrine CLI - Manage Docker containers",
 		Long:  `A CLI tool for managing Docker containers through the Docktrine API.`,
@@ -21,21 +26,52 @@ var (
 					apiURL = envURL
 				}
 			}
-			
+
 			if !cmd.Flags().Changed("api-key") {
 				if envKey := os.Getenv("DOCKTRINE_API_KEY"); envKey != "" {
 					apiKey = envKey
 				}
 			}
-			
+
+			if !cmd.Flags().Changed("api-key-id") {
+				if envKeyID := os.Getenv("DOCKTRINE_API_KEY_ID"); envKeyID != "" {
+					id, err := strconv.ParseInt(envKeyID, 10, 64)
+					if err != nil {
+						return fmt.Errorf("invalid DOCKTRINE_API_KEY_ID: %w", err)
+					}
+					apiKeyID = id
+				}
+			}
+
+			creds, err := loadCredentials()
+			if err != nil {
+				return err
+			}
+
+			if apiURL == "" && creds != nil {
+				apiURL = creds.APIURL
+			}
+
 			if apiURL == "" {
 				return fmt.Errorf("DOCKTRINE_API_URL environment variable or --api-url flag must be set")
 			}
-			
-			if apiKey == "" {
-				return fmt.Errorf("DOCKTRINE_API_KEY environment variable or --api-key flag must be set")
+
+			if apiKey == "" && creds != nil && creds.APIURL == apiURL {
+				sessionToken = creds.Token
+			}
+
+			if cmd.Annotations[skipAuthAnnotation] == "true" {
+				return nil
+			}
+
+			if apiKey == "" && sessionToken == "" {
+				return fmt.Errorf("DOCKTRINE_API_KEY environment variable or --api-key flag must be set, or run `docktrine login`")
 			}
-			
+
+			if apiKey == "" && creds != nil && time.Now().After(creds.ExpiresAt) {
+				return fmt.Errorf("session expired, run `docktrine login` again")
+			}
+
 			return nil
 		},
 	}
@@ -49,4 +85,5 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&apiURL, "api-url", "", "Docktrine API URL (overrides DOCKTRINE_API_URL env var)")
 	rootCmd.PersistentFlags().StringVar(&server, "server", "", "Docker server name to connect to")
 	rootCmd.PersistentFlags().StringVar(&apiKey, "api-key", "", "API Key for authentication (overrides DOCKTRINE_API_KEY env var)")
-} 
\ No newline at end of file
+	rootCmd.PersistentFlags().Int64Var(&apiKeyID, "api-key-id", 0, "Sign requests with the API key instead of sending it, using this key ID (overrides DOCKTRINE_API_KEY_ID env var)")
+}
@@ -4,20 +4,27 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"net/http"
+	"net/url"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/Zeptile/docktrine/internal/docker"
 	"github.com/spf13/cobra"
 )
 
 type ServerResponse struct {
-	ID          int64     `json:"id"`
-	Name        string    `json:"name"`
-	Host        string    `json:"host"`
-	Description string    `json:"description"`
-	IsDefault   bool      `json:"is_default"`
-	CreatedAt   time.Time `json:"created_at"`
-	UpdatedAt   time.Time `json:"updated_at"`
+	ID          int64             `json:"id"`
+	Name        string            `json:"name"`
+	Host        string            `json:"host"`
+	Description string            `json:"description"`
+	IsDefault   bool              `json:"is_default"`
+	Source      string            `json:"source"`
+	Labels      map[string]string `json:"labels"`
+	Groups      []string          `json:"groups"`
+	Protected   bool              `json:"protected"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
 }
 
 var cachedServers []ServerResponse
@@ -25,10 +32,11 @@ var (
 	listServersCmd   *cobra.Command
 	addServerCmd     *cobra.Command
 	removeServerCmd  *cobra.Command
+	importServersCmd *cobra.Command
 )
 
 func fetchServers() error {
-	resp, err := http.Get(fmt.Sprintf("%s/servers", apiURL))
+	resp, err := makeRequest("GET", fmt.Sprintf("%s/v1/servers", apiURL), nil)
 	if err != nil {
 		return err
 	}
@@ -55,7 +63,31 @@ func init() {
 		Use:   "list",
 		Short: "List all servers",
 		Run: func(cmd *cobra.Command, args []string) {
-			resp, err := makeRequest("GET", fmt.Sprintf("%s/servers", apiURL), nil)
+			uri := fmt.Sprintf("%s/v1/servers", apiURL)
+			params := url.Values{}
+
+			if source, _ := cmd.Flags().GetString("source"); source != "" {
+				params.Add("source", source)
+			}
+
+			var terms []string
+			groups, _ := cmd.Flags().GetStringSlice("group")
+			for _, g := range groups {
+				terms = append(terms, "group:"+g)
+			}
+			labels, _ := cmd.Flags().GetStringSlice("label")
+			for _, l := range labels {
+				terms = append(terms, "label:"+l)
+			}
+			if len(terms) > 0 {
+				params.Add("selector", strings.Join(terms, ","))
+			}
+
+			if len(params) > 0 {
+				uri += "?" + params.Encode()
+			}
+
+			resp, err := makeRequest("GET", uri, nil)
 			if err != nil {
 				fmt.Printf("Error: %v\n", err)
 				return
@@ -74,10 +106,31 @@ func init() {
 			}
 
 			for _, server := range servers {
-				fmt.Printf("Name: %s\nHost: %s\nDefault: %v\n", 
-					server.Name, 
-					server.Host, 
+				fmt.Printf("Name: %s\nHost: %s\nDefault: %v\n",
+					server.Name,
+					server.Host,
 					server.IsDefault)
+				if server.Source != "" {
+					fmt.Printf("Source: %s\n", server.Source)
+				}
+				if server.Protected {
+					fmt.Println("Protected: true")
+				}
+				if len(server.Groups) > 0 {
+					fmt.Printf("Groups: %s\n", strings.Join(server.Groups, ", "))
+				}
+				if len(server.Labels) > 0 {
+					keys := make([]string, 0, len(server.Labels))
+					for k := range server.Labels {
+						keys = append(keys, k)
+					}
+					sort.Strings(keys)
+					pairs := make([]string, 0, len(keys))
+					for _, k := range keys {
+						pairs = append(pairs, fmt.Sprintf("%s=%s", k, server.Labels[k]))
+					}
+					fmt.Printf("Labels: %s\n", strings.Join(pairs, ", "))
+				}
 				if server.Description != "" {
 					fmt.Printf("Description: %s\n", server.Description)
 				}
@@ -94,12 +147,28 @@ func init() {
 			host, _ := cmd.Flags().GetString("host")
 			desc, _ := cmd.Flags().GetString("description")
 			isDefault, _ := cmd.Flags().GetBool("default")
+			groups, _ := cmd.Flags().GetStringSlice("group")
+			labelArgs, _ := cmd.Flags().GetStringSlice("label")
+			protected, _ := cmd.Flags().GetBool("protected")
+
+			labels := map[string]string{}
+			for _, l := range labelArgs {
+				key, value, ok := strings.Cut(l, "=")
+				if !ok || key == "" {
+					fmt.Printf("Error: invalid label %q, expected key=value\n", l)
+					return
+				}
+				labels[key] = value
+			}
 
 			serverData := map[string]interface{}{
 				"name":        name,
 				"host":        host,
 				"description": desc,
 				"is_default":  isDefault,
+				"labels":      labels,
+				"groups":      groups,
+				"protected":   protected,
 			}
 
 			jsonData, err := json.Marshal(serverData)
@@ -108,7 +177,7 @@ func init() {
 				return
 			}
 
-			resp, err := makeRequest("POST", fmt.Sprintf("%s/servers", apiURL), 
+			resp, err := makeRequest("POST", fmt.Sprintf("%s/v1/servers", apiURL),
 				bytes.NewBuffer(jsonData))
 			if err != nil {
 				fmt.Printf("Error: %v\n", err)
@@ -131,18 +200,82 @@ func init() {
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			name := args[0]
-			
-			req, err := http.NewRequest(
-				"DELETE",
-				fmt.Sprintf("%s/servers/%s", apiURL, name),
-				nil,
-			)
+
+			resp, err := makeRequest("DELETE", fmt.Sprintf("%s/v1/servers/%s", apiURL, name), nil)
 			if err != nil {
 				fmt.Printf("Error: %v\n", err)
 				return
 			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			if printAccepted(resp) {
+				return
+			}
 
-			resp, err := http.DefaultClient.Do(req)
+			if err := fetchServers(); err != nil {
+				fmt.Printf("Warning: Failed to refresh server cache: %v\n", err)
+			}
+
+			fmt.Printf("Server '%s' removed successfully\n", name)
+		},
+	}
+
+	listServersCmd.Flags().String("source", "", "Only show servers from this source (config, api or docker-context)")
+	listServersCmd.Flags().StringSlice("group", nil, "Only show servers in this group (repeatable)")
+	listServersCmd.Flags().StringSlice("label", nil, "Only show servers with this label, as key or key=value (repeatable)")
+
+	importServersCmd = &cobra.Command{
+		Use:   "import",
+		Short: "Import servers from Docker CLI contexts",
+		Run: func(cmd *cobra.Command, args []string) {
+			fromContexts, _ := cmd.Flags().GetBool("from-docker-contexts")
+			configDir, _ := cmd.Flags().GetString("docker-config")
+			update, _ := cmd.Flags().GetBool("update")
+
+			if !fromContexts {
+				fmt.Println("Error: --from-docker-contexts is required")
+				return
+			}
+
+			if configDir == "" {
+				dir, err := docker.DefaultDockerConfigDir()
+				if err != nil {
+					fmt.Printf("Error: %v\n", err)
+					return
+				}
+				configDir = dir
+			}
+
+			servers, skipped, err := docker.LoadDockerContexts(configDir)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			if len(servers) == 0 {
+				fmt.Printf("No usable Docker contexts found in %s\n", configDir)
+				for _, s := range skipped {
+					fmt.Printf("Skipped %s\n", s)
+				}
+				return
+			}
+
+			jsonData, err := json.Marshal(map[string]interface{}{
+				"servers": servers,
+				"update":  update,
+			})
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			resp, err := makeRequest("POST", fmt.Sprintf("%s/v1/servers/import", apiURL),
+				bytes.NewBuffer(jsonData))
 			if err != nil {
 				fmt.Printf("Error: %v\n", err)
 				return
@@ -154,19 +287,52 @@ func init() {
 				return
 			}
 
-			if err := fetchServers(); err != nil {
-				fmt.Printf("Warning: Failed to refresh server cache: %v\n", err)
+			var result docker.ImportResult
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
 			}
 
-			fmt.Printf("Server '%s' removed successfully\n", name)
+			for _, name := range result.Created {
+				fmt.Printf("Created %s\n", name)
+			}
+			for _, name := range result.Updated {
+				fmt.Printf("Updated %s\n", name)
+			}
+			for _, s := range append(result.Skipped, skipped...) {
+				fmt.Printf("Skipped %s\n", s)
+			}
 		},
 	}
 
+	importServersCmd.Flags().Bool("from-docker-contexts", false, "Import servers from Docker CLI contexts")
+	importServersCmd.Flags().String("docker-config", "", "Docker CLI config directory (defaults to $DOCKER_CONFIG or ~/.docker)")
+	importServersCmd.Flags().Bool("update", false, "Update servers that already exist instead of skipping them")
+
 	addServerCmd.Flags().String("name", "", "Server name")
 	addServerCmd.Flags().String("host", "", "Server host (e.g., unix:///var/run/docker.sock)")
 	addServerCmd.Flags().String("description", "", "Server description")
 	addServerCmd.Flags().Bool("default", false, "Set as default server")
+	addServerCmd.Flags().StringSlice("group", nil, "Add the server to a group (repeatable)")
+	addServerCmd.Flags().StringSlice("label", nil, "Label the server as key=value (repeatable)")
+	addServerCmd.Flags().Bool("protected", false, "Require a second user or API key to approve stopping, restarting or removing")
 
-	serversCmd.AddCommand(listServersCmd, addServerCmd, removeServerCmd)
+	serverHistoryCmd := &cobra.Command{
+		Use:   "history [name]",
+		Short: "Show the recorded lifecycle events of a server's containers",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			params := url.Values{}
+			if container, _ := cmd.Flags().GetString("container"); container != "" {
+				params.Add("container", container)
+			}
+			showHistory(cmd, fmt.Sprintf("%s/v1/servers/%s/history", apiURL, url.PathEscape(args[0])), params)
+		},
+	}
+
+	addHistoryFlags(serverHistoryCmd)
+	serverHistoryCmd.Flags().String("container", "", "Only this container (ID, ID prefix or name)")
+
+	serversCmd.AddCommand(listServersCmd, addServerCmd, removeServerCmd, importServersCmd, serverHistoryCmd)
 	rootCmd.AddCommand(serversCmd)
-} 
\ No newline at end of file
+}
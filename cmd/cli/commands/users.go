@@ -0,0 +1,158 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type UserResponse struct {
+	ID          int64      `json:"id"`
+	Username    string     `json:"username"`
+	Role        string     `json:"role"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+}
+
+func init() {
+	usersCmd := &cobra.Command{
+		Use:   "users",
+		Short: "Manage user accounts (requires admin)",
+	}
+
+	listUsersCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List users",
+		Run: func(cmd *cobra.Command, args []string) {
+			resp, err := makeRequest("GET", fmt.Sprintf("%s/v1/users", apiURL), nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			var users []UserResponse
+			if err := json.NewDecoder(resp.Body).Decode(&users); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			for _, user := range users {
+				lastLogin := "never"
+				if user.LastLoginAt != nil {
+					lastLogin = user.LastLoginAt.Format(time.RFC3339)
+				}
+				fmt.Printf("Username: %s\nRole: %s\nLast login: %s\n\n",
+					user.Username,
+					user.Role,
+					lastLogin)
+			}
+		},
+	}
+
+	addUserCmd := &cobra.Command{
+		Use:   "add [username]",
+		Short: "Create a user",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			role, _ := cmd.Flags().GetString("role")
+
+			password, err := readPassword("Password: ")
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			jsonData, err := json.Marshal(map[string]string{
+				"username": args[0],
+				"password": password,
+				"role":     role,
+			})
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			resp, err := makeRequest("POST", fmt.Sprintf("%s/v1/users", apiURL), bytes.NewBuffer(jsonData))
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			fmt.Printf("User %s created with role %s\n", args[0], role)
+		},
+	}
+
+	passwdCmd := &cobra.Command{
+		Use:   "passwd [username]",
+		Short: "Set a user's password",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			password, err := readPassword("New password: ")
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			jsonData, err := json.Marshal(map[string]string{"password": password})
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			resp, err := makeRequest("PUT", fmt.Sprintf("%s/v1/users/%s/password", apiURL, args[0]), bytes.NewBuffer(jsonData))
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			fmt.Printf("Password updated for %s\n", args[0])
+		},
+	}
+
+	removeUserCmd := &cobra.Command{
+		Use:   "remove [username]",
+		Short: "Delete a user",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			resp, err := makeRequest("DELETE", fmt.Sprintf("%s/v1/users/%s", apiURL, args[0]), nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			fmt.Printf("User %s removed\n", args[0])
+		},
+	}
+
+	addUserCmd.Flags().String("role", "viewer", "Role: viewer, operator or admin")
+
+	usersCmd.AddCommand(listUsersCmd, addUserCmd, passwdCmd, removeUserCmd)
+	rootCmd.AddCommand(usersCmd)
+}
@@ -0,0 +1,401 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+type WebhookResponse struct {
+	ID          int64             `json:"id"`
+	Name        string            `json:"name"`
+	URL         string            `json:"url"`
+	Secret      string            `json:"secret"`
+	Events      []string          `json:"events"`
+	Format      string            `json:"format"`
+	Templates   map[string]string `json:"templates"`
+	MinSeverity string            `json:"min_severity"`
+	Enabled     bool              `json:"enabled"`
+	CreatedAt   time.Time         `json:"created_at"`
+}
+
+type WebhookDeliveryResponse struct {
+	ID             int64           `json:"id"`
+	WebhookID      int64           `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at"`
+	ResponseStatus *int            `json:"response_status"`
+	Error          string          `json:"error"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at"`
+}
+
+func printWebhook(webhook WebhookResponse) {
+	state := "enabled"
+	if !webhook.Enabled {
+		state = "disabled"
+	}
+	minSeverity := webhook.MinSeverity
+	if minSeverity == "" {
+		minSeverity = "any"
+	}
+	fmt.Printf("ID: %d\nName: %s\nURL: %s\nEvents: %s\nFormat: %s\nMin severity: %s\nState: %s\n",
+		webhook.ID,
+		webhook.Name,
+		webhook.URL,
+		strings.Join(webhook.Events, ", "),
+		webhook.Format,
+		minSeverity,
+		state)
+	if len(webhook.Templates) > 0 {
+		events := make([]string, 0, len(webhook.Templates))
+		for event := range webhook.Templates {
+			events = append(events, event)
+		}
+		sort.Strings(events)
+		fmt.Println("Templates:")
+		for _, event := range events {
+			fmt.Printf("  %s: %s\n", event, webhook.Templates[event])
+		}
+	}
+}
+
+// parseTemplates turns event=template flags into a template map.
+func parseTemplates(values []string) (map[string]string, error) {
+	templates := map[string]string{}
+	for _, value := range values {
+		event, text, ok := strings.Cut(value, "=")
+		if !ok || event == "" {
+			return nil, fmt.Errorf("invalid template %q, expected event=template", value)
+		}
+		templates[event] = text
+	}
+	return templates, nil
+}
+
+func webhookActionCmd(use, short, method, action, done string) *cobra.Command {
+	return &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			uri := fmt.Sprintf("%s/v1/webhooks/%s", apiURL, url.PathEscape(args[0]))
+			if action != "" {
+				uri += "/" + action
+			}
+
+			resp, err := makeRequest(method, uri, nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			fmt.Printf("Webhook %s %s\n", args[0], done)
+		},
+	}
+}
+
+func init() {
+	webhooksCmd := &cobra.Command{
+		Use:   "webhooks",
+		Short: "Manage webhook notifications (requires an admin key)",
+	}
+
+	listWebhooksCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List webhooks",
+		Run: func(cmd *cobra.Command, args []string) {
+			resp, err := makeRequest("GET", fmt.Sprintf("%s/v1/webhooks", apiURL), nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			var webhooks []WebhookResponse
+			if err := json.NewDecoder(resp.Body).Decode(&webhooks); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			if len(webhooks) == 0 {
+				fmt.Println("No webhooks")
+				return
+			}
+			for _, webhook := range webhooks {
+				printWebhook(webhook)
+				fmt.Println()
+			}
+		},
+	}
+
+	addWebhookCmd := &cobra.Command{
+		Use:   "add",
+		Short: "Register a webhook",
+		Run: func(cmd *cobra.Command, args []string) {
+			name, _ := cmd.Flags().GetString("name")
+			endpoint, _ := cmd.Flags().GetString("url")
+			secret, _ := cmd.Flags().GetString("secret")
+			events, _ := cmd.Flags().GetStringSlice("event")
+			format, _ := cmd.Flags().GetString("format")
+			minSeverity, _ := cmd.Flags().GetString("min-severity")
+			templateFlags, _ := cmd.Flags().GetStringArray("template")
+			templates, err := parseTemplates(templateFlags)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			jsonData, err := json.Marshal(map[string]interface{}{
+				"name":         name,
+				"url":          endpoint,
+				"secret":       secret,
+				"events":       events,
+				"format":       format,
+				"templates":    templates,
+				"min_severity": minSeverity,
+			})
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			resp, err := makeRequest("POST", fmt.Sprintf("%s/v1/webhooks", apiURL), bytes.NewBuffer(jsonData))
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			var webhook WebhookResponse
+			if err := json.NewDecoder(resp.Body).Decode(&webhook); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			printWebhook(webhook)
+			fmt.Printf("Secret: %s\n", webhook.Secret)
+			fmt.Println("Store this secret now to verify signatures, it will not be shown again.")
+		},
+	}
+	addWebhookCmd.Flags().String("name", "", "Name of the webhook")
+	addWebhookCmd.Flags().String("url", "", "Endpoint notifications are POSTed to")
+	addWebhookCmd.Flags().String("secret", "", "Signing secret (generated if not given)")
+	addWebhookCmd.Flags().StringSlice("event", nil, "Event to send: alert.fired, alert.resolved, container.died, container.restarted, server.offline, server.online, job.finished (repeatable, default all)")
+	addWebhookCmd.Flags().String("format", "json", "Payload format: json, slack, mattermost or discord")
+	addWebhookCmd.Flags().String("min-severity", "", "Only send notifications of this severity or higher: info, warning or critical")
+	addWebhookCmd.Flags().StringArray("template", nil, "Message template for chat formats as event=template, with * for all events (repeatable)")
+	addWebhookCmd.MarkFlagRequired("name")
+	addWebhookCmd.MarkFlagRequired("url")
+
+	updateWebhookCmd := &cobra.Command{
+		Use:   "update [id]",
+		Short: "Change the settings of a webhook",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			changes := map[string]interface{}{}
+			for _, flag := range []struct{ name, field string }{
+				{"name", "name"},
+				{"url", "url"},
+				{"format", "format"},
+				{"min-severity", "min_severity"},
+			} {
+				if cmd.Flags().Changed(flag.name) {
+					value, _ := cmd.Flags().GetString(flag.name)
+					changes[flag.field] = value
+				}
+			}
+			if cmd.Flags().Changed("event") {
+				events, _ := cmd.Flags().GetStringSlice("event")
+				changes["events"] = events
+			}
+			if cmd.Flags().Changed("template") {
+				templateFlags, _ := cmd.Flags().GetStringArray("template")
+				templates, err := parseTemplates(templateFlags)
+				if err != nil {
+					fmt.Printf("Error: %v\n", err)
+					return
+				}
+				changes["templates"] = templates
+			}
+			if clear, _ := cmd.Flags().GetBool("clear-templates"); clear {
+				changes["templates"] = map[string]string{}
+			}
+			if len(changes) == 0 {
+				fmt.Println("Error: nothing to change")
+				return
+			}
+
+			jsonData, err := json.Marshal(changes)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			resp, err := makeRequest("PATCH", fmt.Sprintf("%s/v1/webhooks/%s", apiURL, url.PathEscape(args[0])), bytes.NewBuffer(jsonData))
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			var webhook WebhookResponse
+			if err := json.NewDecoder(resp.Body).Decode(&webhook); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			printWebhook(webhook)
+		},
+	}
+	updateWebhookCmd.Flags().String("name", "", "New name")
+	updateWebhookCmd.Flags().String("url", "", "New endpoint")
+	updateWebhookCmd.Flags().StringSlice("event", nil, "Events to send, replacing the current ones (repeatable)")
+	updateWebhookCmd.Flags().String("format", "", "Payload format: json, slack, mattermost or discord")
+	updateWebhookCmd.Flags().String("min-severity", "", "Only send notifications of this severity or higher; empty sends all")
+	updateWebhookCmd.Flags().StringArray("template", nil, "Message template as event=template, replacing the current ones (repeatable)")
+	updateWebhookCmd.Flags().Bool("clear-templates", false, "Remove all templates")
+
+	testWebhookCmd := &cobra.Command{
+		Use:   "test [id]",
+		Short: "Send a test notification to a webhook",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			resp, err := makeRequest("POST", fmt.Sprintf("%s/v1/webhooks/%s/test", apiURL, url.PathEscape(args[0])), nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			var delivery WebhookDeliveryResponse
+			if err := json.NewDecoder(resp.Body).Decode(&delivery); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			fmt.Printf("Queued delivery %d. Check its outcome with:\n  docktrine webhooks deliveries %s\n", delivery.ID, args[0])
+		},
+	}
+
+	deliveriesCmd := &cobra.Command{
+		Use:   "deliveries [id]",
+		Short: "Show the delivery log of a webhook",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			params := url.Values{}
+			if status, _ := cmd.Flags().GetString("status"); status != "" {
+				params.Add("status", status)
+			}
+			if cmd.Flags().Changed("limit") {
+				limit, _ := cmd.Flags().GetInt("limit")
+				params.Add("limit", fmt.Sprint(limit))
+			}
+
+			uri := fmt.Sprintf("%s/v1/webhooks/%s/deliveries", apiURL, url.PathEscape(args[0]))
+			if len(params) > 0 {
+				uri += "?" + params.Encode()
+			}
+
+			resp, err := makeRequest("GET", uri, nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			var deliveries []WebhookDeliveryResponse
+			if err := json.NewDecoder(resp.Body).Decode(&deliveries); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			if len(deliveries) == 0 {
+				fmt.Println("No deliveries")
+				return
+			}
+			for _, d := range deliveries {
+				line := fmt.Sprintf("%d  %s  %-20s %-9s attempts: %d", d.ID, d.CreatedAt.Local().Format(time.RFC3339), d.Event, d.Status, d.Attempts)
+				if d.ResponseStatus != nil {
+					line += fmt.Sprintf("  HTTP %d", *d.ResponseStatus)
+				}
+				if d.Status == "pending" && d.NextAttemptAt != nil {
+					line += fmt.Sprintf("  next attempt %s", d.NextAttemptAt.Local().Format(time.RFC3339))
+				}
+				fmt.Println(line)
+				if d.Error != "" {
+					fmt.Printf("    %s\n", d.Error)
+				}
+			}
+		},
+	}
+	deliveriesCmd.Flags().String("status", "", "Only deliveries with this status (pending, succeeded, failed)")
+	deliveriesCmd.Flags().Int("limit", 50, "Maximum number of deliveries")
+
+	redeliverCmd := &cobra.Command{
+		Use:   "redeliver [id] [delivery]",
+		Short: "Send a delivery again",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			uri := fmt.Sprintf("%s/v1/webhooks/%s/deliveries/%s/redeliver", apiURL, url.PathEscape(args[0]), url.PathEscape(args[1]))
+			resp, err := makeRequest("POST", uri, nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			defer resp.Body.Close()
+
+			if err := handleError(resp); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+
+			fmt.Printf("Delivery %s queued\n", args[1])
+		},
+	}
+
+	removeWebhookCmd := webhookActionCmd("remove [id]", "Delete a webhook and its delivery log", "DELETE", "", "removed")
+	disableWebhookCmd := webhookActionCmd("disable [id]", "Stop sending notifications to a webhook", "POST", "disable", "disabled")
+	enableWebhookCmd := webhookActionCmd("enable [id]", "Resume sending notifications to a webhook", "POST", "enable", "enabled")
+
+	webhooksCmd.AddCommand(listWebhooksCmd, addWebhookCmd, updateWebhookCmd, removeWebhookCmd, disableWebhookCmd, enableWebhookCmd,
+		testWebhookCmd, deliveriesCmd, redeliverCmd)
+	rootCmd.AddCommand(webhooksCmd)
+}
@@ -0,0 +1,211 @@
+package alerts
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/Zeptile/docktrine/internal/notify"
+)
+
+// Alert kinds.
+const (
+	KindCrashLoop = "crash_loop"
+	KindFailing   = "failing"
+	KindOOMKilled = "oom_killed"
+)
+
+const sweepInterval = time.Minute
+
+// Rules are the thresholds alerts are raised at.
+type Rules struct {
+	// CrashLoopRestarts is how many starts within Window make a crash loop.
+	CrashLoopRestarts int
+	// FailedExits is how many non-zero exits within Window make a container
+	// failing.
+	FailedExits int
+	Window      time.Duration
+}
+
+var DefaultRules = Rules{
+	CrashLoopRestarts: 5,
+	FailedExits:       3,
+	Window:            10 * time.Minute,
+}
+
+// Detector raises alerts from recorded container events and resolves them
+// once their condition has cleared for a whole window.
+type Detector struct {
+	db     *database.DB
+	notify *notify.Dispatcher
+	Rules  Rules
+}
+
+func NewDetector(db *database.DB, dispatcher *notify.Dispatcher, rules Rules) *Detector {
+	return &Detector{db: db, notify: dispatcher, Rules: rules}
+}
+
+// Observe checks the rules against a newly recorded event. It is meant to be
+// the history recorder's OnEvent hook.
+func (d *Detector) Observe(event database.ContainerEvent) {
+	switch event.Action {
+	case "oom":
+		d.raise(event, KindOOMKilled, notify.SeverityCritical, "was killed for running out of memory")
+	case "start":
+		count, err := d.count(event, database.ContainerEventFilter{Actions: []string{"start"}})
+		if err != nil {
+			logger.Error(err, "Failed to check container restarts")
+			return
+		}
+		if count > d.Rules.CrashLoopRestarts {
+			d.raise(event, KindCrashLoop, notify.SeverityCritical,
+				fmt.Sprintf("started %d times in %s", count, d.Rules.Window))
+		}
+	case "die":
+		if event.ExitCode == nil || *event.ExitCode == 0 {
+			return
+		}
+		count, err := d.count(event, database.ContainerEventFilter{FailedOnly: true})
+		if err != nil {
+			logger.Error(err, "Failed to check container exits")
+			return
+		}
+		if count >= d.Rules.FailedExits {
+			d.raise(event, KindFailing, notify.SeverityWarning,
+				fmt.Sprintf("exited non-zero %d times in %s, last with code %d", count, d.Rules.Window, *event.ExitCode))
+		}
+	}
+}
+
+// count counts the container's events matching filter within the window
+// ending at event.
+func (d *Detector) count(event database.ContainerEvent, filter database.ContainerEventFilter) (int, error) {
+	filter.Servers = []string{event.Server}
+	filter.Container = event.ContainerID
+	filter.Since = event.Time.Add(-d.Rules.Window)
+	return d.db.CountContainerEvents(filter)
+}
+
+func (d *Detector) raise(event database.ContainerEvent, kind, severity, message string) {
+	alert, created, err := d.db.RaiseAlert(&database.Alert{
+		Server:        event.Server,
+		ContainerID:   event.ContainerID,
+		ContainerName: event.ContainerName,
+		Kind:          kind,
+		Severity:      severity,
+		Message:       message,
+		Labels:        containerLabels(event.Attributes),
+	})
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("Failed to raise %s alert for container %s on %s", kind, event.ContainerName, event.Server))
+		return
+	}
+	if !created {
+		return
+	}
+
+	d.notify.Send(notify.Notification{
+		Event:     notify.EventAlertFired,
+		Severity:  alert.Severity,
+		Title:     fmt.Sprintf("Container %s on %s: %s", alert.ContainerName, alert.Server, kind),
+		Message:   fmt.Sprintf("Container %s on %s %s", alert.ContainerName, alert.Server, message),
+		Server:    alert.Server,
+		Container: alert.ContainerName,
+		Data:      alert,
+	})
+}
+
+// Run resolves cleared alerts every minute until ctx is cancelled.
+func (d *Detector) Run(ctx context.Context) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		d.sweep()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep resolves the active alerts whose condition no longer holds over the
+// last window.
+func (d *Detector) sweep() {
+	active, err := d.db.ListAlerts(database.AlertFilter{Status: database.AlertActive})
+	if err != nil {
+		logger.Error(err, "Failed to list active alerts")
+		return
+	}
+
+	now := time.Now()
+	for _, alert := range active {
+		filter := database.ContainerEventFilter{
+			Servers:   []string{alert.Server},
+			Container: alert.ContainerID,
+			Since:     now.Add(-d.Rules.Window),
+		}
+		threshold := 1
+		switch alert.Kind {
+		case KindOOMKilled:
+			filter.Actions = []string{"oom"}
+		case KindCrashLoop:
+			filter.Actions = []string{"start"}
+			threshold = d.Rules.CrashLoopRestarts + 1
+		case KindFailing:
+			filter.FailedOnly = true
+			threshold = d.Rules.FailedExits
+		}
+
+		count, err := d.db.CountContainerEvents(filter)
+		if err != nil {
+			logger.Error(err, fmt.Sprintf("Failed to check alert %d", alert.ID))
+			continue
+		}
+		if count >= threshold {
+			continue
+		}
+		d.resolve(alert)
+	}
+}
+
+func (d *Detector) resolve(alert database.Alert) {
+	resolved, err := d.db.ResolveAlert(alert.ID)
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("Failed to resolve alert %d", alert.ID))
+		return
+	}
+	if !resolved {
+		return
+	}
+
+	now := time.Now().UTC()
+	alert.Status = database.AlertResolved
+	alert.ResolvedAt = &now
+	d.notify.Send(notify.Notification{
+		Event:     notify.EventAlertResolved,
+		Severity:  notify.SeverityInfo,
+		Title:     fmt.Sprintf("Container %s on %s: %s resolved", alert.ContainerName, alert.Server, alert.Kind),
+		Message:   fmt.Sprintf("Container %s on %s has been stable for %s", alert.ContainerName, alert.Server, d.Rules.Window),
+		Server:    alert.Server,
+		Container: alert.ContainerName,
+		Data:      alert,
+	})
+}
+
+// containerLabels keeps the container labels among event attributes,
+// dropping the attributes Docker adds itself.
+func containerLabels(attributes map[string]string) map[string]string {
+	labels := map[string]string{}
+	for key, value := range attributes {
+		switch key {
+		case "name", "image", "exitCode", "signal", "execDuration":
+			continue
+		}
+		labels[key] = value
+	}
+	return labels
+}
@@ -0,0 +1,182 @@
+// Package apierror is the error model of the API. Every failed request is
+// answered with {"error": Error}, where Error carries a stable
+// machine-readable code next to the human-readable message.
+package apierror
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	CodeBadRequest        = "bad_request"
+	CodeUnauthorized      = "unauthorized"
+	CodeForbidden         = "forbidden"
+	CodeNotFound          = "not_found"
+	CodeConflict          = "conflict"
+	CodeNotModified       = "not_modified"
+	CodeRateLimited       = "rate_limited"
+	CodeInternal          = "internal"
+	CodeNotImplemented    = "not_implemented"
+	CodePartialFailure    = "partial_failure"
+	CodeDockerUnreachable = "docker_unreachable"
+	CodeDockerUnavailable = "docker_unavailable"
+	CodeDockerTimeout     = "docker_timeout"
+	CodeDockerAuth        = "docker_unauthorized"
+	CodeIdentityProvider  = "identity_provider_error"
+	CodeSMTP              = "smtp_error"
+	// The device login codes of RFC 8628, returned while polling.
+	CodeAuthorizationPending = "authorization_pending"
+	CodeSlowDown             = "slow_down"
+)
+
+// RequestIDHeader carries the ID of a request in both directions.
+const RequestIDHeader = "X-Request-ID"
+
+type Error struct {
+	// Status is the HTTP status the error is answered with.
+	Status  int                    `json:"-"`
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	// RequestID matches the X-Request-ID response header and the API log.
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// Response is the body of a failed request.
+type Response struct {
+	Error *Error `json:"error"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// WithDetail returns e with key set in its details.
+func (e *Error) WithDetail(key string, value interface{}) *Error {
+	if e.Details == nil {
+		e.Details = map[string]interface{}{}
+	}
+	e.Details[key] = value
+	return e
+}
+
+func New(status int, code string, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+func BadRequest(message string) *Error {
+	return New(fiber.StatusBadRequest, CodeBadRequest, message)
+}
+
+func Unauthorized(message string) *Error {
+	return New(fiber.StatusUnauthorized, CodeUnauthorized, message)
+}
+
+func Forbidden(message string) *Error {
+	return New(fiber.StatusForbidden, CodeForbidden, message)
+}
+
+func NotFound(message string) *Error {
+	return New(fiber.StatusNotFound, CodeNotFound, message)
+}
+
+func Conflict(message string) *Error {
+	return New(fiber.StatusConflict, CodeConflict, message)
+}
+
+func Internal(message string) *Error {
+	return New(fiber.StatusInternalServerError, CodeInternal, message)
+}
+
+// From classifies err. Errors that are already an *Error are returned as
+// is, Docker errors are mapped by their errdefs class and anything else is
+// an internal error.
+func From(err error) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		return New(fiberErr.Code, codeForStatus(fiberErr.Code), fiberErr.Message)
+	}
+
+	message := err.Error()
+	switch {
+	case errdefs.IsNotFound(err):
+		return NotFound(message)
+	case errdefs.IsInvalidParameter(err):
+		return BadRequest(message)
+	case errdefs.IsConflict(err):
+		return Conflict(message)
+	case errdefs.IsNotModified(err):
+		return New(fiber.StatusNotModified, CodeNotModified, message)
+	case errdefs.IsForbidden(err):
+		return Forbidden(message)
+	case errdefs.IsUnauthorized(err):
+		// The daemon or a registry refused Docktrine's credentials, which
+		// is not the caller's authentication failing.
+		return New(fiber.StatusBadGateway, CodeDockerAuth, message)
+	case client.IsErrConnectionFailed(err):
+		return New(fiber.StatusBadGateway, CodeDockerUnreachable, message)
+	case errdefs.IsUnavailable(err):
+		return New(fiber.StatusServiceUnavailable, CodeDockerUnavailable, message)
+	case errdefs.IsDeadline(err), errors.Is(err, context.DeadlineExceeded), isTimeout(err):
+		return New(fiber.StatusGatewayTimeout, CodeDockerTimeout, message)
+	case errdefs.IsNotImplemented(err):
+		return New(fiber.StatusNotImplemented, CodeNotImplemented, message)
+	case isNetError(err):
+		return New(fiber.StatusBadGateway, CodeDockerUnreachable, message)
+	}
+	return Internal(message)
+}
+
+// Send answers the request with err, classified by From.
+func Send(c *fiber.Ctx, err error) error {
+	apiErr := From(err)
+	if apiErr.Status == fiber.StatusNotModified {
+		// 304 responses cannot carry a body.
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	body := *apiErr
+	body.RequestID = c.GetRespHeader(RequestIDHeader)
+	return c.Status(apiErr.Status).JSON(Response{Error: &body})
+}
+
+func codeForStatus(status int) string {
+	switch status {
+	case fiber.StatusBadRequest, fiber.StatusUnprocessableEntity, fiber.StatusRequestEntityTooLarge:
+		return CodeBadRequest
+	case fiber.StatusUnauthorized:
+		return CodeUnauthorized
+	case fiber.StatusForbidden:
+		return CodeForbidden
+	case fiber.StatusNotFound, fiber.StatusMethodNotAllowed:
+		return CodeNotFound
+	case fiber.StatusConflict:
+		return CodeConflict
+	case fiber.StatusTooManyRequests:
+		return CodeRateLimited
+	case fiber.StatusNotImplemented:
+		return CodeNotImplemented
+	}
+	return CodeInternal
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func isNetError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
@@ -0,0 +1,161 @@
+// Package audit holds the hash chain and checkpoint signatures that make the
+// audit log tamper-evident. It is shared by the API, which writes the chain,
+// and the CLI, which verifies exported events.
+package audit
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// GenesisHash is the previous hash of the first event in the chain.
+var GenesisHash = hex.EncodeToString(make([]byte, sha256.Size))
+
+// Record is the part of an audit event covered by its hash.
+type Record struct {
+	ID         int64           `json:"id"`
+	Timestamp  time.Time       `json:"timestamp"`
+	ActorType  string          `json:"actor_type"`
+	ActorID    int64           `json:"actor_id"`
+	ActorName  string          `json:"actor_name"`
+	SourceIP   string          `json:"source_ip"`
+	Action     string          `json:"action"`
+	Server     string          `json:"server"`
+	Target     string          `json:"target"`
+	Params     json.RawMessage `json:"params"`
+	Status     int             `json:"status"`
+	Result     string          `json:"result"`
+	Error      string          `json:"error"`
+	DurationMS int64           `json:"duration_ms"`
+	PrevHash   string          `json:"prev_hash"`
+	Hash       string          `json:"hash"`
+}
+
+type Checkpoint struct {
+	ID        int64     `json:"id"`
+	EventID   int64     `json:"event_id"`
+	Hash      string    `json:"hash"`
+	Signature string    `json:"signature"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ComputeHash hashes the record's fields together with the previous hash.
+// Params are compacted first so whitespace differences between the stored
+// and exported JSON do not matter.
+func (r *Record) ComputeHash() string {
+	params := []byte("{}")
+	if len(r.Params) > 0 && string(r.Params) != "null" {
+		var m map[string]interface{}
+		if err := json.Unmarshal(r.Params, &m); err == nil {
+			params, _ = json.Marshal(m)
+		}
+	}
+
+	fields := []interface{}{
+		r.PrevHash,
+		r.ID,
+		r.Timestamp.UTC().Format(time.RFC3339Nano),
+		r.ActorType,
+		r.ActorID,
+		r.ActorName,
+		r.SourceIP,
+		r.Action,
+		r.Server,
+		r.Target,
+		json.RawMessage(params),
+		r.Status,
+		r.Result,
+		r.Error,
+		r.DurationMS,
+	}
+	data, _ := json.Marshal(fields)
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkpointMessage is what a checkpoint signature covers.
+func checkpointMessage(eventID int64, hash string) []byte {
+	return []byte(fmt.Sprintf("docktrine-audit-checkpoint:%d:%s", eventID, hash))
+}
+
+func SignCheckpoint(key ed25519.PrivateKey, eventID int64, hash string) string {
+	return hex.EncodeToString(ed25519.Sign(key, checkpointMessage(eventID, hash)))
+}
+
+func VerifyCheckpoint(key ed25519.PublicKey, checkpoint Checkpoint) bool {
+	signature, err := hex.DecodeString(checkpoint.Signature)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(key, checkpointMessage(checkpoint.EventID, checkpoint.Hash), signature)
+}
+
+// VerifyResult reports the outcome of Verify. BrokenAt is the ID of the
+// first event or checkpoint that failed, and zero when the chain is intact.
+type VerifyResult struct {
+	EventsChecked      int
+	CheckpointsChecked int
+	BrokenAt           int64
+	Reason             string
+}
+
+func (r *VerifyResult) OK() bool {
+	return r.Reason == ""
+}
+
+// Verify walks records, which must be every event in ID order, checking
+// each hash and its link to the previous record, then checks that every
+// checkpoint is signed by key and matches the event it covers. Deleting or
+// editing any event up to the last checkpoint is detected; events after the
+// last checkpoint are only protected by the chain itself.
+func Verify(records []Record, checkpoints []Checkpoint, key ed25519.PublicKey) *VerifyResult {
+	result := &VerifyResult{}
+
+	hashes := make(map[int64]string, len(records))
+	prev := GenesisHash
+	for _, record := range records {
+		result.EventsChecked++
+
+		if record.PrevHash != prev {
+			result.BrokenAt = record.ID
+			result.Reason = "previous hash does not match the preceding event; an event was deleted or reordered"
+			return result
+		}
+		if record.ComputeHash() != record.Hash {
+			result.BrokenAt = record.ID
+			result.Reason = "hash does not match the event's contents; the event was edited"
+			return result
+		}
+
+		hashes[record.ID] = record.Hash
+		prev = record.Hash
+	}
+
+	for _, checkpoint := range checkpoints {
+		result.CheckpointsChecked++
+
+		if !VerifyCheckpoint(key, checkpoint) {
+			result.BrokenAt = checkpoint.EventID
+			result.Reason = fmt.Sprintf("checkpoint %d has an invalid signature", checkpoint.ID)
+			return result
+		}
+		hash, ok := hashes[checkpoint.EventID]
+		if !ok {
+			result.BrokenAt = checkpoint.EventID
+			result.Reason = fmt.Sprintf("checkpoint %d covers an event that no longer exists; events were deleted", checkpoint.ID)
+			return result
+		}
+		if hash != checkpoint.Hash {
+			result.BrokenAt = checkpoint.EventID
+			result.Reason = fmt.Sprintf("checkpoint %d does not match the event's hash; the chain was rewritten", checkpoint.ID)
+			return result
+		}
+	}
+
+	return result
+}
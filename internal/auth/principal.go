@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/Zeptile/docktrine/internal/database"
+)
+
+const (
+	PrincipalAPIKey       = "api_key"
+	PrincipalUser         = "user"
+	PrincipalRegistryHook = "registry_hook"
+)
+
+// Principal is whoever a request is authenticated as, an API key or a
+// logged-in user, reduced to what authorization needs.
+type Principal struct {
+	Type            string
+	ID              int64
+	Name            string
+	IsAdmin         bool
+	Scopes          []string
+	AllowedServers  []string
+	ContainerLabels map[string]string
+}
+
+func FromAPIKey(key *database.APIKey) *Principal {
+	return &Principal{
+		Type:            PrincipalAPIKey,
+		ID:              key.ID,
+		Name:            key.Description,
+		IsAdmin:         key.IsAdmin,
+		Scopes:          key.Scopes,
+		AllowedServers:  key.AllowedServers,
+		ContainerLabels: key.ContainerLabels,
+	}
+}
+
+func FromUser(user *database.User) *Principal {
+	return &Principal{
+		Type:    PrincipalUser,
+		ID:      user.ID,
+		Name:    user.Username,
+		IsAdmin: user.Role == database.RoleAdmin,
+		Scopes:  RoleScopes(user.Role),
+	}
+}
+
+// FromRegistryHook is the principal of a registry hook's requests. It can
+// only recreate the hook's containers, which the hook itself enforces.
+func FromRegistryHook(hook *database.RegistryHook) *Principal {
+	return &Principal{
+		Type:   PrincipalRegistryHook,
+		ID:     hook.ID,
+		Name:   hook.Name,
+		Scopes: []string{ScopeContainersRestart, ScopeImagesWrite},
+	}
+}
+
+// String identifies the principal in logs, e.g. "api_key:3 (ci)".
+func (p *Principal) String() string {
+	return fmt.Sprintf("%s:%d (%s)", p.Type, p.ID, p.Name)
+}
+
+// RoleScopes returns the scopes granted to users with role. Admins are
+// handled through Principal.IsAdmin and get every scope.
+func RoleScopes(role string) []string {
+	switch role {
+	case database.RoleViewer:
+		return []string{ScopeContainersRead, ScopeServersRead}
+	case database.RoleOperator:
+		return []string{ScopeContainersRead, ScopeContainersWrite, ScopeImagesWrite, ScopeServersRead}
+	case database.RoleAdmin:
+		return append([]string{}, knownScopes...)
+	default:
+		return []string{}
+	}
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/docker"
+)
+
+const (
+	ScopeContainersRead    = "containers:read"
+	ScopeContainersWrite   = "containers:write"
+	ScopeContainersStart   = "containers:start"
+	ScopeContainersStop    = "containers:stop"
+	ScopeContainersRestart = "containers:restart"
+	ScopeImagesWrite       = "images:write"
+	ScopeServersRead       = "servers:read"
+	ScopeServersAdmin      = "servers:admin"
+)
+
+// impliedBy lists, for a scope, the broader scopes that also grant it.
+var impliedBy = map[string][]string{
+	ScopeContainersStart:   {ScopeContainersWrite},
+	ScopeContainersStop:    {ScopeContainersWrite},
+	ScopeContainersRestart: {ScopeContainersWrite},
+	ScopeServersRead:       {ScopeServersAdmin},
+}
+
+var knownScopes = []string{
+	ScopeContainersRead,
+	ScopeContainersWrite,
+	ScopeContainersStart,
+	ScopeContainersStop,
+	ScopeContainersRestart,
+	ScopeImagesWrite,
+	ScopeServersRead,
+	ScopeServersAdmin,
+}
+
+// DefaultScopes are given to keys created without explicit scopes.
+var DefaultScopes = []string{ScopeContainersRead, ScopeServersRead}
+
+func ValidateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		if !containsString(knownScopes, scope) {
+			return fmt.Errorf("unknown scope %q", scope)
+		}
+	}
+	return nil
+}
+
+// HasScope reports whether p grants scope. Admins have every scope.
+func HasScope(p *Principal, scope string) bool {
+	if p.IsAdmin || containsString(p.Scopes, scope) {
+		return true
+	}
+	for _, broader := range impliedBy[scope] {
+		if containsString(p.Scopes, broader) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsServer reports whether p may act on server.
+func AllowsServer(p *Principal, server database.Server) bool {
+	if p.IsAdmin || len(p.AllowedServers) == 0 {
+		return true
+	}
+	for _, allowed := range p.AllowedServers {
+		selector, err := docker.ParseSelector(allowed)
+		if err != nil {
+			continue
+		}
+		if selector.Matches(server) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsContainer reports whether p may act on a container with labels.
+func AllowsContainer(p *Principal, labels map[string]string) bool {
+	if p.IsAdmin {
+		return true
+	}
+	for k, want := range p.ContainerLabels {
+		got, ok := labels[k]
+		if !ok {
+			return false
+		}
+		if want != "" && got != want {
+			return false
+		}
+	}
+	return true
+}
+
+// RestrictsContainers reports whether p is limited to labelled containers.
+func RestrictsContainers(p *Principal) bool {
+	return !p.IsAdmin && len(p.ContainerLabels) > 0
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	AlertActive   = "active"
+	AlertResolved = "resolved"
+)
+
+// Alert reports a container that is crash-looping, failing or being
+// OOM-killed. There is at most one active alert per container and kind;
+// repeated detections update it.
+type Alert struct {
+	ID            int64  `json:"id"`
+	Server        string `json:"server"`
+	ContainerID   string `json:"container_id"`
+	ContainerName string `json:"container_name"`
+	// Kind is crash_loop, failing or oom_killed.
+	Kind     string `json:"kind"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	// Count is how many times the condition was detected while active.
+	Count  int    `json:"count"`
+	Status string `json:"status"`
+	// Labels are the container's labels when the alert fired.
+	Labels     map[string]string `json:"labels"`
+	FirstSeen  time.Time         `json:"first_seen"`
+	LastSeen   time.Time         `json:"last_seen"`
+	ResolvedAt *time.Time        `json:"resolved_at"`
+}
+
+// AlertFilter narrows ListAlerts. Zero fields match everything.
+type AlertFilter struct {
+	Status  string
+	Servers []string
+	Kind    string
+	Limit   int
+}
+
+const alertColumns = `id, server, container_id, container_name, kind, severity, message, count, status,
+	labels, first_seen, last_seen, resolved_at`
+
+func scanAlert(row rowScanner) (*Alert, error) {
+	var a Alert
+	var labels string
+	err := row.Scan(&a.ID, &a.Server, &a.ContainerID, &a.ContainerName, &a.Kind, &a.Severity, &a.Message, &a.Count, &a.Status,
+		&labels, &a.FirstSeen, &a.LastSeen, &a.ResolvedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(labels), &a.Labels); err != nil {
+		return nil, fmt.Errorf("alert %d: invalid labels: %w", a.ID, err)
+	}
+	if a.Labels == nil {
+		a.Labels = map[string]string{}
+	}
+	return &a, nil
+}
+
+// RaiseAlert records a detection of alert's condition. If the container
+// already has an active alert of that kind it is updated and returned with
+// false, otherwise alert is stored as a new active alert and true is
+// returned.
+func (db *DB) RaiseAlert(alert *Alert) (*Alert, bool, error) {
+	now := time.Now().UTC()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	existing, err := scanAlert(tx.QueryRow(`
+		SELECT `+alertColumns+` FROM alerts
+		WHERE server = ? AND container_id = ? AND kind = ? AND status = ?`,
+		alert.Server, alert.ContainerID, alert.Kind, AlertActive))
+	if err != nil && err != sql.ErrNoRows {
+		return nil, false, err
+	}
+
+	if existing != nil {
+		existing.Message = alert.Message
+		existing.Count++
+		existing.LastSeen = now
+		_, err = tx.Exec(`UPDATE alerts SET message = ?, count = ?, last_seen = ? WHERE id = ?`,
+			existing.Message, existing.Count, existing.LastSeen, existing.ID)
+		if err != nil {
+			return nil, false, err
+		}
+		return existing, false, tx.Commit()
+	}
+
+	if alert.Labels == nil {
+		alert.Labels = map[string]string{}
+	}
+	labels, err := json.Marshal(alert.Labels)
+	if err != nil {
+		return nil, false, err
+	}
+
+	alert.Count = 1
+	alert.Status = AlertActive
+	alert.FirstSeen = now
+	alert.LastSeen = now
+	result, err := tx.Exec(`
+		INSERT INTO alerts (server, container_id, container_name, kind, severity, message, count, status,
+			labels, first_seen, last_seen)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		alert.Server, alert.ContainerID, alert.ContainerName, alert.Kind, alert.Severity, alert.Message, alert.Count, alert.Status,
+		string(labels), alert.FirstSeen, alert.LastSeen)
+	if err != nil {
+		return nil, false, err
+	}
+	if alert.ID, err = result.LastInsertId(); err != nil {
+		return nil, false, err
+	}
+	return alert, true, tx.Commit()
+}
+
+// ResolveAlert marks an active alert resolved. It returns false if the
+// alert was not active.
+func (db *DB) ResolveAlert(id int64) (bool, error) {
+	result, err := db.Exec(`UPDATE alerts SET status = ?, resolved_at = ? WHERE id = ? AND status = ?`,
+		AlertResolved, time.Now().UTC(), id, AlertActive)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// ListAlerts returns alerts, most recently seen first.
+func (db *DB) ListAlerts(filter AlertFilter) ([]Alert, error) {
+	var conditions []string
+	var args []interface{}
+
+	if filter.Status != "" {
+		conditions = append(conditions, "status = ?")
+		args = append(args, filter.Status)
+	}
+	if filter.Kind != "" {
+		conditions = append(conditions, "kind = ?")
+		args = append(args, filter.Kind)
+	}
+	if len(filter.Servers) > 0 {
+		conditions = append(conditions, "server IN ("+placeholders(len(filter.Servers))+")")
+		for _, server := range filter.Servers {
+			args = append(args, server)
+		}
+	}
+
+	query := `SELECT ` + alertColumns + ` FROM alerts`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	query += ` ORDER BY last_seen DESC, id DESC`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := []Alert{}
+	for rows.Next() {
+		a, err := scanAlert(rows)
+		if err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, *a)
+	}
+	return alerts, rows.Err()
+}
@@ -1,17 +1,155 @@
 package database
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
 	"time"
+
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/Zeptile/docktrine/internal/signing"
 )
 
+// apiKeysTable is formatted with the table name so the plaintext key
+// migration can build a replacement table with the same schema.
+const apiKeysTable = `CREATE TABLE IF NOT EXISTS %s (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	key_prefix TEXT NOT NULL,
+	key_hash TEXT NOT NULL,
+	key_salt TEXT NOT NULL,
+	description TEXT,
+	is_admin BOOLEAN NOT NULL DEFAULT 0,
+	scopes TEXT NOT NULL DEFAULT '[]',
+	allowed_servers TEXT NOT NULL DEFAULT '[]',
+	container_labels TEXT NOT NULL DEFAULT '{}',
+	expires_at DATETIME,
+	allowed_cidrs TEXT NOT NULL DEFAULT '[]',
+	disabled BOOLEAN NOT NULL DEFAULT 0,
+	disabled_reason TEXT NOT NULL DEFAULT '',
+	signing_key TEXT NOT NULL DEFAULT '',
+	created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+	last_used_at DATETIME
+)`
+
+// apiKeyPrefixLength is the number of leading characters of a key stored in
+// clear text to find its row without storing the secret.
+const apiKeyPrefixLength = 8
+
 type APIKey struct {
-	ID          int64     `json:"id"`
-	Key         string    `json:"key"`
-	Description string    `json:"description"`
-	CreatedAt   time.Time `json:"created_at"`
-	LastUsedAt  *time.Time `json:"last_used_at"`
+	ID int64 `json:"id"`
+	// Key is the secret. It is only set when a key is created or rotated.
+	Key         string   `json:"key,omitempty"`
+	Prefix      string   `json:"prefix"`
+	Description string   `json:"description"`
+	IsAdmin     bool     `json:"is_admin"`
+	Scopes      []string `json:"scopes"`
+	// AllowedServers restricts the key to servers matching any of these
+	// names or selectors. Empty means every server.
+	AllowedServers []string `json:"allowed_servers"`
+	// ContainerLabels restricts the key to containers carrying all of these
+	// labels. An empty value only requires the label to be present.
+	ContainerLabels map[string]string `json:"container_labels"`
+	ExpiresAt       *time.Time        `json:"expires_at"`
+	// AllowedCIDRs restricts the client addresses the key can be used from.
+	// Empty means any address.
+	AllowedCIDRs   []string   `json:"allowed_cidrs"`
+	Disabled       bool       `json:"disabled"`
+	DisabledReason string     `json:"disabled_reason,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastUsedAt     *time.Time `json:"last_used_at"`
+
+	hash string
+	salt string
+	// signingKey is the HMAC key derived from the secret for request
+	// signing, empty for keys that predate it until their next use. It is
+	// stored encrypted with the secrets key.
+	signingKey string
+}
+
+const apiKeyColumns = `id, key_prefix, key_hash, key_salt, description, is_admin,
+	scopes, allowed_servers, container_labels, expires_at, allowed_cidrs, disabled, disabled_reason,
+	signing_key, created_at, last_used_at`
+
+func (db *DB) scanAPIKey(row rowScanner) (*APIKey, error) {
+	var apiKey APIKey
+	var description sql.NullString
+	var scopes, allowedServers, containerLabels, allowedCIDRs string
+	err := row.Scan(&apiKey.ID, &apiKey.Prefix, &apiKey.hash, &apiKey.salt, &description,
+		&apiKey.IsAdmin, &scopes, &allowedServers, &containerLabels,
+		&apiKey.ExpiresAt, &allowedCIDRs, &apiKey.Disabled, &apiKey.DisabledReason,
+		&apiKey.signingKey, &apiKey.CreatedAt, &apiKey.LastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	apiKey.Description = description.String
+	if apiKey.signingKey, err = db.openSecret(apiKey.signingKey); err != nil {
+		return nil, fmt.Errorf("api key %d: signing key: %w", apiKey.ID, err)
+	}
+
+	if err := json.Unmarshal([]byte(scopes), &apiKey.Scopes); err != nil {
+		return nil, fmt.Errorf("api key %d: invalid scopes: %w", apiKey.ID, err)
+	}
+	if err := json.Unmarshal([]byte(allowedServers), &apiKey.AllowedServers); err != nil {
+		return nil, fmt.Errorf("api key %d: invalid allowed servers: %w", apiKey.ID, err)
+	}
+	if err := json.Unmarshal([]byte(containerLabels), &apiKey.ContainerLabels); err != nil {
+		return nil, fmt.Errorf("api key %d: invalid container labels: %w", apiKey.ID, err)
+	}
+	if err := json.Unmarshal([]byte(allowedCIDRs), &apiKey.AllowedCIDRs); err != nil {
+		return nil, fmt.Errorf("api key %d: invalid allowed CIDRs: %w", apiKey.ID, err)
+	}
+	if apiKey.Scopes == nil {
+		apiKey.Scopes = []string{}
+	}
+	if apiKey.AllowedServers == nil {
+		apiKey.AllowedServers = []string{}
+	}
+	if apiKey.ContainerLabels == nil {
+		apiKey.ContainerLabels = map[string]string{}
+	}
+	if apiKey.AllowedCIDRs == nil {
+		apiKey.AllowedCIDRs = []string{}
+	}
+	return &apiKey, nil
+}
+
+func encodeAPIKeyPermissions(apiKey *APIKey) (string, string, string, string, error) {
+	if apiKey.Scopes == nil {
+		apiKey.Scopes = []string{}
+	}
+	if apiKey.AllowedServers == nil {
+		apiKey.AllowedServers = []string{}
+	}
+	if apiKey.ContainerLabels == nil {
+		apiKey.ContainerLabels = map[string]string{}
+	}
+	if apiKey.AllowedCIDRs == nil {
+		apiKey.AllowedCIDRs = []string{}
+	}
+
+	scopes, err := json.Marshal(apiKey.Scopes)
+	if err != nil {
+		return "", "", "", "", err
+	}
+	allowedServers, err := json.Marshal(apiKey.AllowedServers)
+	if err != nil {
+		return "", "", "", "", err
+	}
+	containerLabels, err := json.Marshal(apiKey.ContainerLabels)
+	if err != nil {
+		return "", "", "", "", err
+	}
+	allowedCIDRs, err := json.Marshal(apiKey.AllowedCIDRs)
+	if err != nil {
+		return "", "", "", "", err
+	}
+	return string(scopes), string(allowedServers), string(containerLabels), string(allowedCIDRs), nil
 }
 
 func generateAPIKey() string {
@@ -20,46 +158,385 @@ func generateAPIKey() string {
 	return hex.EncodeToString(bytes)
 }
 
+func generateSalt() string {
+	bytes := make([]byte, 16)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
+func hashAPIKey(key, salt string) string {
+	sum := sha256.Sum256([]byte(salt + key))
+	return hex.EncodeToString(sum[:])
+}
+
+func apiKeyPrefix(key string) string {
+	if len(key) < apiKeyPrefixLength {
+		return key
+	}
+	return key[:apiKeyPrefixLength]
+}
+
+// GetAPIKey finds the key matching the presented secret. Candidates are
+// looked up by prefix and the secret is compared against the stored salted
+// hash in constant time.
 func (db *DB) GetAPIKey(key string) (*APIKey, error) {
-	var apiKey APIKey
-	err := db.QueryRow(`
-		SELECT id, key, description, created_at, last_used_at 
-		FROM api_keys WHERE key = ?`, key).Scan(
-		&apiKey.ID, &apiKey.Key, &apiKey.Description, &apiKey.CreatedAt, &apiKey.LastUsedAt)
-	
+	rows, err := db.Query(`
+		SELECT `+apiKeyColumns+`
+		FROM api_keys WHERE key_prefix = ?`, apiKeyPrefix(key))
 	if err != nil {
 		return nil, err
 	}
-	return &apiKey, nil
+	defer rows.Close()
+
+	var match *APIKey
+	for rows.Next() {
+		candidate, err := db.scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		hash := hashAPIKey(key, candidate.salt)
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(candidate.hash)) == 1 {
+			match = candidate
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if match == nil {
+		return nil, sql.ErrNoRows
+	}
+	// SQLite cannot write while the lookup is still reading.
+	rows.Close()
+
+	if match.signingKey == "" {
+		// Keys created before request signing learn their signing key the
+		// next time the secret is presented.
+		match.signingKey = signing.DeriveKey(key)
+		sealed, err := db.sealSecret(match.signingKey)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := db.Exec(`UPDATE api_keys SET signing_key = ? WHERE id = ?`,
+			sealed, match.ID); err != nil {
+			return nil, err
+		}
+	}
+	return match, nil
+}
+
+// VerifySignature checks an HMAC request signature made with this key. It
+// fails for keys that have not been used since request signing was added.
+func (k *APIKey) VerifySignature(canonical, signature string) bool {
+	if k.signingKey == "" {
+		return false
+	}
+	return signing.Verify(k.signingKey, canonical, signature)
+}
+
+func (db *DB) GetAPIKeyByID(id int64) (*APIKey, error) {
+	apiKey, err := db.scanAPIKey(db.QueryRow(`
+		SELECT `+apiKeyColumns+`
+		FROM api_keys WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return apiKey, nil
+}
+
+func (db *DB) ListAPIKeys() ([]APIKey, error) {
+	rows, err := db.Query(`SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		apiKey, err := db.scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *apiKey)
+	}
+	return keys, rows.Err()
 }
 
-func (db *DB) CreateAPIKey(description string) (*APIKey, error) {
+// CreateAPIKey generates a secret for apiKey and stores it. On success
+// apiKey.Key holds the secret, which cannot be recovered afterwards.
+func (db *DB) CreateAPIKey(apiKey *APIKey) error {
 	key := generateAPIKey()
+	salt := generateSalt()
+	if err := db.insertAPIKey(apiKey, apiKeyPrefix(key), hashAPIKey(key, salt), salt, signing.DeriveKey(key)); err != nil {
+		return err
+	}
+	apiKey.Key = key
+	return nil
+}
+
+func (db *DB) insertAPIKey(apiKey *APIKey, prefix, hash, salt, signingKey string) error {
+	scopes, allowedServers, containerLabels, allowedCIDRs, err := encodeAPIKeyPermissions(apiKey)
+	if err != nil {
+		return err
+	}
+	signingKey, err = db.sealSecret(signingKey)
+	if err != nil {
+		return err
+	}
+
 	result, err := db.Exec(`
-		INSERT INTO api_keys (key, description)
-		VALUES (?, ?)`,
-		key, description)
+		INSERT INTO api_keys (key_prefix, key_hash, key_salt, description, is_admin,
+			scopes, allowed_servers, container_labels, expires_at, allowed_cidrs, signing_key)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		prefix, hash, salt, apiKey.Description, apiKey.IsAdmin,
+		scopes, allowedServers, containerLabels, apiKey.ExpiresAt, allowedCIDRs, signingKey)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	apiKey.ID = id
+	apiKey.Prefix = prefix
+	apiKey.CreatedAt = time.Now()
+	return nil
+}
+
+// RotateAPIKey replaces the secret of an existing key and returns the key
+// with its new secret. The old secret stops working immediately.
+func (db *DB) RotateAPIKey(id int64) (*APIKey, error) {
+	key := generateAPIKey()
+	salt := generateSalt()
+	signingKey, err := db.sealSecret(signing.DeriveKey(key))
+	if err != nil {
+		return nil, err
+	}
+	result, err := db.Exec(`
+		UPDATE api_keys SET key_prefix = ?, key_hash = ?, key_salt = ?, signing_key = ?
+		WHERE id = ?`,
+		apiKeyPrefix(key), hashAPIKey(key, salt), salt, signingKey, id)
+	if err != nil {
+		return nil, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if affected == 0 {
+		return nil, fmt.Errorf("api key not found")
+	}
+
+	apiKey, err := db.GetAPIKeyByID(id)
+	if err != nil {
+		return nil, err
+	}
+	apiKey.Key = key
+	return apiKey, nil
+}
+
+func (db *DB) DeleteAPIKey(id int64) error {
+	result, err := db.Exec(`DELETE FROM api_keys WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return fmt.Errorf("api key not found")
+	}
+
+	return nil
+}
+
+// SetAPIKeyDisabled disables or re-enables a key. reason is shown in key
+// listings and cleared when the key is enabled again.
+func (db *DB) SetAPIKeyDisabled(id int64, disabled bool, reason string) error {
+	if !disabled {
+		reason = ""
+	}
+
+	result, err := db.Exec(`
+		UPDATE api_keys SET disabled = ?, disabled_reason = ?
+		WHERE id = ?`, disabled, reason, id)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return fmt.Errorf("api key not found")
+	}
+
+	return nil
+}
+
+// DisableIdleAPIKeys disables non-admin keys that have not been used for
+// maxIdle (or, if never used, were created more than maxIdle ago). Admin
+// keys are left alone so the API cannot lock itself out.
+func (db *DB) DisableIdleAPIKeys(maxIdle time.Duration) ([]APIKey, error) {
+	keys, err := db.ListAPIKeys()
 	if err != nil {
 		return nil, err
 	}
 
-	return &APIKey{
-		ID:          id,
-		Key:         key,
-		Description: description,
-		CreatedAt:   time.Now(),
-	}, nil
+	cutoff := time.Now().Add(-maxIdle)
+	var disabled []APIKey
+	for _, key := range keys {
+		if key.IsAdmin || key.Disabled {
+			continue
+		}
+
+		lastActivity := key.CreatedAt
+		if key.LastUsedAt != nil {
+			lastActivity = *key.LastUsedAt
+		}
+		if lastActivity.After(cutoff) {
+			continue
+		}
+
+		reason := fmt.Sprintf("unused for more than %d days", int(maxIdle.Hours()/24))
+		if err := db.SetAPIKeyDisabled(key.ID, true, reason); err != nil {
+			return nil, err
+		}
+		key.Disabled = true
+		key.DisabledReason = reason
+		disabled = append(disabled, key)
+	}
+
+	return disabled, nil
+}
+
+// WatchIdleAPIKeys runs DisableIdleAPIKeys every interval until ctx is
+// cancelled.
+func (db *DB) WatchIdleAPIKeys(ctx context.Context, maxIdle, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		disabled, err := db.DisableIdleAPIKeys(maxIdle)
+		if err != nil {
+			logger.Error(err, "Failed to disable idle API keys")
+		}
+		for _, key := range disabled {
+			logger.Warn(fmt.Sprintf("Disabled idle API key: %d (%s)", key.ID, key.Description))
+			if err := db.RecordAuditEvent(&AuditEvent{
+				ActorType: AuditActorSystem,
+				ActorName: "idle key watcher",
+				Action:    "apikeys.disable",
+				Target:    strconv.FormatInt(key.ID, 10),
+				Params:    map[string]interface{}{"reason": key.DisabledReason},
+				Result:    AuditResultSuccess,
+			}); err != nil {
+				logger.Error(err, "Failed to record audit event")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (db *DB) CountAdminAPIKeys() (int, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM api_keys WHERE is_admin = 1`).Scan(&count)
+	return count, err
 }
 
-func (db *DB) UpdateAPIKeyLastUsed(key string) error {
+func (db *DB) UpdateAPIKeyLastUsed(id int64) error {
 	_, err := db.Exec(`
 		UPDATE api_keys 
 		SET last_used_at = CURRENT_TIMESTAMP 
-		WHERE key = ?`, key)
+		WHERE id = ?`, id)
 	return err
-}
\ No newline at end of file
+}
+
+// hashPlaintextAPIKeys converts an api_keys table from the original schema,
+// which stored secrets in a plain "key" column, to salted hashes. The table
+// is rebuilt because SQLite cannot drop a UNIQUE column in place.
+func (db *DB) hashPlaintextAPIKeys() error {
+	legacy, err := db.hasColumn("api_keys", "key")
+	if err != nil || !legacy {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf(apiKeysTable, "api_keys_hashed")); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT id, key, description, is_admin, created_at, last_used_at FROM api_keys`)
+	if err != nil {
+		return err
+	}
+
+	type legacyKey struct {
+		id          int64
+		key         string
+		description sql.NullString
+		isAdmin     bool
+		createdAt   time.Time
+		lastUsedAt  *time.Time
+	}
+	var keys []legacyKey
+	for rows.Next() {
+		var k legacyKey
+		if err := rows.Scan(&k.id, &k.key, &k.description, &k.isAdmin, &k.createdAt, &k.lastUsedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, k := range keys {
+		salt := generateSalt()
+		_, err := tx.Exec(`
+			INSERT INTO api_keys_hashed (id, key_prefix, key_hash, key_salt, description, is_admin,
+				signing_key, created_at, last_used_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			k.id, apiKeyPrefix(k.key), hashAPIKey(k.key, salt), salt, k.description, k.isAdmin,
+			signing.DeriveKey(k.key), k.createdAt, k.lastUsedAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DROP TABLE api_keys`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`ALTER TABLE api_keys_hashed RENAME TO api_keys`); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	logger.Info(fmt.Sprintf("Migrated %d plaintext API keys to salted hashes", len(keys)))
+	return nil
+}
@@ -0,0 +1,169 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	ApprovalPending  = "pending"
+	ApprovalApproved = "approved"
+	ApprovalExecuted = "executed"
+	ApprovalFailed   = "failed"
+	ApprovalRejected = "rejected"
+	ApprovalExpired  = "expired"
+)
+
+// Approval is a destructive operation on a protected container or server
+// waiting for a second principal to approve it.
+type Approval struct {
+	ID int64 `json:"id"`
+	// Action is the audit action name, e.g. containers.stop.
+	Action string `json:"action"`
+	// Server is the server name or selector the operation targets.
+	Server string `json:"server"`
+	// Target is the container ID, or the server name for server actions.
+	Target string            `json:"target"`
+	Params map[string]string `json:"params"`
+	// Reason says what is protected.
+	Reason        string     `json:"reason"`
+	Status        string     `json:"status"`
+	RequesterType string     `json:"requester_type"`
+	RequesterID   int64      `json:"requester_id"`
+	RequesterName string     `json:"requester_name"`
+	DeciderType   string     `json:"decider_type,omitempty"`
+	DeciderID     int64      `json:"decider_id,omitempty"`
+	DeciderName   string     `json:"decider_name,omitempty"`
+	Result        string     `json:"result,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	DecidedAt     *time.Time `json:"decided_at"`
+}
+
+const approvalColumns = `id, action, server, target, params, reason, status,
+	requester_type, requester_id, requester_name, decider_type, decider_id, decider_name,
+	result, created_at, expires_at, decided_at`
+
+func scanApproval(row rowScanner) (*Approval, error) {
+	var a Approval
+	var params string
+	err := row.Scan(&a.ID, &a.Action, &a.Server, &a.Target, &params, &a.Reason, &a.Status,
+		&a.RequesterType, &a.RequesterID, &a.RequesterName, &a.DeciderType, &a.DeciderID, &a.DeciderName,
+		&a.Result, &a.CreatedAt, &a.ExpiresAt, &a.DecidedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(params), &a.Params); err != nil {
+		return nil, fmt.Errorf("approval %d: invalid params: %w", a.ID, err)
+	}
+	if a.Params == nil {
+		a.Params = map[string]string{}
+	}
+	return &a, nil
+}
+
+func (db *DB) CreateApproval(approval *Approval) error {
+	if approval.Params == nil {
+		approval.Params = map[string]string{}
+	}
+	params, err := json.Marshal(approval.Params)
+	if err != nil {
+		return err
+	}
+
+	approval.Status = ApprovalPending
+	approval.CreatedAt = time.Now().UTC()
+	approval.ExpiresAt = approval.ExpiresAt.UTC()
+
+	result, err := db.Exec(`
+		INSERT INTO approvals (action, server, target, params, reason, status,
+			requester_type, requester_id, requester_name, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		approval.Action, approval.Server, approval.Target, string(params), approval.Reason, approval.Status,
+		approval.RequesterType, approval.RequesterID, approval.RequesterName, approval.CreatedAt, approval.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	approval.ID, err = result.LastInsertId()
+	return err
+}
+
+// expireApprovals marks pending approvals past their expiry as expired.
+func (db *DB) expireApprovals() error {
+	_, err := db.Exec(`UPDATE approvals SET status = ? WHERE status = ? AND expires_at <= ?`,
+		ApprovalExpired, ApprovalPending, time.Now().UTC())
+	return err
+}
+
+func (db *DB) GetApproval(id int64) (*Approval, error) {
+	if err := db.expireApprovals(); err != nil {
+		return nil, err
+	}
+
+	approval, err := scanApproval(db.QueryRow(`
+		SELECT `+approvalColumns+`
+		FROM approvals WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return approval, err
+}
+
+// ListApprovals returns approvals newest first, optionally only those with
+// status.
+func (db *DB) ListApprovals(status string) ([]Approval, error) {
+	if err := db.expireApprovals(); err != nil {
+		return nil, err
+	}
+
+	query := `SELECT ` + approvalColumns + ` FROM approvals`
+	var args []interface{}
+	if status != "" {
+		query += ` WHERE status = ?`
+		args = append(args, status)
+	}
+	query += ` ORDER BY id DESC`
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	approvals := []Approval{}
+	for rows.Next() {
+		a, err := scanApproval(rows)
+		if err != nil {
+			return nil, err
+		}
+		approvals = append(approvals, *a)
+	}
+	return approvals, rows.Err()
+}
+
+// DecideApproval moves a pending, unexpired approval to status and records
+// who decided. It returns false if the approval was no longer pending, so
+// two approvers racing cannot both run the operation.
+func (db *DB) DecideApproval(id int64, status, deciderType string, deciderID int64, deciderName string) (bool, error) {
+	now := time.Now().UTC()
+	result, err := db.Exec(`
+		UPDATE approvals
+		SET status = ?, decider_type = ?, decider_id = ?, decider_name = ?, decided_at = ?
+		WHERE id = ? AND status = ? AND expires_at > ?`,
+		status, deciderType, deciderID, deciderName, now, id, ApprovalPending, now)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// FinishApproval records the outcome of an approved operation.
+func (db *DB) FinishApproval(id int64, status, result string) error {
+	_, err := db.Exec(`UPDATE approvals SET status = ?, result = ? WHERE id = ?`, status, result, id)
+	return err
+}
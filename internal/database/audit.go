@@ -0,0 +1,285 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/audit"
+	"github.com/Zeptile/docktrine/internal/logger"
+)
+
+const (
+	AuditResultSuccess = "success"
+	AuditResultFailure = "failure"
+	// AuditResultPendingApproval is recorded for requests held for
+	// approval instead of running.
+	AuditResultPendingApproval = "pending_approval"
+)
+
+// AuditActorSystem is the actor type of changes Docktrine makes on its own,
+// such as disabling idle API keys.
+const AuditActorSystem = "system"
+
+type AuditEvent struct {
+	ID         int64                  `json:"id"`
+	Timestamp  time.Time              `json:"timestamp"`
+	ActorType  string                 `json:"actor_type"`
+	ActorID    int64                  `json:"actor_id"`
+	ActorName  string                 `json:"actor_name"`
+	SourceIP   string                 `json:"source_ip"`
+	Action     string                 `json:"action"`
+	Server     string                 `json:"server"`
+	Target     string                 `json:"target"`
+	Params     map[string]interface{} `json:"params"`
+	Status     int                    `json:"status"`
+	Result     string                 `json:"result"`
+	Error      string                 `json:"error,omitempty"`
+	DurationMS int64                  `json:"duration_ms"`
+	PrevHash   string                 `json:"prev_hash"`
+	Hash       string                 `json:"hash"`
+}
+
+// AuditFilter narrows ListAuditEvents. Zero fields match everything.
+type AuditFilter struct {
+	ActorType string
+	ActorName string
+	Action    string
+	Server    string
+	Target    string
+	Result    string
+	Since     time.Time
+	Until     time.Time
+	// AfterID returns only events newer than this ID, for paging.
+	AfterID int64
+	Limit   int
+}
+
+const auditEventColumns = `id, timestamp, actor_type, actor_id, actor_name, source_ip, action,
+	server, target, params, status, result, error, duration_ms, prev_hash, hash`
+
+func scanAuditEvent(row rowScanner) (*AuditEvent, error) {
+	var e AuditEvent
+	var params string
+	err := row.Scan(&e.ID, &e.Timestamp, &e.ActorType, &e.ActorID, &e.ActorName, &e.SourceIP,
+		&e.Action, &e.Server, &e.Target, &params, &e.Status, &e.Result, &e.Error, &e.DurationMS, &e.PrevHash, &e.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(params), &e.Params); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// RecordAuditEvent appends event to the audit log, chaining it to the
+// previous event's hash.
+func (db *DB) RecordAuditEvent(event *AuditEvent) error {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	event.Timestamp = event.Timestamp.UTC()
+	if event.Params == nil {
+		event.Params = map[string]interface{}{}
+	}
+
+	params, err := json.Marshal(event.Params)
+	if err != nil {
+		return err
+	}
+
+	db.auditMu.Lock()
+	defer db.auditMu.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	prevHash, err := lastAuditHash(tx, 0)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO audit_events (timestamp, actor_type, actor_id, actor_name, source_ip, action,
+			server, target, params, status, result, error, duration_ms)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.Timestamp, event.ActorType, event.ActorID, event.ActorName, event.SourceIP, event.Action,
+		event.Server, event.Target, string(params), event.Status, event.Result, event.Error, event.DurationMS)
+	if err != nil {
+		return err
+	}
+
+	event.ID, err = result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	event.PrevHash = prevHash
+	record := event.record(params)
+	event.Hash = record.ComputeHash()
+
+	if _, err := tx.Exec(`UPDATE audit_events SET prev_hash = ?, hash = ? WHERE id = ?`,
+		event.PrevHash, event.Hash, event.ID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (e *AuditEvent) record(params []byte) audit.Record {
+	return audit.Record{
+		ID:         e.ID,
+		Timestamp:  e.Timestamp,
+		ActorType:  e.ActorType,
+		ActorID:    e.ActorID,
+		ActorName:  e.ActorName,
+		SourceIP:   e.SourceIP,
+		Action:     e.Action,
+		Server:     e.Server,
+		Target:     e.Target,
+		Params:     params,
+		Status:     e.Status,
+		Result:     e.Result,
+		Error:      e.Error,
+		DurationMS: e.DurationMS,
+		PrevHash:   e.PrevHash,
+	}
+}
+
+// lastAuditHash returns the hash of the newest chained event before
+// beforeID (or overall when beforeID is 0), or the genesis hash.
+func lastAuditHash(q interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}, beforeID int64) (string, error) {
+	query := `SELECT hash FROM audit_events WHERE hash != ''`
+	args := []interface{}{}
+	if beforeID > 0 {
+		query += ` AND id < ?`
+		args = append(args, beforeID)
+	}
+	query += ` ORDER BY id DESC LIMIT 1`
+
+	var hash string
+	err := q.QueryRow(query, args...).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return audit.GenesisHash, nil
+	}
+	return hash, err
+}
+
+// chainAuditEvents hashes events recorded before the audit log was chained.
+func (db *DB) chainAuditEvents() error {
+	events, err := db.unchainedAuditEvents()
+	if err != nil || len(events) == 0 {
+		return err
+	}
+
+	prevHash, err := lastAuditHash(db, events[0].ID)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		params, err := json.Marshal(event.Params)
+		if err != nil {
+			return err
+		}
+
+		event.PrevHash = prevHash
+		record := event.record(params)
+		event.Hash = record.ComputeHash()
+
+		if _, err := db.Exec(`UPDATE audit_events SET prev_hash = ?, hash = ? WHERE id = ?`,
+			event.PrevHash, event.Hash, event.ID); err != nil {
+			return err
+		}
+		prevHash = event.Hash
+	}
+
+	logger.Info(fmt.Sprintf("Added %d existing audit events to the hash chain", len(events)))
+	return nil
+}
+
+func (db *DB) unchainedAuditEvents() ([]AuditEvent, error) {
+	rows, err := db.Query(`SELECT ` + auditEventColumns + ` FROM audit_events WHERE hash = '' ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []AuditEvent
+	for rows.Next() {
+		e, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *e)
+	}
+	return events, rows.Err()
+}
+
+// ListAuditEvents returns matching events, oldest first.
+func (db *DB) ListAuditEvents(filter AuditFilter) ([]AuditEvent, error) {
+	var conditions []string
+	var args []interface{}
+
+	for _, f := range []struct {
+		column string
+		value  string
+	}{
+		{"actor_type", filter.ActorType},
+		{"actor_name", filter.ActorName},
+		{"action", filter.Action},
+		{"server", filter.Server},
+		{"target", filter.Target},
+		{"result", filter.Result},
+	} {
+		if f.value != "" {
+			conditions = append(conditions, f.column+" = ?")
+			args = append(args, f.value)
+		}
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "timestamp < ?")
+		args = append(args, filter.Until.UTC())
+	}
+	if filter.AfterID > 0 {
+		conditions = append(conditions, "id > ?")
+		args = append(args, filter.AfterID)
+	}
+
+	query := `SELECT ` + auditEventColumns + ` FROM audit_events`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	query += ` ORDER BY id`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		e, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *e)
+	}
+	return events, rows.Err()
+}
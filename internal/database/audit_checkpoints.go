@@ -0,0 +1,149 @@
+package database
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/audit"
+	"github.com/Zeptile/docktrine/internal/logger"
+)
+
+// auditKeyFile holds the hex-encoded Ed25519 seed used to sign audit
+// checkpoints, in the data directory next to the database.
+const auditKeyFile = "audit_signing.key"
+
+// auditSigningKey loads the checkpoint signing key, creating it on first
+// use.
+func (db *DB) auditSigningKey() (ed25519.PrivateKey, error) {
+	path := filepath.Join(db.dataPath, auditKeyFile)
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid audit signing key in %s", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	logger.Info("Created audit signing key: " + path)
+	return key, nil
+}
+
+// AuditPublicKey returns the key that verifies checkpoint signatures.
+func (db *DB) AuditPublicKey() (ed25519.PublicKey, error) {
+	key, err := db.auditSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	return key.Public().(ed25519.PublicKey), nil
+}
+
+// CreateAuditCheckpoint signs the hash of the newest audit event. It
+// returns nil when nothing was recorded since the last checkpoint.
+func (db *DB) CreateAuditCheckpoint() (*audit.Checkpoint, error) {
+	key, err := db.auditSigningKey()
+	if err != nil {
+		return nil, err
+	}
+
+	db.auditMu.Lock()
+	defer db.auditMu.Unlock()
+
+	var eventID int64
+	var hash string
+	err = db.QueryRow(`SELECT id, hash FROM audit_events ORDER BY id DESC LIMIT 1`).Scan(&eventID, &hash)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var lastEventID int64
+	err = db.QueryRow(`SELECT COALESCE(MAX(event_id), 0) FROM audit_checkpoints`).Scan(&lastEventID)
+	if err != nil {
+		return nil, err
+	}
+	if lastEventID >= eventID {
+		return nil, nil
+	}
+
+	checkpoint := &audit.Checkpoint{
+		EventID:   eventID,
+		Hash:      hash,
+		Signature: audit.SignCheckpoint(key, eventID, hash),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO audit_checkpoints (event_id, hash, signature, created_at)
+		VALUES (?, ?, ?, ?)`,
+		checkpoint.EventID, checkpoint.Hash, checkpoint.Signature, checkpoint.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint.ID, err = result.LastInsertId()
+	return checkpoint, err
+}
+
+func (db *DB) ListAuditCheckpoints() ([]audit.Checkpoint, error) {
+	rows, err := db.Query(`
+		SELECT id, event_id, hash, signature, created_at
+		FROM audit_checkpoints ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checkpoints := []audit.Checkpoint{}
+	for rows.Next() {
+		var c audit.Checkpoint
+		if err := rows.Scan(&c.ID, &c.EventID, &c.Hash, &c.Signature, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		checkpoints = append(checkpoints, c)
+	}
+	return checkpoints, rows.Err()
+}
+
+// WatchAuditCheckpoints writes a checkpoint every interval until ctx is
+// cancelled.
+func (db *DB) WatchAuditCheckpoints(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		checkpoint, err := db.CreateAuditCheckpoint()
+		if err != nil {
+			logger.Error(err, "Failed to write audit checkpoint")
+		} else if checkpoint != nil {
+			logger.Debug(fmt.Sprintf("Wrote audit checkpoint at event %d", checkpoint.EventID))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Zeptile/docktrine/internal/signing"
+)
+
+// minOperatorKeyLength is the shortest secret accepted from an operator,
+// matching the entropy of generated keys.
+const minOperatorKeyLength = 32
+
+// NeedsBootstrap reports whether nobody can administer the API yet: there
+// is neither an admin API key nor an admin user.
+func (db *DB) NeedsBootstrap() (bool, error) {
+	var count int
+	err := db.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM api_keys WHERE is_admin = 1)
+			+ (SELECT COUNT(*) FROM users WHERE role = ?)`, RoleAdmin).Scan(&count)
+	return count == 0, err
+}
+
+// CreateAPIKeyWithSecret stores apiKey with a secret chosen by the
+// operator, e.g. from DOCKTRINE_ADMIN_KEY.
+func (db *DB) CreateAPIKeyWithSecret(apiKey *APIKey, secret string) error {
+	if len(secret) < minOperatorKeyLength {
+		return fmt.Errorf("API key must be at least %d characters", minOperatorKeyLength)
+	}
+
+	salt := generateSalt()
+	return db.insertAPIKey(apiKey, apiKeyPrefix(secret), hashAPIKey(secret, salt), salt, signing.DeriveKey(secret))
+}
+
+// HashAPIKeySecret encodes a secret as "<prefix>:<salt>:<hash>" so it can
+// be handed to CreateAPIKeyWithHash without revealing the secret.
+func HashAPIKeySecret(secret string) (string, error) {
+	if len(secret) < minOperatorKeyLength {
+		return "", fmt.Errorf("API key must be at least %d characters", minOperatorKeyLength)
+	}
+
+	salt := generateSalt()
+	return strings.Join([]string{apiKeyPrefix(secret), salt, hashAPIKey(secret, salt)}, ":"), nil
+}
+
+// CreateAPIKeyWithHash stores apiKey from a secret encoded by
+// HashAPIKeySecret. The key can sign requests once it has been used with
+// X-API-Key.
+func (db *DB) CreateAPIKeyWithHash(apiKey *APIKey, encoded string) error {
+	parts := strings.Split(strings.TrimSpace(encoded), ":")
+	if len(parts) != 3 || len(parts[0]) != apiKeyPrefixLength || parts[1] == "" || len(parts[2]) != 64 {
+		return fmt.Errorf("invalid API key hash, expected <prefix>:<salt>:<sha256>")
+	}
+
+	return db.insertAPIKey(apiKey, parts[0], parts[2], parts[1], "")
+}
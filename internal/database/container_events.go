@@ -0,0 +1,213 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ContainerEvent is a recorded change in a container's lifecycle.
+type ContainerEvent struct {
+	ID            int64  `json:"id"`
+	Server        string `json:"server"`
+	ContainerID   string `json:"container_id"`
+	ContainerName string `json:"container_name"`
+	Image         string `json:"image"`
+	// Action is the Docker event action: create, start, die, oom,
+	// health_status, restart, ...
+	Action string `json:"action"`
+	// ExitCode is set on die events.
+	ExitCode *int `json:"exit_code,omitempty"`
+	// Detail is the new health status of health_status events and the
+	// signal of kill events.
+	Detail string `json:"detail,omitempty"`
+	// Attributes are the event's attributes, including the container's
+	// labels.
+	Attributes map[string]string `json:"attributes"`
+	Time       time.Time         `json:"time"`
+}
+
+// ContainerEventFilter narrows ListContainerEvents. Zero fields match
+// everything.
+type ContainerEventFilter struct {
+	Servers []string
+	// Container matches a container ID, ID prefix or name.
+	Container string
+	Actions   []string
+	// FailedOnly matches die events with a non-zero exit code.
+	FailedOnly bool
+	Since      time.Time
+	Until      time.Time
+	Limit      int
+}
+
+const containerEventColumns = `id, server, container_id, container_name, image, action,
+	exit_code, detail, attributes, time`
+
+func scanContainerEvent(row rowScanner) (*ContainerEvent, error) {
+	var e ContainerEvent
+	var attributes string
+	err := row.Scan(&e.ID, &e.Server, &e.ContainerID, &e.ContainerName, &e.Image, &e.Action,
+		&e.ExitCode, &e.Detail, &attributes, &e.Time)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(attributes), &e.Attributes); err != nil {
+		return nil, fmt.Errorf("container event %d: invalid attributes: %w", e.ID, err)
+	}
+	if e.Attributes == nil {
+		e.Attributes = map[string]string{}
+	}
+	return &e, nil
+}
+
+// RecordContainerEvent stores event and reports whether it was new. An
+// event already recorded, e.g. replayed after a reconnect, is ignored.
+func (db *DB) RecordContainerEvent(event *ContainerEvent) (bool, error) {
+	if event.Attributes == nil {
+		event.Attributes = map[string]string{}
+	}
+	attributes, err := json.Marshal(event.Attributes)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := db.Exec(`
+		INSERT OR IGNORE INTO container_events (server, container_id, container_name, image, action,
+			exit_code, detail, attributes, time)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.Server, event.ContainerID, event.ContainerName, event.Image, event.Action,
+		event.ExitCode, event.Detail, string(attributes), event.Time.UTC())
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		return false, err
+	}
+	event.ID, err = result.LastInsertId()
+	return true, err
+}
+
+// LastContainerEventTime returns when the newest recorded event of server
+// happened, or the zero time if there is none.
+func (db *DB) LastContainerEventTime(server string) (time.Time, error) {
+	var last time.Time
+	err := db.QueryRow(`
+		SELECT time FROM container_events WHERE server = ? ORDER BY time DESC LIMIT 1`, server).Scan(&last)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return last, err
+}
+
+// ListContainerEvents returns events oldest first. With a limit, the newest
+// events up to the limit are returned.
+func (db *DB) ListContainerEvents(filter ContainerEventFilter) ([]ContainerEvent, error) {
+	conditions, args := filter.where()
+
+	query := `SELECT ` + containerEventColumns + ` FROM container_events`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	query += ` ORDER BY time DESC, id DESC`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []ContainerEvent{}
+	for rows.Next() {
+		e, err := scanContainerEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, *e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, nil
+}
+
+// CountContainerEvents counts the events matching filter, ignoring its
+// limit.
+func (db *DB) CountContainerEvents(filter ContainerEventFilter) (int, error) {
+	conditions, args := filter.where()
+
+	query := `SELECT COUNT(*) FROM container_events`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+
+	var count int
+	err := db.QueryRow(query, args...).Scan(&count)
+	return count, err
+}
+
+func (filter ContainerEventFilter) where() ([]string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	if len(filter.Servers) > 0 {
+		conditions = append(conditions, "server IN ("+placeholders(len(filter.Servers))+")")
+		for _, server := range filter.Servers {
+			args = append(args, server)
+		}
+	}
+	if filter.Container != "" {
+		conditions = append(conditions, `(container_id LIKE ? ESCAPE '\' OR container_name = ?)`)
+		args = append(args, escapeLike(filter.Container)+"%", strings.TrimPrefix(filter.Container, "/"))
+	}
+	if len(filter.Actions) > 0 {
+		conditions = append(conditions, "action IN ("+placeholders(len(filter.Actions))+")")
+		for _, action := range filter.Actions {
+			args = append(args, action)
+		}
+	}
+	if filter.FailedOnly {
+		conditions = append(conditions, "action = 'die' AND exit_code IS NOT NULL AND exit_code != 0")
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "time >= ?")
+		args = append(args, filter.Since.UTC())
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "time < ?")
+		args = append(args, filter.Until.UTC())
+	}
+	return conditions, args
+}
+
+// PruneContainerEvents deletes events older than before and returns how
+// many it deleted.
+func (db *DB) PruneContainerEvents(before time.Time) (int64, error) {
+	result, err := db.Exec(`DELETE FROM container_events WHERE time < ?`, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// escapeLike escapes the LIKE wildcards in value; queries using it need
+// ESCAPE '\'.
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
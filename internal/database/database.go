@@ -2,15 +2,24 @@ package database
 
 import (
 	"database/sql"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 
-	"github.com/Zeptile/docktrine/internal/logger"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type DB struct {
 	*sql.DB
+
+	// dataPath is the directory holding the database and other state files.
+	dataPath string
+	// secretsKey encrypts the secrets stored in the database.
+	secretsKey []byte
+	// auditMu serialises audit inserts so each event links to the one
+	// before it.
+	auditMu sync.Mutex
 }
 
 func NewDatabaseConnection() (*DB, error) {
@@ -33,46 +42,44 @@ func NewDatabaseConnection() (*DB, error) {
 		return nil, err
 	}
 
-	database := &DB{db}
+	secretsKey, err := loadSecretsKey(dataPath)
+	if err != nil {
+		return nil, err
+	}
+
+	database := &DB{DB: db, dataPath: dataPath, secretsKey: secretsKey}
 	if err := database.createTables(); err != nil {
 		return nil, err
 	}
 
-	var count int
-	err = database.QueryRow("SELECT COUNT(*) FROM servers").Scan(&count)
-	if err != nil {
+	if err := database.migrate(); err != nil {
 		return nil, err
 	}
 
-	if count == 0 {
-		defaultServer := &Server{
-			Name:        "local",
-			Host:        "unix:///var/run/docker.sock",
-			Description: "Local Docker daemon",
-			IsDefault:   true,
-		}
-		if err := database.CreateServer(defaultServer); err != nil {
-			return nil, err
-		}
+	if err := database.hashPlaintextAPIKeys(); err != nil {
+		return nil, err
 	}
 
-	var keyCount int
-	err = database.QueryRow("SELECT COUNT(*) FROM api_keys").Scan(&keyCount)
-	if err != nil {
+	if err := database.sealPlaintextSecrets(); err != nil {
 		return nil, err
 	}
 
-	if keyCount == 0 {
-		apiKey, err := database.CreateAPIKey("Default API key")
-		if err != nil {
-			return nil, err
-		}
-		logger.Info("Created default API key: " + apiKey.Key)
+	if err := database.createIndexes(); err != nil {
+		return nil, err
+	}
+
+	if err := database.chainAuditEvents(); err != nil {
+		return nil, err
 	}
 
 	return database, nil
 }
 
+// DataPath is the directory holding the database and other state files.
+func (db *DB) DataPath() string {
+	return db.dataPath
+}
+
 func (db *DB) createTables() error {
 	queries := []string{
 		`CREATE TABLE IF NOT EXISTS servers (
@@ -81,15 +88,193 @@ func (db *DB) createTables() error {
 			host TEXT NOT NULL,
 			description TEXT,
 			is_default BOOLEAN DEFAULT 0,
+			source TEXT NOT NULL DEFAULT 'api',
+			labels TEXT NOT NULL DEFAULT '{}',
+			groups TEXT NOT NULL DEFAULT '[]',
+			protected BOOLEAN NOT NULL DEFAULT 0,
+			tls_ca TEXT NOT NULL DEFAULT '',
+			tls_cert TEXT NOT NULL DEFAULT '',
+			tls_key TEXT NOT NULL DEFAULT '',
+			tls_skip_verify BOOLEAN NOT NULL DEFAULT 0,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		)`,
-		`CREATE TABLE IF NOT EXISTS api_keys (
+		fmt.Sprintf(apiKeysTable, "api_keys"),
+		`CREATE TABLE IF NOT EXISTS users (
 			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			key TEXT UNIQUE NOT NULL,
-			description TEXT,
+			username TEXT UNIQUE NOT NULL,
+			password_hash TEXT NOT NULL,
+			role TEXT NOT NULL,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
-			last_used_at DATETIME
+			last_login_at DATETIME
+		)`,
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id INTEGER NOT NULL REFERENCES users (id),
+			token_hash TEXT UNIQUE NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			expires_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS audit_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			timestamp DATETIME NOT NULL,
+			actor_type TEXT NOT NULL,
+			actor_id INTEGER NOT NULL DEFAULT 0,
+			actor_name TEXT NOT NULL DEFAULT '',
+			source_ip TEXT NOT NULL DEFAULT '',
+			action TEXT NOT NULL,
+			server TEXT NOT NULL DEFAULT '',
+			target TEXT NOT NULL DEFAULT '',
+			params TEXT NOT NULL DEFAULT '{}',
+			status INTEGER NOT NULL DEFAULT 0,
+			result TEXT NOT NULL,
+			error TEXT NOT NULL DEFAULT '',
+			duration_ms INTEGER NOT NULL DEFAULT 0,
+			prev_hash TEXT NOT NULL DEFAULT '',
+			hash TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE TABLE IF NOT EXISTS approvals (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			action TEXT NOT NULL,
+			server TEXT NOT NULL DEFAULT '',
+			target TEXT NOT NULL DEFAULT '',
+			params TEXT NOT NULL DEFAULT '{}',
+			reason TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL,
+			requester_type TEXT NOT NULL,
+			requester_id INTEGER NOT NULL,
+			requester_name TEXT NOT NULL DEFAULT '',
+			decider_type TEXT NOT NULL DEFAULT '',
+			decider_id INTEGER NOT NULL DEFAULT 0,
+			decider_name TEXT NOT NULL DEFAULT '',
+			result TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			expires_at DATETIME NOT NULL,
+			decided_at DATETIME
+		)`,
+		`CREATE TABLE IF NOT EXISTS jobs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			action TEXT NOT NULL,
+			server TEXT NOT NULL DEFAULT '',
+			target TEXT NOT NULL DEFAULT '',
+			params TEXT NOT NULL DEFAULT '{}',
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			error TEXT NOT NULL DEFAULT '',
+			requester_type TEXT NOT NULL,
+			requester_id INTEGER NOT NULL,
+			requester_name TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			started_at DATETIME,
+			finished_at DATETIME
+		)`,
+		`CREATE TABLE IF NOT EXISTS job_logs (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			job_id INTEGER NOT NULL,
+			message TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS container_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			server TEXT NOT NULL,
+			container_id TEXT NOT NULL,
+			container_name TEXT NOT NULL DEFAULT '',
+			image TEXT NOT NULL DEFAULT '',
+			action TEXT NOT NULL,
+			exit_code INTEGER,
+			detail TEXT NOT NULL DEFAULT '',
+			attributes TEXT NOT NULL DEFAULT '{}',
+			time DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS alerts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			server TEXT NOT NULL,
+			container_id TEXT NOT NULL,
+			container_name TEXT NOT NULL DEFAULT '',
+			kind TEXT NOT NULL,
+			severity TEXT NOT NULL,
+			message TEXT NOT NULL DEFAULT '',
+			count INTEGER NOT NULL DEFAULT 1,
+			status TEXT NOT NULL,
+			labels TEXT NOT NULL DEFAULT '{}',
+			first_seen DATETIME NOT NULL,
+			last_seen DATETIME NOT NULL,
+			resolved_at DATETIME
+		)`,
+		`CREATE TABLE IF NOT EXISTS webhooks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			url TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			events TEXT NOT NULL DEFAULT '[]',
+			format TEXT NOT NULL DEFAULT 'json',
+			templates TEXT NOT NULL DEFAULT '{}',
+			min_severity TEXT NOT NULL DEFAULT '',
+			enabled BOOLEAN NOT NULL DEFAULT 1,
+			created_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			webhook_id INTEGER NOT NULL,
+			event TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			status TEXT NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			next_attempt_at DATETIME,
+			response_status INTEGER,
+			error TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL,
+			delivered_at DATETIME
+		)`,
+		`CREATE TABLE IF NOT EXISTS email_channels (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			host TEXT NOT NULL,
+			port INTEGER NOT NULL,
+			tls TEXT NOT NULL DEFAULT 'starttls',
+			tls_skip_verify BOOLEAN NOT NULL DEFAULT 0,
+			username TEXT NOT NULL DEFAULT '',
+			password TEXT NOT NULL DEFAULT '',
+			from_address TEXT NOT NULL,
+			recipients TEXT NOT NULL DEFAULT '[]',
+			events TEXT NOT NULL DEFAULT '[]',
+			min_severity TEXT NOT NULL DEFAULT '',
+			digest_seconds INTEGER NOT NULL DEFAULT 0,
+			subject_template TEXT NOT NULL DEFAULT '',
+			text_template TEXT NOT NULL DEFAULT '',
+			html_template TEXT NOT NULL DEFAULT '',
+			enabled BOOLEAN NOT NULL DEFAULT 1,
+			last_sent_at DATETIME,
+			next_send_at DATETIME,
+			failures INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS email_outbox (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			channel_id INTEGER NOT NULL,
+			notification TEXT NOT NULL,
+			created_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS registry_hooks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			token_hash TEXT NOT NULL,
+			repository TEXT NOT NULL,
+			tag TEXT NOT NULL DEFAULT 'latest',
+			server TEXT NOT NULL DEFAULT '',
+			containers TEXT NOT NULL DEFAULT '[]',
+			enabled BOOLEAN NOT NULL DEFAULT 1,
+			last_triggered_at DATETIME,
+			last_digest TEXT NOT NULL DEFAULT '',
+			created_at DATETIME NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS audit_checkpoints (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			event_id INTEGER NOT NULL,
+			hash TEXT NOT NULL,
+			signature TEXT NOT NULL,
+			created_at DATETIME NOT NULL
 		)`,
 	}
 
@@ -100,4 +285,121 @@ func (db *DB) createTables() error {
 	}
 
 	return nil
-} 
\ No newline at end of file
+}
+
+// createIndexes runs after migrate so every indexed column exists.
+func (db *DB) createIndexes() error {
+	queries := []string{
+		`CREATE INDEX IF NOT EXISTS idx_api_keys_prefix ON api_keys (key_prefix)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_subject ON users (subject)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_events_timestamp ON audit_events (timestamp)`,
+		`CREATE INDEX IF NOT EXISTS idx_jobs_status ON jobs (status)`,
+		`CREATE INDEX IF NOT EXISTS idx_job_logs_job ON job_logs (job_id)`,
+		// Also keeps an event replayed after a reconnect from being
+		// recorded twice.
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_container_events_unique ON container_events (server, container_id, action, time)`,
+		`CREATE INDEX IF NOT EXISTS idx_container_events_time ON container_events (server, time)`,
+		`CREATE INDEX IF NOT EXISTS idx_alerts_status ON alerts (status, server)`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries (status, next_attempt_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook ON webhook_deliveries (webhook_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_email_outbox_channel ON email_outbox (channel_id)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_registry_hooks_token ON registry_hooks (token_hash)`,
+	}
+
+	for _, query := range queries {
+		if _, err := db.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// migrate brings databases created by older versions up to the current
+// schema. CREATE TABLE IF NOT EXISTS never touches an existing table, so
+// columns added after the first release are added here.
+func (db *DB) migrate() error {
+	columns := []struct {
+		table      string
+		column     string
+		definition string
+		// backfill runs once, right after the column has been added.
+		backfill string
+	}{
+		{"servers", "source", "TEXT NOT NULL DEFAULT 'api'", ""},
+		{"servers", "tls_ca", "TEXT NOT NULL DEFAULT ''", ""},
+		{"servers", "tls_cert", "TEXT NOT NULL DEFAULT ''", ""},
+		{"servers", "tls_key", "TEXT NOT NULL DEFAULT ''", ""},
+		{"servers", "tls_skip_verify", "BOOLEAN NOT NULL DEFAULT 0", ""},
+		{"servers", "labels", "TEXT NOT NULL DEFAULT '{}'", ""},
+		{"servers", "groups", "TEXT NOT NULL DEFAULT '[]'", ""},
+		{"servers", "protected", "BOOLEAN NOT NULL DEFAULT 0", ""},
+		// Keys created before admin scoping were fully privileged.
+		{"api_keys", "is_admin", "BOOLEAN NOT NULL DEFAULT 0", "UPDATE api_keys SET is_admin = 1"},
+		// Keys created before scopes could use every non-admin route.
+		{"api_keys", "scopes", "TEXT NOT NULL DEFAULT '[]'",
+			`UPDATE api_keys SET scopes = '["containers:read","containers:write","images:write","servers:read","servers:admin"]'`},
+		{"api_keys", "allowed_servers", "TEXT NOT NULL DEFAULT '[]'", ""},
+		{"api_keys", "container_labels", "TEXT NOT NULL DEFAULT '{}'", ""},
+		{"api_keys", "expires_at", "DATETIME", ""},
+		{"api_keys", "allowed_cidrs", "TEXT NOT NULL DEFAULT '[]'", ""},
+		{"api_keys", "disabled", "BOOLEAN NOT NULL DEFAULT 0", ""},
+		{"api_keys", "disabled_reason", "TEXT NOT NULL DEFAULT ''", ""},
+		{"api_keys", "signing_key", "TEXT NOT NULL DEFAULT ''", ""},
+		{"users", "source", "TEXT NOT NULL DEFAULT 'local'", ""},
+		{"users", "subject", "TEXT", ""},
+		// Events recorded before the hash chain are chained by
+		// chainAuditEvents on startup.
+		{"audit_events", "prev_hash", "TEXT NOT NULL DEFAULT ''", ""},
+		{"audit_events", "hash", "TEXT NOT NULL DEFAULT ''", ""},
+		{"webhooks", "format", "TEXT NOT NULL DEFAULT 'json'", ""},
+		{"webhooks", "templates", "TEXT NOT NULL DEFAULT '{}'", ""},
+		{"webhooks", "min_severity", "TEXT NOT NULL DEFAULT ''", ""},
+	}
+
+	for _, c := range columns {
+		exists, err := db.hasColumn(c.table, c.column)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", c.table, c.column, c.definition)); err != nil {
+			return err
+		}
+		if c.backfill != "" {
+			if _, err := db.Exec(c.backfill); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (db *DB) hasColumn(table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
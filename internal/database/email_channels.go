@@ -0,0 +1,288 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	EmailTLSStartTLS = "starttls"
+	EmailTLSImplicit = "tls"
+	EmailTLSNone     = "none"
+)
+
+// EmailChannel sends notifications by email through an SMTP server.
+// Notifications arriving within DigestSeconds of the last email are batched
+// into one digest email.
+type EmailChannel struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// TLS is starttls (the default), tls for implicit TLS, or none.
+	TLS string `json:"tls"`
+	// TLSSkipVerify accepts any certificate from the SMTP server.
+	TLSSkipVerify bool   `json:"tls_skip_verify"`
+	Username      string `json:"username"`
+	// Password is the SMTP password. It is never returned.
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	// Events are the notification events the channel receives; * receives
+	// all of them.
+	Events      []string `json:"events"`
+	MinSeverity string   `json:"min_severity"`
+	// DigestSeconds is the least time between two emails; notifications in
+	// between are sent together. Zero sends notifications as they arrive.
+	DigestSeconds int `json:"digest_seconds"`
+	// SubjectTemplate, TextTemplate and HTMLTemplate replace the default
+	// subject and bodies when set.
+	SubjectTemplate string `json:"subject_template"`
+	TextTemplate    string `json:"text_template"`
+	HTMLTemplate    string `json:"html_template"`
+	Enabled         bool   `json:"enabled"`
+	// Pending is how many notifications wait to be sent.
+	Pending    int        `json:"pending"`
+	LastSentAt *time.Time `json:"last_sent_at"`
+	// NextSendAt is when pending notifications are sent next: the end of
+	// the digest window, or the next retry after a failure.
+	NextSendAt *time.Time `json:"next_send_at"`
+	// Failures counts the failed attempts since the last email went out.
+	Failures  int       `json:"failures"`
+	LastError string    `json:"last_error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Subscribes reports whether the channel receives event.
+func (c *EmailChannel) Subscribes(event string) bool {
+	for _, e := range c.Events {
+		if e == "*" || e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// QueuedEmail is a notification waiting in an email channel's outbox.
+type QueuedEmail struct {
+	ID        int64 `json:"id"`
+	ChannelID int64 `json:"channel_id"`
+	// Notification is the notification as JSON.
+	Notification json.RawMessage `json:"notification" swaggertype:"object"`
+	CreatedAt    time.Time       `json:"created_at"`
+}
+
+const emailChannelColumns = `id, name, host, port, tls, tls_skip_verify, username, password, from_address,
+	recipients, events, min_severity, digest_seconds, subject_template, text_template, html_template, enabled,
+	(SELECT COUNT(*) FROM email_outbox WHERE channel_id = email_channels.id),
+	last_sent_at, next_send_at, failures, last_error, created_at`
+
+func (db *DB) scanEmailChannel(row rowScanner) (*EmailChannel, error) {
+	var c EmailChannel
+	var to, events string
+	err := row.Scan(&c.ID, &c.Name, &c.Host, &c.Port, &c.TLS, &c.TLSSkipVerify, &c.Username, &c.Password, &c.From,
+		&to, &events, &c.MinSeverity, &c.DigestSeconds, &c.SubjectTemplate, &c.TextTemplate, &c.HTMLTemplate, &c.Enabled,
+		&c.Pending, &c.LastSentAt, &c.NextSendAt, &c.Failures, &c.LastError, &c.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if c.Password, err = db.openSecret(c.Password); err != nil {
+		return nil, fmt.Errorf("email channel %d: password: %w", c.ID, err)
+	}
+	if err := json.Unmarshal([]byte(to), &c.To); err != nil {
+		return nil, fmt.Errorf("email channel %d: invalid recipients: %w", c.ID, err)
+	}
+	if err := json.Unmarshal([]byte(events), &c.Events); err != nil {
+		return nil, fmt.Errorf("email channel %d: invalid events: %w", c.ID, err)
+	}
+	return &c, nil
+}
+
+func (db *DB) CreateEmailChannel(channel *EmailChannel) error {
+	to, err := json.Marshal(channel.To)
+	if err != nil {
+		return err
+	}
+	events, err := json.Marshal(channel.Events)
+	if err != nil {
+		return err
+	}
+	password, err := db.sealSecret(channel.Password)
+	if err != nil {
+		return err
+	}
+
+	channel.Enabled = true
+	channel.CreatedAt = time.Now().UTC()
+	result, err := db.Exec(`
+		INSERT INTO email_channels (name, host, port, tls, tls_skip_verify, username, password, from_address,
+			recipients, events, min_severity, digest_seconds, subject_template, text_template, html_template,
+			enabled, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		channel.Name, channel.Host, channel.Port, channel.TLS, channel.TLSSkipVerify, channel.Username,
+		password, channel.From, string(to), string(events), channel.MinSeverity, channel.DigestSeconds,
+		channel.SubjectTemplate, channel.TextTemplate, channel.HTMLTemplate, channel.Enabled, channel.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	channel.ID, err = result.LastInsertId()
+	return err
+}
+
+// UpdateEmailChannel saves the settings of channel. Its enabled state and
+// sending state are left unchanged.
+func (db *DB) UpdateEmailChannel(channel *EmailChannel) error {
+	to, err := json.Marshal(channel.To)
+	if err != nil {
+		return err
+	}
+	events, err := json.Marshal(channel.Events)
+	if err != nil {
+		return err
+	}
+	password, err := db.sealSecret(channel.Password)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		UPDATE email_channels SET name = ?, host = ?, port = ?, tls = ?, tls_skip_verify = ?, username = ?,
+			password = ?, from_address = ?, recipients = ?, events = ?, min_severity = ?, digest_seconds = ?,
+			subject_template = ?, text_template = ?, html_template = ?
+		WHERE id = ?`,
+		channel.Name, channel.Host, channel.Port, channel.TLS, channel.TLSSkipVerify, channel.Username,
+		password, channel.From, string(to), string(events), channel.MinSeverity, channel.DigestSeconds,
+		channel.SubjectTemplate, channel.TextTemplate, channel.HTMLTemplate, channel.ID)
+	return err
+}
+
+// GetEmailChannel returns the channel with its password, or nil if there is
+// none with that ID.
+func (db *DB) GetEmailChannel(id int64) (*EmailChannel, error) {
+	c, err := db.scanEmailChannel(db.QueryRow(`SELECT `+emailChannelColumns+` FROM email_channels WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return c, err
+}
+
+// ListEmailChannels returns every email channel, passwords included.
+func (db *DB) ListEmailChannels() ([]EmailChannel, error) {
+	rows, err := db.Query(`SELECT ` + emailChannelColumns + ` FROM email_channels ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	channels := []EmailChannel{}
+	for rows.Next() {
+		c, err := db.scanEmailChannel(rows)
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, *c)
+	}
+	return channels, rows.Err()
+}
+
+func (db *DB) SetEmailChannelEnabled(id int64, enabled bool) error {
+	_, err := db.Exec(`UPDATE email_channels SET enabled = ? WHERE id = ?`, enabled, id)
+	return err
+}
+
+// DeleteEmailChannel deletes the channel and its outbox.
+func (db *DB) DeleteEmailChannel(id int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM email_outbox WHERE channel_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM email_channels WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// QueueEmail adds a notification to the channel's outbox.
+func (db *DB) QueueEmail(channelID int64, notification []byte) error {
+	_, err := db.Exec(`INSERT INTO email_outbox (channel_id, notification, created_at) VALUES (?, ?, ?)`,
+		channelID, string(notification), time.Now().UTC())
+	return err
+}
+
+// QueuedEmails returns up to limit notifications in the channel's outbox,
+// oldest first.
+func (db *DB) QueuedEmails(channelID int64, limit int) ([]QueuedEmail, error) {
+	rows, err := db.Query(`
+		SELECT id, channel_id, notification, created_at FROM email_outbox
+		WHERE channel_id = ? ORDER BY id LIMIT ?`, channelID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queued := []QueuedEmail{}
+	for rows.Next() {
+		var q QueuedEmail
+		var notification string
+		if err := rows.Scan(&q.ID, &q.ChannelID, &notification, &q.CreatedAt); err != nil {
+			return nil, err
+		}
+		q.Notification = json.RawMessage(notification)
+		queued = append(queued, q)
+	}
+	return queued, rows.Err()
+}
+
+// RecordEmailSent removes the sent notifications, up to and including
+// lastID, from the outbox and holds the next email back until next.
+func (db *DB) RecordEmailSent(channelID, lastID int64, next time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM email_outbox WHERE channel_id = ? AND id <= ?`, channelID, lastID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		UPDATE email_channels SET last_sent_at = ?, next_send_at = ?, failures = 0, last_error = ''
+		WHERE id = ?`, time.Now().UTC(), next.UTC(), channelID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RecordEmailFailure stores a failed attempt and when to try again. A nil
+// retry gives up: the notifications up to and including lastID are dropped
+// from the outbox.
+func (db *DB) RecordEmailFailure(channelID, lastID int64, errMessage string, retry *time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if retry == nil {
+		if _, err := tx.Exec(`DELETE FROM email_outbox WHERE channel_id = ? AND id <= ?`, channelID, lastID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE email_channels SET next_send_at = NULL, failures = 0, last_error = ? WHERE id = ?`,
+			errMessage, channelID); err != nil {
+			return err
+		}
+	} else if _, err := tx.Exec(`
+		UPDATE email_channels SET next_send_at = ?, failures = failures + 1, last_error = ?
+		WHERE id = ?`, retry.UTC(), errMessage, channelID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,259 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+)
+
+// Job is an operation queued to run in the background. Jobs are stored so
+// that queued and interrupted jobs are picked up again after a restart.
+type Job struct {
+	ID int64 `json:"id"`
+	// Action is the audit action name, e.g. containers.restart.
+	Action string `json:"action"`
+	// Server is the server name or selector the operation targets.
+	Server        string            `json:"server"`
+	Target        string            `json:"target"`
+	Params        map[string]string `json:"params"`
+	Status        string            `json:"status"`
+	Attempts      int               `json:"attempts"`
+	Error         string            `json:"error,omitempty"`
+	RequesterType string            `json:"requester_type"`
+	RequesterID   int64             `json:"requester_id"`
+	RequesterName string            `json:"requester_name"`
+	CreatedAt     time.Time         `json:"created_at"`
+	StartedAt     *time.Time        `json:"started_at"`
+	FinishedAt    *time.Time        `json:"finished_at"`
+}
+
+// Finished reports whether the job has reached a final status.
+func (j *Job) Finished() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed || j.Status == JobCanceled
+}
+
+// JobLog is one line of a job's output. IDs increase, so a reader can
+// resume after the last line it saw.
+type JobLog struct {
+	ID        int64     `json:"id"`
+	JobID     int64     `json:"job_id"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const jobColumns = `id, action, server, target, params, status, attempts, error,
+	requester_type, requester_id, requester_name, created_at, started_at, finished_at`
+
+func scanJob(row rowScanner) (*Job, error) {
+	var j Job
+	var params string
+	err := row.Scan(&j.ID, &j.Action, &j.Server, &j.Target, &params, &j.Status, &j.Attempts, &j.Error,
+		&j.RequesterType, &j.RequesterID, &j.RequesterName, &j.CreatedAt, &j.StartedAt, &j.FinishedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(params), &j.Params); err != nil {
+		return nil, fmt.Errorf("job %d: invalid params: %w", j.ID, err)
+	}
+	if j.Params == nil {
+		j.Params = map[string]string{}
+	}
+	return &j, nil
+}
+
+func (db *DB) CreateJob(job *Job) error {
+	if job.Params == nil {
+		job.Params = map[string]string{}
+	}
+	params, err := json.Marshal(job.Params)
+	if err != nil {
+		return err
+	}
+
+	job.Status = JobQueued
+	job.CreatedAt = time.Now().UTC()
+
+	result, err := db.Exec(`
+		INSERT INTO jobs (action, server, target, params, status,
+			requester_type, requester_id, requester_name, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		job.Action, job.Server, job.Target, string(params), job.Status,
+		job.RequesterType, job.RequesterID, job.RequesterName, job.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	job.ID, err = result.LastInsertId()
+	return err
+}
+
+func (db *DB) GetJob(id int64) (*Job, error) {
+	job, err := scanJob(db.QueryRow(`
+		SELECT `+jobColumns+`
+		FROM jobs WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return job, err
+}
+
+// JobFilter narrows ListJobs. Zero fields match everything.
+type JobFilter struct {
+	Status        string
+	RequesterType string
+	RequesterID   int64
+	Limit         int
+}
+
+// ListJobs returns jobs newest first.
+func (db *DB) ListJobs(filter JobFilter) ([]Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE 1 = 1`
+	var args []interface{}
+	if filter.Status != "" {
+		query += ` AND status = ?`
+		args = append(args, filter.Status)
+	}
+	if filter.RequesterType != "" {
+		query += ` AND requester_type = ? AND requester_id = ?`
+		args = append(args, filter.RequesterType, filter.RequesterID)
+	}
+	query += ` ORDER BY id DESC`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+
+	return db.queryJobs(query, args...)
+}
+
+// QueuedJobs returns the jobs waiting to run, oldest first.
+func (db *DB) QueuedJobs() ([]Job, error) {
+	return db.queryJobs(`SELECT `+jobColumns+` FROM jobs WHERE status = ? ORDER BY id`, JobQueued)
+}
+
+func (db *DB) queryJobs(query string, args ...interface{}) ([]Job, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *j)
+	}
+	return jobs, rows.Err()
+}
+
+// StartJob moves a queued job to running and counts the attempt. It returns
+// false if the job was no longer queued, e.g. because it was cancelled.
+func (db *DB) StartJob(id int64) (bool, error) {
+	result, err := db.Exec(`
+		UPDATE jobs
+		SET status = ?, attempts = attempts + 1, error = '', started_at = ?, finished_at = NULL
+		WHERE id = ? AND status = ?`,
+		JobRunning, time.Now().UTC(), id, JobQueued)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// FinishJob records the final status of a running job.
+func (db *DB) FinishJob(id int64, status, errMessage string) error {
+	_, err := db.Exec(`UPDATE jobs SET status = ?, error = ?, finished_at = ? WHERE id = ?`,
+		status, errMessage, time.Now().UTC(), id)
+	return err
+}
+
+// CancelQueuedJob cancels a job that has not started yet. It returns false
+// if the job was not queued.
+func (db *DB) CancelQueuedJob(id int64) (bool, error) {
+	result, err := db.Exec(`UPDATE jobs SET status = ?, finished_at = ? WHERE id = ? AND status = ?`,
+		JobCanceled, time.Now().UTC(), id, JobQueued)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// RetryJob queues a failed or cancelled job again. It returns false if the
+// job was in any other status.
+func (db *DB) RetryJob(id int64) (bool, error) {
+	result, err := db.Exec(`
+		UPDATE jobs SET status = ?, error = '', started_at = NULL, finished_at = NULL
+		WHERE id = ? AND status IN (?, ?)`,
+		JobQueued, id, JobFailed, JobCanceled)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	return affected == 1, err
+}
+
+// RequeueRunningJobs queues the jobs left running by a previous process so
+// they run again, and returns their IDs.
+func (db *DB) RequeueRunningJobs() ([]int64, error) {
+	jobs, err := db.queryJobs(`SELECT `+jobColumns+` FROM jobs WHERE status = ?`, JobRunning)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int64
+	for _, job := range jobs {
+		result, err := db.Exec(`UPDATE jobs SET status = ? WHERE id = ? AND status = ?`, JobQueued, job.ID, JobRunning)
+		if err != nil {
+			return ids, err
+		}
+		if affected, _ := result.RowsAffected(); affected == 1 {
+			ids = append(ids, job.ID)
+		}
+	}
+	return ids, nil
+}
+
+func (db *DB) AppendJobLog(jobID int64, message string) error {
+	_, err := db.Exec(`INSERT INTO job_logs (job_id, message, created_at) VALUES (?, ?, ?)`,
+		jobID, message, time.Now().UTC())
+	return err
+}
+
+// JobLogs returns the job's log lines with an ID above afterID, oldest
+// first.
+func (db *DB) JobLogs(jobID, afterID int64) ([]JobLog, error) {
+	rows, err := db.Query(`
+		SELECT id, job_id, message, created_at
+		FROM job_logs WHERE job_id = ? AND id > ? ORDER BY id`, jobID, afterID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	logs := []JobLog{}
+	for rows.Next() {
+		var l JobLog
+		if err := rows.Scan(&l.ID, &l.JobID, &l.Message, &l.CreatedAt); err != nil {
+			return nil, err
+		}
+		logs = append(logs, l)
+	}
+	return logs, rows.Err()
+}
@@ -0,0 +1,181 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// RegistryHook receives image push notifications from a container registry
+// and recreates its containers when a watched image is pushed.
+type RegistryHook struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	// Token is the secret in the hook's URL, /hooks/registry/<token>. Only
+	// its hash is stored; it is returned when the hook is created or its
+	// token rotated.
+	Token string `json:"token,omitempty"`
+	// Repository is the watched image repository, e.g. myorg/api or
+	// ghcr.io/myorg/api.
+	Repository string `json:"repository"`
+	// Tag is the watched tag, or * for any tag.
+	Tag string `json:"tag"`
+	// Server is the server name or selector the containers run on; empty
+	// is the default server.
+	Server string `json:"server"`
+	// Containers are the names or IDs of the containers recreated on every
+	// push.
+	Containers      []string   `json:"containers"`
+	Enabled         bool       `json:"enabled"`
+	LastTriggeredAt *time.Time `json:"last_triggered_at"`
+	// LastDigest is the digest of the last push that triggered the hook,
+	// if the registry sent one.
+	LastDigest string    `json:"last_digest"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+const registryHookColumns = `id, name, repository, tag, server, containers, enabled,
+	last_triggered_at, last_digest, created_at`
+
+func scanRegistryHook(row rowScanner) (*RegistryHook, error) {
+	var h RegistryHook
+	var containers string
+	err := row.Scan(&h.ID, &h.Name, &h.Repository, &h.Tag, &h.Server, &containers, &h.Enabled,
+		&h.LastTriggeredAt, &h.LastDigest, &h.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(containers), &h.Containers); err != nil {
+		return nil, fmt.Errorf("registry hook %d: invalid containers: %w", h.ID, err)
+	}
+	return &h, nil
+}
+
+func generateHookToken() (string, error) {
+	token := make([]byte, 24)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// hashHookToken hashes a hook token for storage. Tokens are random, so
+// unlike API keys they need no salt and can be looked up by their hash.
+func hashHookToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateRegistryHook stores hook with a new token, returned in hook.Token.
+func (db *DB) CreateRegistryHook(hook *RegistryHook) error {
+	token, err := generateHookToken()
+	if err != nil {
+		return err
+	}
+	containers, err := json.Marshal(hook.Containers)
+	if err != nil {
+		return err
+	}
+
+	hook.Enabled = true
+	hook.CreatedAt = time.Now().UTC()
+	result, err := db.Exec(`
+		INSERT INTO registry_hooks (name, token_hash, repository, tag, server, containers, enabled, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		hook.Name, hashHookToken(token), hook.Repository, hook.Tag, hook.Server, string(containers),
+		hook.Enabled, hook.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	hook.ID, err = result.LastInsertId()
+	hook.Token = token
+	return err
+}
+
+// UpdateRegistryHook saves the settings of hook. Its token and enabled state
+// are left unchanged.
+func (db *DB) UpdateRegistryHook(hook *RegistryHook) error {
+	containers, err := json.Marshal(hook.Containers)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		UPDATE registry_hooks SET name = ?, repository = ?, tag = ?, server = ?, containers = ?
+		WHERE id = ?`,
+		hook.Name, hook.Repository, hook.Tag, hook.Server, string(containers), hook.ID)
+	return err
+}
+
+// RotateRegistryHookToken gives the hook a new token and returns it. The
+// old token stops working immediately.
+func (db *DB) RotateRegistryHookToken(id int64) (string, error) {
+	token, err := generateHookToken()
+	if err != nil {
+		return "", err
+	}
+	if _, err := db.Exec(`UPDATE registry_hooks SET token_hash = ? WHERE id = ?`, hashHookToken(token), id); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// GetRegistryHook returns the hook, or nil if there is none with that ID.
+func (db *DB) GetRegistryHook(id int64) (*RegistryHook, error) {
+	h, err := scanRegistryHook(db.QueryRow(`SELECT `+registryHookColumns+` FROM registry_hooks WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return h, err
+}
+
+// GetRegistryHookByToken returns the hook token belongs to, or nil if it
+// belongs to none.
+func (db *DB) GetRegistryHookByToken(token string) (*RegistryHook, error) {
+	h, err := scanRegistryHook(db.QueryRow(`SELECT `+registryHookColumns+` FROM registry_hooks WHERE token_hash = ?`,
+		hashHookToken(token)))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return h, err
+}
+
+func (db *DB) ListRegistryHooks() ([]RegistryHook, error) {
+	rows, err := db.Query(`SELECT ` + registryHookColumns + ` FROM registry_hooks ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hooks := []RegistryHook{}
+	for rows.Next() {
+		h, err := scanRegistryHook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, *h)
+	}
+	return hooks, rows.Err()
+}
+
+func (db *DB) SetRegistryHookEnabled(id int64, enabled bool) error {
+	_, err := db.Exec(`UPDATE registry_hooks SET enabled = ? WHERE id = ?`, enabled, id)
+	return err
+}
+
+// RecordRegistryHookTriggered notes a push that triggered the hook.
+func (db *DB) RecordRegistryHookTriggered(id int64, digest string) error {
+	_, err := db.Exec(`UPDATE registry_hooks SET last_triggered_at = ?, last_digest = ? WHERE id = ?`,
+		time.Now().UTC(), digest, id)
+	return err
+}
+
+func (db *DB) DeleteRegistryHook(id int64) error {
+	_, err := db.Exec(`DELETE FROM registry_hooks WHERE id = ?`, id)
+	return err
+}
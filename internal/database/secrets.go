@@ -0,0 +1,149 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Zeptile/docktrine/internal/logger"
+)
+
+// secretsKeyFile holds the hex-encoded AES-256 key that secrets stored in
+// the database are encrypted with, in the data directory next to the
+// database. A copy of the database alone does not reveal them.
+const secretsKeyFile = "secrets.key"
+
+// sealedPrefix marks an encrypted column value. Values without it were
+// written before encryption and are encrypted on startup.
+const sealedPrefix = "sealed:v1:"
+
+// loadSecretsKey reads the secrets key, creating it on first use.
+func loadSecretsKey(dataPath string) ([]byte, error) {
+	path := filepath.Join(dataPath, secretsKeyFile)
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("invalid secrets key in %s", path)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	logger.Info("Created secrets key: " + path)
+	return key, nil
+}
+
+func (db *DB) secretsAEAD() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(db.secretsKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealSecret encrypts a secret for storage. Empty secrets stay empty.
+func (db *DB) sealSecret(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	aead, err := db.secretsAEAD()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openSecret decrypts a value written by sealSecret. Values that were never
+// sealed are returned as they are.
+func (db *DB) openSecret(stored string) (string, error) {
+	if !strings.HasPrefix(stored, sealedPrefix) {
+		return stored, nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, sealedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("invalid sealed secret: %w", err)
+	}
+	aead, err := db.secretsAEAD()
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("invalid sealed secret: too short")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt secret, is %s the key it was sealed with? %w", secretsKeyFile, err)
+	}
+	return string(plaintext), nil
+}
+
+// sealedColumns are the columns holding secrets encrypted at rest.
+var sealedColumns = []struct{ table, column string }{
+	{"servers", "tls_key"},
+	{"api_keys", "signing_key"},
+	{"webhooks", "secret"},
+	{"email_channels", "password"},
+}
+
+// sealPlaintextSecrets encrypts the secrets written before they were
+// encrypted at rest.
+func (db *DB) sealPlaintextSecrets() error {
+	for _, sc := range sealedColumns {
+		rows, err := db.Query(fmt.Sprintf(`SELECT id, %s FROM %s WHERE %s != '' AND %s NOT LIKE ?`,
+			sc.column, sc.table, sc.column, sc.column), sealedPrefix+"%")
+		if err != nil {
+			return err
+		}
+		plaintext := map[int64]string{}
+		for rows.Next() {
+			var id int64
+			var value string
+			if err := rows.Scan(&id, &value); err != nil {
+				rows.Close()
+				return err
+			}
+			plaintext[id] = value
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for id, value := range plaintext {
+			sealed, err := db.sealSecret(value)
+			if err != nil {
+				return err
+			}
+			if _, err := db.Exec(fmt.Sprintf(`UPDATE %s SET %s = ? WHERE id = ?`, sc.table, sc.column), sealed, id); err != nil {
+				return err
+			}
+		}
+		if len(plaintext) > 0 {
+			logger.Info(fmt.Sprintf("Encrypted %d stored %s.%s values", len(plaintext), sc.table, sc.column))
+		}
+	}
+	return nil
+}
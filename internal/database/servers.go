@@ -2,22 +2,76 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"time"
 )
 
+const (
+	ServerSourceAPI           = "api"
+	ServerSourceConfig        = "config"
+	ServerSourceDockerContext = "docker-context"
+)
+
 type Server struct {
-	ID          int64
-	Name        string
-	Host        string
-	Description string
-	IsDefault   bool
-	CreatedAt   time.Time
-	UpdatedAt   time.Time
+	ID          int64             `json:"id"`
+	Name        string            `json:"name"`
+	Host        string            `json:"host"`
+	Description string            `json:"description"`
+	IsDefault   bool              `json:"is_default"`
+	Source      string            `json:"source"`
+	Labels      map[string]string `json:"labels"`
+	Groups      []string          `json:"groups"`
+	// Protected servers need a second principal to approve destructive
+	// operations.
+	Protected bool `json:"protected"`
+	// TLS material is stored as PEM text, the private key encrypted, and
+	// never serialized in API responses.
+	TLSCA         string    `json:"-"`
+	TLSCert       string    `json:"-"`
+	TLSKey        string    `json:"-"`
+	TLSSkipVerify bool      `json:"tls_skip_verify"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+const serverColumns = `id, name, host, description, is_default, source, labels, groups, protected,
+	tls_ca, tls_cert, tls_key, tls_skip_verify, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func (db *DB) scanServer(row rowScanner) (*Server, error) {
+	var s Server
+	var description sql.NullString
+	var labels, groups string
+	err := row.Scan(&s.ID, &s.Name, &s.Host, &description, &s.IsDefault, &s.Source, &labels, &groups, &s.Protected,
+		&s.TLSCA, &s.TLSCert, &s.TLSKey, &s.TLSSkipVerify, &s.CreatedAt, &s.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	s.Description = description.String
+	if s.TLSKey, err = db.openSecret(s.TLSKey); err != nil {
+		return nil, fmt.Errorf("server %s: TLS key: %w", s.Name, err)
+	}
+	if err := json.Unmarshal([]byte(labels), &s.Labels); err != nil {
+		return nil, fmt.Errorf("server %s: invalid labels: %w", s.Name, err)
+	}
+	if err := json.Unmarshal([]byte(groups), &s.Groups); err != nil {
+		return nil, fmt.Errorf("server %s: invalid groups: %w", s.Name, err)
+	}
+	if s.Labels == nil {
+		s.Labels = map[string]string{}
+	}
+	if s.Groups == nil {
+		s.Groups = []string{}
+	}
+	return &s, nil
 }
 
 func (db *DB) GetServers() ([]Server, error) {
-	rows, err := db.Query(`SELECT id, name, host, description, is_default, created_at, updated_at FROM servers`)
+	rows, err := db.Query(`SELECT ` + serverColumns + ` FROM servers`)
 	if err != nil {
 		return nil, err
 	}
@@ -25,49 +79,78 @@ func (db *DB) GetServers() ([]Server, error) {
 
 	var servers []Server
 	for rows.Next() {
-		var s Server
-		err := rows.Scan(&s.ID, &s.Name, &s.Host, &s.Description, &s.IsDefault, &s.CreatedAt, &s.UpdatedAt)
+		s, err := db.scanServer(rows)
 		if err != nil {
 			return nil, err
 		}
-		servers = append(servers, s)
+		servers = append(servers, *s)
 	}
-	return servers, nil
+	return servers, rows.Err()
 }
 
 func (db *DB) GetServerByName(name string) (*Server, error) {
-	var s Server
-	err := db.QueryRow(`
-		SELECT id, name, host, description, is_default, created_at, updated_at 
-		FROM servers WHERE name = ?`, name).Scan(
-		&s.ID, &s.Name, &s.Host, &s.Description, &s.IsDefault, &s.CreatedAt, &s.UpdatedAt)
-	
+	s, err := db.scanServer(db.QueryRow(`
+		SELECT `+serverColumns+` 
+		FROM servers WHERE name = ?`, name))
+
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	return &s, nil
+	return s, nil
 }
 
 func (db *DB) GetDefaultServer() (*Server, error) {
-	var s Server
-	err := db.QueryRow(`
-		SELECT id, name, host, description, is_default, created_at, updated_at 
-		FROM servers WHERE is_default = 1`).Scan(
-		&s.ID, &s.Name, &s.Host, &s.Description, &s.IsDefault, &s.CreatedAt, &s.UpdatedAt)
-	
+	s, err := db.scanServer(db.QueryRow(`
+		SELECT ` + serverColumns + ` 
+		FROM servers WHERE is_default = 1`))
+
 	if err == sql.ErrNoRows {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	return &s, nil
+	return s, nil
+}
+
+func encodeServerTags(server *Server) (string, string, error) {
+	labels := server.Labels
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	groups := server.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+
+	labelsJSON, err := json.Marshal(labels)
+	if err != nil {
+		return "", "", err
+	}
+	groupsJSON, err := json.Marshal(groups)
+	if err != nil {
+		return "", "", err
+	}
+	return string(labelsJSON), string(groupsJSON), nil
 }
 
 func (db *DB) CreateServer(server *Server) error {
+	if server.Source == "" {
+		server.Source = ServerSourceAPI
+	}
+
+	labels, groups, err := encodeServerTags(server)
+	if err != nil {
+		return err
+	}
+	tlsKey, err := db.sealSecret(server.TLSKey)
+	if err != nil {
+		return err
+	}
+
 	tx, err := db.Begin()
 	if err != nil {
 		return err
@@ -82,9 +165,11 @@ func (db *DB) CreateServer(server *Server) error {
 	}
 
 	result, err := tx.Exec(`
-		INSERT INTO servers (name, host, description, is_default)
-		VALUES (?, ?, ?, ?)`,
-		server.Name, server.Host, server.Description, server.IsDefault)
+		INSERT INTO servers (name, host, description, is_default, source, labels, groups, protected,
+			tls_ca, tls_cert, tls_key, tls_skip_verify)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		server.Name, server.Host, server.Description, server.IsDefault, server.Source, labels, groups, server.Protected,
+		server.TLSCA, server.TLSCert, tlsKey, server.TLSSkipVerify)
 	if err != nil {
 		return err
 	}
@@ -98,6 +183,80 @@ func (db *DB) CreateServer(server *Server) error {
 	return tx.Commit()
 }
 
+func (db *DB) UpdateServer(server *Server) error {
+	if server.Source == "" {
+		server.Source = ServerSourceAPI
+	}
+
+	labels, groups, err := encodeServerTags(server)
+	if err != nil {
+		return err
+	}
+	tlsKey, err := db.sealSecret(server.TLSKey)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if server.IsDefault {
+		_, err = tx.Exec(`UPDATE servers SET is_default = 0 WHERE name != ?`, server.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.Exec(`
+		UPDATE servers
+		SET host = ?, description = ?, is_default = ?, source = ?, labels = ?, groups = ?, protected = ?,
+			tls_ca = ?, tls_cert = ?, tls_key = ?, tls_skip_verify = ?,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE name = ?`,
+		server.Host, server.Description, server.IsDefault, server.Source, labels, groups, server.Protected,
+		server.TLSCA, server.TLSCert, tlsKey, server.TLSSkipVerify, server.Name)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if affected == 0 {
+		return fmt.Errorf("server not found")
+	}
+
+	return tx.Commit()
+}
+
+// DeleteServers deletes the named servers in one transaction: either all of
+// them are deleted or none.
+func (db *DB) DeleteServers(names []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, name := range names {
+		if _, err := tx.Exec(`DELETE FROM servers WHERE name = ?`, name); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// HasTLS reports whether the server has client TLS material configured.
+func (s *Server) HasTLS() bool {
+	return s.TLSCA != "" || s.TLSCert != "" || s.TLSKey != "" || s.TLSSkipVerify
+}
+
 func (db *DB) DeleteServer(name string) error {
 	result, err := db.Exec(`DELETE FROM servers WHERE name = ?`, name)
 	if err != nil {
@@ -114,4 +273,4 @@ func (db *DB) DeleteServer(name string) error {
 	}
 
 	return nil
-} 
\ No newline at end of file
+}
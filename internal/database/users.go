@@ -0,0 +1,308 @@
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	RoleViewer   = "viewer"
+	RoleOperator = "operator"
+	RoleAdmin    = "admin"
+)
+
+const (
+	UserSourceLocal = "local"
+	UserSourceOIDC  = "oidc"
+)
+
+func ValidRole(role string) bool {
+	return role == RoleViewer || role == RoleOperator || role == RoleAdmin
+}
+
+type User struct {
+	ID          int64      `json:"id"`
+	Username    string     `json:"username"`
+	Role        string     `json:"role"`
+	Source      string     `json:"source"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+
+	passwordHash string
+}
+
+type Session struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	Token     string    `json:"token,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+const userColumns = `id, username, password_hash, role, source, created_at, last_login_at`
+
+func scanUser(row rowScanner) (*User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.Username, &u.passwordHash, &u.Role, &u.Source, &u.CreatedAt, &u.LastLoginAt)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// dummyPasswordHash is compared against when a username does not exist so
+// that login takes the same time whether or not the user exists.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("docktrine"), bcrypt.DefaultCost)
+
+func (db *DB) GetUsers() ([]User, error) {
+	rows, err := db.Query(`SELECT ` + userColumns + ` FROM users ORDER BY username`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *u)
+	}
+	return users, rows.Err()
+}
+
+func (db *DB) GetUserByUsername(username string) (*User, error) {
+	u, err := scanUser(db.QueryRow(`
+		SELECT `+userColumns+`
+		FROM users WHERE username = ?`, username))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// GetUserBySubject returns the SSO user with the provider's subject, or nil.
+func (db *DB) GetUserBySubject(subject string) (*User, error) {
+	u, err := scanUser(db.QueryRow(`
+		SELECT `+userColumns+`
+		FROM users WHERE subject = ?`, subject))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (db *DB) CreateUser(user *User, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO users (username, password_hash, role)
+		VALUES (?, ?, ?)`,
+		user.Username, string(hash), user.Role)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	user.ID = id
+	user.Source = UserSourceLocal
+	user.CreatedAt = time.Now()
+	return nil
+}
+
+// UpsertSSOUser records a login through the OIDC provider. Users are keyed
+// by the provider's subject; their username and role are refreshed from the
+// latest token so group changes at the provider take effect on next login.
+// SSO users have no password and cannot use password login.
+func (db *DB) UpsertSSOUser(subject, username, role string) (*User, error) {
+	var owner sql.NullString
+	err := db.QueryRow(`SELECT subject FROM users WHERE username = ?`, username).Scan(&owner)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil && owner.String != subject {
+		return nil, fmt.Errorf("username %q is already taken by another user", username)
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO users (username, password_hash, role, source, subject, last_login_at)
+		VALUES (?, '', ?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT (subject) DO UPDATE SET
+			username = excluded.username,
+			role = excluded.role,
+			last_login_at = CURRENT_TIMESTAMP`,
+		username, role, UserSourceOIDC, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanUser(db.QueryRow(`
+		SELECT `+userColumns+`
+		FROM users WHERE subject = ?`, subject))
+}
+
+func (db *DB) UpdateUserPassword(username, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec(`UPDATE users SET password_hash = ? WHERE username = ?`, string(hash), username)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	// Changing the password ends every existing session.
+	_, err = db.Exec(`DELETE FROM sessions WHERE user_id = (SELECT id FROM users WHERE username = ?)`, username)
+	return err
+}
+
+func (db *DB) DeleteUser(username string) error {
+	user, err := db.GetUserByUsername(username)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("user not found")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, user.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM users WHERE id = ?`, user.ID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AuthenticateUser checks a username and password. It returns nil without
+// an error when the credentials are wrong.
+func (db *DB) AuthenticateUser(username, password string) (*User, error) {
+	user, err := db.GetUserByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
+	if user == nil {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, nil
+	}
+
+	if user.Source != UserSourceLocal {
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, nil
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.passwordHash), []byte(password)); err != nil {
+		return nil, nil
+	}
+
+	if _, err := db.Exec(`UPDATE users SET last_login_at = CURRENT_TIMESTAMP WHERE id = ?`, user.ID); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession issues a new session token for user valid for ttl. Only the
+// hash of the token is stored.
+func (db *DB) CreateSession(user *User, ttl time.Duration) (*Session, error) {
+	token := generateAPIKey()
+	expiresAt := time.Now().Add(ttl).UTC()
+
+	result, err := db.Exec(`
+		INSERT INTO sessions (user_id, token_hash, expires_at)
+		VALUES (?, ?, ?)`,
+		user.ID, hashSessionToken(token), expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		ID:        id,
+		UserID:    user.ID,
+		Token:     token,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// GetSessionUser returns the session and user for a token, or nil if the
+// token is unknown or expired. Expired sessions are deleted.
+func (db *DB) GetSessionUser(token string) (*Session, *User, error) {
+	var session Session
+	err := db.QueryRow(`
+		SELECT id, user_id, created_at, expires_at
+		FROM sessions WHERE token_hash = ?`, hashSessionToken(token)).Scan(
+		&session.ID, &session.UserID, &session.CreatedAt, &session.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if time.Now().After(session.ExpiresAt) {
+		_, err := db.Exec(`DELETE FROM sessions WHERE id = ?`, session.ID)
+		return nil, nil, err
+	}
+
+	user, err := scanUser(db.QueryRow(`
+		SELECT `+userColumns+`
+		FROM users WHERE id = ?`, session.UserID))
+	if err == sql.ErrNoRows {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &session, user, nil
+}
+
+func (db *DB) DeleteSession(id int64) error {
+	_, err := db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	return err
+}
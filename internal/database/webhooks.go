@@ -0,0 +1,354 @@
+package database
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook is an endpoint notifications are POSTed to.
+type Webhook struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Secret is the HMAC key payloads are signed with. It is only returned
+	// when the webhook is created.
+	Secret string `json:"secret,omitempty"`
+	// Events are the notification events the webhook receives; * receives
+	// all of them.
+	Events []string `json:"events"`
+	// Format is the payload format: json, slack, mattermost or discord.
+	Format string `json:"format"`
+	// Templates override the message text of chat formats per event, with
+	// * as the fallback for every event.
+	Templates map[string]string `json:"templates"`
+	// MinSeverity drops notifications below this severity; empty receives
+	// all of them.
+	MinSeverity string    `json:"min_severity"`
+	Enabled     bool      `json:"enabled"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Subscribes reports whether the webhook receives event.
+func (w *Webhook) Subscribes(event string) bool {
+	for _, e := range w.Events {
+		if e == "*" || e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is one notification queued for, or sent to, a webhook.
+// Pending deliveries form the outbox; the others are the delivery log.
+type WebhookDelivery struct {
+	ID        int64  `json:"id"`
+	WebhookID int64  `json:"webhook_id"`
+	Event     string `json:"event"`
+	// Payload is the JSON body that is POSTed, the same on every attempt.
+	Payload       json.RawMessage `json:"payload" swaggertype:"object"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt *time.Time      `json:"next_attempt_at"`
+	// ResponseStatus is the HTTP status of the last attempt, if it got a
+	// response.
+	ResponseStatus *int       `json:"response_status"`
+	Error          string     `json:"error,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+}
+
+const webhookColumns = `id, name, url, secret, events, format, templates, min_severity, enabled, created_at`
+
+func (db *DB) scanWebhook(row rowScanner) (*Webhook, error) {
+	var w Webhook
+	var events, templates string
+	err := row.Scan(&w.ID, &w.Name, &w.URL, &w.Secret, &events, &w.Format, &templates, &w.MinSeverity, &w.Enabled, &w.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if w.Secret, err = db.openSecret(w.Secret); err != nil {
+		return nil, fmt.Errorf("webhook %d: secret: %w", w.ID, err)
+	}
+	if err := json.Unmarshal([]byte(events), &w.Events); err != nil {
+		return nil, fmt.Errorf("webhook %d: invalid events: %w", w.ID, err)
+	}
+	if err := json.Unmarshal([]byte(templates), &w.Templates); err != nil {
+		return nil, fmt.Errorf("webhook %d: invalid templates: %w", w.ID, err)
+	}
+	if w.Templates == nil {
+		w.Templates = map[string]string{}
+	}
+	return &w, nil
+}
+
+const webhookDeliveryColumns = `id, webhook_id, event, payload, status, attempts, next_attempt_at,
+	response_status, error, created_at, delivered_at`
+
+func scanWebhookDelivery(row rowScanner) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	var payload string
+	err := row.Scan(&d.ID, &d.WebhookID, &d.Event, &payload, &d.Status, &d.Attempts, &d.NextAttemptAt,
+		&d.ResponseStatus, &d.Error, &d.CreatedAt, &d.DeliveredAt)
+	if err != nil {
+		return nil, err
+	}
+	d.Payload = json.RawMessage(payload)
+	return &d, nil
+}
+
+// CreateWebhook stores webhook, generating a secret if it has none.
+func (db *DB) CreateWebhook(webhook *Webhook) error {
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	}
+	if webhook.Format == "" {
+		webhook.Format = "json"
+	}
+	if webhook.Templates == nil {
+		webhook.Templates = map[string]string{}
+	}
+	events, err := json.Marshal(webhook.Events)
+	if err != nil {
+		return err
+	}
+	templates, err := json.Marshal(webhook.Templates)
+	if err != nil {
+		return err
+	}
+	secret, err := db.sealSecret(webhook.Secret)
+	if err != nil {
+		return err
+	}
+
+	webhook.Enabled = true
+	webhook.CreatedAt = time.Now().UTC()
+	result, err := db.Exec(`
+		INSERT INTO webhooks (name, url, secret, events, format, templates, min_severity, enabled, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		webhook.Name, webhook.URL, secret, string(events), webhook.Format, string(templates), webhook.MinSeverity,
+		webhook.Enabled, webhook.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	webhook.ID, err = result.LastInsertId()
+	return err
+}
+
+// UpdateWebhook saves the settings of webhook. Its secret and enabled state
+// are left unchanged.
+func (db *DB) UpdateWebhook(webhook *Webhook) error {
+	events, err := json.Marshal(webhook.Events)
+	if err != nil {
+		return err
+	}
+	templates, err := json.Marshal(webhook.Templates)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		UPDATE webhooks SET name = ?, url = ?, events = ?, format = ?, templates = ?, min_severity = ?
+		WHERE id = ?`,
+		webhook.Name, webhook.URL, string(events), webhook.Format, string(templates), webhook.MinSeverity, webhook.ID)
+	return err
+}
+
+// GetWebhook returns the webhook with its secret, or nil if there is none
+// with that ID.
+func (db *DB) GetWebhook(id int64) (*Webhook, error) {
+	w, err := db.scanWebhook(db.QueryRow(`SELECT `+webhookColumns+` FROM webhooks WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return w, err
+}
+
+// ListWebhooks returns every webhook, secrets included.
+func (db *DB) ListWebhooks() ([]Webhook, error) {
+	rows, err := db.Query(`SELECT ` + webhookColumns + ` FROM webhooks ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		w, err := db.scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, *w)
+	}
+	return webhooks, rows.Err()
+}
+
+func (db *DB) SetWebhookEnabled(id int64, enabled bool) error {
+	_, err := db.Exec(`UPDATE webhooks SET enabled = ? WHERE id = ?`, enabled, id)
+	return err
+}
+
+// DeleteWebhook deletes the webhook and its deliveries.
+func (db *DB) DeleteWebhook(id int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM webhook_deliveries WHERE webhook_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM webhooks WHERE id = ?`, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// QueueWebhookDelivery adds a delivery of payload to the outbox, due
+// immediately.
+func (db *DB) QueueWebhookDelivery(webhookID int64, event string, payload []byte) (*WebhookDelivery, error) {
+	now := time.Now().UTC()
+	delivery := &WebhookDelivery{
+		WebhookID:     webhookID,
+		Event:         event,
+		Payload:       json.RawMessage(payload),
+		Status:        DeliveryPending,
+		NextAttemptAt: &now,
+		CreatedAt:     now,
+	}
+
+	result, err := db.Exec(`
+		INSERT INTO webhook_deliveries (webhook_id, event, payload, status, attempts, next_attempt_at, created_at)
+		VALUES (?, ?, ?, ?, 0, ?, ?)`,
+		webhookID, event, string(payload), delivery.Status, delivery.NextAttemptAt, delivery.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery.ID, err = result.LastInsertId()
+	return delivery, err
+}
+
+// DueWebhookDeliveries returns up to limit pending deliveries whose next
+// attempt is due, oldest first.
+func (db *DB) DueWebhookDeliveries(limit int) ([]WebhookDelivery, error) {
+	rows, err := db.Query(`
+		SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries
+		WHERE status = ? AND next_attempt_at <= ?
+		ORDER BY id LIMIT ?`,
+		DeliveryPending, time.Now().UTC(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *d)
+	}
+	return deliveries, rows.Err()
+}
+
+// RecordWebhookAttempt stores the outcome of an attempt to deliver. A nil
+// nextAttempt with a non-empty errMessage gives up on the delivery.
+func (db *DB) RecordWebhookAttempt(id int64, responseStatus *int, errMessage string, nextAttempt *time.Time) error {
+	now := time.Now().UTC()
+	status := DeliverySucceeded
+	var deliveredAt *time.Time
+	switch {
+	case errMessage == "":
+		deliveredAt = &now
+		nextAttempt = nil
+	case nextAttempt != nil:
+		status = DeliveryPending
+	default:
+		status = DeliveryFailed
+	}
+
+	_, err := db.Exec(`
+		UPDATE webhook_deliveries
+		SET status = ?, attempts = attempts + 1, next_attempt_at = ?, response_status = ?, error = ?, delivered_at = ?
+		WHERE id = ?`,
+		status, nextAttempt, responseStatus, errMessage, deliveredAt, id)
+	return err
+}
+
+// GetWebhookDelivery returns the delivery, or nil if there is none with that
+// ID.
+func (db *DB) GetWebhookDelivery(id int64) (*WebhookDelivery, error) {
+	d, err := scanWebhookDelivery(db.QueryRow(`SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return d, err
+}
+
+// ListWebhookDeliveries returns a webhook's deliveries, newest first,
+// optionally only those with status.
+func (db *DB) ListWebhookDeliveries(webhookID int64, status string, limit int) ([]WebhookDelivery, error) {
+	query := `SELECT ` + webhookDeliveryColumns + ` FROM webhook_deliveries WHERE webhook_id = ?`
+	args := []interface{}{webhookID}
+	if status != "" {
+		query += ` AND status = ?`
+		args = append(args, status)
+	}
+	query += ` ORDER BY id DESC`
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *d)
+	}
+	return deliveries, rows.Err()
+}
+
+// RedeliverWebhookDelivery puts a delivery back in the outbox, due
+// immediately, keeping its attempt count.
+func (db *DB) RedeliverWebhookDelivery(id int64) error {
+	_, err := db.Exec(`UPDATE webhook_deliveries SET status = ?, next_attempt_at = ?, delivered_at = NULL WHERE id = ?`,
+		DeliveryPending, time.Now().UTC(), id)
+	return err
+}
+
+// PruneWebhookDeliveries deletes finished deliveries created before before
+// and returns how many it deleted.
+func (db *DB) PruneWebhookDeliveries(before time.Time) (int64, error) {
+	result, err := db.Exec(`DELETE FROM webhook_deliveries WHERE status != ? AND created_at < ?`,
+		DeliveryPending, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -2,14 +2,21 @@ package docker
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"strings"
 	"time"
 
 	"github.com/Zeptile/docktrine/internal/database"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/client"
-	"github.com/gofiber/fiber/v2"
+	"github.com/docker/docker/errdefs"
 )
 
 type DockerClient struct {
@@ -23,6 +30,13 @@ func NewDockerClient(db *database.DB) *DockerClient {
 }
 
 func (d *DockerClient) newClient(serverName string) (*client.Client, error) {
+	return d.connect(serverName, 15*time.Second)
+}
+
+// connect opens a client for the named server, or the default server when
+// serverName is empty. A zero timeout leaves requests bounded only by their
+// context.
+func (d *DockerClient) connect(serverName string, timeout time.Duration) (*client.Client, error) {
 	var server *database.Server
 	var err error
 
@@ -37,17 +51,66 @@ func (d *DockerClient) newClient(serverName string) (*client.Client, error) {
 	}
 
 	if server == nil {
-		return nil, fmt.Errorf("server not found")
+		return nil, serverNotFound(serverName)
+	}
+
+	opts := []client.Opt{}
+	if server.HasTLS() {
+		tlsConfig, err := newTLSConfig(server)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, client.WithHTTPClient(&http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}))
 	}
 
-	return client.NewClientWithOpts(
+	opts = append(opts,
 		client.WithHost(server.Host),
 		client.WithAPIVersionNegotiation(),
-		client.WithTimeout(15*time.Second),
 	)
+	if timeout > 0 {
+		opts = append(opts, client.WithTimeout(timeout))
+	}
+
+	return client.NewClientWithOpts(opts...)
+}
+
+// serverNotFound reports an unknown server name, or a missing default
+// server when name is empty.
+func serverNotFound(name string) error {
+	if name == "" {
+		return errdefs.NotFound(fmt.Errorf("no default server configured"))
+	}
+	return errdefs.NotFound(fmt.Errorf("server %s not found", name))
+}
+
+func newTLSConfig(server *database.Server) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: server.TLSSkipVerify,
+	}
+
+	if server.TLSCA != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(server.TLSCA)) {
+			return nil, fmt.Errorf("server %s: invalid TLS CA certificate", server.Name)
+		}
+		config.RootCAs = pool
+	}
+
+	if server.TLSCert != "" || server.TLSKey != "" {
+		cert, err := tls.X509KeyPair([]byte(server.TLSCert), []byte(server.TLSKey))
+		if err != nil {
+			return nil, fmt.Errorf("server %s: invalid TLS client certificate: %w", server.Name, err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
 }
 
-func (d *DockerClient) ListContainers(serverName string) ([]fiber.Map, error) {
+func (d *DockerClient) ListContainers(serverName string) ([]Container, error) {
 	cli, err := d.newClient(serverName)
 	if err != nil {
 		return nil, err
@@ -61,48 +124,95 @@ func (d *DockerClient) ListContainers(serverName string) ([]fiber.Map, error) {
 		return nil, err
 	}
 
-	var containerDetails []fiber.Map
+	containerDetails := []Container{}
 	for _, c := range containers {
 		inspect, err := cli.ContainerInspect(context.Background(), c.ID)
 		if err != nil {
 			continue
 		}
 
-		containerDetails = append(containerDetails, fiber.Map{
-			"id":      inspect.ID,
-			"name":    inspect.Name,
-			"image":   inspect.Image,
-			"state":   inspect.State,
-			"created": inspect.Created,
-			"status":  inspect.State.Status,
-			"ports":   c.Ports,
-			"labels":  inspect.Config.Labels,
-		})
-	}
-	
+		containerDetails = append(containerDetails, newContainer(inspect))
+	}
+
 	return containerDetails, nil
 }
 
-func (d *DockerClient) RestartContainer(containerID string, serverName string, pullLatest bool) error {
+// RestartContainer restarts the container, pulling its image first when
+// pullLatest is set. It returns the digest of the pulled image, if the
+// registry reported one.
+func (d *DockerClient) RestartContainer(containerID string, serverName string, pullLatest bool) (string, error) {
 	cli, err := d.newClient(serverName)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer cli.Close()
 
+	return restartContainer(context.Background(), cli, containerID, pullLatest, nil)
+}
+
+func restartContainer(ctx context.Context, cli *client.Client, containerID string, pullLatest bool, progress func(string)) (string, error) {
+	digest := ""
 	if pullLatest {
-		inspect, err := cli.ContainerInspect(context.Background(), containerID)
-		if err != nil {
-			return err
+		var err error
+		if digest, err = pullContainerImage(ctx, cli, containerID, progress); err != nil {
+			return "", err
 		}
+	}
 
-		_, err = cli.ImagePull(context.Background(), inspect.Config.Image, image.PullOptions{})
-		if err != nil {
-			return err
-		}
+	return digest, cli.ContainerRestart(ctx, containerID, container.StopOptions{})
+}
+
+// pullMessage is one line of the JSON progress stream of an image pull.
+type pullMessage struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+// pullContainerImage pulls the image the container was created from and
+// returns the digest the registry reported for it.
+func pullContainerImage(ctx context.Context, cli *client.Client, containerID string, progress func(string)) (string, error) {
+	inspect, err := cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return "", err
 	}
+	return pullImage(ctx, cli, inspect.Config.Image, progress)
+}
 
-	return cli.ContainerRestart(context.Background(), containerID, container.StopOptions{})
+// pullImage pulls ref and returns the digest the registry reported for it.
+// The pull only completes once its progress stream has been read to the
+// end, and each distinct status line is passed to progress.
+func pullImage(ctx context.Context, cli *client.Client, ref string, progress func(string)) (string, error) {
+	reader, err := cli.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	decoder := json.NewDecoder(reader)
+	last := ""
+	digest := ""
+	for {
+		var message pullMessage
+		if err := decoder.Decode(&message); err == io.EOF {
+			return digest, nil
+		} else if err != nil {
+			return "", err
+		}
+		if message.Error != "" {
+			return "", errors.New(message.Error)
+		}
+		if d, ok := strings.CutPrefix(message.Status, "Digest: "); ok {
+			digest = d
+		}
+		// Download and extraction progress repeats the same status with a
+		// changing progress bar, only report when the status changes.
+		line := strings.TrimSpace(strings.TrimPrefix(message.ID+": "+message.Status, ": "))
+		if progress != nil && message.Status != "" && line != last {
+			progress(line)
+		}
+		last = line
+	}
 }
 
 func (d *DockerClient) StartContainer(containerID string, serverName string) error {
@@ -125,7 +235,7 @@ func (d *DockerClient) StopContainer(containerID string, serverName string) erro
 	return cli.ContainerStop(context.Background(), containerID, container.StopOptions{})
 }
 
-func (d *DockerClient) GetContainer(containerID string, serverName string) (fiber.Map, error) {
+func (d *DockerClient) GetContainer(containerID string, serverName string) (*Container, error) {
 	cli, err := d.newClient(serverName)
 	if err != nil {
 		return nil, err
@@ -137,12 +247,25 @@ func (d *DockerClient) GetContainer(containerID string, serverName string) (fibe
 		return nil, err
 	}
 
-	return fiber.Map{
-		"id":      inspect.ID,
-		"name":    inspect.Name,
-		"image":   inspect.Image,
-		"state":   inspect.State,
-		"created": inspect.Created,
-		"status":  inspect.State.Status,
-	}, nil
-} 
\ No newline at end of file
+	result := newContainer(inspect)
+	return &result, nil
+}
+
+// ProtectedLabel marks a container whose stop and restart need a second
+// principal's approval when set to "true".
+const ProtectedLabel = "docktrine.protected"
+
+func (d *DockerClient) ContainerLabels(containerID string, serverName string) (map[string]string, error) {
+	cli, err := d.newClient(serverName)
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+
+	inspect, err := cli.ContainerInspect(context.Background(), containerID)
+	if err != nil {
+		return nil, err
+	}
+
+	return inspect.Config.Labels, nil
+}
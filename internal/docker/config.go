@@ -3,17 +3,30 @@ package docker
 import (
 	"encoding/json"
 	"os"
+
+	"github.com/Zeptile/docktrine/internal/database"
 )
 
 type ServerConfig struct {
-	Name        string `json:"name"`
-	Host        string `json:"host"`
-	Description string `json:"description,omitempty"`
-	Default     bool   `json:"default,omitempty"`
+	Name          string            `json:"name"`
+	Host          string            `json:"host"`
+	Description   string            `json:"description,omitempty"`
+	Default       bool              `json:"default,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	Groups        []string          `json:"groups,omitempty"`
+	Protected     bool              `json:"protected,omitempty"`
+	TLSCA         string            `json:"tls_ca,omitempty"`
+	TLSCert       string            `json:"tls_cert,omitempty"`
+	TLSKey        string            `json:"tls_key,omitempty"`
+	TLSSkipVerify bool              `json:"tls_skip_verify,omitempty"`
 }
 
 type Config struct {
 	Servers []ServerConfig `json:"servers"`
+
+	// fromFile is set when the config was read from a file rather than
+	// being the built-in default for a missing one.
+	fromFile bool
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -56,6 +69,24 @@ func LoadConfig(path string) (*Config, error) {
 	if !hasDefault && len(config.Servers) > 0 {
 		config.Servers[0].Default = true
 	}
+	config.fromFile = true
 
 	return &config, nil
-} 
\ No newline at end of file
+}
+
+func (sc ServerConfig) toServer(source string) database.Server {
+	return database.Server{
+		Name:          sc.Name,
+		Host:          sc.Host,
+		Description:   sc.Description,
+		IsDefault:     sc.Default,
+		Source:        source,
+		Labels:        sc.Labels,
+		Groups:        sc.Groups,
+		Protected:     sc.Protected,
+		TLSCA:         sc.TLSCA,
+		TLSCert:       sc.TLSCert,
+		TLSKey:        sc.TLSKey,
+		TLSSkipVerify: sc.TLSSkipVerify,
+	}
+}
@@ -0,0 +1,116 @@
+package docker
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// Container is a container as the API returns it. Field names are part of
+// the /v1 contract: add fields, never rename or remove them.
+type Container struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Image is the ID of the image the container runs.
+	Image string `json:"image"`
+	// ImageName is the image reference the container was created from,
+	// e.g. nginx:latest.
+	ImageName string            `json:"image_name"`
+	Status    string            `json:"status"`
+	State     ContainerState    `json:"state"`
+	Created   time.Time         `json:"created"`
+	Ports     []Port            `json:"ports"`
+	Labels    map[string]string `json:"labels"`
+	// Server is the server the container runs on.
+	Server string `json:"server,omitempty"`
+	// Alerts are the kinds of the container's active alerts, e.g.
+	// crash_loop.
+	Alerts []string `json:"alerts,omitempty"`
+}
+
+type ContainerState struct {
+	Status     string    `json:"status"`
+	Running    bool      `json:"running"`
+	Paused     bool      `json:"paused"`
+	Restarting bool      `json:"restarting"`
+	OOMKilled  bool      `json:"oom_killed"`
+	Dead       bool      `json:"dead"`
+	Pid        int       `json:"pid"`
+	ExitCode   int       `json:"exit_code"`
+	Error      string    `json:"error"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+type Port struct {
+	IP          string `json:"ip,omitempty"`
+	PrivatePort int    `json:"private_port"`
+	PublicPort  int    `json:"public_port,omitempty"`
+	Type        string `json:"type"`
+}
+
+func newContainer(inspect types.ContainerJSON) Container {
+	c := Container{
+		ID:      inspect.ID,
+		Name:    strings.TrimPrefix(inspect.Name, "/"),
+		Image:   inspect.Image,
+		Created: parseDockerTime(inspect.Created),
+		Ports:   []Port{},
+		Labels:  map[string]string{},
+	}
+
+	if inspect.Config != nil {
+		c.ImageName = inspect.Config.Image
+		if inspect.Config.Labels != nil {
+			c.Labels = inspect.Config.Labels
+		}
+	}
+
+	if s := inspect.State; s != nil {
+		c.Status = s.Status
+		c.State = ContainerState{
+			Status:     s.Status,
+			Running:    s.Running,
+			Paused:     s.Paused,
+			Restarting: s.Restarting,
+			OOMKilled:  s.OOMKilled,
+			Dead:       s.Dead,
+			Pid:        s.Pid,
+			ExitCode:   s.ExitCode,
+			Error:      s.Error,
+			StartedAt:  parseDockerTime(s.StartedAt),
+			FinishedAt: parseDockerTime(s.FinishedAt),
+		}
+	}
+
+	if inspect.NetworkSettings != nil {
+		for port, bindings := range inspect.NetworkSettings.Ports {
+			if len(bindings) == 0 {
+				c.Ports = append(c.Ports, Port{PrivatePort: port.Int(), Type: port.Proto()})
+				continue
+			}
+			for _, b := range bindings {
+				public, _ := strconv.Atoi(b.HostPort)
+				c.Ports = append(c.Ports, Port{IP: b.HostIP, PrivatePort: port.Int(), PublicPort: public, Type: port.Proto()})
+			}
+		}
+		sort.Slice(c.Ports, func(i, j int) bool {
+			if c.Ports[i].PrivatePort != c.Ports[j].PrivatePort {
+				return c.Ports[i].PrivatePort < c.Ports[j].PrivatePort
+			}
+			return c.Ports[i].Type < c.Ports[j].Type
+		})
+	}
+
+	return c
+}
+
+// parseDockerTime parses the RFC 3339 timestamps Docker reports, which are
+// the zero time when unset.
+func parseDockerTime(value string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, value)
+	return t
+}
@@ -0,0 +1,171 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Zeptile/docktrine/internal/database"
+)
+
+// dockerContextMeta mirrors the meta.json files the Docker CLI writes under
+// contexts/meta/<id>/.
+type dockerContextMeta struct {
+	Name     string `json:"Name"`
+	Metadata struct {
+		Description string `json:"Description"`
+	} `json:"Metadata"`
+	Endpoints map[string]struct {
+		Host          string `json:"Host"`
+		SkipTLSVerify bool   `json:"SkipTLSVerify"`
+	} `json:"Endpoints"`
+}
+
+type ImportResult struct {
+	Created []string `json:"created"`
+	Updated []string `json:"updated"`
+	Skipped []string `json:"skipped"`
+}
+
+// DefaultDockerConfigDir returns the Docker CLI config directory, honouring
+// DOCKER_CONFIG like the Docker CLI does.
+func DefaultDockerConfigDir() (string, error) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".docker"), nil
+}
+
+// LoadDockerContexts reads the Docker CLI contexts stored under
+// <configDir>/contexts. Contexts whose endpoint cannot be used by the API
+// (for example ssh:// hosts) are returned in skipped with the reason.
+func LoadDockerContexts(configDir string) ([]ServerConfig, []string, error) {
+	metaDir := filepath.Join(configDir, "contexts", "meta")
+	entries, err := os.ReadDir(metaDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	var servers []ServerConfig
+	var skipped []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		file, err := os.ReadFile(filepath.Join(metaDir, entry.Name(), "meta.json"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, nil, err
+		}
+
+		var meta dockerContextMeta
+		if err := json.Unmarshal(file, &meta); err != nil {
+			return nil, nil, fmt.Errorf("context %s: %w", entry.Name(), err)
+		}
+
+		endpoint, ok := meta.Endpoints["docker"]
+		if !ok || endpoint.Host == "" {
+			skipped = append(skipped, fmt.Sprintf("%s: no docker endpoint", meta.Name))
+			continue
+		}
+		if strings.HasPrefix(endpoint.Host, "ssh://") {
+			skipped = append(skipped, fmt.Sprintf("%s: ssh endpoints are not supported", meta.Name))
+			continue
+		}
+
+		server := ServerConfig{
+			Name:          meta.Name,
+			Host:          endpoint.Host,
+			Description:   meta.Metadata.Description,
+			TLSSkipVerify: endpoint.SkipTLSVerify,
+		}
+
+		tlsDir := filepath.Join(configDir, "contexts", "tls", entry.Name(), "docker")
+		for file, dest := range map[string]*string{
+			"ca.pem":   &server.TLSCA,
+			"cert.pem": &server.TLSCert,
+			"key.pem":  &server.TLSKey,
+		} {
+			data, err := os.ReadFile(filepath.Join(tlsDir, file))
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, nil, err
+			}
+			*dest = string(data)
+		}
+
+		servers = append(servers, server)
+	}
+
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Name < servers[j].Name })
+	return servers, skipped, nil
+}
+
+// ImportServers creates a server for each entry. Entries whose name already
+// exists are updated when update is true and skipped otherwise.
+func ImportServers(db *database.DB, servers []ServerConfig, update bool) (*ImportResult, error) {
+	result := &ImportResult{
+		Created: []string{},
+		Updated: []string{},
+		Skipped: []string{},
+	}
+
+	for _, sc := range servers {
+		if sc.Name == "" || sc.Host == "" {
+			return nil, fmt.Errorf("imported servers require a name and host")
+		}
+
+		server := sc.toServer(database.ServerSourceDockerContext)
+
+		existing, err := db.GetServerByName(sc.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		if existing == nil {
+			if err := db.CreateServer(&server); err != nil {
+				return nil, err
+			}
+			result.Created = append(result.Created, sc.Name)
+			continue
+		}
+
+		if !update {
+			result.Skipped = append(result.Skipped, fmt.Sprintf("%s: already exists", sc.Name))
+			continue
+		}
+
+		// Importing must not move the default away from the current server,
+		// drop its protection or take it out of its selectors: contexts
+		// carry no labels or groups.
+		server.IsDefault = existing.IsDefault
+		server.Protected = server.Protected || existing.Protected
+		if len(server.Labels) == 0 {
+			server.Labels = existing.Labels
+		}
+		if len(server.Groups) == 0 {
+			server.Groups = existing.Groups
+		}
+		if err := db.UpdateServer(&server); err != nil {
+			return nil, err
+		}
+		result.Updated = append(result.Updated, sc.Name)
+	}
+
+	return result, nil
+}
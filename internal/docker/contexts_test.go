@@ -0,0 +1,264 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Zeptile/docktrine/internal/database"
+)
+
+// contextFixture is a Docker CLI context written the way the CLI stores it:
+// contexts/meta/<sha256 of name>/meta.json and, optionally,
+// contexts/tls/<sha256 of name>/docker/*.pem.
+type contextFixture struct {
+	name string
+	meta string
+	tls  map[string]string
+}
+
+func writeContexts(t *testing.T, dir string, contexts []contextFixture) {
+	t.Helper()
+	for _, ctx := range contexts {
+		sum := sha256.Sum256([]byte(ctx.name))
+		id := hex.EncodeToString(sum[:])
+
+		metaDir := filepath.Join(dir, "contexts", "meta", id)
+		if err := os.MkdirAll(metaDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if ctx.meta != "" {
+			if err := os.WriteFile(filepath.Join(metaDir, "meta.json"), []byte(ctx.meta), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if len(ctx.tls) == 0 {
+			continue
+		}
+		tlsDir := filepath.Join(dir, "contexts", "tls", id, "docker")
+		if err := os.MkdirAll(tlsDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for file, data := range ctx.tls {
+			if err := os.WriteFile(filepath.Join(tlsDir, file), []byte(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestLoadDockerContexts(t *testing.T) {
+	tests := []struct {
+		name     string
+		contexts []contextFixture
+		want     []ServerConfig
+		skipped  []string
+		wantErr  string
+	}{
+		{
+			name: "no contexts directory",
+		},
+		{
+			name: "tcp context with TLS material",
+			contexts: []contextFixture{{
+				name: "prod",
+				meta: `{"Name":"prod","Metadata":{"Description":"Production"},"Endpoints":{"docker":{"Host":"tcp://prod.example.com:2376","SkipTLSVerify":false}}}`,
+				tls: map[string]string{
+					"ca.pem":   "CA PEM",
+					"cert.pem": "CERT PEM",
+					"key.pem":  "KEY PEM",
+				},
+			}},
+			want: []ServerConfig{{
+				Name:        "prod",
+				Host:        "tcp://prod.example.com:2376",
+				Description: "Production",
+				TLSCA:       "CA PEM",
+				TLSCert:     "CERT PEM",
+				TLSKey:      "KEY PEM",
+			}},
+		},
+		{
+			name: "partial TLS material and skip verify",
+			contexts: []contextFixture{{
+				name: "staging",
+				meta: `{"Name":"staging","Endpoints":{"docker":{"Host":"tcp://staging:2376","SkipTLSVerify":true}}}`,
+				tls:  map[string]string{"ca.pem": "CA PEM"},
+			}},
+			want: []ServerConfig{{
+				Name:          "staging",
+				Host:          "tcp://staging:2376",
+				TLSCA:         "CA PEM",
+				TLSSkipVerify: true,
+			}},
+		},
+		{
+			name: "unsupported endpoints are skipped",
+			contexts: []contextFixture{
+				{
+					name: "remote",
+					meta: `{"Name":"remote","Endpoints":{"docker":{"Host":"ssh://user@remote"}}}`,
+				},
+				{
+					name: "k8s",
+					meta: `{"Name":"k8s","Endpoints":{"kubernetes":{"Host":"https://k8s"}}}`,
+				},
+			},
+			skipped: []string{
+				"k8s: no docker endpoint",
+				"remote: ssh endpoints are not supported",
+			},
+		},
+		{
+			name: "sorted by name, directories without meta.json ignored",
+			contexts: []contextFixture{
+				{name: "b", meta: `{"Name":"b","Endpoints":{"docker":{"Host":"unix:///b.sock"}}}`},
+				{name: "a", meta: `{"Name":"a","Endpoints":{"docker":{"Host":"unix:///a.sock"}}}`},
+				{name: "empty"},
+			},
+			want: []ServerConfig{
+				{Name: "a", Host: "unix:///a.sock"},
+				{Name: "b", Host: "unix:///b.sock"},
+			},
+		},
+		{
+			name: "invalid meta.json",
+			contexts: []contextFixture{
+				{name: "broken", meta: `{"Name":`},
+			},
+			wantErr: "context ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeContexts(t, dir, tt.contexts)
+
+			servers, skipped, err := LoadDockerContexts(dir)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(servers, tt.want) {
+				t.Errorf("servers = %+v, want %+v", servers, tt.want)
+			}
+			// Skipped contexts come in directory order, which is by ID.
+			sort.Strings(skipped)
+			if len(skipped) != 0 || len(tt.skipped) != 0 {
+				if !reflect.DeepEqual(skipped, tt.skipped) {
+					t.Errorf("skipped = %q, want %q", skipped, tt.skipped)
+				}
+			}
+		})
+	}
+}
+
+func TestDefaultDockerConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dir)
+
+	got, err := DefaultDockerConfigDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != dir {
+		t.Errorf("DefaultDockerConfigDir() = %q, want %q", got, dir)
+	}
+}
+
+func TestImportServers(t *testing.T) {
+	dataDir := t.TempDir()
+	t.Setenv("CONFIG_PATH", dataDir)
+	db, err := database.NewDatabaseConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	dockerConfig := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dockerConfig)
+	writeContexts(t, dockerConfig, []contextFixture{{
+		name: "prod",
+		meta: `{"Name":"prod","Endpoints":{"docker":{"Host":"tcp://prod:2376"}}}`,
+		tls:  map[string]string{"cert.pem": "CERT PEM", "key.pem": "KEY PEM"},
+	}})
+	dir, err := DefaultDockerConfigDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, _, err := LoadDockerContexts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ImportServers(db, servers, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Created, []string{"prod"}) {
+		t.Fatalf("created = %q, want [prod]", result.Created)
+	}
+
+	server, err := db.GetServerByName("prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.TLSKey != "KEY PEM" || server.Source != database.ServerSourceDockerContext {
+		t.Errorf("imported server = %+v", server)
+	}
+
+	// The private key must not be readable from the database file alone.
+	var stored string
+	if err := db.QueryRow(`SELECT tls_key FROM servers WHERE name = 'prod'`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored == "" || strings.Contains(stored, "KEY PEM") {
+		t.Errorf("tls_key stored as %q, want it encrypted", stored)
+	}
+
+	result, err = ImportServers(db, servers, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Created) != 0 || !reflect.DeepEqual(result.Skipped, []string{"prod: already exists"}) {
+		t.Errorf("second import = %+v, want prod skipped", result)
+	}
+
+	server.Labels = map[string]string{"env": "prod"}
+	server.Groups = []string{"web"}
+	if err := db.UpdateServer(server); err != nil {
+		t.Fatal(err)
+	}
+	servers[0].Host = "tcp://prod:2377"
+	result, err = ImportServers(db, servers, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Updated, []string{"prod"}) {
+		t.Errorf("updated = %q, want [prod]", result.Updated)
+	}
+
+	// Contexts have no labels or groups, so updating keeps the server's own.
+	server, err = db.GetServerByName("prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.Host != "tcp://prod:2377" {
+		t.Errorf("updated host = %q, want tcp://prod:2377", server.Host)
+	}
+	if !reflect.DeepEqual(server.Labels, map[string]string{"env": "prod"}) || !reflect.DeepEqual(server.Groups, []string{"web"}) {
+		t.Errorf("updated labels = %v, groups = %q, want them kept", server.Labels, server.Groups)
+	}
+}
@@ -0,0 +1,183 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// EventTypeStream is the type of the events Docktrine adds to a stream to
+// report that it lost or regained a server's event feed.
+const EventTypeStream = "docktrine"
+
+const (
+	eventRetryMin = time.Second
+	eventRetryMax = 30 * time.Second
+)
+
+// Event is a Docker daemon event, tagged with the server it happened on.
+type Event struct {
+	Server string `json:"server"`
+	// Type is what the event is about: container, image, network, volume,
+	// ..., or docktrine for the stream's own events.
+	Type   string `json:"type"`
+	Action string `json:"action"`
+	// ActorID is the ID of the container, image, ... the event is about.
+	ActorID    string            `json:"actor_id"`
+	Attributes map[string]string `json:"attributes"`
+	Scope      string            `json:"scope,omitempty"`
+	Time       time.Time         `json:"time"`
+}
+
+// EventFilter narrows the events of a stream. Each field matches any of its
+// values; empty fields match everything.
+type EventFilter struct {
+	Types   []string
+	Actions []string
+	// Labels are key or key=value terms.
+	Labels []string
+}
+
+func (f EventFilter) args() filters.Args {
+	args := filters.NewArgs()
+	for _, t := range f.Types {
+		args.Add("type", t)
+	}
+	for _, a := range f.Actions {
+		args.Add("event", a)
+	}
+	for _, l := range f.Labels {
+		args.Add("label", l)
+	}
+	return args
+}
+
+// WatchEvents sends the server's events matching filter to out until ctx is
+// cancelled, starting at since, or with new events if since is zero. When
+// the feed breaks it reconnects with since set to the last event received,
+// so nothing that happened in between is lost, and reports the outage with
+// disconnected and reconnected events of type docktrine.
+func (d *DockerClient) WatchEvents(ctx context.Context, serverName string, filter EventFilter, since time.Time, out chan<- Event) {
+	retry := eventRetryMin
+	disconnected := false
+
+	send := func(event Event) bool {
+		select {
+		case out <- event:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	status := func(action string, err error) bool {
+		attributes := map[string]string{}
+		if err != nil {
+			attributes["error"] = err.Error()
+		}
+		return send(Event{Server: serverName, Type: EventTypeStream, Action: action, Attributes: attributes, Time: time.Now().UTC()})
+	}
+
+	for {
+		var connectedAt time.Time
+		err := d.watchEvents(ctx, serverName, filter, &since, func(event Event) bool {
+			retry = eventRetryMin
+			return send(event)
+		}, func() bool {
+			connectedAt = time.Now().UTC()
+			if disconnected {
+				disconnected = false
+				return status("reconnected", nil)
+			}
+			return true
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		// Without any event yet, resume from when the feed was up so
+		// events during the outage are still delivered.
+		if since.IsZero() && !connectedAt.IsZero() {
+			since = connectedAt
+		}
+
+		if !disconnected {
+			logger.Warn(fmt.Sprintf("Lost the event stream of server %s, retrying: %v", serverName, err))
+		} else {
+			logger.Debug(fmt.Sprintf("Event stream of server %s still down, retrying in %s: %v", serverName, retry, err))
+		}
+		if !disconnected {
+			disconnected = true
+			if !status("disconnected", err) {
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, eventRetryMax)
+	}
+}
+
+// watchEvents follows one connection to the server's event feed, advancing
+// since with every event, until the connection fails. connected is called
+// once the daemon answered.
+func (d *DockerClient) watchEvents(ctx context.Context, serverName string, filter EventFilter, since *time.Time, emit func(Event) bool, connected func() bool) error {
+	cli, err := d.connect(serverName, 0)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	if _, err := cli.Ping(ctx); err != nil {
+		return err
+	}
+	if !connected() {
+		return ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	options := events.ListOptions{Filters: filter.args()}
+	if !since.IsZero() {
+		options.Since = fmt.Sprintf("%d.%09d", since.Unix(), since.Nanosecond())
+	}
+	messages, errs := cli.Events(ctx, options)
+
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case message := <-messages:
+			at := time.Unix(0, message.TimeNano).UTC()
+			// since is inclusive, so the last event before a reconnect
+			// comes again.
+			if !since.IsZero() && !at.After(*since) {
+				continue
+			}
+			*since = at
+
+			attributes := message.Actor.Attributes
+			if attributes == nil {
+				attributes = map[string]string{}
+			}
+			if !emit(Event{
+				Server:     serverName,
+				Type:       string(message.Type),
+				Action:     string(message.Action),
+				ActorID:    message.Actor.ID,
+				Attributes: attributes,
+				Scope:      message.Scope,
+				Time:       at,
+			}) {
+				return ctx.Err()
+			}
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package docker
+
+import (
+	"context"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// The Context variants back asynchronous jobs. Unlike the methods the API
+// handlers call, they have no request timeout and are bounded by ctx only,
+// so pulls and slow stops can take as long as they need.
+
+func (d *DockerClient) StartContainerContext(ctx context.Context, containerID string, serverName string) error {
+	cli, err := d.connect(serverName, 0)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	return cli.ContainerStart(ctx, containerID, container.StartOptions{})
+}
+
+func (d *DockerClient) StopContainerContext(ctx context.Context, containerID string, serverName string) error {
+	cli, err := d.connect(serverName, 0)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	return cli.ContainerStop(ctx, containerID, container.StopOptions{})
+}
+
+// RestartContainerContext restarts the container, pulling its image first
+// when pullLatest is set. Pull progress is reported to progress, and the
+// digest of the pulled image is returned.
+func (d *DockerClient) RestartContainerContext(ctx context.Context, containerID string, serverName string, pullLatest bool, progress func(string)) (string, error) {
+	cli, err := d.connect(serverName, 0)
+	if err != nil {
+		return "", err
+	}
+	defer cli.Close()
+
+	return restartContainer(ctx, cli, containerID, pullLatest, progress)
+}
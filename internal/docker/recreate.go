@@ -0,0 +1,212 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+)
+
+// RecreateContainerContext pulls the container's image and, if that brought
+// a new image, replaces the container with one created from it with the
+// same configuration, name and networks. image, if set, is the image, or
+// the repository of any tag, the container must be running, e.g. the one a
+// registry reported a push of.
+// Pull and recreate progress is reported to progress, if set, and the
+// digest of the pulled image is returned.
+func (d *DockerClient) RecreateContainerContext(ctx context.Context, containerID, serverName, image string, progress func(string)) (string, error) {
+	cli, err := d.connect(serverName, 0)
+	if err != nil {
+		return "", err
+	}
+	defer cli.Close()
+
+	return recreateContainer(ctx, cli, containerID, image, progress)
+}
+
+func recreateContainer(ctx context.Context, cli *client.Client, containerID, image string, progress func(string)) (string, error) {
+	if progress == nil {
+		progress = func(string) {}
+	}
+	old, err := cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return "", err
+	}
+	name := strings.TrimPrefix(old.Name, "/")
+	if image != "" && !runsImage(old.Config.Image, image) {
+		return "", fmt.Errorf("container %s runs %s, not %s", name, old.Config.Image, image)
+	}
+
+	progress(fmt.Sprintf("pulling %s", old.Config.Image))
+	digest, err := pullImage(ctx, cli, old.Config.Image, progress)
+	if err != nil {
+		return "", err
+	}
+	pulled, _, err := cli.ImageInspectWithRaw(ctx, old.Config.Image)
+	if err != nil {
+		return "", err
+	}
+	if pulled.ID == old.Image {
+		progress("already running the latest image")
+		return digest, nil
+	}
+
+	config := *old.Config
+	if previous, _, err := cli.ImageInspectWithRaw(ctx, old.Image); err == nil && previous.Config != nil {
+		dropImageDefaults(&config, previous.Config)
+	}
+	if config.Hostname == shortID(old.ID) {
+		config.Hostname = ""
+	}
+
+	running := old.State != nil && old.State.Running
+	if running {
+		progress("stopping the old container")
+		if err := cli.ContainerStop(ctx, old.ID, container.StopOptions{}); err != nil {
+			return "", err
+		}
+	}
+	// The old container keeps its name until the new one is up, so it can
+	// be put back if anything fails.
+	backup := name + "-docktrine-old"
+	if err := cli.ContainerRename(ctx, old.ID, backup); err != nil {
+		return "", restore(ctx, cli, old.ID, "", running, err)
+	}
+
+	created, err := cli.ContainerCreate(ctx, &config, old.HostConfig, endpoints(old.ID, old.NetworkSettings), nil, name)
+	if err != nil {
+		return "", restore(ctx, cli, old.ID, name, running, err)
+	}
+	for _, warning := range created.Warnings {
+		progress("warning: " + warning)
+	}
+	if running {
+		if err := cli.ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+			cli.ContainerRemove(ctx, created.ID, container.RemoveOptions{Force: true})
+			return "", restore(ctx, cli, old.ID, name, running, err)
+		}
+	}
+
+	if err := cli.ContainerRemove(ctx, old.ID, container.RemoveOptions{}); err != nil {
+		progress(fmt.Sprintf("warning: could not remove the old container %s: %v", backup, err))
+	}
+	progress(fmt.Sprintf("recreated %s as %s", name, shortID(created.ID)))
+	return digest, nil
+}
+
+// restore puts the old container back after a failed recreate and returns
+// cause.
+func restore(ctx context.Context, cli *client.Client, id, name string, start bool, cause error) error {
+	if name != "" {
+		if err := cli.ContainerRename(ctx, id, name); err != nil {
+			return fmt.Errorf("%w (restoring the old container's name failed too: %v)", cause, err)
+		}
+	}
+	if start {
+		if err := cli.ContainerStart(ctx, id, container.StartOptions{}); err != nil {
+			return fmt.Errorf("%w (restarting the old container failed too: %v)", cause, err)
+		}
+	}
+	return cause
+}
+
+// endpoints reconnects the new container to the networks of the old one,
+// keeping the addresses and aliases that were asked for.
+func endpoints(oldID string, settings *types.NetworkSettings) *network.NetworkingConfig {
+	config := &network.NetworkingConfig{EndpointsConfig: map[string]*network.EndpointSettings{}}
+	if settings == nil {
+		return config
+	}
+	for name, endpoint := range settings.Networks {
+		if endpoint == nil {
+			continue
+		}
+		config.EndpointsConfig[name] = &network.EndpointSettings{
+			IPAMConfig: endpoint.IPAMConfig,
+			Links:      endpoint.Links,
+			// Docker adds the short container ID as an alias itself.
+			Aliases: slices.DeleteFunc(slices.Clone(endpoint.Aliases), func(alias string) bool {
+				return alias == shortID(oldID)
+			}),
+			DriverOpts: endpoint.DriverOpts,
+		}
+	}
+	return config
+}
+
+// dropImageDefaults removes from config what it inherited from image, so
+// the new container picks up the new image's defaults instead of keeping
+// the old ones.
+func dropImageDefaults(config, image *container.Config) {
+	config.Env = slices.DeleteFunc(config.Env, func(env string) bool {
+		return slices.Contains(image.Env, env)
+	})
+	for key, value := range image.Labels {
+		if config.Labels[key] == value {
+			delete(config.Labels, key)
+		}
+	}
+	for port := range image.ExposedPorts {
+		delete(config.ExposedPorts, port)
+	}
+	for volume := range image.Volumes {
+		delete(config.Volumes, volume)
+	}
+	if slices.Equal(config.Cmd, image.Cmd) {
+		config.Cmd = nil
+	}
+	if slices.Equal(config.Entrypoint, image.Entrypoint) {
+		config.Entrypoint = nil
+	}
+	if config.WorkingDir == image.WorkingDir {
+		config.WorkingDir = ""
+	}
+	if config.User == image.User {
+		config.User = ""
+	}
+	if config.StopSignal == image.StopSignal {
+		config.StopSignal = ""
+	}
+	if reflect.DeepEqual(config.Healthcheck, image.Healthcheck) {
+		config.Healthcheck = nil
+	}
+}
+
+// SameImage reports whether two image references name the same repository
+// and tag, e.g. nginx and docker.io/library/nginx:latest.
+func SameImage(a, b string) bool {
+	return normalizeImage(a) == normalizeImage(b)
+}
+
+// runsImage reports whether a container created from ref runs image, which
+// may be a repository without a tag to match any of its tags.
+func runsImage(ref, image string) bool {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil || !reference.IsNameOnly(named) {
+		return SameImage(ref, image)
+	}
+	running, err := reference.ParseNormalizedNamed(ref)
+	return err == nil && running.Name() == named.Name()
+}
+
+func normalizeImage(ref string) string {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return ref
+	}
+	return reference.TagNameOnly(named).String()
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,148 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/docker/docker/errdefs"
+)
+
+// Selector picks the servers a request targets. A selector is either a
+// plain server name or a comma-separated list of terms that must all match:
+//
+//	group:prod          servers in the "prod" group
+//	label:region=eu     servers whose "region" label is "eu"
+//	label:region        servers that have a "region" label
+//	*                   every server
+type Selector struct {
+	name   string
+	all    bool
+	groups []string
+	labels map[string]*string
+}
+
+// IsSelector reports whether value targets potentially several servers
+// rather than naming a single one.
+func IsSelector(value string) bool {
+	return value == "*" ||
+		strings.Contains(value, ",") ||
+		strings.HasPrefix(value, "group:") ||
+		strings.HasPrefix(value, "label:")
+}
+
+func ParseSelector(value string) (*Selector, error) {
+	if !IsSelector(value) {
+		return &Selector{name: value}, nil
+	}
+
+	selector := &Selector{labels: map[string]*string{}}
+	for _, term := range strings.Split(value, ",") {
+		term = strings.TrimSpace(term)
+		switch {
+		case term == "*":
+			selector.all = true
+		case strings.HasPrefix(term, "group:"):
+			group := strings.TrimPrefix(term, "group:")
+			if group == "" {
+				return nil, errdefs.InvalidParameter(fmt.Errorf("invalid server selector %q: empty group", value))
+			}
+			selector.groups = append(selector.groups, group)
+		case strings.HasPrefix(term, "label:"):
+			key, val, hasValue := strings.Cut(strings.TrimPrefix(term, "label:"), "=")
+			if key == "" {
+				return nil, errdefs.InvalidParameter(fmt.Errorf("invalid server selector %q: empty label", value))
+			}
+			if hasValue {
+				selector.labels[key] = &val
+			} else {
+				selector.labels[key] = nil
+			}
+		default:
+			return nil, errdefs.InvalidParameter(fmt.Errorf("invalid server selector term %q", term))
+		}
+	}
+
+	return selector, nil
+}
+
+// Single reports whether the selector names exactly one server.
+func (s *Selector) Single() bool {
+	return !s.all && len(s.groups) == 0 && len(s.labels) == 0
+}
+
+func (s *Selector) Matches(server database.Server) bool {
+	if s.Single() {
+		return server.Name == s.name
+	}
+
+	for _, group := range s.groups {
+		if !containsString(server.Groups, group) {
+			return false
+		}
+	}
+
+	for key, want := range s.labels {
+		got, ok := server.Labels[key]
+		if !ok {
+			return false
+		}
+		if want != nil && got != *want {
+			return false
+		}
+	}
+
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveServers returns the servers targeted by selector. An empty selector
+// targets the default server, a plain name targets that server.
+func (d *DockerClient) ResolveServers(selector string) ([]database.Server, error) {
+	if !IsSelector(selector) {
+		var server *database.Server
+		var err error
+		if selector != "" {
+			server, err = d.db.GetServerByName(selector)
+		} else {
+			server, err = d.db.GetDefaultServer()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if server == nil {
+			return nil, serverNotFound(selector)
+		}
+		return []database.Server{*server}, nil
+	}
+
+	parsed, err := ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	servers, err := d.db.GetServers()
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []database.Server
+	for _, server := range servers {
+		if parsed.Matches(server) {
+			matched = append(matched, server)
+		}
+	}
+
+	if len(matched) == 0 {
+		return nil, errdefs.NotFound(fmt.Errorf("no servers match selector %q", selector))
+	}
+	return matched, nil
+}
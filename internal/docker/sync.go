@@ -0,0 +1,207 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/logger"
+)
+
+type SyncMode string
+
+const (
+	// SyncModeSeed only adds servers from the config file that are missing
+	// from the database. Servers that already exist are left untouched.
+	SyncModeSeed SyncMode = "seed"
+	// SyncModeAuthoritative makes the config file the source of truth:
+	// servers are created or updated to match it and any server not listed
+	// in the file is removed.
+	SyncModeAuthoritative SyncMode = "authoritative"
+)
+
+func ParseSyncMode(mode string) (SyncMode, error) {
+	switch SyncMode(mode) {
+	case "":
+		return SyncModeSeed, nil
+	case SyncModeSeed, SyncModeAuthoritative:
+		return SyncMode(mode), nil
+	default:
+		return "", fmt.Errorf("invalid config sync mode %q (expected %q or %q)", mode, SyncModeSeed, SyncModeAuthoritative)
+	}
+}
+
+func SyncServers(db *database.DB, config *Config, mode SyncMode) error {
+	if mode == SyncModeAuthoritative && !config.fromFile {
+		// A mistyped path or an unmounted volume must not wipe every server
+		// added through the API.
+		logger.Warn("Config file not found, not syncing servers authoritatively")
+		mode = SyncModeSeed
+	}
+
+	existing, err := db.GetServers()
+	if err != nil {
+		return err
+	}
+	if !config.fromFile && len(existing) > 0 {
+		// The built-in local server only seeds an empty database, so one
+		// deleted through the API is not brought back on every start.
+		return nil
+	}
+
+	byName := make(map[string]database.Server, len(existing))
+	hasDefault := false
+	for _, s := range existing {
+		byName[s.Name] = s
+		if s.IsDefault {
+			hasDefault = true
+		}
+	}
+
+	inConfig := make(map[string]bool, len(config.Servers))
+	for _, sc := range config.Servers {
+		if sc.Name == "" || sc.Host == "" {
+			return fmt.Errorf("config server entries require a name and host")
+		}
+		inConfig[sc.Name] = true
+
+		server := sc.toServer(database.ServerSourceConfig)
+
+		current, found := byName[sc.Name]
+		switch {
+		case !found:
+			if mode == SyncModeSeed && hasDefault {
+				server.IsDefault = false
+			}
+			if err := db.CreateServer(&server); err != nil {
+				return err
+			}
+			hasDefault = hasDefault || server.IsDefault
+			logger.Info(fmt.Sprintf("Added server from config: %s", sc.Name))
+		case mode == SyncModeAuthoritative && !sameServer(current, server):
+			// Dropping protection is a change to a protected server, which
+			// the config file must not make without an approval.
+			if current.Protected && !server.Protected {
+				logger.Warn(fmt.Sprintf("Config does not protect server %s, keeping it protected", sc.Name))
+				server.Protected = true
+				if sameServer(current, server) {
+					continue
+				}
+			}
+			if err := db.UpdateServer(&server); err != nil {
+				return err
+			}
+			logger.Info(fmt.Sprintf("Updated server from config: %s", sc.Name))
+		}
+	}
+
+	if mode != SyncModeAuthoritative {
+		return nil
+	}
+	if len(config.Servers) == 0 {
+		logger.Warn("Config file lists no servers, not removing any")
+		return nil
+	}
+
+	var removed []string
+	for _, s := range existing {
+		if inConfig[s.Name] {
+			continue
+		}
+		if s.Protected {
+			// Deleting a protected server needs an approval.
+			logger.Warn(fmt.Sprintf("Not removing protected server %s, which is not in config; delete it through the API", s.Name))
+			continue
+		}
+		removed = append(removed, s.Name)
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	if err := db.DeleteServers(removed); err != nil {
+		return err
+	}
+	for _, name := range removed {
+		logger.Info(fmt.Sprintf("Removed server not present in config: %s", name))
+	}
+
+	return nil
+}
+
+func sameServer(a, b database.Server) bool {
+	return a.Host == b.Host &&
+		a.Description == b.Description &&
+		a.IsDefault == b.IsDefault &&
+		a.Source == b.Source &&
+		reflect.DeepEqual(normalizeLabels(a.Labels), normalizeLabels(b.Labels)) &&
+		reflect.DeepEqual(normalizeGroups(a.Groups), normalizeGroups(b.Groups)) &&
+		a.Protected == b.Protected &&
+		a.TLSCA == b.TLSCA &&
+		a.TLSCert == b.TLSCert &&
+		a.TLSKey == b.TLSKey &&
+		a.TLSSkipVerify == b.TLSSkipVerify
+}
+
+func normalizeLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return map[string]string{}
+	}
+	return labels
+}
+
+func normalizeGroups(groups []string) []string {
+	if groups == nil {
+		return []string{}
+	}
+	return groups
+}
+
+// WatchConfig polls the config file and re-syncs servers whenever its
+// modification time changes. It blocks until ctx is cancelled.
+func WatchConfig(ctx context.Context, db *database.DB, path string, mode SyncMode, interval time.Duration) {
+	lastMod := configModTime(path)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			modTime := configModTime(path)
+			if modTime.Equal(lastMod) {
+				continue
+			}
+			lastMod = modTime
+
+			if modTime.IsZero() {
+				logger.Warn(fmt.Sprintf("Config file %s is missing, keeping current servers", path))
+				continue
+			}
+
+			config, err := LoadConfig(path)
+			if err != nil {
+				logger.Error(err, fmt.Sprintf("Failed to reload config: %s", path))
+				continue
+			}
+
+			if err := SyncServers(db, config, mode); err != nil {
+				logger.Error(err, "Failed to sync servers from config")
+				continue
+			}
+			logger.Info(fmt.Sprintf("Reloaded servers from config: %s", path))
+		}
+	}
+}
+
+func configModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,105 @@
+package docker
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Zeptile/docktrine/internal/database"
+)
+
+func openSyncDB(t *testing.T) *database.DB {
+	t.Helper()
+	t.Setenv("CONFIG_PATH", t.TempDir())
+	db, err := database.NewDatabaseConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// syncFile writes config as the config file and syncs it in mode.
+func syncFile(t *testing.T, db *database.DB, config string, mode SyncMode) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SyncServers(db, loaded, mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getServer(t *testing.T, db *database.DB, name string) *database.Server {
+	t.Helper()
+	server, err := db.GetServerByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestAuthoritativeSyncKeepsProtectedServers(t *testing.T) {
+	db := openSyncDB(t)
+	syncFile(t, db, `{"servers": [
+		{"name": "prod", "host": "tcp://prod:2376", "protected": true},
+		{"name": "vault", "host": "tcp://vault:2376", "protected": true},
+		{"name": "dev", "host": "tcp://dev:2376"}
+	]}`, SyncModeAuthoritative)
+
+	// prod loses its protection in the file, vault and dev are dropped.
+	syncFile(t, db, `{"servers": [
+		{"name": "prod", "host": "tcp://prod:2377"}
+	]}`, SyncModeAuthoritative)
+
+	prod := getServer(t, db, "prod")
+	if prod == nil || !prod.Protected {
+		t.Fatalf("prod = %+v, want it kept protected", prod)
+	}
+	if prod.Host != "tcp://prod:2377" {
+		t.Errorf("prod host = %q, want the other changes synced", prod.Host)
+	}
+	if vault := getServer(t, db, "vault"); vault == nil {
+		t.Error("protected server vault was removed")
+	}
+	if dev := getServer(t, db, "dev"); dev != nil {
+		t.Errorf("dev = %+v, want it removed", dev)
+	}
+}
+
+func TestBuiltInDefaultOnlySeedsEmptyDatabase(t *testing.T) {
+	db := openSyncDB(t)
+	missing := filepath.Join(t.TempDir(), "config.json")
+	sync := func() {
+		t.Helper()
+		config, err := LoadConfig(missing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := SyncServers(db, config, SyncModeSeed); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sync()
+	if local := getServer(t, db, "local"); local == nil || !local.IsDefault {
+		t.Fatalf("local = %+v, want it seeded as the default", local)
+	}
+
+	remote := database.Server{Name: "remote", Host: "tcp://remote:2376", Source: database.ServerSourceAPI}
+	if err := db.CreateServer(&remote); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteServer("local"); err != nil {
+		t.Fatal(err)
+	}
+	sync()
+	if local := getServer(t, db, "local"); local != nil {
+		t.Errorf("local = %+v, want it to stay deleted", local)
+	}
+}
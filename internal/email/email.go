@@ -0,0 +1,309 @@
+// Package email sends notifications by email through SMTP servers.
+//
+// Notifications for an email channel are written to an outbox table and
+// sent from there, so they survive restarts. After an email goes out, the
+// notifications arriving within the channel's digest window are held back
+// and sent together in one digest email when it ends, so a flapping
+// container does not flood anyone's inbox. Failed sends are retried with
+// exponential backoff.
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/Zeptile/docktrine/internal/notify"
+)
+
+const (
+	// MaxAttempts is how many times an email is tried before its
+	// notifications are dropped.
+	MaxAttempts = 10
+
+	retryMin     = 30 * time.Second
+	retryMax     = time.Hour
+	dialTimeout  = 10 * time.Second
+	sendTimeout  = time.Minute
+	pollInterval = 5 * time.Second
+	// maxDigest caps the notifications in one email; the rest go in the
+	// next one.
+	maxDigest = 500
+)
+
+// Notifier queues notifications for the email channels that subscribe to
+// them and sends the outbox in the background.
+type Notifier struct {
+	db   *database.DB
+	wake chan struct{}
+}
+
+func NewNotifier(db *database.DB) *Notifier {
+	return &Notifier{
+		db:   db,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+func (n *Notifier) Name() string {
+	return "email"
+}
+
+// Notify adds notification to the outbox of every enabled email channel
+// subscribed to its event and severity.
+func (n *Notifier) Notify(notification notify.Notification) error {
+	channels, err := n.db.ListEmailChannels()
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	queued := false
+	for _, channel := range channels {
+		if !channel.Enabled || !channel.Subscribes(notification.Event) || !notify.AtLeast(notification.Severity, channel.MinSeverity) {
+			continue
+		}
+		if err := n.db.QueueEmail(channel.ID, payload); err != nil {
+			return err
+		}
+		queued = true
+	}
+	if queued {
+		n.Wake()
+	}
+	return nil
+}
+
+// Test sends a test email to channel right away, bypassing the outbox, and
+// returns the SMTP error, if any.
+func (n *Notifier) Test(ctx context.Context, channel *database.EmailChannel) error {
+	msg, err := Build(channel, []notify.Notification{{
+		Event:    "ping",
+		Severity: notify.SeverityInfo,
+		Title:    "Test notification",
+		Message:  fmt.Sprintf("Email channel %s is set up", channel.Name),
+		Time:     time.Now().UTC(),
+	}})
+	if err != nil {
+		return err
+	}
+	return Send(ctx, channel, msg)
+}
+
+// Wake makes the sender look at the outbox now rather than on its next
+// poll.
+func (n *Notifier) Wake() {
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends the outbox until ctx is cancelled.
+func (n *Notifier) Run(ctx context.Context) {
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+
+	for {
+		n.sendDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.wake:
+		case <-poll.C:
+		}
+	}
+}
+
+// sendDue sends an email for every enabled channel with pending
+// notifications whose digest window or retry delay is over. A slow SMTP
+// server does not hold up the other channels.
+func (n *Notifier) sendDue(ctx context.Context) {
+	channels, err := n.db.ListEmailChannels()
+	if err != nil {
+		logger.Error(err, "Failed to read the email channels")
+		return
+	}
+
+	now := time.Now()
+	var wg sync.WaitGroup
+	for _, channel := range channels {
+		if !channel.Enabled || channel.Pending == 0 || (channel.NextSendAt != nil && now.Before(*channel.NextSendAt)) {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.flush(ctx, &channel)
+		}()
+	}
+	wg.Wait()
+}
+
+// flush sends the channel's pending notifications in one email.
+func (n *Notifier) flush(ctx context.Context, channel *database.EmailChannel) {
+	queued, err := n.db.QueuedEmails(channel.ID, maxDigest)
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("Failed to read the outbox of email channel %s", channel.Name))
+		return
+	}
+	if len(queued) == 0 {
+		return
+	}
+	lastID := queued[len(queued)-1].ID
+
+	notifications := make([]notify.Notification, 0, len(queued))
+	for _, q := range queued {
+		var notification notify.Notification
+		if err := json.Unmarshal(q.Notification, &notification); err != nil {
+			logger.Error(err, fmt.Sprintf("Skipping unreadable notification %d of email channel %s", q.ID, channel.Name))
+			continue
+		}
+		notifications = append(notifications, notification)
+	}
+	if len(notifications) == 0 {
+		if err := n.db.RecordEmailFailure(channel.ID, lastID, "unreadable notifications", nil); err != nil {
+			logger.Error(err, fmt.Sprintf("Failed to drop the outbox of email channel %s", channel.Name))
+		}
+		return
+	}
+
+	msg, err := Build(channel, notifications)
+	if err == nil {
+		err = Send(ctx, channel, msg)
+	}
+	if ctx.Err() != nil {
+		// Shutting down; the notifications stay queued and are sent on the
+		// next start.
+		return
+	}
+
+	if err == nil {
+		next := time.Now().Add(time.Duration(channel.DigestSeconds) * time.Second)
+		if err := n.db.RecordEmailSent(channel.ID, lastID, next); err != nil {
+			logger.Error(err, fmt.Sprintf("Failed to record the email sent to channel %s", channel.Name))
+		}
+		logger.Info(fmt.Sprintf("Sent %d notifications to email channel %s", len(notifications), channel.Name))
+		return
+	}
+
+	var retry *time.Time
+	attempts := channel.Failures + 1
+	if attempts < MaxAttempts {
+		t := time.Now().Add(backoff(attempts))
+		retry = &t
+		logger.Debug(fmt.Sprintf("Email to channel %s failed, retrying at %s: %v", channel.Name, t.Format(time.RFC3339), err))
+	} else {
+		logger.Warn(fmt.Sprintf("Gave up on %d notifications for email channel %s after %d attempts: %v", len(queued), channel.Name, attempts, err))
+	}
+	if err := n.db.RecordEmailFailure(channel.ID, lastID, err.Error(), retry); err != nil {
+		logger.Error(err, fmt.Sprintf("Failed to record the email failure of channel %s", channel.Name))
+	}
+}
+
+// backoff is the delay before the attempt after the given number of
+// attempts: 30s, 1m, 2m, ... up to an hour.
+func backoff(attempts int) time.Duration {
+	delay := retryMin
+	for i := 1; i < attempts && delay < retryMax; i++ {
+		delay *= 2
+	}
+	return min(delay, retryMax)
+}
+
+// Send delivers msg to the channel's recipients through its SMTP server.
+func Send(ctx context.Context, channel *database.EmailChannel, msg []byte) error {
+	from, err := mail.ParseAddress(channel.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender %q: %w", channel.From, err)
+	}
+
+	addr := net.JoinHostPort(channel.Host, strconv.Itoa(channel.Port))
+	tlsConfig := &tls.Config{ServerName: channel.Host, InsecureSkipVerify: channel.TLSSkipVerify}
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	if channel.TLS == database.EmailTLSImplicit {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(sendTimeout))
+
+	client, err := smtp.NewClient(conn, channel.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	if err := client.Hello(hostname); err != nil {
+		return err
+	}
+	if channel.TLS == database.EmailTLSStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("%s does not support STARTTLS", addr)
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if channel.Username != "" {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return fmt.Errorf("%s does not support authentication", addr)
+		}
+		// PlainAuth refuses to send the password over an unencrypted
+		// connection, except to localhost.
+		if err := client.Auth(smtp.PlainAuth("", channel.Username, channel.Password, channel.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	for _, recipient := range channel.To {
+		to, err := mail.ParseAddress(recipient)
+		if err != nil {
+			return fmt.Errorf("invalid recipient %q: %w", recipient, err)
+		}
+		if err := client.Rcpt(to.Address); err != nil {
+			return fmt.Errorf("recipient %s: %w", to.Address, err)
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := client.Quit(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
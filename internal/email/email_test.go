@@ -0,0 +1,616 @@
+package email
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/notify"
+)
+
+// fakeSMTP is an in-process SMTP server speaking just enough of the
+// protocol for Send: EHLO, STARTTLS, AUTH PLAIN, MAIL, RCPT, DATA and QUIT.
+type fakeSMTP struct {
+	listener net.Listener
+	tls      *tls.Config
+	// startTLS advertises STARTTLS on plain connections.
+	startTLS bool
+	// username and password are accepted by AUTH PLAIN when username is set.
+	username, password string
+	// rejectRcpt makes RCPT fail with a permanent error.
+	rejectRcpt bool
+
+	mu       sync.Mutex
+	messages []receivedMail
+}
+
+type receivedMail struct {
+	from string
+	to   []string
+	data string
+	// tls is set when the message came over an encrypted connection.
+	tls bool
+	// auth is the user that authenticated, if any.
+	auth string
+}
+
+type fakeSMTPOption func(*fakeSMTP)
+
+func withStartTLS() fakeSMTPOption           { return func(s *fakeSMTP) { s.startTLS = true } }
+func withRejectedRecipients() fakeSMTPOption { return func(s *fakeSMTP) { s.rejectRcpt = true } }
+func withAuth(username, password string) fakeSMTPOption {
+	return func(s *fakeSMTP) { s.username, s.password = username, password }
+}
+
+// newFakeSMTP starts a server on a local port. With implicit set, the
+// connection is TLS from the start.
+func newFakeSMTP(t *testing.T, implicit bool, options ...fakeSMTPOption) *fakeSMTP {
+	t.Helper()
+	s := &fakeSMTP{tls: &tls.Config{Certificates: []tls.Certificate{selfSignedCert(t)}}}
+	for _, option := range options {
+		option(s)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if implicit {
+		listener = tls.NewListener(listener, s.tls)
+	}
+	s.listener = listener
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, implicit)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeSMTP) received() []receivedMail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]receivedMail(nil), s.messages...)
+}
+
+func (s *fakeSMTP) serve(conn net.Conn, encrypted bool) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 fake.smtp ESMTP ready")
+
+	var msg receivedMail
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			extensions := []string{"fake.smtp"}
+			if s.startTLS && !encrypted {
+				extensions = append(extensions, "STARTTLS")
+			}
+			if s.username != "" {
+				extensions = append(extensions, "AUTH PLAIN")
+			}
+			for i, ext := range extensions {
+				sep := "-"
+				if i == len(extensions)-1 {
+					sep = " "
+				}
+				text.PrintfLine("250%s%s", sep, ext)
+			}
+		case "STARTTLS":
+			if !s.startTLS || encrypted {
+				text.PrintfLine("502 not supported")
+				continue
+			}
+			text.PrintfLine("220 go ahead")
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, encrypted = tlsConn, true
+			text = textproto.NewConn(conn)
+		case "AUTH":
+			mechanism, initial, _ := strings.Cut(arg, " ")
+			credentials, err := base64.StdEncoding.DecodeString(initial)
+			parts := strings.Split(string(credentials), "\x00")
+			if mechanism != "PLAIN" || err != nil || len(parts) != 3 || parts[1] != s.username || parts[2] != s.password {
+				text.PrintfLine("535 authentication failed")
+				continue
+			}
+			msg.auth = parts[1]
+			text.PrintfLine("235 authenticated")
+		case "MAIL":
+			msg.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			text.PrintfLine("250 ok")
+		case "RCPT":
+			if s.rejectRcpt {
+				text.PrintfLine("550 no such user")
+				continue
+			}
+			msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>"))
+			text.PrintfLine("250 ok")
+		case "DATA":
+			text.PrintfLine("354 end with .")
+			data, err := io.ReadAll(text.DotReader())
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			msg.tls = encrypted
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			msg = receivedMail{auth: msg.auth}
+			text.PrintfLine("250 queued")
+		case "QUIT":
+			text.PrintfLine("221 bye")
+			return
+		default:
+			text.PrintfLine("500 unknown command")
+		}
+	}
+}
+
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fake.smtp"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func testChannel(server *fakeSMTP, tlsMode string) *database.EmailChannel {
+	return &database.EmailChannel{
+		Name:          "ops",
+		Host:          "127.0.0.1",
+		Port:          server.port(),
+		TLS:           tlsMode,
+		TLSSkipVerify: true,
+		From:          "Docktrine <docktrine@example.com>",
+		To:            []string{"ops@example.com", "Oncall <oncall@example.com>"},
+		Events:        []string{"*"},
+	}
+}
+
+// parsedMail is a received email with its subject decoded and the
+// plain-text part extracted.
+type parsedMail struct {
+	subject string
+	text    string
+}
+
+func parseMail(t *testing.T, data string) parsedMail {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatalf("no text/plain part: %v", err)
+		}
+		if strings.HasPrefix(part.Header.Get("Content-Type"), "text/plain") {
+			text, err := io.ReadAll(part)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return parsedMail{subject: subject, text: string(text)}
+		}
+	}
+}
+
+func testMessage(t *testing.T, channel *database.EmailChannel) []byte {
+	t.Helper()
+	msg, err := Build(channel, []notify.Notification{{
+		Event:    "ping",
+		Severity: notify.SeverityInfo,
+		Title:    "Test notification",
+		Message:  "hello",
+		Time:     time.Now().UTC(),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestSendTLSModes(t *testing.T) {
+	tests := []struct {
+		name       string
+		implicit   bool
+		options    []fakeSMTPOption
+		mode       string
+		skipVerify bool
+		username   string
+		password   string
+		wantTLS    bool
+		wantAuth   string
+		wantErr    string
+	}{
+		{
+			name:       "STARTTLS",
+			options:    []fakeSMTPOption{withStartTLS()},
+			mode:       database.EmailTLSStartTLS,
+			skipVerify: true,
+			wantTLS:    true,
+		},
+		{
+			name:       "STARTTLS with authentication",
+			options:    []fakeSMTPOption{withStartTLS(), withAuth("bot", "hunter2")},
+			mode:       database.EmailTLSStartTLS,
+			skipVerify: true,
+			username:   "bot",
+			password:   "hunter2",
+			wantTLS:    true,
+			wantAuth:   "bot",
+		},
+		{
+			name:       "STARTTLS not offered",
+			mode:       database.EmailTLSStartTLS,
+			skipVerify: true,
+			wantErr:    "does not support STARTTLS",
+		},
+		{
+			name:    "STARTTLS with an untrusted certificate",
+			options: []fakeSMTPOption{withStartTLS()},
+			mode:    database.EmailTLSStartTLS,
+			wantErr: "certificate",
+		},
+		{
+			name:       "implicit TLS",
+			implicit:   true,
+			mode:       database.EmailTLSImplicit,
+			skipVerify: true,
+			wantTLS:    true,
+		},
+		{
+			name:     "implicit TLS with an untrusted certificate",
+			implicit: true,
+			mode:     database.EmailTLSImplicit,
+			wantErr:  "certificate",
+		},
+		{
+			name:    "no TLS ignores STARTTLS",
+			options: []fakeSMTPOption{withStartTLS()},
+			mode:    database.EmailTLSNone,
+		},
+		{
+			name:       "wrong password",
+			options:    []fakeSMTPOption{withStartTLS(), withAuth("bot", "hunter2")},
+			mode:       database.EmailTLSStartTLS,
+			skipVerify: true,
+			username:   "bot",
+			password:   "wrong",
+			wantErr:    "535",
+		},
+		{
+			name:       "authentication not offered",
+			options:    []fakeSMTPOption{withStartTLS()},
+			mode:       database.EmailTLSStartTLS,
+			skipVerify: true,
+			username:   "bot",
+			password:   "hunter2",
+			wantErr:    "does not support authentication",
+		},
+		{
+			name:    "recipient rejected",
+			options: []fakeSMTPOption{withRejectedRecipients()},
+			mode:    database.EmailTLSNone,
+			wantErr: "recipient ops@example.com: 550",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeSMTP(t, tt.implicit, tt.options...)
+			channel := testChannel(server, tt.mode)
+			channel.TLSSkipVerify = tt.skipVerify
+			channel.Username, channel.Password = tt.username, tt.password
+
+			err := Send(context.Background(), channel, testMessage(t, channel))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				if n := len(server.received()); n != 0 {
+					t.Errorf("%d emails received despite the error", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			received := server.received()
+			if len(received) != 1 {
+				t.Fatalf("%d emails received, want 1", len(received))
+			}
+			got := received[0]
+			if got.tls != tt.wantTLS {
+				t.Errorf("sent over TLS = %v, want %v", got.tls, tt.wantTLS)
+			}
+			if got.auth != tt.wantAuth {
+				t.Errorf("authenticated as %q, want %q", got.auth, tt.wantAuth)
+			}
+			if got.from != "docktrine@example.com" || strings.Join(got.to, ",") != "ops@example.com,oncall@example.com" {
+				t.Errorf("envelope from %q to %q", got.from, got.to)
+			}
+			if subject := parseMail(t, got.data).subject; subject != "[Docktrine] Test notification" {
+				t.Errorf("subject = %q", subject)
+			}
+		})
+	}
+}
+
+// openDB opens the database in a temporary data directory.
+func openDB(t *testing.T) *database.DB {
+	t.Helper()
+	t.Setenv("CONFIG_PATH", t.TempDir())
+	db, err := database.NewDatabaseConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func createChannel(t *testing.T, db *database.DB, server *fakeSMTP, digest time.Duration) *database.EmailChannel {
+	t.Helper()
+	channel := testChannel(server, database.EmailTLSNone)
+	channel.DigestSeconds = int(digest.Seconds())
+	if err := db.CreateEmailChannel(channel); err != nil {
+		t.Fatal(err)
+	}
+	return channel
+}
+
+func getChannel(t *testing.T, db *database.DB, id int64) *database.EmailChannel {
+	t.Helper()
+	channel, err := db.GetEmailChannel(id)
+	if err != nil || channel == nil {
+		t.Fatalf("channel %d: %v", id, err)
+	}
+	return channel
+}
+
+func notifyTitle(t *testing.T, notifier *Notifier, title string) {
+	t.Helper()
+	err := notifier.Notify(notify.Notification{
+		Event:    "container.restarted",
+		Severity: notify.SeverityWarning,
+		Title:    title,
+		Message:  title + " happened",
+		Time:     time.Now().UTC(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// endWindow moves the channel's next send to now, as if the digest window
+// or retry delay had passed.
+func endWindow(t *testing.T, db *database.DB, id int64) {
+	t.Helper()
+	if _, err := db.Exec(`UPDATE email_channels SET next_send_at = ? WHERE id = ?`, time.Now().UTC().Add(-time.Second), id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDigestBatching(t *testing.T) {
+	db := openDB(t)
+	server := newFakeSMTP(t, false)
+	channel := createChannel(t, db, server, 10*time.Minute)
+	notifier := NewNotifier(db)
+	ctx := context.Background()
+
+	// The first notification goes out right away and opens the window.
+	notifyTitle(t, notifier, "web restarted")
+	notifier.sendDue(ctx)
+	received := server.received()
+	if len(received) != 1 {
+		t.Fatalf("%d emails after the first notification, want 1", len(received))
+	}
+	if subject := parseMail(t, received[0].data).subject; subject != "[Docktrine] web restarted" {
+		t.Errorf("subject = %q", subject)
+	}
+	state := getChannel(t, db, channel.ID)
+	if state.Pending != 0 || state.NextSendAt == nil {
+		t.Fatalf("channel = %+v, want an empty outbox and a window", state)
+	}
+	if wait := time.Until(*state.NextSendAt); wait < 9*time.Minute || wait > 10*time.Minute {
+		t.Errorf("window ends in %s, want 10m", wait)
+	}
+
+	// Notifications within the window are held back.
+	notifyTitle(t, notifier, "web restarted")
+	notifyTitle(t, notifier, "web restarted")
+	notifyTitle(t, notifier, "db restarted")
+	notifier.sendDue(ctx)
+	if n := len(server.received()); n != 1 {
+		t.Fatalf("%d emails within the digest window, want 1", n)
+	}
+	if state := getChannel(t, db, channel.ID); state.Pending != 3 {
+		t.Fatalf("%d notifications pending, want 3", state.Pending)
+	}
+
+	// When it ends they are sent together in one digest.
+	endWindow(t, db, channel.ID)
+	notifier.sendDue(ctx)
+	received = server.received()
+	if len(received) != 2 {
+		t.Fatalf("%d emails after the window, want 2", len(received))
+	}
+	digest := parseMail(t, received[1].data)
+	if digest.subject != "[Docktrine] 3 notifications" {
+		t.Errorf("digest subject = %q", digest.subject)
+	}
+	for _, line := range []string{"2 x web restarted", "1 x db restarted", "db restarted happened"} {
+		if !strings.Contains(digest.text, line) {
+			t.Errorf("digest does not contain %q:\n%s", line, digest.text)
+		}
+	}
+	if strings.Index(digest.text, "2 x web restarted") > strings.Index(digest.text, "1 x db restarted") {
+		t.Error("digest summary is not sorted by count")
+	}
+	if state := getChannel(t, db, channel.ID); state.Pending != 0 {
+		t.Errorf("%d notifications pending after the digest, want 0", state.Pending)
+	}
+}
+
+func TestNoDigestWindow(t *testing.T) {
+	db := openDB(t)
+	server := newFakeSMTP(t, false)
+	createChannel(t, db, server, 0)
+	notifier := NewNotifier(db)
+
+	for i := 0; i < 3; i++ {
+		notifyTitle(t, notifier, "restart "+strconv.Itoa(i))
+		notifier.sendDue(context.Background())
+	}
+	if n := len(server.received()); n != 3 {
+		t.Errorf("%d emails, want one per notification", n)
+	}
+}
+
+func TestSendRetry(t *testing.T) {
+	db := openDB(t)
+	server := newFakeSMTP(t, false, withRejectedRecipients())
+	channel := createChannel(t, db, server, 10*time.Minute)
+	notifier := NewNotifier(db)
+
+	notifyTitle(t, notifier, "web restarted")
+	notifier.sendDue(context.Background())
+
+	state := getChannel(t, db, channel.ID)
+	if state.Failures != 1 || state.Pending != 1 || !strings.Contains(state.LastError, "550") {
+		t.Fatalf("channel = %+v, want one failure and the notification kept", state)
+	}
+	if state.NextSendAt == nil {
+		t.Fatal("no retry scheduled")
+	}
+	if wait := time.Until(*state.NextSendAt); wait < retryMin-5*time.Second || wait > retryMin {
+		t.Errorf("retry in %s, want %s", wait, retryMin)
+	}
+
+	server.mu.Lock()
+	server.rejectRcpt = false
+	server.mu.Unlock()
+	endWindow(t, db, channel.ID)
+	notifier.sendDue(context.Background())
+
+	if n := len(server.received()); n != 1 {
+		t.Fatalf("%d emails after the retry, want 1", n)
+	}
+	state = getChannel(t, db, channel.ID)
+	if state.Failures != 0 || state.Pending != 0 || state.LastError != "" {
+		t.Errorf("channel = %+v, want the failure cleared", state)
+	}
+}
+
+func TestSendGivesUp(t *testing.T) {
+	db := openDB(t)
+	server := newFakeSMTP(t, false, withRejectedRecipients())
+	channel := createChannel(t, db, server, 0)
+	notifier := NewNotifier(db)
+
+	notifyTitle(t, notifier, "web restarted")
+	if _, err := db.Exec(`UPDATE email_channels SET failures = ? WHERE id = ?`, MaxAttempts-1, channel.ID); err != nil {
+		t.Fatal(err)
+	}
+	notifier.sendDue(context.Background())
+
+	state := getChannel(t, db, channel.ID)
+	if state.Pending != 0 || state.NextSendAt != nil || state.LastError == "" {
+		t.Errorf("channel = %+v, want the notification dropped", state)
+	}
+}
+
+func TestPasswordStoredEncrypted(t *testing.T) {
+	db := openDB(t)
+	server := newFakeSMTP(t, false, withStartTLS(), withAuth("bot", "hunter2"))
+	channel := testChannel(server, database.EmailTLSStartTLS)
+	channel.Username, channel.Password = "bot", "wrong"
+	if err := db.CreateEmailChannel(channel); err != nil {
+		t.Fatal(err)
+	}
+	channel.Password = "hunter2"
+	if err := db.UpdateEmailChannel(channel); err != nil {
+		t.Fatal(err)
+	}
+
+	// The password must not be readable from the database file alone.
+	var stored string
+	if err := db.QueryRow(`SELECT password FROM email_channels WHERE id = ?`, channel.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored == "" || strings.Contains(stored, "hunter2") {
+		t.Errorf("password stored as %q, want it encrypted", stored)
+	}
+	if got := getChannel(t, db, channel.ID).Password; got != "hunter2" {
+		t.Errorf("password = %q, want hunter2", got)
+	}
+
+	notifier := NewNotifier(db)
+	notifyTitle(t, notifier, "web restarted")
+	notifier.sendDue(context.Background())
+	if n := len(server.received()); n != 1 {
+		t.Errorf("%d emails sent with the stored password, want 1", n)
+	}
+}
@@ -0,0 +1,235 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/notify"
+)
+
+const defaultSubject = `[Docktrine] {{if .Digest}}{{.Count}} notifications{{else}}{{(index .Notifications 0).Title}}{{end}}`
+
+const defaultText = `{{if .Digest}}{{.Count}} notifications since {{(index .Notifications 0).Time.Format "2006-01-02 15:04:05 MST"}}:
+{{range .Summary}}
+  {{.Count}} x {{.Title}}{{end}}
+
+{{end}}{{range .Notifications}}{{.Time.Format "2006-01-02 15:04:05 MST"}} [{{upper .Severity}}] {{.Title}}
+{{.Message}}
+
+{{end}}--
+Sent by Docktrine to the {{.Channel}} email channel.
+`
+
+const defaultHTML = `<!DOCTYPE html>
+<html>
+<body style="font-family: -apple-system, Helvetica, Arial, sans-serif; font-size: 14px; color: #24292f;">
+{{if .Digest}}<p>{{.Count}} notifications since {{(index .Notifications 0).Time.Format "2006-01-02 15:04:05 MST"}}:</p>
+<ul>{{range .Summary}}<li>{{.Count}} &times; {{.Title}}</li>{{end}}</ul>
+{{end}}<table cellpadding="6" style="border-collapse: collapse;">
+{{range .Notifications}}<tr style="border-top: 1px solid #d0d7de;">
+<td style="white-space: nowrap; color: #57606a; vertical-align: top;">{{.Time.Format "2006-01-02 15:04:05 MST"}}</td>
+<td style="vertical-align: top; font-weight: bold; color: {{severityColor .Severity}};">{{upper .Severity}}</td>
+<td><strong>{{.Title}}</strong><br>{{.Message}}</td>
+</tr>
+{{end}}</table>
+<p style="color: #57606a; font-size: 12px;">Sent by Docktrine to the {{.Channel}} email channel.</p>
+</body>
+</html>
+`
+
+// Message is what the subject and body templates render.
+type Message struct {
+	// Channel is the name of the email channel.
+	Channel string
+	// Notifications are the notifications the email carries, oldest first.
+	// Their Data is the JSON object of the notification, e.g.
+	// {{.Data.digest}} of restarts.
+	Notifications []notify.Notification
+	Count         int
+	// Digest is set when the email carries more than one notification.
+	Digest bool
+	// Severity is the highest severity of the notifications.
+	Severity string
+	// Summary counts the notifications by title, most frequent first, so a
+	// flapping container shows up as one line.
+	Summary []SummaryLine
+}
+
+type SummaryLine struct {
+	Title string
+	Count int
+}
+
+func newMessage(channel string, notifications []notify.Notification) Message {
+	m := Message{
+		Channel:       channel,
+		Notifications: notifications,
+		Count:         len(notifications),
+		Digest:        len(notifications) > 1,
+	}
+
+	counts := map[string]int{}
+	var titles []string
+	for _, n := range notifications {
+		if !notify.AtLeast(m.Severity, n.Severity) {
+			m.Severity = n.Severity
+		}
+		if counts[n.Title] == 0 {
+			titles = append(titles, n.Title)
+		}
+		counts[n.Title]++
+	}
+	for _, title := range titles {
+		m.Summary = append(m.Summary, SummaryLine{Title: title, Count: counts[title]})
+	}
+	sort.SliceStable(m.Summary, func(i, j int) bool {
+		return m.Summary[i].Count > m.Summary[j].Count
+	})
+	return m
+}
+
+func severityColor(severity string) string {
+	switch severity {
+	case notify.SeverityCritical:
+		return "#d93f0b"
+	case notify.SeverityWarning:
+		return "#b08800"
+	}
+	return "#2eb886"
+}
+
+func textFuncs() template.FuncMap {
+	funcs := template.FuncMap{"severityColor": severityColor}
+	for name, fn := range notify.TemplateFuncs {
+		funcs[name] = fn
+	}
+	return funcs
+}
+
+// templates are the parsed subject and body templates of a channel.
+type templates struct {
+	subject *template.Template
+	text    *template.Template
+	html    *htmltemplate.Template
+}
+
+// ParseTemplates checks a channel's templates; empty ones are replaced by
+// the defaults. Templates are Go templates over a Message; the HTML one is
+// an html/template, so notification text is escaped.
+func ParseTemplates(subject, text, html string) error {
+	_, err := parseTemplates(subject, text, html)
+	return err
+}
+
+func parseTemplates(subject, text, html string) (*templates, error) {
+	if subject == "" {
+		subject = defaultSubject
+	}
+	if text == "" {
+		text = defaultText
+	}
+	if html == "" {
+		html = defaultHTML
+	}
+
+	var t templates
+	var err error
+	if t.subject, err = template.New("subject").Funcs(textFuncs()).Parse(subject); err != nil {
+		return nil, fmt.Errorf("subject template: %w", err)
+	}
+	if t.text, err = template.New("text").Funcs(textFuncs()).Parse(text); err != nil {
+		return nil, fmt.Errorf("text template: %w", err)
+	}
+	if t.html, err = htmltemplate.New("html").Funcs(htmltemplate.FuncMap(textFuncs())).Parse(html); err != nil {
+		return nil, fmt.Errorf("HTML template: %w", err)
+	}
+	return &t, nil
+}
+
+// Build renders the email of notifications for channel as a multipart
+// message with a plain-text and an HTML body.
+func Build(channel *database.EmailChannel, notifications []notify.Notification) ([]byte, error) {
+	t, err := parseTemplates(channel.SubjectTemplate, channel.TextTemplate, channel.HTMLTemplate)
+	if err != nil {
+		return nil, err
+	}
+	m := newMessage(channel.Name, notifications)
+
+	var subject, text, html bytes.Buffer
+	if err := t.subject.Execute(&subject, m); err != nil {
+		return nil, fmt.Errorf("subject template: %w", err)
+	}
+	if err := t.text.Execute(&text, m); err != nil {
+		return nil, fmt.Errorf("text template: %w", err)
+	}
+	if err := t.html.Execute(&html, m); err != nil {
+		return nil, fmt.Errorf("HTML template: %w", err)
+	}
+
+	var msg bytes.Buffer
+	body := multipart.NewWriter(&msg)
+	headers := []struct{ name, value string }{
+		{"From", channel.From},
+		{"To", strings.Join(channel.To, ", ")},
+		// Headers cannot span lines.
+		{"Subject", mime.QEncoding.Encode("utf-8", strings.Join(strings.Fields(subject.String()), " "))},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", messageID(channel.From)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", body.Boundary())},
+	}
+	for _, h := range headers {
+		fmt.Fprintf(&msg, "%s: %s\r\n", h.name, h.value)
+	}
+	msg.WriteString("\r\n")
+
+	for _, part := range []struct {
+		contentType string
+		content     []byte
+	}{
+		{"text/plain; charset=utf-8", text.Bytes()},
+		{"text/html; charset=utf-8", html.Bytes()},
+	} {
+		w, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write(part.content); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := body.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
+
+// messageID makes a unique Message-ID in the domain of the sender.
+func messageID(from string) string {
+	domain := "docktrine"
+	if _, d, ok := strings.Cut(strings.Trim(from, "<> "), "@"); ok {
+		domain = strings.TrimRight(d, ">")
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(id), domain)
+}
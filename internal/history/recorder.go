@@ -0,0 +1,225 @@
+package history
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/docker"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/Zeptile/docktrine/internal/notify"
+)
+
+// Actions are the container lifecycle events that are recorded.
+var Actions = []string{
+	"create", "start", "restart", "stop", "kill", "die", "oom", "health_status", "destroy",
+}
+
+const (
+	// serverSyncInterval is how often the recorder picks up added and
+	// removed servers.
+	serverSyncInterval = 30 * time.Second
+	pruneInterval      = time.Hour
+)
+
+// Recorder follows the container events of every server and stores their
+// lifecycle in the database. After a restart each server's feed resumes
+// from its last recorded event, within what the daemon still remembers.
+type Recorder struct {
+	db     *database.DB
+	docker *docker.DockerClient
+	// Retention is how long events are kept; zero keeps them forever.
+	Retention time.Duration
+	// OnEvent, if set, is called with each newly recorded event.
+	OnEvent func(event database.ContainerEvent)
+	// Notifications, if set, is sent container deaths and servers going
+	// offline and coming back.
+	Notifications *notify.Dispatcher
+}
+
+func NewRecorder(db *database.DB, d *docker.DockerClient, retention time.Duration) *Recorder {
+	return &Recorder{db: db, docker: d, Retention: retention}
+}
+
+// Run records events until ctx is cancelled.
+func (r *Recorder) Run(ctx context.Context) {
+	events := make(chan docker.Event, 256)
+	watching := map[string]context.CancelFunc{}
+	defer func() {
+		for _, cancel := range watching {
+			cancel()
+		}
+	}()
+
+	r.syncServers(ctx, watching, events)
+	r.prune()
+
+	syncTicker := time.NewTicker(serverSyncInterval)
+	defer syncTicker.Stop()
+	pruneTicker := time.NewTicker(pruneInterval)
+	defer pruneTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-events:
+			r.record(event)
+		case <-syncTicker.C:
+			r.syncServers(ctx, watching, events)
+		case <-pruneTicker.C:
+			r.prune()
+		}
+	}
+}
+
+// syncServers starts watching new servers and stops watching removed ones.
+func (r *Recorder) syncServers(ctx context.Context, watching map[string]context.CancelFunc, events chan<- docker.Event) {
+	servers, err := r.db.GetServers()
+	if err != nil {
+		logger.Error(err, "Failed to list servers for container history")
+		return
+	}
+
+	current := map[string]bool{}
+	for _, server := range servers {
+		current[server.Name] = true
+		if _, ok := watching[server.Name]; ok {
+			continue
+		}
+
+		since, err := r.db.LastContainerEventTime(server.Name)
+		if err != nil {
+			logger.Error(err, fmt.Sprintf("Failed to read the container history of server %s", server.Name))
+			continue
+		}
+
+		serverCtx, cancel := context.WithCancel(ctx)
+		watching[server.Name] = cancel
+		filter := docker.EventFilter{Types: []string{"container"}, Actions: Actions}
+		go r.docker.WatchEvents(serverCtx, server.Name, filter, since, events)
+		logger.Debug(fmt.Sprintf("Recording container history of server %s", server.Name))
+	}
+
+	for name, cancel := range watching {
+		if !current[name] {
+			cancel()
+			delete(watching, name)
+			logger.Debug(fmt.Sprintf("Stopped recording container history of server %s", name))
+		}
+	}
+}
+
+func (r *Recorder) record(event docker.Event) {
+	if event.Type == docker.EventTypeStream {
+		r.notifyStream(event)
+		return
+	}
+	if event.Type != "container" {
+		return
+	}
+
+	action, detail, _ := strings.Cut(event.Action, ": ")
+	if action == "kill" {
+		detail = event.Attributes["signal"]
+	}
+
+	record := &database.ContainerEvent{
+		Server:        event.Server,
+		ContainerID:   event.ActorID,
+		ContainerName: event.Attributes["name"],
+		Image:         event.Attributes["image"],
+		Action:        action,
+		Detail:        detail,
+		Attributes:    event.Attributes,
+		Time:          event.Time,
+	}
+	if code, err := strconv.Atoi(event.Attributes["exitCode"]); err == nil && action == "die" {
+		record.ExitCode = &code
+	}
+
+	inserted, err := r.db.RecordContainerEvent(record)
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("Failed to record %s of container %s on %s", action, record.ContainerName, event.Server))
+		return
+	}
+	if !inserted {
+		return
+	}
+	if r.OnEvent != nil {
+		r.OnEvent(*record)
+	}
+	if action == "die" {
+		r.notifyDied(record)
+	}
+}
+
+func (r *Recorder) notifyDied(event *database.ContainerEvent) {
+	severity := notify.SeverityInfo
+	message := fmt.Sprintf("Container %s on %s exited", event.ContainerName, event.Server)
+	if event.ExitCode != nil {
+		message = fmt.Sprintf("Container %s on %s exited with code %d", event.ContainerName, event.Server, *event.ExitCode)
+		if *event.ExitCode != 0 {
+			severity = notify.SeverityWarning
+		}
+	}
+
+	r.Notifications.Send(notify.Notification{
+		Event:     notify.EventContainerDied,
+		Severity:  severity,
+		Title:     fmt.Sprintf("Container %s on %s died", event.ContainerName, event.Server),
+		Message:   message,
+		Server:    event.Server,
+		Container: event.ContainerName,
+		Time:      event.Time,
+		Data:      event,
+	})
+}
+
+// notifyStream reports the loss and recovery of a server's event feed as
+// the server going offline and coming back.
+func (r *Recorder) notifyStream(event docker.Event) {
+	switch event.Action {
+	case "disconnected":
+		message := fmt.Sprintf("Lost the connection to server %s", event.Server)
+		if event.Attributes["error"] != "" {
+			message += ": " + event.Attributes["error"]
+		}
+		r.Notifications.Send(notify.Notification{
+			Event:    notify.EventServerOffline,
+			Severity: notify.SeverityCritical,
+			Title:    fmt.Sprintf("Server %s is offline", event.Server),
+			Message:  message,
+			Server:   event.Server,
+			Time:     event.Time,
+			Data:     event,
+		})
+	case "reconnected":
+		r.Notifications.Send(notify.Notification{
+			Event:    notify.EventServerOnline,
+			Severity: notify.SeverityInfo,
+			Title:    fmt.Sprintf("Server %s is back online", event.Server),
+			Message:  fmt.Sprintf("Reconnected to server %s", event.Server),
+			Server:   event.Server,
+			Time:     event.Time,
+			Data:     event,
+		})
+	}
+}
+
+func (r *Recorder) prune() {
+	if r.Retention <= 0 {
+		return
+	}
+	deleted, err := r.db.PruneContainerEvents(time.Now().Add(-r.Retention))
+	if err != nil {
+		logger.Error(err, "Failed to prune container history")
+		return
+	}
+	if deleted > 0 {
+		logger.Info(fmt.Sprintf("Pruned %d container events older than %s", deleted, r.Retention))
+	}
+}
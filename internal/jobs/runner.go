@@ -0,0 +1,367 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/docker"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/Zeptile/docktrine/internal/notify"
+	"github.com/Zeptile/docktrine/internal/ratelimit"
+)
+
+// Actions are the operations that can run as jobs.
+var Actions = map[string]bool{
+	"containers.start":   true,
+	"containers.stop":    true,
+	"containers.restart": true,
+	// Queued by registry hooks; params are the pushed image and digest.
+	"containers.recreate": true,
+}
+
+// pollInterval is how often the runner looks for queued jobs it was not
+// woken up for, e.g. ones held back by a busy server.
+const pollInterval = time.Second
+
+// Runner executes queued jobs in the background, at most workers at a time
+// and within the per-server operation limits the API enforces.
+type Runner struct {
+	db     *database.DB
+	docker *docker.DockerClient
+	slots  *ratelimit.Slots
+
+	workers chan struct{}
+	wake    chan struct{}
+
+	mu       sync.Mutex
+	running  map[int64]context.CancelFunc
+	canceled map[int64]bool
+
+	// Notifications, if set, is sent finished jobs and the restarts they
+	// perform.
+	Notifications *notify.Dispatcher
+}
+
+// NewRunner runs up to workers jobs at once. slots may be nil to not limit
+// operations per server.
+func NewRunner(db *database.DB, d *docker.DockerClient, slots *ratelimit.Slots, workers int) *Runner {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Runner{
+		db:       db,
+		docker:   d,
+		slots:    slots,
+		workers:  make(chan struct{}, workers),
+		wake:     make(chan struct{}, 1),
+		running:  make(map[int64]context.CancelFunc),
+		canceled: make(map[int64]bool),
+	}
+}
+
+// Run requeues the jobs a previous process left running, then runs queued
+// jobs until ctx is cancelled. Jobs interrupted by the shutdown are left
+// running in the database and requeued by the next Run.
+func (r *Runner) Run(ctx context.Context) {
+	ids, err := r.db.RequeueRunningJobs()
+	if err != nil {
+		logger.Error(err, "Failed to requeue interrupted jobs")
+	}
+	for _, id := range ids {
+		logger.Warn(fmt.Sprintf("Requeued job %d interrupted by a restart", id))
+		r.log(id, "interrupted by an API restart, requeued")
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		r.dispatch(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Notify wakes the runner up to look for queued jobs.
+func (r *Runner) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Cancel cancels a queued or running job. It returns false if the job was
+// neither.
+func (r *Runner) Cancel(id int64) (bool, error) {
+	canceled, err := r.db.CancelQueuedJob(id)
+	if err != nil || canceled {
+		if canceled {
+			r.log(id, "canceled before it started")
+		}
+		return canceled, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cancel, ok := r.running[id]
+	if !ok {
+		return false, nil
+	}
+	r.canceled[id] = true
+	cancel()
+	return true, nil
+}
+
+func (r *Runner) dispatch(ctx context.Context) {
+	queued, err := r.db.QueuedJobs()
+	if err != nil {
+		logger.Error(err, "Failed to list queued jobs")
+		return
+	}
+
+	for _, job := range queued {
+		select {
+		case r.workers <- struct{}{}:
+		default:
+			return
+		}
+
+		if !r.start(ctx, job) {
+			<-r.workers
+		}
+	}
+}
+
+// start claims job and runs it in a goroutine holding a worker. It returns
+// false if the job was not started.
+func (r *Runner) start(ctx context.Context, job database.Job) bool {
+	servers, resolveErr := r.docker.ResolveServers(job.Server)
+	names := make([]string, len(servers))
+	for i, server := range servers {
+		names[i] = server.Name
+	}
+
+	if r.slots != nil && !r.slots.TryAcquire(names) {
+		// The servers are busy, try again on the next pass.
+		return false
+	}
+	release := func() {
+		if r.slots != nil {
+			r.slots.Release(names)
+		}
+	}
+
+	claimed, err := r.db.StartJob(job.ID)
+	if err != nil {
+		logger.Error(err, fmt.Sprintf("Failed to start job %d", job.ID))
+	}
+	if !claimed {
+		release()
+		return false
+	}
+	job.Attempts++
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	r.mu.Lock()
+	r.running[job.ID] = cancel
+	r.mu.Unlock()
+
+	go func() {
+		defer func() {
+			cancel()
+			release()
+			<-r.workers
+			r.Notify()
+		}()
+
+		started := time.Now()
+		r.log(job.ID, fmt.Sprintf("attempt %d started", job.Attempts))
+
+		err := resolveErr
+		if err == nil {
+			err = r.execute(jobCtx, &job, names)
+		}
+
+		r.mu.Lock()
+		canceled := r.canceled[job.ID]
+		delete(r.canceled, job.ID)
+		delete(r.running, job.ID)
+		r.mu.Unlock()
+
+		if ctx.Err() != nil && !canceled {
+			// The API is shutting down; the job stays running and is
+			// requeued on the next start.
+			return
+		}
+
+		status := database.JobSucceeded
+		errMessage := ""
+		switch {
+		// An operation that completed before the cancellation reached it
+		// still succeeded.
+		case canceled && err != nil:
+			status = database.JobCanceled
+		case err != nil:
+			status = database.JobFailed
+			errMessage = err.Error()
+		}
+
+		// The last line is written first so that anyone following the log
+		// has it by the time they see the job finished.
+		if errMessage != "" {
+			r.log(job.ID, fmt.Sprintf("%s: %s", status, errMessage))
+		} else {
+			r.log(job.ID, status)
+		}
+		if err := r.db.FinishJob(job.ID, status, errMessage); err != nil {
+			logger.Error(err, fmt.Sprintf("Failed to record the result of job %d", job.ID))
+		}
+		logger.Info(fmt.Sprintf("Job %d (%s on %s) %s", job.ID, job.Action, job.Target, status))
+		r.audit(&job, started, status, errMessage)
+		r.notifyFinished(&job, status, errMessage)
+	}()
+	return true
+}
+
+// execute runs the job's action on every server concurrently and logs the
+// outcome per server.
+func (r *Runner) execute(ctx context.Context, job *database.Job, servers []string) error {
+	if !Actions[job.Action] {
+		return fmt.Errorf("unknown job action %s", job.Action)
+	}
+
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server string) {
+			defer wg.Done()
+
+			digest := ""
+			progress := func(message string) {
+				r.log(job.ID, fmt.Sprintf("%s: %s", server, message))
+			}
+
+			switch job.Action {
+			case "containers.start":
+				errs[i] = r.docker.StartContainerContext(ctx, job.Target, server)
+			case "containers.stop":
+				errs[i] = r.docker.StopContainerContext(ctx, job.Target, server)
+			case "containers.restart":
+				pullLatest := job.Params["pull_latest"] == "true"
+				if pullLatest {
+					progress("pulling the latest image")
+				}
+				digest, errs[i] = r.docker.RestartContainerContext(ctx, job.Target, server, pullLatest, progress)
+			case "containers.recreate":
+				digest, errs[i] = r.docker.RecreateContainerContext(ctx, job.Target, server, job.Params["image"], progress)
+			}
+
+			if errs[i] != nil {
+				progress("error: " + errs[i].Error())
+				return
+			}
+			progress("ok")
+			if job.Action == "containers.restart" || job.Action == "containers.recreate" {
+				r.Notifications.Send(notify.Restarted(notify.Restart{
+					Server:     server,
+					Container:  job.Target,
+					PullLatest: job.Params["pull_latest"] == "true" || job.Action == "containers.recreate",
+					Recreated:  job.Action == "containers.recreate",
+					Digest:     digest,
+					By:         job.RequesterName,
+				}))
+			}
+		}(i, server)
+	}
+	wg.Wait()
+
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", servers[i], err))
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	if len(servers) == 1 {
+		return errs[0]
+	}
+	return fmt.Errorf("failed on %d of %d servers: %s", len(failed), len(servers), strings.Join(failed, "; "))
+}
+
+func (r *Runner) log(jobID int64, message string) {
+	if err := r.db.AppendJobLog(jobID, message); err != nil {
+		logger.Error(err, fmt.Sprintf("Failed to write the log of job %d", jobID))
+	}
+}
+
+// audit records the operation the job ran under the principal that queued
+// it. The request that queued it is recorded separately by the audit
+// middleware.
+func (r *Runner) audit(job *database.Job, started time.Time, status, errMessage string) {
+	params := map[string]interface{}{
+		"job_id":  job.ID,
+		"attempt": job.Attempts,
+	}
+	for k, v := range job.Params {
+		params[k] = v
+	}
+
+	event := &database.AuditEvent{
+		Timestamp:  started,
+		ActorType:  job.RequesterType,
+		ActorID:    job.RequesterID,
+		ActorName:  job.RequesterName,
+		Action:     job.Action,
+		Server:     job.Server,
+		Target:     job.Target,
+		Params:     params,
+		Status:     200,
+		Result:     database.AuditResultSuccess,
+		DurationMS: time.Since(started).Milliseconds(),
+	}
+	if status != database.JobSucceeded {
+		event.Status = 500
+		event.Result = database.AuditResultFailure
+		event.Error = errMessage
+	}
+
+	if err := r.db.RecordAuditEvent(event); err != nil {
+		logger.Error(err, "Failed to record audit event")
+	}
+}
+
+func (r *Runner) notifyFinished(job *database.Job, status, errMessage string) {
+	severity := notify.SeverityInfo
+	target := job.Target
+	if job.Server != "" {
+		target += " on " + job.Server
+	}
+	message := fmt.Sprintf("Job %d (%s of %s) %s", job.ID, job.Action, target, status)
+	if status == database.JobFailed {
+		severity = notify.SeverityWarning
+		message += ": " + errMessage
+	}
+	job.Status = status
+	job.Error = errMessage
+
+	r.Notifications.Send(notify.Notification{
+		Event:    notify.EventJobFinished,
+		Severity: severity,
+		Title:    fmt.Sprintf("Job %d %s", job.ID, status),
+		Message:  message,
+		Server:   job.Server,
+		Data:     job,
+	})
+}
@@ -0,0 +1,189 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/logger"
+)
+
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// severityRanks orders the severities, lowest first.
+var severityRanks = map[string]int{
+	SeverityInfo:     1,
+	SeverityWarning:  2,
+	SeverityCritical: 3,
+}
+
+// ValidSeverity reports whether severity is info, warning or critical.
+func ValidSeverity(severity string) bool {
+	_, ok := severityRanks[severity]
+	return ok
+}
+
+// AtLeast reports whether severity is min or higher. Every severity is at
+// least the empty one.
+func AtLeast(severity, min string) bool {
+	return severityRanks[severity] >= severityRanks[min]
+}
+
+// TemplateFuncs are available to the message templates of notifiers.
+var TemplateFuncs = map[string]interface{}{
+	// short abbreviates a digest or ID: sha256:4f1e2d3c4b5a… becomes
+	// sha256:4f1e2d3c4b5a.
+	"short": func(s string) string {
+		algorithm, hash, ok := strings.Cut(s, ":")
+		if !ok {
+			hash, algorithm = algorithm, ""
+		}
+		if len(hash) > 12 {
+			hash = hash[:12]
+		}
+		if algorithm == "" {
+			return hash
+		}
+		return algorithm + ":" + hash
+	},
+	"upper": strings.ToUpper,
+}
+
+// Events notifications are sent for.
+const (
+	EventAlertFired         = "alert.fired"
+	EventAlertResolved      = "alert.resolved"
+	EventContainerDied      = "container.died"
+	EventContainerRestarted = "container.restarted"
+	EventServerOffline      = "server.offline"
+	EventServerOnline       = "server.online"
+	EventJobFinished        = "job.finished"
+)
+
+// Events lists every event, for validating subscriptions.
+var Events = []string{
+	EventAlertFired, EventAlertResolved, EventContainerDied, EventContainerRestarted,
+	EventServerOffline, EventServerOnline, EventJobFinished,
+}
+
+// Notification is something worth telling people about, such as an alert
+// firing.
+type Notification struct {
+	// Event names what happened, e.g. alert.fired or alert.resolved.
+	Event    string `json:"event"`
+	Severity string `json:"severity"`
+	Title    string `json:"title"`
+	Message  string `json:"message"`
+	Server   string `json:"server,omitempty"`
+	// Container is the container's name, if the notification is about one.
+	Container string    `json:"container,omitempty"`
+	Time      time.Time `json:"time"`
+	// Data is the object the notification is about, e.g. the alert.
+	Data interface{} `json:"data,omitempty"`
+}
+
+// Notifier delivers notifications somewhere.
+type Notifier interface {
+	Name() string
+	Notify(n Notification) error
+}
+
+// Dispatcher sends every notification to each of its notifiers.
+type Dispatcher struct {
+	mu        sync.RWMutex
+	notifiers []Notifier
+}
+
+func NewDispatcher(notifiers ...Notifier) *Dispatcher {
+	return &Dispatcher{notifiers: notifiers}
+}
+
+func (d *Dispatcher) Add(n Notifier) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.notifiers = append(d.notifiers, n)
+}
+
+// Send hands n to every notifier. A failing notifier is logged and does not
+// keep the others from being notified. Sending to a nil Dispatcher does
+// nothing.
+func (d *Dispatcher) Send(n Notification) {
+	if d == nil {
+		return
+	}
+	if n.Time.IsZero() {
+		n.Time = time.Now().UTC()
+	}
+
+	d.mu.RLock()
+	notifiers := append([]Notifier{}, d.notifiers...)
+	d.mu.RUnlock()
+
+	for _, notifier := range notifiers {
+		if err := notifier.Notify(n); err != nil {
+			logger.Error(err, fmt.Sprintf("Failed to send %s notification to %s", n.Event, notifier.Name()))
+		}
+	}
+}
+
+// LogNotifier writes notifications to the API log.
+type LogNotifier struct{}
+
+func (LogNotifier) Name() string {
+	return "log"
+}
+
+func (LogNotifier) Notify(n Notification) error {
+	message := fmt.Sprintf("[%s] %s: %s", n.Severity, n.Title, n.Message)
+	if n.Severity == SeverityInfo {
+		logger.Info(message)
+	} else {
+		logger.Warn(message)
+	}
+	return nil
+}
+
+// Restart describes a container restart Docktrine performed. It is the
+// Data of container.restarted notifications.
+type Restart struct {
+	Server    string `json:"server"`
+	Container string `json:"container"`
+	// PullLatest is set if the image was pulled before the restart.
+	PullLatest bool `json:"pull_latest"`
+	// Digest is the digest of the pulled image, if known.
+	Digest string `json:"digest,omitempty"`
+	// Recreated is set if the container was replaced by one created from
+	// the pulled image.
+	Recreated bool `json:"recreated,omitempty"`
+	// By is the principal that asked for the restart.
+	By string `json:"by"`
+}
+
+// Restarted builds the notification of a restart.
+func Restarted(r Restart) Notification {
+	verb := "restarted"
+	if r.Recreated {
+		verb = "recreated"
+	}
+	message := fmt.Sprintf("%s %s on %s by %s", r.Container, verb, r.Server, r.By)
+	switch {
+	case r.Digest != "":
+		message += fmt.Sprintf(" (pulled %s)", r.Digest)
+	case r.PullLatest:
+		message += " (pulled the latest image)"
+	}
+	return Notification{
+		Event:     EventContainerRestarted,
+		Severity:  SeverityInfo,
+		Title:     fmt.Sprintf("Container %s %s on %s", r.Container, verb, r.Server),
+		Message:   message,
+		Server:    r.Server,
+		Container: r.Container,
+		Data:      r,
+	}
+}
@@ -0,0 +1,98 @@
+package oidc
+
+import (
+	"os"
+	"strings"
+
+	"github.com/Zeptile/docktrine/internal/database"
+)
+
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the API's /auth/oidc/callback URL as registered with
+	// the provider. Only needed for the browser flow.
+	RedirectURL string
+	Scopes      []string
+	// Audience accepted in bearer tokens, defaults to ClientID.
+	Audience string
+	// GroupsClaim names the claim holding the user's groups.
+	GroupsClaim string
+	// AdminGroups, OperatorGroups and ViewerGroups map groups to roles. The
+	// most privileged match wins.
+	AdminGroups    []string
+	OperatorGroups []string
+	ViewerGroups   []string
+	// DefaultRole is given to users in none of the groups above. Empty
+	// denies them access.
+	DefaultRole string
+}
+
+// ConfigFromEnv reads the OIDC_* environment variables. It returns nil when
+// OIDC_ISSUER is not set, which disables single sign-on.
+func ConfigFromEnv() *Config {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+
+	config := &Config{
+		Issuer:         strings.TrimSuffix(issuer, "/"),
+		ClientID:       os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret:   os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:    os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:         splitList(os.Getenv("OIDC_SCOPES")),
+		Audience:       os.Getenv("OIDC_AUDIENCE"),
+		GroupsClaim:    os.Getenv("OIDC_GROUPS_CLAIM"),
+		AdminGroups:    splitList(os.Getenv("OIDC_ADMIN_GROUPS")),
+		OperatorGroups: splitList(os.Getenv("OIDC_OPERATOR_GROUPS")),
+		ViewerGroups:   splitList(os.Getenv("OIDC_VIEWER_GROUPS")),
+		DefaultRole:    os.Getenv("OIDC_DEFAULT_ROLE"),
+	}
+
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "email"}
+	}
+	if config.Audience == "" {
+		config.Audience = config.ClientID
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	return config
+}
+
+// RoleForGroups maps a user's groups to a Docktrine role, or "" if the user
+// should not get access.
+func (c *Config) RoleForGroups(groups []string) string {
+	for _, mapping := range []struct {
+		role   string
+		groups []string
+	}{
+		{database.RoleAdmin, c.AdminGroups},
+		{database.RoleOperator, c.OperatorGroups},
+		{database.RoleViewer, c.ViewerGroups},
+	} {
+		for _, group := range groups {
+			for _, g := range mapping.groups {
+				if group == g {
+					return mapping.role
+				}
+			}
+		}
+	}
+
+	if database.ValidRole(c.DefaultRole) {
+		return c.DefaultRole
+	}
+	return ""
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		items = append(items, item)
+	}
+	return items
+}
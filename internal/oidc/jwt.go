@@ -0,0 +1,216 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// clockSkew is tolerated when checking exp, nbf and iat.
+const clockSkew = time.Minute
+
+type Claims struct {
+	Issuer            string
+	Subject           string
+	Audience          []string
+	Expiry            time.Time
+	NotBefore         time.Time
+	Email             string
+	PreferredUsername string
+	Groups            []string
+	Raw               map[string]interface{}
+}
+
+// Username picks the most readable stable identifier in the claims.
+func (c *Claims) Username() string {
+	switch {
+	case c.PreferredUsername != "":
+		return c.PreferredUsername
+	case c.Email != "":
+		return c.Email
+	default:
+		return c.Subject
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// LooksLikeJWT reports whether token has the three dot-separated parts of a
+// compact JWS. Opaque session tokens never contain dots.
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Verify checks the signature of a JWT against the provider's JWKS and
+// validates its issuer, audience and lifetime.
+func (p *Provider) Verify(raw string, audience string) (*Claims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %w", err)
+	}
+
+	key, err := p.keys.get(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token payload: %w", err)
+	}
+	claims, err := parseClaims(payload, p.config.GroupsClaim)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Issuer != p.discovery.Issuer {
+		return nil, fmt.Errorf("unexpected token issuer %q", claims.Issuer)
+	}
+	if audience != "" && !contains(claims.Audience, audience) {
+		return nil, fmt.Errorf("token audience does not include %q", audience)
+	}
+
+	now := time.Now()
+	if claims.Expiry.IsZero() || now.After(claims.Expiry.Add(clockSkew)) {
+		return nil, errors.New("token has expired")
+	}
+	if !claims.NotBefore.IsZero() && now.Add(clockSkew).Before(claims.NotBefore) {
+		return nil, errors.New("token is not valid yet")
+	}
+
+	return claims, nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var h hash.Hash
+	var hashID crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		h, hashID = sha256.New(), crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		h, hashID = sha512.New384(), crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		h, hashID = sha512.New(), crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(pub, hashID, digest, signature)
+		case "PS":
+			return rsa.VerifyPSS(pub, hashID, digest, signature, nil)
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			break
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid token signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("key type does not match token algorithm %q", alg)
+}
+
+func parseClaims(payload []byte, groupsClaim string) (*Claims, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return nil, fmt.Errorf("malformed token payload: %w", err)
+	}
+
+	claims := &Claims{
+		Issuer:            stringClaim(raw, "iss"),
+		Subject:           stringClaim(raw, "sub"),
+		Audience:          listClaim(raw, "aud"),
+		Expiry:            timeClaim(raw, "exp"),
+		NotBefore:         timeClaim(raw, "nbf"),
+		Email:             stringClaim(raw, "email"),
+		PreferredUsername: stringClaim(raw, "preferred_username"),
+		Groups:            listClaim(raw, groupsClaim),
+		Raw:               raw,
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	return claims, nil
+}
+
+func stringClaim(raw map[string]interface{}, name string) string {
+	s, _ := raw[name].(string)
+	return s
+}
+
+// listClaim accepts both a single string and an array of strings, as the
+// aud and groups claims come in either form.
+func listClaim(raw map[string]interface{}, name string) []string {
+	switch v := raw[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+func timeClaim(raw map[string]interface{}, name string) time.Time {
+	if v, ok := raw[name].(float64); ok {
+		return time.Unix(int64(v), 0)
+	}
+	return time.Time{}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,499 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockIssuer is an OIDC provider serving discovery, JWKS, authorization and
+// token endpoints from an httptest server.
+type mockIssuer struct {
+	*httptest.Server
+	t *testing.T
+
+	mu   sync.Mutex
+	keys map[string]crypto.Signer
+	// jwksFetches counts the requests for the key set.
+	jwksFetches int
+	// challenges maps issued authorization codes to their PKCE challenge.
+	challenges map[string]string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	m := &mockIssuer{t: t, keys: map[string]crypto.Signer{}, challenges: map[string]string{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Discovery{
+			Issuer:                m.URL,
+			AuthorizationEndpoint: m.URL + "/authorize",
+			TokenEndpoint:         m.URL + "/token",
+			JWKSURI:               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", m.serveJWKS)
+	mux.HandleFunc("/token", m.serveToken)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// setKeys replaces the published signing keys, as a provider rolling its
+// keys does.
+func (m *mockIssuer) setKeys(keys map[string]crypto.Signer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys = keys
+}
+
+func (m *mockIssuer) fetches() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.jwksFetches
+}
+
+func (m *mockIssuer) serveJWKS(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jwksFetches++
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	for kid, key := range m.keys {
+		jwk := jsonWebKey{Kid: kid, Use: "sig"}
+		switch pub := key.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case *ecdsa.PublicKey:
+			jwk.Kty = "EC"
+			jwk.Crv = "P-256"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub.X.FillBytes(make([]byte, 32)))
+			jwk.Y = base64.RawURLEncoding.EncodeToString(pub.Y.FillBytes(make([]byte, 32)))
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	json.NewEncoder(w).Encode(set)
+}
+
+// authorize records the PKCE challenge of an authorization URL and returns
+// the code the provider would redirect back with.
+func (m *mockIssuer) authorize(authURL string) string {
+	m.t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	query := u.Query()
+	if query.Get("code_challenge_method") != "S256" {
+		m.t.Fatalf("code_challenge_method = %q, want S256", query.Get("code_challenge_method"))
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	code := "code-" + query.Get("state")
+	m.challenges[code] = query.Get("code_challenge")
+	return code
+}
+
+func (m *mockIssuer) serveToken(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	m.mu.Lock()
+	challenge, ok := m.challenges[r.PostForm.Get("code")]
+	delete(m.challenges, r.PostForm.Get("code"))
+	m.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(tokenError{Error: "invalid_grant", Description: "PKCE verification failed"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken: "opaque",
+		IDToken:     m.sign("rsa-1", m.claims(nil)),
+		TokenType:   "Bearer",
+		ExpiresIn:   300,
+	})
+}
+
+// claims returns valid claims for the test client, with overrides applied.
+func (m *mockIssuer) claims(overrides map[string]interface{}) map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss":                m.URL,
+		"sub":                "user-1",
+		"aud":                "docktrine",
+		"exp":                time.Now().Add(5 * time.Minute).Unix(),
+		"iat":                time.Now().Unix(),
+		"preferred_username": "alice",
+		"groups":             []string{"ops"},
+	}
+	for k, v := range overrides {
+		if v == nil {
+			delete(claims, k)
+		} else {
+			claims[k] = v
+		}
+	}
+	return claims
+}
+
+// sign issues a compact JWS signed with the key kid, whether or not the
+// key is published.
+func (m *mockIssuer) sign(kid string, claims map[string]interface{}) string {
+	m.t.Helper()
+	m.mu.Lock()
+	key := m.keys[kid]
+	m.mu.Unlock()
+	if key == nil {
+		m.t.Fatalf("no key %q", kid)
+	}
+	return signToken(m.t, kid, key, claims)
+}
+
+func signToken(t *testing.T, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(jwtHeader{Alg: alg, Kid: kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func rsaKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func ecKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newTestProvider(t *testing.T, issuer *mockIssuer) *Provider {
+	t.Helper()
+	provider, err := NewProvider(context.Background(), Config{
+		Issuer:      issuer.URL,
+		ClientID:    "docktrine",
+		RedirectURL: "http://localhost:3000/v1/auth/oidc/callback",
+		Scopes:      []string{"openid"},
+		Audience:    "docktrine-api",
+		GroupsClaim: "groups",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func TestNewProviderRejectsOtherIssuer(t *testing.T) {
+	issuer := newMockIssuer(t)
+	_, err := NewProvider(context.Background(), Config{Issuer: issuer.URL + "/other", ClientID: "docktrine"})
+	if err == nil {
+		t.Fatal("NewProvider accepted a discovery document of another issuer")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	issuer := newMockIssuer(t)
+	rsaSigner, ecSigner := rsaKey(t), ecKey(t)
+	issuer.setKeys(map[string]crypto.Signer{"rsa-1": rsaSigner, "ec-1": ecSigner})
+	provider := newTestProvider(t, issuer)
+
+	tests := []struct {
+		name    string
+		token   func() string
+		wantErr string
+	}{
+		{
+			name:  "RSA signed",
+			token: func() string { return issuer.sign("rsa-1", issuer.claims(nil)) },
+		},
+		{
+			name:  "EC signed",
+			token: func() string { return issuer.sign("ec-1", issuer.claims(nil)) },
+		},
+		{
+			name: "audience in a list",
+			token: func() string {
+				return issuer.sign("rsa-1", issuer.claims(map[string]interface{}{"aud": []string{"other", "docktrine"}}))
+			},
+		},
+		{
+			name:    "wrong audience",
+			token:   func() string { return issuer.sign("rsa-1", issuer.claims(map[string]interface{}{"aud": "other"})) },
+			wantErr: "audience",
+		},
+		{
+			name: "expired",
+			token: func() string {
+				return issuer.sign("rsa-1", issuer.claims(map[string]interface{}{"exp": time.Now().Add(-2 * clockSkew).Unix()}))
+			},
+			wantErr: "expired",
+		},
+		{
+			name: "expired within the clock skew",
+			token: func() string {
+				return issuer.sign("rsa-1", issuer.claims(map[string]interface{}{"exp": time.Now().Add(-clockSkew / 2).Unix()}))
+			},
+		},
+		{
+			name:    "no expiry",
+			token:   func() string { return issuer.sign("rsa-1", issuer.claims(map[string]interface{}{"exp": nil})) },
+			wantErr: "expired",
+		},
+		{
+			name: "not valid yet",
+			token: func() string {
+				return issuer.sign("rsa-1", issuer.claims(map[string]interface{}{"nbf": time.Now().Add(2 * clockSkew).Unix()}))
+			},
+			wantErr: "not valid yet",
+		},
+		{
+			name: "other issuer",
+			token: func() string {
+				return issuer.sign("rsa-1", issuer.claims(map[string]interface{}{"iss": "https://evil.example.com"}))
+			},
+			wantErr: "issuer",
+		},
+		{
+			name:    "no subject",
+			token:   func() string { return issuer.sign("rsa-1", issuer.claims(map[string]interface{}{"sub": nil})) },
+			wantErr: "subject",
+		},
+		{
+			name:    "signed by an unpublished key",
+			token:   func() string { return signToken(t, "rsa-1", rsaKey(t), issuer.claims(nil)) },
+			wantErr: "verification error",
+		},
+		{
+			name: "tampered payload",
+			token: func() string {
+				parts := strings.Split(issuer.sign("rsa-1", issuer.claims(nil)), ".")
+				payload, _ := json.Marshal(issuer.claims(map[string]interface{}{"groups": []string{"admins"}}))
+				return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+			},
+			wantErr: "verification error",
+		},
+		{
+			name: "unsigned",
+			token: func() string {
+				header, _ := json.Marshal(jwtHeader{Alg: "none", Kid: "rsa-1"})
+				payload, _ := json.Marshal(issuer.claims(nil))
+				return base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+			},
+			wantErr: "unsupported token algorithm",
+		},
+		{
+			name: "algorithm does not match the key",
+			token: func() string {
+				parts := strings.Split(issuer.sign("ec-1", issuer.claims(nil)), ".")
+				header, _ := json.Marshal(jwtHeader{Alg: "RS256", Kid: "ec-1"})
+				return base64.RawURLEncoding.EncodeToString(header) + "." + parts[1] + "." + parts[2]
+			},
+			wantErr: "does not match",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := provider.Verify(tt.token(), "docktrine")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.Subject != "user-1" || claims.Username() != "alice" || len(claims.Groups) != 1 || claims.Groups[0] != "ops" {
+				t.Errorf("claims = %+v", claims)
+			}
+		})
+	}
+}
+
+func TestVerifyAccessTokenAudience(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.setKeys(map[string]crypto.Signer{"rsa-1": rsaKey(t)})
+	provider := newTestProvider(t, issuer)
+
+	// Bearer tokens are checked against the API audience, ID tokens against
+	// the client ID.
+	idToken := issuer.sign("rsa-1", issuer.claims(nil))
+	if _, err := provider.VerifyAccessToken(idToken); err == nil {
+		t.Error("VerifyAccessToken accepted a token for the client ID")
+	}
+	if _, err := provider.VerifyIDToken(idToken); err != nil {
+		t.Errorf("VerifyIDToken: %v", err)
+	}
+
+	accessToken := issuer.sign("rsa-1", issuer.claims(map[string]interface{}{"aud": "docktrine-api"}))
+	if _, err := provider.VerifyAccessToken(accessToken); err != nil {
+		t.Errorf("VerifyAccessToken: %v", err)
+	}
+}
+
+func TestVerifyKeyRotation(t *testing.T) {
+	issuer := newMockIssuer(t)
+	oldKey, newKey := rsaKey(t), rsaKey(t)
+	issuer.setKeys(map[string]crypto.Signer{"old": oldKey})
+	provider := newTestProvider(t, issuer)
+
+	oldToken := issuer.sign("old", issuer.claims(nil))
+	if _, err := provider.Verify(oldToken, "docktrine"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.Verify(oldToken, "docktrine"); err != nil {
+		t.Fatal(err)
+	}
+	if got := issuer.fetches(); got != 1 {
+		t.Fatalf("JWKS fetched %d times, want the keys cached after the first", got)
+	}
+
+	issuer.setKeys(map[string]crypto.Signer{"new": newKey})
+	newToken := issuer.sign("new", issuer.claims(nil))
+
+	// An unknown key ID right after a fetch does not hit the provider again,
+	// so tokens with made-up key IDs cannot hammer it.
+	if _, err := provider.Verify(newToken, "docktrine"); err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+		t.Fatalf("err = %v, want unknown signing key", err)
+	}
+	if got := issuer.fetches(); got != 1 {
+		t.Fatalf("JWKS fetched %d times within the refresh interval, want 1", got)
+	}
+
+	// Once the interval has passed, the unknown key ID refreshes the set:
+	// the new key is picked up and the retired one is dropped.
+	provider.keys.mu.Lock()
+	provider.keys.lastFetched = time.Now().Add(-jwksRefreshInterval)
+	provider.keys.mu.Unlock()
+
+	if _, err := provider.Verify(newToken, "docktrine"); err != nil {
+		t.Fatalf("token signed with the rotated key: %v", err)
+	}
+	if got := issuer.fetches(); got != 2 {
+		t.Fatalf("JWKS fetched %d times, want 2", got)
+	}
+	if _, err := provider.Verify(oldToken, "docktrine"); err == nil {
+		t.Error("token signed with the retired key still verifies")
+	}
+}
+
+func TestVerifyWithoutKeyID(t *testing.T) {
+	issuer := newMockIssuer(t)
+	key := rsaKey(t)
+	issuer.setKeys(map[string]crypto.Signer{"only": key})
+	provider := newTestProvider(t, issuer)
+
+	if _, err := provider.Verify(signToken(t, "", key, issuer.claims(nil)), "docktrine"); err != nil {
+		t.Fatalf("token without kid against a single key: %v", err)
+	}
+
+	issuer.setKeys(map[string]crypto.Signer{"only": key, "other": rsaKey(t)})
+	provider = newTestProvider(t, issuer)
+	if _, err := provider.Verify(signToken(t, "", key, issuer.claims(nil)), "docktrine"); err == nil {
+		t.Error("token without kid accepted although the key is ambiguous")
+	}
+}
+
+func TestAuthCodeFlowPKCE(t *testing.T) {
+	issuer := newMockIssuer(t)
+	issuer.setKeys(map[string]crypto.Signer{"rsa-1": rsaKey(t)})
+	provider := newTestProvider(t, issuer)
+
+	state, verifier := RandomString(), RandomString()
+	if state == verifier {
+		t.Fatal("RandomString returned the same value twice")
+	}
+
+	authURL := provider.AuthCodeURL(state, verifier)
+	if !strings.HasPrefix(authURL, issuer.URL+"/authorize?") {
+		t.Fatalf("AuthCodeURL = %q", authURL)
+	}
+	u, _ := url.Parse(authURL)
+	for param, want := range map[string]string{
+		"response_type": "code",
+		"client_id":     "docktrine",
+		"state":         state,
+		"redirect_uri":  "http://localhost:3000/v1/auth/oidc/callback",
+	} {
+		if got := u.Query().Get(param); got != want {
+			t.Errorf("%s = %q, want %q", param, got, want)
+		}
+	}
+	if strings.Contains(authURL, verifier) {
+		t.Error("the authorization URL reveals the PKCE verifier")
+	}
+
+	t.Run("wrong verifier", func(t *testing.T) {
+		code := issuer.authorize(authURL)
+		_, err := provider.Exchange(context.Background(), code, RandomString())
+		if err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+			t.Fatalf("err = %v, want invalid_grant", err)
+		}
+	})
+
+	t.Run("matching verifier", func(t *testing.T) {
+		code := issuer.authorize(authURL)
+		tokens, err := provider.Exchange(context.Background(), code, verifier)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := provider.VerifyIDToken(tokens.IDToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.Subject != "user-1" {
+			t.Errorf("subject = %q", claims.Subject)
+		}
+	})
+}
@@ -0,0 +1,240 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Device flow errors returned by the provider while the user has not yet
+// finished signing in. Callers keep polling on these.
+var (
+	ErrAuthorizationPending = errors.New("authorization_pending")
+	ErrSlowDown             = errors.New("slow_down")
+)
+
+type Discovery struct {
+	Issuer                      string `json:"issuer"`
+	AuthorizationEndpoint       string `json:"authorization_endpoint"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	JWKSURI                     string `json:"jwks_uri"`
+}
+
+type Provider struct {
+	config    Config
+	discovery Discovery
+	client    *http.Client
+	keys      *keySet
+}
+
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type tokenError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// NewProvider fetches the issuer's discovery document. The issuer may be a
+// plain http:// URL so a local mock provider can stand in during testing.
+func NewProvider(ctx context.Context, config Config) (*Provider, error) {
+	if config.ClientID == "" {
+		return nil, errors.New("OIDC_CLIENT_ID is required")
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", config.Issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching OIDC discovery document: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching OIDC discovery document: HTTP %d", resp.StatusCode)
+	}
+
+	var discovery Discovery
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		return nil, fmt.Errorf("decoding OIDC discovery document: %w", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != config.Issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q, not %q", discovery.Issuer, config.Issuer)
+	}
+	if discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing token_endpoint or jwks_uri")
+	}
+
+	return &Provider{
+		config:    config,
+		discovery: discovery,
+		client:    client,
+		keys:      &keySet{url: discovery.JWKSURI, client: client},
+	}, nil
+}
+
+func (p *Provider) Config() *Config {
+	return &p.config
+}
+
+// SupportsDeviceFlow reports whether the provider advertises a device
+// authorization endpoint.
+func (p *Provider) SupportsDeviceFlow() bool {
+	return p.discovery.DeviceAuthorizationEndpoint != ""
+}
+
+// AuthCodeURL builds the provider login URL for the browser flow, using
+// PKCE with the S256 method.
+func (p *Provider) AuthCodeURL(state, verifier string) string {
+	challenge := sha256.Sum256([]byte(verifier))
+
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(p.discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.discovery.AuthorizationEndpoint + separator + params.Encode()
+}
+
+// Exchange trades an authorization code for tokens.
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (*TokenResponse, error) {
+	return p.token(ctx, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {verifier},
+	})
+}
+
+// AuthorizeDevice starts a device authorization grant.
+func (p *Provider) AuthorizeDevice(ctx context.Context) (*DeviceAuthorization, error) {
+	if !p.SupportsDeviceFlow() {
+		return nil, errors.New("OIDC provider does not support the device flow")
+	}
+
+	var device DeviceAuthorization
+	if err := p.post(ctx, p.discovery.DeviceAuthorizationEndpoint, url.Values{
+		"scope": {strings.Join(p.config.Scopes, " ")},
+	}, &device); err != nil {
+		return nil, err
+	}
+	if device.Interval == 0 {
+		device.Interval = 5
+	}
+	return &device, nil
+}
+
+// PollDevice checks whether the user has finished a device authorization.
+// It returns ErrAuthorizationPending or ErrSlowDown while they have not.
+func (p *Provider) PollDevice(ctx context.Context, deviceCode string) (*TokenResponse, error) {
+	return p.token(ctx, url.Values{
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		"device_code": {deviceCode},
+	})
+}
+
+// VerifyIDToken validates an ID token issued to this client.
+func (p *Provider) VerifyIDToken(raw string) (*Claims, error) {
+	return p.Verify(raw, p.config.ClientID)
+}
+
+// VerifyAccessToken validates a JWT access token presented as a bearer
+// token to the API.
+func (p *Provider) VerifyAccessToken(raw string) (*Claims, error) {
+	return p.Verify(raw, p.config.Audience)
+}
+
+func (p *Provider) token(ctx context.Context, form url.Values) (*TokenResponse, error) {
+	var tokens TokenResponse
+	if err := p.post(ctx, p.discovery.TokenEndpoint, form, &tokens); err != nil {
+		return nil, err
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token response has no id_token")
+	}
+	return &tokens, nil
+}
+
+func (p *Provider) post(ctx context.Context, endpoint string, form url.Values, out interface{}) error {
+	form.Set("client_id", p.config.ClientID)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var tokenErr tokenError
+		if err := json.NewDecoder(resp.Body).Decode(&tokenErr); err != nil || tokenErr.Error == "" {
+			return fmt.Errorf("OIDC provider returned HTTP %d", resp.StatusCode)
+		}
+		switch tokenErr.Error {
+		case ErrAuthorizationPending.Error():
+			return ErrAuthorizationPending
+		case ErrSlowDown.Error():
+			return ErrSlowDown
+		}
+		if tokenErr.Description != "" {
+			return fmt.Errorf("%s: %s", tokenErr.Error, tokenErr.Description)
+		}
+		return errors.New(tokenErr.Error)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// RandomString returns a URL-safe random string for use as a PKCE verifier
+// or state parameter.
+func RandomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,153 @@
+// Package ratelimit provides keyed token buckets and per-key concurrency
+// slots used to protect Docker daemons from runaway clients.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// idleBucketTTL is how long a full bucket is kept after its last use.
+const idleBucketTTL = 10 * time.Minute
+
+// Rate allows Count requests per Per, with bursts of up to Count.
+type Rate struct {
+	Count int
+	Per   time.Duration
+}
+
+// ParseRate parses "<count>/<duration>", e.g. "300/1m" or "5/1s". "0" or an
+// empty string disables the limit.
+func ParseRate(value string) (Rate, error) {
+	if value == "" || value == "0" {
+		return Rate{}, nil
+	}
+
+	count, per, ok := strings.Cut(value, "/")
+	if !ok {
+		return Rate{}, fmt.Errorf("invalid rate %q, expected <count>/<duration>", value)
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return Rate{}, fmt.Errorf("invalid rate count %q", count)
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return Rate{}, fmt.Errorf("invalid rate duration %q", per)
+	}
+	return Rate{Count: n, Per: d}, nil
+}
+
+func (r Rate) Enabled() bool {
+	return r.Count > 0
+}
+
+func (r Rate) String() string {
+	if !r.Enabled() {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d/%s", r.Count, r.Per)
+}
+
+type bucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// Limiter keeps one token bucket per key.
+type Limiter struct {
+	rate Rate
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+
+	allowed  atomic.Int64
+	rejected atomic.Int64
+}
+
+type LimiterStats struct {
+	Rate     string `json:"rate"`
+	Allowed  int64  `json:"allowed"`
+	Rejected int64  `json:"rejected"`
+	Clients  int    `json:"clients"`
+}
+
+func NewLimiter(rate Rate) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+func (l *Limiter) Rate() Rate {
+	return l.rate
+}
+
+// Allow takes a token from key's bucket. It returns the tokens left, and
+// when the request is refused, how long until a token is available.
+func (l *Limiter) Allow(key string) (ok bool, remaining int, retryAfter time.Duration) {
+	if !l.rate.Enabled() {
+		l.allowed.Add(1)
+		return true, 0, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	perToken := l.rate.Per / time.Duration(l.rate.Count)
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: float64(l.rate.Count), lastSeen: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(l.rate.Count), b.tokens+float64(now.Sub(b.lastSeen))/float64(perToken))
+	b.lastSeen = now
+
+	if b.tokens < 1 {
+		l.rejected.Add(1)
+		wait := time.Duration((1 - b.tokens) * float64(perToken))
+		return false, 0, wait
+	}
+
+	b.tokens--
+	l.allowed.Add(1)
+	return true, int(b.tokens), 0
+}
+
+// prune drops buckets that have refilled completely, at most once a minute.
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+
+	for key, b := range l.buckets {
+		if now.Sub(b.lastSeen) > idleBucketTTL && now.Sub(b.lastSeen) > l.rate.Per {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *Limiter) Stats() LimiterStats {
+	l.mu.Lock()
+	clients := len(l.buckets)
+	l.mu.Unlock()
+
+	return LimiterStats{
+		Rate:     l.rate.String(),
+		Allowed:  l.allowed.Load(),
+		Rejected: l.rejected.Load(),
+		Clients:  clients,
+	}
+}
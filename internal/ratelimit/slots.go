@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Slots caps how many operations may run at once for each key.
+type Slots struct {
+	max int
+
+	mu       sync.Mutex
+	inFlight map[string]int
+
+	rejected atomic.Int64
+}
+
+type SlotsStats struct {
+	MaxPerKey int            `json:"max_per_server"`
+	InFlight  map[string]int `json:"in_flight"`
+	Rejected  int64          `json:"rejected"`
+}
+
+// NewSlots allows max operations per key; zero means unlimited.
+func NewSlots(max int) *Slots {
+	return &Slots{
+		max:      max,
+		inFlight: make(map[string]int),
+	}
+}
+
+// Acquire takes a slot for every key, or none of them if any key is at its
+// limit.
+func (s *Slots) Acquire(keys []string) bool {
+	if !s.TryAcquire(keys) {
+		s.rejected.Add(1)
+		return false
+	}
+	return true
+}
+
+// TryAcquire is Acquire for callers that wait and try again, such as the
+// job runner: being turned away is not counted as a rejection.
+func (s *Slots) TryAcquire(keys []string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.max > 0 {
+		for _, key := range keys {
+			if s.inFlight[key] >= s.max {
+				return false
+			}
+		}
+	}
+
+	for _, key := range keys {
+		s.inFlight[key]++
+	}
+	return true
+}
+
+func (s *Slots) Release(keys []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		s.inFlight[key]--
+		if s.inFlight[key] <= 0 {
+			delete(s.inFlight, key)
+		}
+	}
+}
+
+func (s *Slots) Stats() SlotsStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	inFlight := make(map[string]int, len(s.inFlight))
+	for key, n := range s.inFlight {
+		inFlight[key] = n
+	}
+	return SlotsStats{
+		MaxPerKey: s.max,
+		InFlight:  inFlight,
+		Rejected:  s.rejected.Load(),
+	}
+}
@@ -0,0 +1,300 @@
+// Package registry understands the "image pushed" webhooks container
+// registries send: Docker Hub, GitHub Packages (ghcr.io), Harbor, and a
+// generic format for everything else, e.g. a CI job announcing its push.
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/distribution/reference"
+)
+
+// Payload sources.
+const (
+	SourceDockerHub = "dockerhub"
+	SourceGitHub    = "github"
+	SourceHarbor    = "harbor"
+	SourceGeneric   = "generic"
+)
+
+// AnyTag as a hook's tag matches pushes of every tag.
+const AnyTag = "*"
+
+var tagPattern = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+
+// ErrUnrecognized is returned for payloads in none of the known formats.
+var ErrUnrecognized = errors.New("unrecognized payload: expected a Docker Hub, GitHub package, Harbor or generic push event")
+
+// Push is an image pushed to a registry.
+type Push struct {
+	Source string
+	// Repository is the normalized repository name, e.g.
+	// docker.io/library/nginx or ghcr.io/myorg/api.
+	Repository string
+	Tag        string
+	// Digest is the manifest digest, if the registry sent it.
+	Digest string
+	// Pusher is the account that pushed, if the registry sent it.
+	Pusher string
+}
+
+// Image is the pushed reference, e.g. ghcr.io/myorg/api:latest.
+func (p Push) Image() string {
+	return p.Repository + ":" + p.Tag
+}
+
+// NormalizeRepository returns the full name of repository, e.g.
+// docker.io/library/nginx for nginx. Tags and digests are not allowed.
+func NormalizeRepository(repository string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(repository)
+	if err != nil {
+		return "", fmt.Errorf("invalid repository %q: %w", repository, err)
+	}
+	if !reference.IsNameOnly(named) {
+		return "", fmt.Errorf("repository %q must not have a tag or digest", repository)
+	}
+	return named.Name(), nil
+}
+
+// ValidateTag checks that tag is a valid image tag or AnyTag.
+func ValidateTag(tag string) error {
+	if tag != AnyTag && !tagPattern.MatchString(tag) {
+		return fmt.Errorf("invalid tag %q", tag)
+	}
+	return nil
+}
+
+// Matches reports whether push is of the repository and tag a hook
+// watches.
+func Matches(repository, tag string, push Push) bool {
+	name, err := NormalizeRepository(repository)
+	if err != nil || name != push.Repository {
+		return false
+	}
+	return tag == AnyTag || tag == push.Tag
+}
+
+// Parse reads the pushes from a registry webhook request. header returns
+// the value of a request header. Events that are not pushes, such as
+// GitHub's ping, give no pushes and no error.
+func Parse(header func(string) string, body []byte) ([]Push, error) {
+	if event := header("X-GitHub-Event"); event != "" {
+		return parseGitHub(event, body)
+	}
+
+	var probe struct {
+		Type       string          `json:"type"`
+		PushData   json.RawMessage `json:"push_data"`
+		Repository json.RawMessage `json:"repository"`
+		Image      string          `json:"image"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	switch {
+	case probe.Type != "":
+		return parseHarbor(probe.Type, body)
+	case probe.PushData != nil:
+		return parseDockerHub(body)
+	case probe.Image != "" || len(probe.Repository) > 0 && probe.Repository[0] == '"':
+		return parseGeneric(body)
+	}
+	return nil, ErrUnrecognized
+}
+
+// push builds a Push, normalizing repository, which may carry a tag or
+// digest, e.g. harbor.example.com/library/nginx:latest.
+func push(source, repository, tag, digest, pusher string) (Push, error) {
+	named, err := reference.ParseNormalizedNamed(repository)
+	if err != nil {
+		return Push{}, fmt.Errorf("invalid repository %q: %w", repository, err)
+	}
+	if tag == "" {
+		if tagged, ok := named.(reference.Tagged); ok {
+			tag = tagged.Tag()
+		}
+	}
+	if digest == "" {
+		if digested, ok := named.(reference.Digested); ok {
+			digest = digested.Digest().String()
+		}
+	}
+	if tag == "" {
+		return Push{}, fmt.Errorf("no tag for %s", repository)
+	}
+	return Push{
+		Source:     source,
+		Repository: named.Name(),
+		Tag:        tag,
+		Digest:     digest,
+		Pusher:     pusher,
+	}, nil
+}
+
+// parseDockerHub reads a Docker Hub repository webhook. Docker Hub sends no
+// digest.
+func parseDockerHub(body []byte) ([]Push, error) {
+	var payload struct {
+		PushData struct {
+			Tag    string `json:"tag"`
+			Pusher string `json:"pusher"`
+		} `json:"push_data"`
+		Repository struct {
+			RepoName string `json:"repo_name"`
+		} `json:"repository"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid Docker Hub payload: %w", err)
+	}
+	if payload.Repository.RepoName == "" {
+		return nil, errors.New("invalid Docker Hub payload: no repository.repo_name")
+	}
+
+	p, err := push(SourceDockerHub, payload.Repository.RepoName, payload.PushData.Tag, "", payload.PushData.Pusher)
+	if err != nil {
+		return nil, err
+	}
+	return []Push{p}, nil
+}
+
+type githubPackage struct {
+	Name        string `json:"name"`
+	PackageType string `json:"package_type"`
+	Owner       struct {
+		Login string `json:"login"`
+	} `json:"owner"`
+	PackageVersion struct {
+		PackageURL        string `json:"package_url"`
+		ContainerMetadata struct {
+			Tag struct {
+				Name   string `json:"name"`
+				Digest string `json:"digest"`
+			} `json:"tag"`
+		} `json:"container_metadata"`
+	} `json:"package_version"`
+}
+
+// parseGitHub reads the package and registry_package events of a GitHub
+// repository or organization webhook. Only published container versions
+// with a tag are pushes.
+func parseGitHub(event string, body []byte) ([]Push, error) {
+	if event != "package" && event != "registry_package" {
+		return nil, nil
+	}
+
+	var payload struct {
+		Action          string         `json:"action"`
+		Package         *githubPackage `json:"package"`
+		RegistryPackage *githubPackage `json:"registry_package"`
+		Sender          struct {
+			Login string `json:"login"`
+		} `json:"sender"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid GitHub payload: %w", err)
+	}
+	pkg := payload.Package
+	if pkg == nil {
+		pkg = payload.RegistryPackage
+	}
+	if payload.Action != "published" || pkg == nil || !strings.EqualFold(pkg.PackageType, "container") {
+		return nil, nil
+	}
+	tag := pkg.PackageVersion.ContainerMetadata.Tag
+	if tag.Name == "" {
+		// An untagged manifest, e.g. one platform of a multi-arch image.
+		return nil, nil
+	}
+
+	repository := pkg.PackageVersion.PackageURL
+	if repository == "" {
+		repository = fmt.Sprintf("ghcr.io/%s/%s", strings.ToLower(pkg.Owner.Login), pkg.Name)
+	}
+	p, err := push(SourceGitHub, repository, tag.Name, tag.Digest, payload.Sender.Login)
+	if err != nil {
+		return nil, err
+	}
+	return []Push{p}, nil
+}
+
+// parseHarbor reads a Harbor webhook: PUSH_ARTIFACT events of Harbor 2 and
+// pushImage events of Harbor 1.
+func parseHarbor(eventType string, body []byte) ([]Push, error) {
+	if eventType != "PUSH_ARTIFACT" && eventType != "pushImage" {
+		return nil, nil
+	}
+
+	var payload struct {
+		Operator  string `json:"operator"`
+		EventData struct {
+			Resources []struct {
+				Digest      string `json:"digest"`
+				Tag         string `json:"tag"`
+				ResourceURL string `json:"resource_url"`
+			} `json:"resources"`
+			Repository struct {
+				RepoFullName string `json:"repo_full_name"`
+			} `json:"repository"`
+		} `json:"event_data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid Harbor payload: %w", err)
+	}
+
+	var pushes []Push
+	for _, resource := range payload.EventData.Resources {
+		if resource.Tag == "" {
+			continue
+		}
+		// The resource URL includes the registry host; the repository name
+		// does not.
+		repository := resource.ResourceURL
+		if repository == "" {
+			repository = payload.EventData.Repository.RepoFullName
+		}
+		p, err := push(SourceHarbor, repository, resource.Tag, resource.Digest, payload.Operator)
+		if err != nil {
+			return nil, err
+		}
+		pushes = append(pushes, p)
+	}
+	return pushes, nil
+}
+
+// parseGeneric reads {"repository": "myorg/api", "tag": "v2", "digest":
+// "sha256:..."} or {"image": "myorg/api:v2"}. The tag defaults to latest.
+func parseGeneric(body []byte) ([]Push, error) {
+	var payload struct {
+		Repository string `json:"repository"`
+		Image      string `json:"image"`
+		Tag        string `json:"tag"`
+		Digest     string `json:"digest"`
+		Pusher     string `json:"pusher"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, fmt.Errorf("invalid payload: %w", err)
+	}
+
+	repository := payload.Repository
+	if repository == "" {
+		repository = payload.Image
+	}
+	named, err := reference.ParseNormalizedNamed(repository)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository %q: %w", repository, err)
+	}
+	tag := payload.Tag
+	if _, ok := named.(reference.Tagged); !ok && tag == "" {
+		tag = "latest"
+	}
+
+	p, err := push(SourceGeneric, repository, tag, payload.Digest, payload.Pusher)
+	if err != nil {
+		return nil, err
+	}
+	return []Push{p}, nil
+}
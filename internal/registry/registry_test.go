@@ -0,0 +1,254 @@
+package registry
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const (
+	ghcrDigest   = "sha256:3b1f8c3d9d54f3ec1d5f0a0e2c2a4c7e2b6f9d7e1a5c3b8f0e4d2c6a9b7e1f30"
+	nginxDigest  = "sha256:954b378c375d852eb3c63ab88978f640b4348b01c1b3456a024a81536dafbbf4"
+	harborDigest = "sha256:0a9d1b8e2c3f4a5b6c7d8e9f0a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d6e7f8a9b"
+)
+
+// fixture reads a sample payload from testdata.
+func fixture(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func headers(values map[string]string) func(string) string {
+	return func(name string) string { return values[name] }
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		fixture string
+		body    string
+		want    []Push
+	}{
+		{
+			name:    "Docker Hub",
+			fixture: "dockerhub_push.json",
+			want: []Push{{
+				Source:     SourceDockerHub,
+				Repository: "docker.io/svendowideit/testhook",
+				Tag:        "latest",
+				Pusher:     "trustedbuilder",
+			}},
+		},
+		{
+			name:    "Docker Hub official image",
+			fixture: "dockerhub_official.json",
+			want: []Push{{
+				Source:     SourceDockerHub,
+				Repository: "docker.io/library/nginx",
+				Tag:        "1.25-alpine",
+				Pusher:     "doijanky",
+			}},
+		},
+		{
+			name:    "GitHub package event",
+			headers: map[string]string{"X-GitHub-Event": "package"},
+			fixture: "github_package.json",
+			want: []Push{{
+				Source:     SourceGitHub,
+				Repository: "ghcr.io/myorg/api",
+				Tag:        "v1.2.0",
+				Digest:     ghcrDigest,
+				Pusher:     "octocat",
+			}},
+		},
+		{
+			// Without a package URL the repository is built from the owner,
+			// lowercased as ghcr.io requires.
+			name:    "GitHub registry_package event",
+			headers: map[string]string{"X-GitHub-Event": "registry_package"},
+			fixture: "github_registry_package.json",
+			want: []Push{{
+				Source:     SourceGitHub,
+				Repository: "ghcr.io/myorg/api",
+				Tag:        "main",
+				Digest:     ghcrDigest,
+				Pusher:     "octocat",
+			}},
+		},
+		{
+			name:    "GitHub untagged manifest",
+			headers: map[string]string{"X-GitHub-Event": "package"},
+			fixture: "github_untagged.json",
+		},
+		{
+			name:    "GitHub updated package",
+			headers: map[string]string{"X-GitHub-Event": "package"},
+			fixture: "github_updated.json",
+		},
+		{
+			name:    "GitHub npm package",
+			headers: map[string]string{"X-GitHub-Event": "package"},
+			fixture: "github_npm.json",
+		},
+		{
+			name:    "GitHub ping",
+			headers: map[string]string{"X-GitHub-Event": "ping"},
+			fixture: "github_ping.json",
+		},
+		{
+			name:    "GitHub push event",
+			headers: map[string]string{"X-GitHub-Event": "push"},
+			body:    `{"ref": "refs/heads/main"}`,
+		},
+		{
+			name:    "Harbor PUSH_ARTIFACT",
+			fixture: "harbor_push_artifact.json",
+			want: []Push{{
+				Source:     SourceHarbor,
+				Repository: "harbor.example.com/library/nginx",
+				Tag:        "latest",
+				Digest:     nginxDigest,
+				Pusher:     "admin",
+			}},
+		},
+		{
+			// Untagged resources are skipped.
+			name:    "Harbor pushImage",
+			fixture: "harbor_push_image.json",
+			want: []Push{{
+				Source:     SourceHarbor,
+				Repository: "harbor.example.com/myproject/api",
+				Tag:        "v1.0",
+				Digest:     harborDigest,
+				Pusher:     "robot$ci",
+			}},
+		},
+		{
+			name:    "Harbor DELETE_ARTIFACT",
+			fixture: "harbor_delete_artifact.json",
+		},
+		{
+			name: "generic repository and tag",
+			body: `{"repository": "myorg/api", "tag": "v2", "digest": "` + ghcrDigest + `", "pusher": "ci"}`,
+			want: []Push{{
+				Source:     SourceGeneric,
+				Repository: "docker.io/myorg/api",
+				Tag:        "v2",
+				Digest:     ghcrDigest,
+				Pusher:     "ci",
+			}},
+		},
+		{
+			name: "generic short name",
+			body: `{"repository": "nginx"}`,
+			want: []Push{{Source: SourceGeneric, Repository: "docker.io/library/nginx", Tag: "latest"}},
+		},
+		{
+			name: "generic image reference",
+			body: `{"image": "ghcr.io/myorg/api:main"}`,
+			want: []Push{{Source: SourceGeneric, Repository: "ghcr.io/myorg/api", Tag: "main"}},
+		},
+		{
+			name: "generic image by digest",
+			body: `{"image": "myorg/api@` + nginxDigest + `"}`,
+			want: []Push{{Source: SourceGeneric, Repository: "docker.io/myorg/api", Tag: "latest", Digest: nginxDigest}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := []byte(tt.body)
+			if tt.fixture != "" {
+				body = fixture(t, tt.fixture)
+			}
+			got, err := Parse(headers(tt.headers), body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pushes = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		body    string
+	}{
+		{"invalid JSON", nil, `{"repository":`},
+		{"unrecognized", nil, `{"event": "push", "data": {}}`},
+		{"Docker Hub without repository", nil, `{"push_data": {"tag": "latest"}, "repository": {}}`},
+		{"generic invalid repository", nil, `{"repository": "myorg/API"}`},
+		{"GitHub invalid JSON", map[string]string{"X-GitHub-Event": "package"}, `[`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if pushes, err := Parse(headers(tt.headers), []byte(tt.body)); err == nil {
+				t.Errorf("Parse = %+v, want an error", pushes)
+			}
+		})
+	}
+
+	if _, err := Parse(headers(nil), []byte(`{"event": "push"}`)); !errors.Is(err, ErrUnrecognized) {
+		t.Errorf("unrecognized payload: err = %v, want ErrUnrecognized", err)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	nginx := Push{Repository: "docker.io/library/nginx", Tag: "latest"}
+	ghcr := Push{Repository: "ghcr.io/myorg/api", Tag: "main"}
+
+	tests := []struct {
+		repository string
+		tag        string
+		push       Push
+		want       bool
+	}{
+		{"nginx", "latest", nginx, true},
+		{"library/nginx", "latest", nginx, true},
+		{"docker.io/library/nginx", "latest", nginx, true},
+		{"nginx", AnyTag, Push{Repository: "docker.io/library/nginx", Tag: "1.25"}, true},
+		{"nginx", "latest", Push{Repository: "docker.io/library/nginx", Tag: "1.25"}, false},
+		{"nginx", "latest", Push{Repository: "docker.io/myorg/nginx", Tag: "latest"}, false},
+		{"ghcr.io/myorg/api", "main", ghcr, true},
+		{"ghcr.io/myorg/api", AnyTag, ghcr, true},
+		{"myorg/api", AnyTag, ghcr, false},
+		{"Not A Repository", AnyTag, nginx, false},
+	}
+	for _, tt := range tests {
+		if got := Matches(tt.repository, tt.tag, tt.push); got != tt.want {
+			t.Errorf("Matches(%q, %q, %s) = %v, want %v", tt.repository, tt.tag, tt.push.Image(), got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeRepository(t *testing.T) {
+	for repository, want := range map[string]string{
+		"nginx":                       "docker.io/library/nginx",
+		"myorg/api":                   "docker.io/myorg/api",
+		"ghcr.io/myorg/api":           "ghcr.io/myorg/api",
+		"harbor.example.com:8443/x/y": "harbor.example.com:8443/x/y",
+	} {
+		if got, err := NormalizeRepository(repository); err != nil || got != want {
+			t.Errorf("NormalizeRepository(%q) = %q, %v, want %q", repository, got, err, want)
+		}
+	}
+	for _, repository := range []string{"nginx:latest", "nginx@" + nginxDigest, "myorg/API", ""} {
+		if got, err := NormalizeRepository(repository); err == nil {
+			t.Errorf("NormalizeRepository(%q) = %q, want an error", repository, got)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package signing
+
+import (
+	"sync"
+	"time"
+)
+
+// NonceCache remembers nonces for the length of the replay window so each
+// signed request is accepted once.
+type NonceCache struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+func NewNonceCache(window time.Duration) *NonceCache {
+	return &NonceCache{
+		window: window,
+		nonces: make(map[string]time.Time),
+	}
+}
+
+// Use records nonce and reports whether it had not been seen within the
+// window.
+func (n *NonceCache) Use(nonce string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	for seen, expires := range n.nonces {
+		if now.After(expires) {
+			delete(n.nonces, seen)
+		}
+	}
+
+	if _, ok := n.nonces[nonce]; ok {
+		return false
+	}
+	// A timestamp may be up to one window in the future, so a nonce must be
+	// kept for two windows to cover its whole validity.
+	n.nonces[nonce] = now.Add(2 * n.window)
+	return true
+}
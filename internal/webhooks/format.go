@@ -0,0 +1,168 @@
+package webhooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/notify"
+)
+
+// Payload formats.
+const (
+	FormatJSON       = "json"
+	FormatSlack      = "slack"
+	FormatMattermost = "mattermost"
+	FormatDiscord    = "discord"
+)
+
+var Formats = []string{FormatJSON, FormatSlack, FormatMattermost, FormatDiscord}
+
+// defaultTemplate is the message text of chat formats without a template for
+// the event.
+const defaultTemplate = "{{.Message}}"
+
+// ParseTemplate checks a message template. Templates are Go text/template
+// strings over the notification: {{.Title}}, {{.Message}}, {{.Server}},
+// {{.Container}}, {{.Severity}}, {{.Event}}, {{.Time}} and the event's
+// {{.Data}}, e.g. {{.Data.By}} and {{.Data.Digest}} of restarts.
+func ParseTemplate(text string) (*template.Template, error) {
+	return template.New("message").Funcs(notify.TemplateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// Render builds the body POSTed to webhook for n.
+func Render(webhook *database.Webhook, n notify.Notification) ([]byte, error) {
+	if webhook.Format == FormatJSON || webhook.Format == "" {
+		return json.Marshal(n)
+	}
+
+	text, err := renderText(webhook, n)
+	if err != nil {
+		return nil, err
+	}
+
+	switch webhook.Format {
+	case FormatSlack:
+		return json.Marshal(slackPayload(n, text))
+	case FormatMattermost:
+		return json.Marshal(mattermostPayload(n, text))
+	case FormatDiscord:
+		return json.Marshal(discordPayload(n, text))
+	}
+	return nil, fmt.Errorf("unknown webhook format %s", webhook.Format)
+}
+
+// renderText renders the webhook's template for the event, falling back to
+// its * template and then to the notification's message.
+func renderText(webhook *database.Webhook, n notify.Notification) (string, error) {
+	text, ok := webhook.Templates[n.Event]
+	if !ok {
+		text, ok = webhook.Templates["*"]
+	}
+	if !ok {
+		text = defaultTemplate
+	}
+
+	tmpl, err := ParseTemplate(text)
+	if err != nil {
+		return "", fmt.Errorf("template for %s: %w", n.Event, err)
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, n); err != nil {
+		return "", fmt.Errorf("template for %s: %w", n.Event, err)
+	}
+	return b.String(), nil
+}
+
+func severityEmoji(severity string) string {
+	switch severity {
+	case notify.SeverityCritical:
+		return ":red_circle:"
+	case notify.SeverityWarning:
+		return ":warning:"
+	}
+	return ":information_source:"
+}
+
+// severityColor is the sidebar color of Mattermost attachments and Discord
+// embeds.
+func severityColor(severity string) int {
+	switch severity {
+	case notify.SeverityCritical:
+		return 0xd93f0b
+	case notify.SeverityWarning:
+		return 0xfbca04
+	}
+	return 0x2eb886
+}
+
+// contextLine is the line under the message naming the event and where it
+// happened.
+func contextLine(n notify.Notification) string {
+	parts := []string{n.Event}
+	if n.Server != "" {
+		parts = append(parts, "server "+n.Server)
+	}
+	if n.Container != "" {
+		parts = append(parts, "container "+n.Container)
+	}
+	return strings.Join(parts, " · ")
+}
+
+// slackPayload renders a Slack Block Kit message.
+func slackPayload(n notify.Notification, text string) map[string]interface{} {
+	return map[string]interface{}{
+		"text": text,
+		"blocks": []map[string]interface{}{
+			{
+				"type": "section",
+				"text": map[string]string{
+					"type": "mrkdwn",
+					"text": fmt.Sprintf("%s %s", severityEmoji(n.Severity), text),
+				},
+			},
+			{
+				"type": "context",
+				"elements": []map[string]string{
+					{"type": "mrkdwn", "text": fmt.Sprintf("%s · <!date^%d^{date_short_pretty} {time_secs}|%s>", contextLine(n), n.Time.Unix(), n.Time.Format(time.RFC3339))},
+				},
+			},
+		},
+	}
+}
+
+// mattermostPayload renders a Mattermost message attachment.
+func mattermostPayload(n notify.Notification, text string) map[string]interface{} {
+	return map[string]interface{}{
+		"username": "Docktrine",
+		"attachments": []map[string]interface{}{
+			{
+				"fallback": text,
+				"color":    fmt.Sprintf("#%06x", severityColor(n.Severity)),
+				"text":     text,
+				"footer":   contextLine(n),
+				"ts":       n.Time.Unix(),
+			},
+		},
+	}
+}
+
+// discordPayload renders a Discord embed.
+func discordPayload(n notify.Notification, text string) map[string]interface{} {
+	return map[string]interface{}{
+		"username": "Docktrine",
+		"embeds": []map[string]interface{}{
+			{
+				"title":       n.Title,
+				"description": text,
+				"color":       severityColor(n.Severity),
+				"footer":      map[string]string{"text": contextLine(n)},
+				"timestamp":   n.Time.Format(time.RFC3339),
+			},
+		},
+	}
+}
@@ -0,0 +1,297 @@
+// Package webhooks delivers notifications to registered HTTP endpoints.
+//
+// Each notification a webhook subscribes to is written to an outbox table
+// and POSTed as JSON from there, so deliveries survive restarts. Chat
+// webhooks (Slack, Mattermost, Discord) get it rendered as a message in the
+// service's format. Failed attempts are retried with exponential backoff.
+// Every request is signed:
+//
+//	X-Docktrine-Signature: t=<unix time>,v1=<hex HMAC-SHA256 of "<t>.<body>">
+//
+// keyed with the webhook's secret, so receivers can check that the payload
+// came from Docktrine and reject old replays.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/logger"
+	"github.com/Zeptile/docktrine/internal/notify"
+)
+
+const (
+	// MaxAttempts is how many times a delivery is tried before it is given
+	// up on.
+	MaxAttempts = 10
+
+	retryMin        = 30 * time.Second
+	retryMax        = time.Hour
+	requestTimeout  = 10 * time.Second
+	pollInterval    = 5 * time.Second
+	pruneInterval   = time.Hour
+	deliveryBatch   = 100
+	maxErrorSnippet = 200
+)
+
+// EventPing is the event of the test deliveries sent on request.
+const EventPing = "ping"
+
+// Sign returns the signature header value for body sent at t.
+func Sign(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%s,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// Notifier queues notifications for the webhooks that subscribe to them and
+// delivers the outbox in the background.
+type Notifier struct {
+	db     *database.DB
+	client *http.Client
+	wake   chan struct{}
+	// Retention is how long finished deliveries are kept; zero keeps them
+	// forever.
+	Retention time.Duration
+}
+
+func NewNotifier(db *database.DB, retention time.Duration) *Notifier {
+	return &Notifier{
+		db:        db,
+		client:    &http.Client{Timeout: requestTimeout},
+		wake:      make(chan struct{}, 1),
+		Retention: retention,
+	}
+}
+
+func (n *Notifier) Name() string {
+	return "webhooks"
+}
+
+// Notify adds a delivery of notification to the outbox of every enabled
+// webhook subscribed to its event and severity, rendered in the webhook's
+// format. A webhook whose template fails to render is skipped and reported.
+func (n *Notifier) Notify(notification notify.Notification) error {
+	webhooks, err := n.db.ListWebhooks()
+	if err != nil {
+		return err
+	}
+
+	queued := false
+	var failed []string
+	for _, webhook := range webhooks {
+		if !webhook.Enabled || !webhook.Subscribes(notification.Event) || !notify.AtLeast(notification.Severity, webhook.MinSeverity) {
+			continue
+		}
+		payload, err := Render(&webhook, notification)
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", webhook.Name, err))
+			continue
+		}
+		if _, err := n.db.QueueWebhookDelivery(webhook.ID, notification.Event, payload); err != nil {
+			return err
+		}
+		queued = true
+	}
+	if queued {
+		n.Wake()
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("rendering failed for %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// Ping queues a test delivery to webhook, whatever its subscriptions.
+func (n *Notifier) Ping(webhook *database.Webhook) (*database.WebhookDelivery, error) {
+	payload, err := Render(webhook, notify.Notification{
+		Event:    EventPing,
+		Severity: notify.SeverityInfo,
+		Title:    "Test notification",
+		Message:  fmt.Sprintf("Webhook %s is set up", webhook.Name),
+		Time:     time.Now().UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	delivery, err := n.db.QueueWebhookDelivery(webhook.ID, EventPing, payload)
+	if err != nil {
+		return nil, err
+	}
+	n.Wake()
+	return delivery, nil
+}
+
+// Wake makes the sender look at the outbox now rather than on its next
+// poll.
+func (n *Notifier) Wake() {
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers the outbox until ctx is cancelled.
+func (n *Notifier) Run(ctx context.Context) {
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+	prune := time.NewTicker(pruneInterval)
+	defer prune.Stop()
+
+	n.prune()
+	for {
+		n.deliverDue(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.wake:
+		case <-poll.C:
+		case <-prune.C:
+			n.prune()
+		}
+	}
+}
+
+// deliverDue sends the due deliveries. Each webhook's deliveries go out in
+// order, and a slow endpoint does not hold up the others.
+func (n *Notifier) deliverDue(ctx context.Context) {
+	due, err := n.db.DueWebhookDeliveries(deliveryBatch)
+	if err != nil {
+		logger.Error(err, "Failed to read the webhook outbox")
+		return
+	}
+
+	byWebhook := map[int64][]database.WebhookDelivery{}
+	for _, delivery := range due {
+		byWebhook[delivery.WebhookID] = append(byWebhook[delivery.WebhookID], delivery)
+	}
+
+	var wg sync.WaitGroup
+	for webhookID, deliveries := range byWebhook {
+		webhook, err := n.db.GetWebhook(webhookID)
+		if err != nil {
+			logger.Error(err, fmt.Sprintf("Failed to get webhook %d", webhookID))
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, delivery := range deliveries {
+				if ctx.Err() != nil {
+					return
+				}
+				n.attempt(ctx, webhook, delivery)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (n *Notifier) attempt(ctx context.Context, webhook *database.Webhook, delivery database.WebhookDelivery) {
+	var status *int
+	var err error
+	if webhook == nil {
+		err = fmt.Errorf("webhook %d no longer exists", delivery.WebhookID)
+	} else if !webhook.Enabled {
+		err = fmt.Errorf("webhook %s is disabled", webhook.Name)
+	} else {
+		status, err = n.post(ctx, webhook, delivery)
+	}
+	if ctx.Err() != nil {
+		// Shutting down; the delivery stays due and is sent on the next
+		// start.
+		return
+	}
+
+	errMessage := ""
+	var next *time.Time
+	attempts := delivery.Attempts + 1
+	if err != nil {
+		errMessage = err.Error()
+		if attempts < MaxAttempts && webhook != nil && webhook.Enabled {
+			t := time.Now().UTC().Add(backoff(attempts))
+			next = &t
+		}
+		if next == nil {
+			logger.Warn(fmt.Sprintf("Gave up on webhook delivery %d (%s) after %d attempts: %v", delivery.ID, delivery.Event, attempts, err))
+		} else {
+			logger.Debug(fmt.Sprintf("Webhook delivery %d (%s) failed, retrying at %s: %v", delivery.ID, delivery.Event, next.Format(time.RFC3339), err))
+		}
+	}
+
+	if err := n.db.RecordWebhookAttempt(delivery.ID, status, errMessage, next); err != nil {
+		logger.Error(err, fmt.Sprintf("Failed to record webhook delivery %d", delivery.ID))
+	}
+}
+
+// post sends the delivery and returns the response status, if any. Any
+// status but 2xx is an error.
+func (n *Notifier) post(ctx context.Context, webhook *database.Webhook, delivery database.WebhookDelivery) (*int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Docktrine-Webhook")
+	req.Header.Set("X-Docktrine-Event", delivery.Event)
+	req.Header.Set("X-Docktrine-Delivery", strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set("X-Docktrine-Signature", Sign(webhook.Secret, time.Now(), delivery.Payload))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	status := resp.StatusCode
+	if status >= 200 && status < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return &status, nil
+	}
+
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorSnippet))
+	if len(bytes.TrimSpace(snippet)) > 0 {
+		return &status, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(snippet))
+	}
+	return &status, fmt.Errorf("%s", resp.Status)
+}
+
+// backoff is the delay before the attempt after the given number of
+// attempts: 30s, 1m, 2m, ... up to an hour.
+func backoff(attempts int) time.Duration {
+	delay := retryMin
+	for i := 1; i < attempts && delay < retryMax; i++ {
+		delay *= 2
+	}
+	return min(delay, retryMax)
+}
+
+func (n *Notifier) prune() {
+	if n.Retention <= 0 {
+		return
+	}
+	deleted, err := n.db.PruneWebhookDeliveries(time.Now().Add(-n.Retention))
+	if err != nil {
+		logger.Error(err, "Failed to prune webhook deliveries")
+		return
+	}
+	if deleted > 0 {
+		logger.Info(fmt.Sprintf("Pruned %d webhook deliveries older than %s", deleted, n.Retention))
+	}
+}
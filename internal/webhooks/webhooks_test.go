@@ -0,0 +1,399 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Zeptile/docktrine/internal/database"
+	"github.com/Zeptile/docktrine/internal/notify"
+)
+
+// openDB opens the database in dir, as the API does on start.
+func openDB(t *testing.T, dir string) *database.DB {
+	t.Helper()
+	t.Setenv("CONFIG_PATH", dir)
+	db, err := database.NewDatabaseConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// receiver is a webhook endpoint answering with the queued statuses, then
+// 200, and recording every request.
+type receiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []receivedRequest
+}
+
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	t.Helper()
+	r := &receiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		r.requests = append(r.requests, receivedRequest{header: req.Header.Clone(), body: body})
+		status := http.StatusOK
+		if len(r.statuses) > 0 {
+			status, r.statuses = r.statuses[0], r.statuses[1:]
+		}
+		r.mu.Unlock()
+
+		w.WriteHeader(status)
+		if status >= 300 {
+			io.WriteString(w, "  try again later\n")
+		}
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) received() []receivedRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]receivedRequest(nil), r.requests...)
+}
+
+func createWebhook(t *testing.T, db *database.DB, url string) *database.Webhook {
+	t.Helper()
+	webhook := &database.Webhook{Name: "ops", URL: url, Events: []string{"*"}}
+	if err := db.CreateWebhook(webhook); err != nil {
+		t.Fatal(err)
+	}
+	return webhook
+}
+
+func queue(t *testing.T, notifier *Notifier) {
+	t.Helper()
+	err := notifier.Notify(notify.Notification{
+		Event:    "container.restarted",
+		Severity: notify.SeverityInfo,
+		Title:    "Container restarted",
+		Message:  "web was restarted",
+		Time:     time.Now().UTC(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func onlyDelivery(t *testing.T, db *database.DB, webhookID int64) database.WebhookDelivery {
+	t.Helper()
+	deliveries, err := db.ListWebhookDeliveries(webhookID, "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("%d deliveries, want 1", len(deliveries))
+	}
+	return deliveries[0]
+}
+
+// makeDue moves the next attempt of every pending delivery to now, as if
+// the backoff had passed.
+func makeDue(t *testing.T, db *database.DB) {
+	t.Helper()
+	if _, err := db.Exec(`UPDATE webhook_deliveries SET next_attempt_at = ? WHERE status = ?`,
+		time.Now().UTC().Add(-time.Second), database.DeliveryPending); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSign(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	body := []byte(`{"event":"ping"}`)
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte("1700000000." + string(body)))
+	want := "t=1700000000,v1=" + hex.EncodeToString(mac.Sum(nil))
+
+	if got := Sign("s3cret", at, body); got != want {
+		t.Errorf("Sign() = %q, want %q", got, want)
+	}
+	if Sign("other", at, body) == want {
+		t.Error("signature does not depend on the secret")
+	}
+	if Sign("s3cret", at.Add(time.Second), body) == want {
+		t.Error("signature does not depend on the timestamp")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{5, 8 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{MaxAttempts, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestDeliverySigned(t *testing.T) {
+	db := openDB(t, t.TempDir())
+	defer db.Close()
+	recv := newReceiver(t)
+	webhook := createWebhook(t, db, recv.URL)
+	notifier := NewNotifier(db, 0)
+
+	// The signing key must not be readable from the database file alone.
+	var stored string
+	if err := db.QueryRow(`SELECT secret FROM webhooks WHERE id = ?`, webhook.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored == "" || strings.Contains(stored, webhook.Secret) {
+		t.Errorf("secret stored as %q, want it encrypted", stored)
+	}
+
+	queue(t, notifier)
+	notifier.deliverDue(context.Background())
+
+	requests := recv.received()
+	if len(requests) != 1 {
+		t.Fatalf("%d requests, want 1", len(requests))
+	}
+	req := requests[0]
+	delivery := onlyDelivery(t, db, webhook.ID)
+
+	for header, want := range map[string]string{
+		"Content-Type":         "application/json",
+		"User-Agent":           "Docktrine-Webhook",
+		"X-Docktrine-Event":    "container.restarted",
+		"X-Docktrine-Delivery": strconv.FormatInt(delivery.ID, 10),
+	} {
+		if got := req.header.Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+
+	// Check the signature the way a receiver would.
+	signature := req.header.Get("X-Docktrine-Signature")
+	timestamp, _, ok := strings.Cut(strings.TrimPrefix(signature, "t="), ",")
+	if !ok {
+		t.Fatalf("malformed signature header %q", signature)
+	}
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+		t.Errorf("signature timestamp %q is not the send time", timestamp)
+	}
+	if want := Sign(webhook.Secret, time.Unix(sent, 0), req.body); signature != want {
+		t.Errorf("signature = %q, want %q", signature, want)
+	}
+
+	var payload notify.Notification
+	if err := json.Unmarshal(req.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != "container.restarted" || payload.Message != "web was restarted" {
+		t.Errorf("payload = %+v", payload)
+	}
+
+	if delivery.Status != database.DeliverySucceeded || delivery.Attempts != 1 || delivery.DeliveredAt == nil {
+		t.Errorf("delivery = %+v, want succeeded after one attempt", delivery)
+	}
+}
+
+func TestDeliveryRetry(t *testing.T) {
+	db := openDB(t, t.TempDir())
+	defer db.Close()
+	recv := newReceiver(t, http.StatusServiceUnavailable, http.StatusInternalServerError)
+	webhook := createWebhook(t, db, recv.URL)
+	notifier := NewNotifier(db, 0)
+
+	queue(t, notifier)
+	notifier.deliverDue(context.Background())
+
+	delivery := onlyDelivery(t, db, webhook.ID)
+	if delivery.Status != database.DeliveryPending || delivery.Attempts != 1 {
+		t.Fatalf("delivery = %+v, want pending after one attempt", delivery)
+	}
+	if delivery.ResponseStatus == nil || *delivery.ResponseStatus != http.StatusServiceUnavailable {
+		t.Errorf("response status = %v, want 503", delivery.ResponseStatus)
+	}
+	if delivery.Error != "503 Service Unavailable: try again later" {
+		t.Errorf("error = %q", delivery.Error)
+	}
+	if delivery.NextAttemptAt == nil {
+		t.Fatal("no next attempt scheduled")
+	}
+	if wait := time.Until(*delivery.NextAttemptAt); wait < retryMin-5*time.Second || wait > retryMin {
+		t.Errorf("next attempt in %s, want %s", wait, retryMin)
+	}
+
+	// Not due yet: nothing is sent.
+	notifier.deliverDue(context.Background())
+	if n := len(recv.received()); n != 1 {
+		t.Fatalf("%d requests before the backoff passed, want 1", n)
+	}
+
+	makeDue(t, db)
+	notifier.deliverDue(context.Background())
+	delivery = onlyDelivery(t, db, webhook.ID)
+	if delivery.Attempts != 2 || delivery.NextAttemptAt == nil {
+		t.Fatalf("delivery = %+v, want pending after two attempts", delivery)
+	}
+	if wait := time.Until(*delivery.NextAttemptAt); wait < 2*retryMin-5*time.Second || wait > 2*retryMin {
+		t.Errorf("second retry in %s, want %s", wait, 2*retryMin)
+	}
+
+	makeDue(t, db)
+	notifier.deliverDue(context.Background())
+	delivery = onlyDelivery(t, db, webhook.ID)
+	if delivery.Status != database.DeliverySucceeded || delivery.Attempts != 3 || delivery.Error != "" || delivery.NextAttemptAt != nil {
+		t.Errorf("delivery = %+v, want succeeded on the third attempt", delivery)
+	}
+
+	// Every attempt carries the same payload and delivery ID.
+	requests := recv.received()
+	for _, req := range requests[1:] {
+		if string(req.body) != string(requests[0].body) || req.header.Get("X-Docktrine-Delivery") != requests[0].header.Get("X-Docktrine-Delivery") {
+			t.Error("a retry differs from the first attempt")
+		}
+	}
+}
+
+func TestDeliveryGivesUp(t *testing.T) {
+	db := openDB(t, t.TempDir())
+	defer db.Close()
+	recv := newReceiver(t, http.StatusBadGateway)
+	webhook := createWebhook(t, db, recv.URL)
+	notifier := NewNotifier(db, 0)
+
+	queue(t, notifier)
+	if _, err := db.Exec(`UPDATE webhook_deliveries SET attempts = ?`, MaxAttempts-1); err != nil {
+		t.Fatal(err)
+	}
+	notifier.deliverDue(context.Background())
+
+	delivery := onlyDelivery(t, db, webhook.ID)
+	if delivery.Status != database.DeliveryFailed || delivery.Attempts != MaxAttempts || delivery.NextAttemptAt != nil {
+		t.Errorf("delivery = %+v, want failed after %d attempts", delivery, MaxAttempts)
+	}
+}
+
+func TestDeliveryToDisabledWebhook(t *testing.T) {
+	db := openDB(t, t.TempDir())
+	defer db.Close()
+	recv := newReceiver(t)
+	webhook := createWebhook(t, db, recv.URL)
+	notifier := NewNotifier(db, 0)
+
+	queue(t, notifier)
+	if err := db.SetWebhookEnabled(webhook.ID, false); err != nil {
+		t.Fatal(err)
+	}
+	notifier.deliverDue(context.Background())
+
+	if n := len(recv.received()); n != 0 {
+		t.Errorf("%d requests to a disabled webhook", n)
+	}
+	delivery := onlyDelivery(t, db, webhook.ID)
+	if delivery.Status != database.DeliveryFailed || !strings.Contains(delivery.Error, "disabled") {
+		t.Errorf("delivery = %+v, want failed as disabled", delivery)
+	}
+}
+
+func TestOutboxSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+
+	// The receiver hangs until the API shuts down mid-delivery.
+	release := make(chan struct{})
+	var hung sync.Once
+	started := make(chan struct{})
+	recv := newReceiver(t)
+	hanging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		hung.Do(func() { close(started) })
+		<-release
+	}))
+	defer hanging.Close()
+	defer close(release)
+
+	db := openDB(t, dir)
+	webhook := createWebhook(t, db, hanging.URL)
+	notifier := NewNotifier(db, 0)
+	queue(t, notifier)
+	queue(t, notifier)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		notifier.Run(ctx)
+		close(done)
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the delivery was not attempted")
+	}
+	cancel()
+	<-done
+
+	// An attempt cut short by the shutdown does not count.
+	deliveries, err := db.ListWebhookDeliveries(webhook.ID, database.DeliveryPending, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 2 {
+		t.Fatalf("%d pending deliveries after shutdown, want 2", len(deliveries))
+	}
+	for _, delivery := range deliveries {
+		if delivery.Attempts != 0 {
+			t.Errorf("delivery %d has %d attempts after shutdown, want 0", delivery.ID, delivery.Attempts)
+		}
+	}
+	if _, err := db.Exec(`UPDATE webhooks SET url = ?`, recv.URL); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// After a restart the outbox is sent from the database, in order.
+	db = openDB(t, dir)
+	defer db.Close()
+	notifier = NewNotifier(db, 0)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go notifier.Run(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(recv.received()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	requests := recv.received()
+	if len(requests) != 2 {
+		t.Fatalf("%d deliveries after restart, want 2", len(requests))
+	}
+	// Deliveries are listed newest first.
+	for i, req := range requests {
+		if got, want := req.header.Get("X-Docktrine-Delivery"), strconv.FormatInt(deliveries[len(deliveries)-1-i].ID, 10); got != want {
+			t.Errorf("request %d is delivery %s, want %s", i, got, want)
+		}
+	}
+}